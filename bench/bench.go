@@ -0,0 +1,266 @@
+// Package bench benchmarks the index package against a corpus of fixture documents, so performance regressions in
+// the decoder are caught.
+//
+// Fixtures are the Pages, Numbers and Keynote documents under a directory, typically a testdata corpus kept
+// outside the repository. Each is classed as small, medium or large by its size on disk, and benchmarked opening
+// it, streaming its text and extracting its tables. The report marshals to JSON, and Compare lists the benchmarks
+// that got slower or allocate more than in a report saved from an earlier release. The same benchmarks run under go
+// test, e.g. go test -bench . ./bench -args -corpus testdata.
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/iworktest"
+)
+
+// Size classes
+const (
+	Small  = "small"
+	Medium = "medium"
+	Large  = "large"
+)
+
+// Size class limits, in bytes on disk.
+const (
+	smallMax  = 1 << 20
+	mediumMax = 20 << 20
+)
+
+// Benchmarks
+const (
+	Open   = "open"
+	Text   = "text"
+	Tables = "tables"
+)
+
+// Fixture is a document of the corpus.
+type Fixture struct {
+	Path  string     `json:"path"`
+	Type  index.Type `json:"type"`
+	Size  string     `json:"size"`
+	Bytes int64      `json:"bytes"`
+}
+
+// Result is one benchmark of one fixture. Times are per operation.
+type Result struct {
+	Fixture     Fixture `json:"fixture"`
+	Benchmark   string  `json:"benchmark"`
+	N           int     `json:"n"`
+	NsPerOp     int64   `json:"ns_per_op"`
+	AllocsPerOp int64   `json:"allocs_per_op"`
+	BytesPerOp  int64   `json:"bytes_per_op"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// Report is the result of a corpus run.
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// Fixtures returns the documents under dir, ordered by path. Documents whose type can't be detected, like
+// encrypted or iWork '09 ones, are left out.
+func Fixtures(dir string) ([]Fixture, error) {
+	var rval []Fixture
+	err := filepath.Walk(dir, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !iworktest.IsDocument(fn) {
+			return nil
+		}
+		typ, derr := index.DetectType(fn, "")
+		if derr == nil {
+			bytes, err := diskSize(fn, fi)
+			if err != nil {
+				return err
+			}
+			rval = append(rval, Fixture{Path: fn, Type: typ, Size: sizeClass(bytes), Bytes: bytes})
+		}
+		if fi.IsDir() {
+			// bundle, don't look inside
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Slice(rval, func(i, j int) bool { return rval[i].Path < rval[j].Path })
+	return rval, err
+}
+
+// diskSize returns the size of a document, adding up the files of a bundle.
+func diskSize(fn string, fi os.FileInfo) (int64, error) {
+	if !fi.IsDir() {
+		return fi.Size(), nil
+	}
+	var rval int64
+	err := filepath.Walk(fn, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			rval += fi.Size()
+		}
+		return err
+	})
+	return rval, err
+}
+
+func sizeClass(bytes int64) string {
+	switch {
+	case bytes <= smallMax:
+		return Small
+	case bytes <= mediumMax:
+		return Medium
+	}
+	return Large
+}
+
+// benchmarks are run in this order for each fixture. setup runs once per fixture, outside of the timing, and
+// returns the operation that is timed.
+var benchmarks = []struct {
+	name  string
+	setup func(doc string) (func() error, error)
+}{
+	{Open, func(doc string) (func() error, error) {
+		return func() error {
+			_, err := index.OpenContext(context.Background(), doc, "")
+			return err
+		}, nil
+	}},
+	{Text, func(doc string) (func() error, error) {
+		return func() error {
+			return index.ExtractTextTo(ioutil.Discard, doc, "")
+		}, nil
+	}},
+	{Tables, func(doc string) (func() error, error) {
+		ix, err := index.OpenContext(context.Background(), doc, "")
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			ix.Tables()
+			return nil
+		}, nil
+	}},
+}
+
+// benchTime is the least time a benchmark runs for, the default of go test -bench.
+const benchTime = time.Second
+
+// Run benchmarks each fixture under dir.
+func Run(dir string) (*Report, error) {
+	fixtures, err := Fixtures(dir)
+	if err != nil {
+		return nil, err
+	}
+	rval := &Report{}
+	for _, f := range fixtures {
+		for _, b := range benchmarks {
+			rval.Results = append(rval.Results, run(f, b.name, b.setup))
+		}
+	}
+	return rval, nil
+}
+
+// run benchmarks an operation on a fixture, doubling the number of runs until they take benchTime. A fixture that
+// fails is run once, to report the error.
+func run(f Fixture, name string, setup func(doc string) (func() error, error)) Result {
+	rval := Result{Fixture: f, Benchmark: name}
+	op, err := setup(f.Path)
+	if err == nil {
+		err = op()
+	}
+	if err != nil {
+		rval.Error = err.Error()
+		return rval
+	}
+	for n := 1; ; n *= 2 {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if err := op(); err != nil {
+				rval.Error = err.Error()
+				return rval
+			}
+		}
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&after)
+		if elapsed >= benchTime || n >= 1<<30 {
+			rval.N = n
+			rval.NsPerOp = elapsed.Nanoseconds() / int64(n)
+			rval.AllocsPerOp = int64(after.Mallocs-before.Mallocs) / int64(n)
+			rval.BytesPerOp = int64(after.TotalAlloc-before.TotalAlloc) / int64(n)
+			return rval
+		}
+	}
+}
+
+// Regression is a benchmark that got worse. The ratios are new over old.
+type Regression struct {
+	Path      string  `json:"path"`
+	Benchmark string  `json:"benchmark"`
+	Time      float64 `json:"time"`
+	Allocs    float64 `json:"allocs"`
+}
+
+func (r Regression) String() string {
+	return fmt.Sprintf("%s %s: %.2fx time, %.2fx allocations", r.Path, r.Benchmark, r.Time, r.Allocs)
+}
+
+// Compare returns the benchmarks of cur that take more than tolerance times the time or allocations they took in
+// old, e.g. 1.1 for 10% slower. Benchmarks missing from either report, or failing in either, are skipped.
+func Compare(old, cur *Report, tolerance float64) []Regression {
+	type key struct{ path, name string }
+	prev := make(map[key]Result)
+	for _, r := range old.Results {
+		prev[key{r.Fixture.Path, r.Benchmark}] = r
+	}
+	var rval []Regression
+	for _, r := range cur.Results {
+		o, ok := prev[key{r.Fixture.Path, r.Benchmark}]
+		if !ok || o.Error != "" || r.Error != "" {
+			continue
+		}
+		reg := Regression{Path: r.Fixture.Path, Benchmark: r.Benchmark,
+			Time: ratio(r.NsPerOp, o.NsPerOp), Allocs: ratio(r.AllocsPerOp, o.AllocsPerOp)}
+		if reg.Time > tolerance || reg.Allocs > tolerance {
+			rval = append(rval, reg)
+		}
+	}
+	return rval
+}
+
+func ratio(cur, old int64) float64 {
+	if old == 0 {
+		if cur == 0 {
+			return 1
+		}
+		return float64(cur)
+	}
+	return float64(cur) / float64(old)
+}
+
+// ReadJSON reads a report written by WriteJSON.
+func ReadJSON(r io.Reader) (*Report, error) {
+	var rval Report
+	if err := json.NewDecoder(r).Decode(&rval); err != nil {
+		return nil, err
+	}
+	return &rval, nil
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
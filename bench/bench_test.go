@@ -0,0 +1,46 @@
+package bench
+
+import (
+	"flag"
+	"path/filepath"
+	"testing"
+)
+
+var corpus = flag.String("corpus", "", "directory of fixture documents")
+
+func BenchmarkOpen(b *testing.B)   { benchmark(b, Open) }
+func BenchmarkText(b *testing.B)   { benchmark(b, Text) }
+func BenchmarkTables(b *testing.B) { benchmark(b, Tables) }
+
+// benchmark runs one of the benchmarks on each fixture of the corpus, with the setup outside of the timing.
+func benchmark(b *testing.B, name string) {
+	if *corpus == "" {
+		b.Skip("no corpus, run with -args -corpus dir")
+	}
+	fixtures, err := Fixtures(*corpus)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var setup func(doc string) (func() error, error)
+	for _, bm := range benchmarks {
+		if bm.name == name {
+			setup = bm.setup
+		}
+	}
+	for _, f := range fixtures {
+		f := f
+		b.Run(f.Size+"/"+filepath.Base(f.Path), func(b *testing.B) {
+			op, err := setup(f.Path)
+			if err != nil {
+				b.Skip(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := op(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
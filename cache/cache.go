@@ -0,0 +1,192 @@
+// Package cache saves results extracted from documents, keyed by a hash of the document content, so repeated scans
+// of unchanged files can skip parsing them.
+//
+// The storage is pluggable through the Store interface. Dir keeps entries as files in a directory, which survives
+// between runs, and Memory keeps them in a map. Results are stored as JSON.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned by Store.Get for keys that have no entry.
+var ErrNotFound = errors.New("cache: not found")
+
+// Store is a key value store for cache entries. Keys are hex strings, safe to use as file names.
+type Store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+}
+
+// Cache pairs a Store with a namespace, so different kinds of results, or results from different versions of the
+// extraction code, don't collide in a shared store.
+type Cache struct {
+	Store     Store
+	Namespace string
+}
+
+// Load fills v, a pointer, with the cached result for doc. On a miss, compute is called to fill v and the result
+// is saved for next time. Load reports whether v came from the cache.
+func (c *Cache) Load(doc string, v interface{}, compute func() error) (bool, error) {
+	sum, err := Hash(doc)
+	if err != nil {
+		return false, err
+	}
+	key := c.key(sum)
+	data, err := c.Store.Get(key)
+	if err == nil && json.Unmarshal(data, v) == nil {
+		return true, nil
+	}
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+	if err := compute(); err != nil {
+		return false, err
+	}
+	data, err = json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	return false, c.Store.Put(key, data)
+}
+
+func (c *Cache) key(sum string) string {
+	if c.Namespace == "" {
+		return sum
+	}
+	h := sha256.Sum256([]byte(c.Namespace + "\x00" + sum))
+	return hex.EncodeToString(h[:])
+}
+
+// Hash returns the SHA-256 of a document's content as a hex string. For bundles it covers the relative path and
+// content of every file, so renaming or moving the bundle keeps the hash.
+func Hash(doc string) (string, error) {
+	fi, err := os.Stat(doc)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if !fi.IsDir() {
+		if err := hashFile(h, doc); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	var files []string
+	err = filepath.Walk(doc, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			rel, err := filepath.Rel(doc, fn)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	for _, rel := range files {
+		fmt.Fprintf(h, "%s\x00", rel)
+		if err := hashFile(h, filepath.Join(doc, filepath.FromSlash(rel))); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile writes the length and content of a file to w. The length keeps file boundaries unambiguous.
+func hashFile(w io.Writer, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d\x00", fi.Size())
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Dir is a Store that keeps each entry in a file in the named directory.
+type Dir string
+
+// Get reads an entry from the directory.
+func (d Dir) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(string(d), key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Put writes an entry to the directory, creating the directory if needed. The entry is written to a temporary
+// file and renamed into place, so concurrent readers never see a partial entry.
+func (d Dir) Put(key string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(string(d), key+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(string(d), key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Memory is a Store that keeps entries in memory. It is safe for concurrent use.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+// NewMemory returns an empty Memory store.
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string][]byte)}
+}
+
+// Get returns an entry.
+func (m *Memory) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.entries[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+// Put saves an entry.
+func (m *Memory) Put(key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = append([]byte(nil), data...)
+	return nil
+}
@@ -0,0 +1,72 @@
+// Command iworkbench benchmarks opening, text extraction and table extraction on a corpus of documents and writes
+// the results as JSON. Given a report from an earlier run with -compare, it lists the benchmarks that got slower
+// or allocate more, and exits with status 1 if there are any.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dunhamsteve/iwork/bench"
+)
+
+func main() {
+	out := flag.String("o", "", "write the report to this file rather than stdout")
+	compare := flag.String("compare", "", "report of an earlier run to check for regressions")
+	tolerance := flag.Float64("tolerance", 1.1, "ratio of time or allocations to the earlier run counted as a regression")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] corpusdir\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var old *bench.Report
+	if *compare != "" {
+		f, err := os.Open(*compare)
+		if err != nil {
+			fail(err)
+		}
+		old, err = bench.ReadJSON(f)
+		f.Close()
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	report, err := bench.Run(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			fail(err)
+		}
+	}
+	if err := report.WriteJSON(w); err != nil {
+		fail(err)
+	}
+	if err := w.Close(); err != nil {
+		fail(err)
+	}
+
+	if old != nil {
+		regressions := bench.Compare(old, report, *tolerance)
+		for _, r := range regressions {
+			fmt.Fprintln(os.Stderr, r)
+		}
+		if len(regressions) > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
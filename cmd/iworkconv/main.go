@@ -0,0 +1,165 @@
+// Command iworkconv converts Pages, Numbers and Keynote documents to other formats in batch. Inputs may be file
+// names or glob patterns; each is written to the output directory under its own name with the new extension.
+// csv writes one file per table, named after the document and the table number, and svg and png one file per
+// Keynote slide in the same way.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/dunhamsteve/iwork/docx"
+	"github.com/dunhamsteve/iwork/html"
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/markdown"
+	"github.com/dunhamsteve/iwork/pptx"
+	"github.com/dunhamsteve/iwork/render"
+	"github.com/dunhamsteve/iwork/xlsx"
+)
+
+// writers are the output formats that render a whole document to one file.
+var writers = map[string]func(io.Writer, *index.Index) error{
+	"md":   markdown.Write,
+	"docx": docx.Write,
+	"xlsx": xlsx.Write,
+	"pptx": pptx.Write,
+	"html": func(w io.Writer, ix *index.Index) error { return html.Write(w, ix, nil) },
+}
+
+func main() {
+	to := flag.String("to", "txt", "output format: txt, md, html, csv, docx, xlsx, pptx, svg or png")
+	dir := flag.String("o", ".", "output directory")
+	workers := flag.Int("j", runtime.NumCPU(), "number of documents converted at once")
+	password := flag.String("password", "", "password of encrypted documents")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Converts iWork documents to other formats.
+
+Usage:
+    %s [flags] infile.pages 'docs/*.numbers' ...
+
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		return
+	}
+	if _, ok := writers[*to]; !ok && *to != "txt" && *to != "csv" && *to != "svg" && *to != "png" {
+		fmt.Fprintln(os.Stderr, "unknown format", *to)
+		os.Exit(2)
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var inputs []string
+	for _, arg := range flag.Args() {
+		matches, err := filepath.Glob(arg)
+		if err != nil || len(matches) == 0 {
+			matches = []string{arg}
+		}
+		inputs = append(inputs, matches...)
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := false
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for in := range jobs {
+				if err := convert(in, *dir, *to, *password); err != nil {
+					mu.Lock()
+					fmt.Fprintf(os.Stderr, "%s: %v\n", in, err)
+					failed = true
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, in := range inputs {
+		jobs <- in
+	}
+	close(jobs)
+	wg.Wait()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// convert writes one document to dir in the given format.
+func convert(in, dir, format, password string) error {
+	base := filepath.Join(dir, strings.TrimSuffix(filepath.Base(in), filepath.Ext(in)))
+	if format == "txt" {
+		return create(base+".txt", func(w io.Writer) error {
+			return index.ExtractTextTo(w, in, password)
+		})
+	}
+
+	ix, err := index.OpenWithPassword(in, password)
+	if err != nil {
+		return err
+	}
+	if format == "csv" {
+		tables := ix.Tables()
+		if len(tables) == 0 {
+			return errors.New("no tables")
+		}
+		for i, t := range tables {
+			if err := create(fmt.Sprintf("%s-%d.csv", base, i+1), t.WriteCSV); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if format == "svg" || format == "png" {
+		if ix.Type != "key" {
+			return fmt.Errorf("can't render %s documents", ix.Type)
+		}
+		for n := range ix.Slides() {
+			err := create(fmt.Sprintf("%s-%d.%s", base, n+1, format), func(w io.Writer) error {
+				if format == "svg" {
+					return render.SVG(w, ix, n+1)
+				}
+				return render.PNG(w, ix, n+1, 0)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return create(base+"."+format, func(w io.Writer) error {
+		return writers[format](w, ix)
+	})
+}
+
+// create writes a file with fn, removing it again if fn fails.
+func create(name string, fn func(io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = fn(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
@@ -0,0 +1,193 @@
+// Command iworkdump writes the records of an iWork document to stdout as JSON, for debugging and shell
+// pipelines. By default it dumps every record with its type name and the identifiers it references; -text,
+// -tables and -metadata dump just that part of the document instead.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// record is a record as dumped: the decoded value, its message type and the records it references.
+type record struct {
+	ID    uint64      `json:"id"`
+	Type  string      `json:"type"`
+	File  string      `json:"file,omitempty"`
+	Refs  []uint64    `json:"refs,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// storage is the plain text of a text storage.
+type storage struct {
+	ID   uint64 `json:"id"`
+	Text string `json:"text"`
+}
+
+func main() {
+	password := flag.String("password", "", "password of an encrypted document")
+	text := flag.Bool("text", false, "dump the text storages only")
+	tables := flag.Bool("tables", false, "dump the tables only")
+	metadata := flag.Bool("metadata", false, "dump the document metadata only")
+	stats := flag.Bool("stats", false, "dump the word, table and slide counts only")
+	pages := flag.Bool("pages", false, "dump the body text of each Pages page only")
+	allText := flag.Bool("alltext", false, "dump the text of a Pages document in reading order, with its shapes, text boxes and tables")
+	floating := flag.Bool("floating", true, "with -alltext, include the objects floating on the pages")
+	notes := flag.Bool("notes", false, "dump the presenter notes of each Keynote slide only")
+	animations := flag.Bool("animations", false, "dump the transitions and builds of each Keynote slide only")
+	attachments := flag.Bool("attachments", false, "dump the equations, movies, sounds, web videos and unused files only")
+	search := flag.String("search", "", "dump the places the text is found, ignoring case")
+	diff := flag.String("diff", "", "dump the differences from an older version of the document")
+	validate := flag.Bool("validate", false, "check the document for damage and dump the problems found")
+	chunks := flag.Bool("chunks", false, "dump the record payloads as stored, without decoding them")
+	dot := flag.Bool("dot", false, "dump the reference graph of the records in Graphviz DOT format")
+	types := flag.String("types", "", "comma separated message types or packages to dump, e.g. TST,TSWP.StorageArchive")
+	indent := flag.Bool("indent", false, "indent the output")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Dumps the records of an iWork document as JSON. Outputs to stdout.
+
+Usage:
+    %s [flags] infile.pages
+
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		return
+	}
+
+	if *validate {
+		report, err := index.Validate(context.Background(), flag.Arg(0), *password)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, p := range report.Problems {
+			fmt.Println(p)
+		}
+		if !report.OK() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *chunks {
+		enc := json.NewEncoder(os.Stdout)
+		err := index.ReadChunks(flag.Arg(0), *password, func(c *index.Chunk) error {
+			return enc.Encode(c)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	opts := &index.Options{Password: *password, ErrorHandler: func(*index.DecodeError) {}}
+	if *types != "" {
+		opts.Types = strings.Split(*types, ",")
+	}
+	ix, err := index.OpenOptions(context.Background(), flag.Arg(0), opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *dot {
+		if err := ix.WriteDOT(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var out interface{}
+	switch {
+	case *metadata:
+		out, err = ix.Metadata()
+	case *tables:
+		out = ix.Tables()
+	case *stats:
+		out = ix.Stats()
+	case *pages:
+		out = ix.BodyPages()
+	case *allText:
+		out, err = ix.PagesText(index.TextOptions{Floating: *floating})
+	case *notes:
+		out, err = ix.Notes()
+	case *animations:
+		out, err = ix.Animations()
+	case *attachments:
+		out = ix.Attachments()
+	case *search != "":
+		out, err = ix.Search(*search, nil)
+	case *diff != "":
+		var old *index.Index
+		old, err = index.OpenOptions(context.Background(), *diff, opts)
+		if err == nil {
+			out, err = index.Diff(old, ix)
+		}
+	case *text:
+		out = storages(ix)
+	default:
+		out = map[string]interface{}{"type": ix.Type, "records": records(ix)}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	if *indent {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func records(ix *index.Index) []record {
+	var rval []record
+	for _, rec := range ix.SortedRecords() {
+		r := record{ID: rec.ID, Type: rec.Type, File: rec.File, Value: rec.Value}
+		ix.Walk(rec.ID, 1, func(ref uint64, _ interface{}, _ uint64, depth int) error {
+			if depth > 0 {
+				r.Refs = append(r.Refs, ref)
+			}
+			return nil
+		})
+		sort.Slice(r.Refs, func(i, j int) bool { return r.Refs[i] < r.Refs[j] })
+		rval = append(rval, r)
+	}
+	return rval
+}
+
+func storages(ix *index.Index) []storage {
+	var rval []storage
+	for _, id := range ix.IDs() {
+		st, ok := ix.Records[id].(*TSWP.StorageArchive)
+		if !ok {
+			continue
+		}
+		var lines []string
+		for _, p := range ix.StorageParagraphs(st) {
+			line := ix.ParagraphText(p)
+			if p.ListLabel != "" {
+				line = strings.Repeat("\t", int(p.ListLevel)) + p.ListLabel + " " + line
+			}
+			lines = append(lines, line)
+		}
+		rval = append(rval, storage{id, strings.Join(lines, "\n")})
+	}
+	return rval
+}
@@ -0,0 +1,327 @@
+// Package docx converts Pages documents to Office Open XML word processing documents (.docx).
+//
+// The conversion covers body text, paragraph and character formatting, headings, lists, tables and inline images.
+// Floating objects, headers and footers are not carried over.
+package docx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Write converts a Pages document and writes the .docx archive to w.
+func Write(w io.Writer, ix *index.Index) error {
+	if ix.Type != "pages" {
+		return fmt.Errorf("docx: can't convert %s documents", ix.Type)
+	}
+	da, ok := ix.Root().(*TP.DocumentArchive)
+	if !ok {
+		return errors.New("docx: missing document archive")
+	}
+	bs, ok := ix.Deref(da.BodyStorage).(*TSWP.StorageArchive)
+	if !ok {
+		return errors.New("docx: missing body storage")
+	}
+
+	c := &converter{ix: ix, media: make(map[uint64]string)}
+	c.storage(bs)
+
+	zw := zip.NewWriter(w)
+	parts := []struct {
+		name string
+		data string
+	}{
+		{"[Content_Types].xml", c.contentTypes()},
+		{"_rels/.rels", rootRels},
+		{"word/document.xml", documentHeader + c.body.String() + documentFooter},
+		{"word/styles.xml", styles},
+		{"word/numbering.xml", numbering},
+		{"word/_rels/document.xml.rels", c.documentRels()},
+	}
+	for _, part := range parts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.data); err != nil {
+			return err
+		}
+	}
+	for _, m := range c.files {
+		f, err := zw.Create("word/" + m.name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(m.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+type mediaFile struct {
+	rel  string
+	name string
+	data []byte
+}
+
+type converter struct {
+	ix     *index.Index
+	body   bytes.Buffer
+	files  []mediaFile
+	media  map[uint64]string // data id -> relationship id
+	nextID int
+}
+
+// storage writes the paragraphs of a storage to the document body.
+func (c *converter) storage(st *TSWP.StorageArchive) {
+	for _, p := range c.ix.StorageParagraphs(st) {
+		var after []string
+		c.body.WriteString("<w:p>")
+		c.paraProps(p)
+		for _, run := range p.Runs {
+			c.run(p, run, &after)
+		}
+		c.body.WriteString("</w:p>\n")
+		for _, block := range after {
+			c.body.WriteString(block)
+		}
+	}
+}
+
+func (c *converter) paraProps(p index.Paragraph) {
+	var props []string
+	para := c.ix.ResolveParagraph(p.Style)
+	if para.OutlineLevel > 0 && para.OutlineLevel < 7 {
+		props = append(props, fmt.Sprintf(`<w:pStyle w:val="Heading%d"/>`, para.OutlineLevel))
+	}
+
+	if p.ListStyle != nil {
+		if numID := listNumID(p.ListStyle, p.ListLevel); numID != 0 {
+			props = append(props, fmt.Sprintf(`<w:numPr><w:ilvl w:val="%d"/><w:numId w:val="%d"/></w:numPr>`, p.ListLevel, numID))
+		}
+	}
+
+	if para.SpaceBefore != 0 || para.SpaceAfter != 0 {
+		props = append(props, fmt.Sprintf(`<w:spacing w:before="%d" w:after="%d"/>`, twips(para.SpaceBefore), twips(para.SpaceAfter)))
+	}
+	if para.LeftIndent != 0 || para.RightIndent != 0 || para.FirstLineIndent != 0 {
+		props = append(props, fmt.Sprintf(`<w:ind w:left="%d" w:right="%d" w:firstLine="%d"/>`,
+			twips(para.LeftIndent), twips(para.RightIndent), twips(para.FirstLineIndent-para.LeftIndent)))
+	}
+	if jc := alignments[para.Alignment]; jc != "" {
+		props = append(props, fmt.Sprintf(`<w:jc w:val="%s"/>`, jc))
+	}
+	if len(props) > 0 {
+		c.body.WriteString("<w:pPr>" + strings.Join(props, "") + "</w:pPr>")
+	}
+}
+
+var alignments = map[int32]string{0: "", 1: "right", 2: "center", 3: "both"}
+
+// listNumID picks the numbering definition for a list level, see numbering below.
+func listNumID(ls *TSWP.ListStyleArchive, level uint32) int {
+	if len(ls.LabelTypes) == 0 {
+		return 0
+	}
+	lt := ls.LabelTypes[len(ls.LabelTypes)-1]
+	if int(level) < len(ls.LabelTypes) {
+		lt = ls.LabelTypes[level]
+	}
+	switch lt {
+	case TSWP.ListStyleArchive_kNumber:
+		return 2
+	case TSWP.ListStyleArchive_kString, TSWP.ListStyleArchive_kImage:
+		return 1
+	}
+	return 0
+}
+
+// run writes a text run. Tables can't live inside a paragraph, so they are appended to after and written once the
+// paragraph is closed.
+func (c *converter) run(p index.Paragraph, run index.Run, after *[]string) {
+	if f := c.ix.RunField(run); f != nil {
+		run.Text = f.Text
+	} else if run.Attachment != nil {
+		c.attachment(run.Attachment, after)
+		return
+	}
+	c.body.WriteString("<w:r>")
+	if rpr := runProps(c.ix.RunStyle(p, run)); rpr != "" {
+		c.body.WriteString("<w:rPr>" + rpr + "</w:rPr>")
+	}
+	c.text([]rune(run.Text))
+	c.body.WriteString("</w:r>")
+}
+
+// text writes text to a run, translating tabs and line breaks and dropping paragraph terminators.
+func (c *converter) text(rr []rune) {
+	var buf []rune
+	flush := func() {
+		if len(buf) > 0 {
+			c.body.WriteString(`<w:t xml:space="preserve">`)
+			xml.EscapeText(&c.body, []byte(string(buf)))
+			c.body.WriteString(`</w:t>`)
+			buf = buf[:0]
+		}
+	}
+	for _, r := range rr {
+		switch r {
+		case '\n', '\u2029':
+			// paragraph end
+		case '\u2028', '\u000b':
+			flush()
+			c.body.WriteString("<w:br/>")
+		case '\u000c':
+			flush()
+			c.body.WriteString(`<w:br w:type="page"/>`)
+		case '\t':
+			flush()
+			c.body.WriteString("<w:tab/>")
+		default:
+			buf = append(buf, r)
+		}
+	}
+	flush()
+}
+
+func (c *converter) attachment(v interface{}, after *[]string) {
+	att, ok := v.(*TSWP.DrawableAttachmentArchive)
+	if !ok {
+		return
+	}
+	switch d := c.ix.Deref(att.Drawable).(type) {
+	case *TSD.ImageArchive:
+		c.image(d)
+	case *TST.WPTableInfoArchive:
+		if tm, ok := c.ix.Deref(d.GetSuper().GetTableModel()).(*TST.TableModelArchive); ok {
+			*after = append(*after, c.table(tm))
+		}
+	case *TST.TableInfoArchive:
+		if tm, ok := c.ix.Deref(d.TableModel).(*TST.TableModelArchive); ok {
+			*after = append(*after, c.table(tm))
+		}
+	}
+}
+
+func (c *converter) image(img *TSD.ImageArchive) {
+	m, ok := c.ix.MediaFor(img.Data)
+	if !ok {
+		return
+	}
+	rel, ok := c.media[m.ID]
+	if !ok {
+		rc, err := c.ix.OpenMedia(m.ID)
+		if err != nil {
+			return
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return
+		}
+		c.nextID++
+		rel = fmt.Sprintf("rIdImg%d", c.nextID)
+		name := fmt.Sprintf("media/image%d%s", c.nextID, strings.ToLower(path.Ext(m.Path)))
+		c.files = append(c.files, mediaFile{rel, name, data})
+		c.media[m.ID] = rel
+	}
+
+	var width, height float32
+	if size := img.GetSuper().GetGeometry().GetSize(); size != nil {
+		width, height = size.GetWidth(), size.GetHeight()
+	} else if size := img.OriginalSize; size != nil {
+		width, height = size.GetWidth(), size.GetHeight()
+	}
+	cx, cy := emu(width), emu(height)
+	c.nextID++
+	fmt.Fprintf(&c.body, `<w:r><w:drawing><wp:inline><wp:extent cx="%d" cy="%d"/><wp:docPr id="%d" name="Picture %d"/>`+
+		`<a:graphic><a:graphicData uri="http://schemas.openxmlformats.org/drawingml/2006/picture">`+
+		`<pic:pic><pic:nvPicPr><pic:cNvPr id="%d" name="%s"/><pic:cNvPicPr/></pic:nvPicPr>`+
+		`<pic:blipFill><a:blip r:embed="%s"/><a:stretch><a:fillRect/></a:stretch></pic:blipFill>`+
+		`<pic:spPr><a:xfrm><a:off x="0" y="0"/><a:ext cx="%d" cy="%d"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></pic:spPr>`+
+		`</pic:pic></a:graphicData></a:graphic></wp:inline></w:drawing></w:r>`,
+		cx, cy, c.nextID, c.nextID, c.nextID, escape(m.Name), rel, cx, cy)
+}
+
+func (c *converter) table(tm *TST.TableModelArchive) string {
+	var buf bytes.Buffer
+	buf.WriteString(`<w:tbl><w:tblPr><w:tblStyle w:val="TableGrid"/><w:tblW w:w="0" w:type="auto"/></w:tblPr>`)
+	for _, row := range c.ix.Cells(tm) {
+		buf.WriteString("<w:tr>")
+		for _, cell := range row {
+			buf.WriteString("<w:tc><w:p>")
+			if cell.Type != index.EmptyCell {
+				buf.WriteString(`<w:r><w:t xml:space="preserve">`)
+				xml.EscapeText(&buf, []byte(cell.String()))
+				buf.WriteString(`</w:t></w:r>`)
+			}
+			buf.WriteString("</w:p></w:tc>")
+		}
+		buf.WriteString("</w:tr>")
+	}
+	buf.WriteString("</w:tbl>\n")
+	return buf.String()
+}
+
+func (c *converter) contentTypes() string {
+	exts := map[string]bool{}
+	var defaults string
+	for _, m := range c.files {
+		ext := strings.TrimPrefix(path.Ext(m.name), ".")
+		if ext == "" || exts[ext] {
+			continue
+		}
+		exts[ext] = true
+		mime := "image/" + ext
+		if ext == "jpg" {
+			mime = "image/jpeg"
+		}
+		defaults += fmt.Sprintf(`<Default Extension="%s" ContentType="%s"/>`, ext, mime)
+	}
+	return xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` + defaults +
+		`<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>` +
+		`<Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/>` +
+		`<Override PartName="/word/numbering.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.numbering+xml"/>` +
+		`</Types>`
+}
+
+func (c *converter) documentRels() string {
+	rels := `<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`<Relationship Id="rIdNumbering" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/numbering" Target="numbering.xml"/>`
+	for _, m := range c.files {
+		rels += fmt.Sprintf(`<Relationship Id="%s" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="%s"/>`, m.rel, m.name)
+	}
+	return xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` + rels + `</Relationships>`
+}
+
+// twips converts points to twentieths of a point.
+func twips(pt float32) int {
+	return int(pt * 20)
+}
+
+// emu converts points to English Metric Units.
+func emu(pt float32) int64 {
+	return int64(pt * 12700)
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
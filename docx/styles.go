@@ -0,0 +1,100 @@
+package docx
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// runProps returns the w:rPr contents for a run's formatting.
+func runProps(p index.TextStyle) string {
+	rval := ""
+	if p.Font != "" {
+		f := escape(p.Font)
+		rval += fmt.Sprintf(`<w:rFonts w:ascii="%s" w:hAnsi="%s" w:cs="%s"/>`, f, f, f)
+	}
+	if p.Bold {
+		rval += "<w:b/>"
+	}
+	if p.Italic {
+		rval += "<w:i/>"
+	}
+	if p.Strikethrough {
+		rval += "<w:strike/>"
+	}
+	if p.Color != nil && p.Color.GetModel() == TSP.Color_rgb {
+		rval += fmt.Sprintf(`<w:color w:val="%02X%02X%02X"/>`,
+			channel(p.Color.GetR()), channel(p.Color.GetG()), channel(p.Color.GetB()))
+	}
+	if p.Size > 0 {
+		rval += fmt.Sprintf(`<w:sz w:val="%d"/>`, int(p.Size*2))
+	}
+	if p.Underline {
+		rval += `<w:u w:val="single"/>`
+	}
+	switch p.Baseline {
+	case int32(TSWP.CharacterStylePropertiesArchive_kSuperscript):
+		rval += `<w:vertAlign w:val="superscript"/>`
+	case int32(TSWP.CharacterStylePropertiesArchive_kSubscript):
+		rval += `<w:vertAlign w:val="subscript"/>`
+	}
+	return rval
+}
+
+func channel(v float32) int {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 255
+	}
+	return int(v*255 + 0.5)
+}
+
+const rootRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>` +
+	`</Relationships>`
+
+const documentHeader = xml.Header + `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"` +
+	` xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"` +
+	` xmlns:wp="http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing"` +
+	` xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main"` +
+	` xmlns:pic="http://schemas.openxmlformats.org/drawingml/2006/picture"><w:body>` + "\n"
+
+const documentFooter = `<w:sectPr/></w:body></w:document>`
+
+const styles = xml.Header + `<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">` +
+	`<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/><w:basedOn w:val="Normal"/><w:pPr><w:outlineLvl w:val="0"/></w:pPr><w:rPr><w:b/><w:sz w:val="36"/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Heading2"><w:name w:val="heading 2"/><w:basedOn w:val="Normal"/><w:pPr><w:outlineLvl w:val="1"/></w:pPr><w:rPr><w:b/><w:sz w:val="32"/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Heading3"><w:name w:val="heading 3"/><w:basedOn w:val="Normal"/><w:pPr><w:outlineLvl w:val="2"/></w:pPr><w:rPr><w:b/><w:sz w:val="28"/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Heading4"><w:name w:val="heading 4"/><w:basedOn w:val="Normal"/><w:pPr><w:outlineLvl w:val="3"/></w:pPr><w:rPr><w:b/><w:sz w:val="24"/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Heading5"><w:name w:val="heading 5"/><w:basedOn w:val="Normal"/><w:pPr><w:outlineLvl w:val="4"/></w:pPr><w:rPr><w:b/></w:rPr></w:style>` +
+	`<w:style w:type="paragraph" w:styleId="Heading6"><w:name w:val="heading 6"/><w:basedOn w:val="Normal"/><w:pPr><w:outlineLvl w:val="5"/></w:pPr><w:rPr><w:b/><w:i/></w:rPr></w:style>` +
+	`<w:style w:type="table" w:styleId="TableGrid"><w:name w:val="Table Grid"/><w:tblPr><w:tblBorders>` +
+	`<w:top w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:left w:val="single" w:sz="4" w:space="0" w:color="auto"/>` +
+	`<w:bottom w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:right w:val="single" w:sz="4" w:space="0" w:color="auto"/>` +
+	`<w:insideH w:val="single" w:sz="4" w:space="0" w:color="auto"/><w:insideV w:val="single" w:sz="4" w:space="0" w:color="auto"/>` +
+	`</w:tblBorders></w:tblPr></w:style>` +
+	`</w:styles>`
+
+// numbering has two list definitions: numId 1 is bulleted and numId 2 is numbered.
+var numbering = func() string {
+	bullets, numbers := "", ""
+	for lvl := 0; lvl < 9; lvl++ {
+		indent := 720 * (lvl + 1)
+		bullets += fmt.Sprintf(`<w:lvl w:ilvl="%d"><w:start w:val="1"/><w:numFmt w:val="bullet"/><w:lvlText w:val="•"/>`+
+			`<w:lvlJc w:val="left"/><w:pPr><w:ind w:left="%d" w:hanging="360"/></w:pPr></w:lvl>`, lvl, indent)
+		numbers += fmt.Sprintf(`<w:lvl w:ilvl="%d"><w:start w:val="1"/><w:numFmt w:val="decimal"/><w:lvlText w:val="%%%d."/>`+
+			`<w:lvlJc w:val="left"/><w:pPr><w:ind w:left="%d" w:hanging="360"/></w:pPr></w:lvl>`, lvl, lvl+1, indent)
+	}
+	return xml.Header + `<w:numbering xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">` +
+		`<w:abstractNum w:abstractNumId="0">` + bullets + `</w:abstractNum>` +
+		`<w:abstractNum w:abstractNumId="1">` + numbers + `</w:abstractNum>` +
+		`<w:num w:numId="1"><w:abstractNumId w:val="0"/></w:num>` +
+		`<w:num w:numId="2"><w:abstractNumId w:val="1"/></w:num>` +
+		`</w:numbering>`
+}()
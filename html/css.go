@@ -0,0 +1,174 @@
+package html
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+var alignments = map[TSWP.ParagraphStylePropertiesArchive_TextAlignmentType]string{
+	0: "left", 1: "right", 2: "center", 3: "justify",
+}
+
+// paraClass returns the CSS class for a paragraph style, registering it on first use. The class carries the
+// paragraph properties and the character properties of the style and its parents.
+func (c *converter) paraClass(id uint64, ps *TSWP.ParagraphStyleArchive) string {
+	if ps == nil {
+		return ""
+	}
+	name := fmt.Sprintf("ps%d", id)
+	if _, ok := c.classes[name]; ok {
+		return name
+	}
+	var chain []*TSWP.ParagraphStyleArchive
+	for s := ps; s != nil && len(chain) < 32; {
+		chain = append([]*TSWP.ParagraphStyleArchive{s}, chain...)
+		s, _ = c.ix.Deref(s.GetSuper().GetParent()).(*TSWP.ParagraphStyleArchive)
+	}
+	props := make(map[string]string)
+	var left, first *float32
+	for _, s := range chain {
+		charCSS(props, s.CharProperties)
+		pp := s.ParaProperties
+		if pp == nil {
+			continue
+		}
+		if pp.Alignment != nil {
+			if align, ok := alignments[*pp.Alignment]; ok {
+				props["text-align"] = align
+			}
+		}
+		if pp.LeftIndent != nil {
+			left = pp.LeftIndent
+		}
+		if pp.FirstLineIndent != nil {
+			first = pp.FirstLineIndent
+		}
+		if pp.RightIndent != nil {
+			props["margin-right"] = pt(*pp.RightIndent)
+		}
+		if pp.SpaceBefore != nil {
+			props["margin-top"] = pt(*pp.SpaceBefore)
+		}
+		if pp.SpaceAfter != nil {
+			props["margin-bottom"] = pt(*pp.SpaceAfter)
+		}
+	}
+	// Pages measures the first line indent from the margin, CSS from the left indent.
+	if left != nil {
+		props["margin-left"] = pt(*left)
+	}
+	if first != nil {
+		indent := *first
+		if left != nil {
+			indent -= *left
+		}
+		props["text-indent"] = pt(indent)
+	}
+	c.classes[name] = declarations(props)
+	return name
+}
+
+// charClass returns the CSS class for a character style, registering it on first use.
+func (c *converter) charClass(id uint64, cs *TSWP.CharacterStyleArchive) string {
+	if cs == nil {
+		return ""
+	}
+	name := fmt.Sprintf("cs%d", id)
+	if _, ok := c.classes[name]; ok {
+		return name
+	}
+	var chain []*TSWP.CharacterStyleArchive
+	for s := cs; s != nil && len(chain) < 32; {
+		chain = append([]*TSWP.CharacterStyleArchive{s}, chain...)
+		s, _ = c.ix.Deref(s.GetSuper().GetParent()).(*TSWP.CharacterStyleArchive)
+	}
+	props := make(map[string]string)
+	for _, s := range chain {
+		charCSS(props, s.CharProperties)
+	}
+	c.classes[name] = declarations(props)
+	return name
+}
+
+// charCSS adds the properties set in cp to props. Properties explicitly turned off are written too, so a
+// character style can undo its paragraph's bold or italic.
+func charCSS(props map[string]string, cp *TSWP.CharacterStylePropertiesArchive) {
+	if cp == nil {
+		return
+	}
+	if cp.Bold != nil {
+		props["font-weight"] = "normal"
+		if *cp.Bold {
+			props["font-weight"] = "bold"
+		}
+	}
+	if cp.Italic != nil {
+		props["font-style"] = "normal"
+		if *cp.Italic {
+			props["font-style"] = "italic"
+		}
+	}
+	if cp.FontSize != nil {
+		props["font-size"] = pt(*cp.FontSize)
+	}
+	if cp.FontName != nil {
+		props["font-family"] = fmt.Sprintf("'%s'", strings.Replace(*cp.FontName, "'", "", -1))
+	}
+	if cp.FontColor != nil && cp.FontColor.GetModel() == TSP.Color_rgb {
+		props["color"] = fmt.Sprintf("rgb(%d, %d, %d)", channel(cp.FontColor.GetR()), channel(cp.FontColor.GetG()), channel(cp.FontColor.GetB()))
+	}
+	if cp.Underline != nil || cp.Strikethru != nil {
+		var decorations []string
+		if cp.Underline != nil && *cp.Underline != TSWP.CharacterStylePropertiesArchive_kNoUnderline {
+			decorations = append(decorations, "underline")
+		}
+		if cp.Strikethru != nil && *cp.Strikethru != TSWP.CharacterStylePropertiesArchive_kNoStrikethru {
+			decorations = append(decorations, "line-through")
+		}
+		if len(decorations) == 0 {
+			decorations = []string{"none"}
+		}
+		props["text-decoration"] = strings.Join(decorations, " ")
+	}
+	if cp.Superscript != nil {
+		switch *cp.Superscript {
+		case TSWP.CharacterStylePropertiesArchive_kSuperscript:
+			props["vertical-align"] = "super"
+		case TSWP.CharacterStylePropertiesArchive_kSubscript:
+			props["vertical-align"] = "sub"
+		default:
+			props["vertical-align"] = "baseline"
+		}
+	}
+}
+
+func declarations(props map[string]string) string {
+	var keys []string
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var rval []string
+	for _, k := range keys {
+		rval = append(rval, k+": "+props[k]+";")
+	}
+	return strings.Join(rval, " ")
+}
+
+func pt(v float32) string {
+	return fmt.Sprintf("%gpt", v)
+}
+
+func channel(v float32) int {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 255
+	}
+	return int(v*255 + 0.5)
+}
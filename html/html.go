@@ -0,0 +1,260 @@
+// Package html renders Pages documents as standalone HTML for previews.
+//
+// Paragraph and character styles become CSS classes, headings and lists map to their HTML elements, and tables and
+// inline images are carried over. Images are embedded as data URIs unless Options.ImageDir is set.
+package html
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Options control how a document is rendered.
+type Options struct {
+	// ImageDir, if set, is a directory the images are written to instead of being embedded. Image links are
+	// relative to the directory's parent, so the HTML should be written there.
+	ImageDir string
+}
+
+// Write renders a Pages document as HTML to w. A nil opts embeds images.
+func Write(w io.Writer, ix *index.Index, opts *Options) error {
+	if ix.Type != "pages" {
+		return fmt.Errorf("html: can't render %s documents", ix.Type)
+	}
+	da, ok := ix.Root().(*TP.DocumentArchive)
+	if !ok {
+		return errors.New("html: missing document archive")
+	}
+	bs, ok := ix.Deref(da.BodyStorage).(*TSWP.StorageArchive)
+	if !ok {
+		return errors.New("html: missing body storage")
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.ImageDir != "" {
+		if err := os.MkdirAll(opts.ImageDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	c := &converter{ix: ix, opts: opts, classes: make(map[string]string), images: make(map[uint64]string)}
+	c.storage(bs)
+	if c.err != nil {
+		return c.err
+	}
+
+	var names []string
+	for name := range c.classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var css bytes.Buffer
+	css.WriteString("p, h1, h2, h3, h4, h5, h6, li { margin: 0; }\ntable { border-collapse: collapse; }\ntd, th { border: 1px solid #ccc; padding: 2pt 4pt; }\n")
+	for _, name := range names {
+		fmt.Fprintf(&css, ".%s { %s }\n", name, c.classes[name])
+	}
+
+	_, err := fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<style>\n%s</style>\n</head>\n<body>\n%s</body>\n</html>\n",
+		css.String(), c.body.String())
+	return err
+}
+
+type converter struct {
+	ix      *index.Index
+	opts    *Options
+	body    bytes.Buffer
+	classes map[string]string // class name -> css
+	images  map[uint64]string // data id -> src
+	lists   []string          // open list elements, one per level
+	err     error
+}
+
+func (c *converter) storage(st *TSWP.StorageArchive) {
+	for _, p := range c.ix.StorageParagraphs(st) {
+		var after []string
+		var inner bytes.Buffer
+		for _, run := range p.Runs {
+			if f := c.ix.RunField(run); f != nil {
+				run.Text = f.Text
+			} else if run.Attachment != nil {
+				if img, table := c.attachment(run.Attachment); table != "" {
+					after = append(after, table)
+				} else {
+					inner.WriteString(img)
+				}
+				continue
+			}
+			text := c.text(run.Text)
+			if text == "" {
+				continue
+			}
+			if class := c.charClass(run.StyleID, run.Style); class != "" {
+				fmt.Fprintf(&inner, `<span class="%s">%s</span>`, class, text)
+			} else {
+				inner.WriteString(text)
+			}
+		}
+
+		class := c.paraClass(p.StyleID, p.Style)
+		attr := ""
+		if class != "" {
+			attr = fmt.Sprintf(` class="%s"`, class)
+		}
+		if level, tag := listItem(p); level >= 0 {
+			c.openList(level, tag)
+			fmt.Fprintf(&c.body, "<li%s>%s</li>\n", attr, inner.String())
+		} else {
+			c.closeLists(0)
+			tag := "p"
+			if level := c.ix.OutlineLevel(p.Style); level > 0 {
+				tag = fmt.Sprintf("h%d", level)
+			}
+			if inner.Len() == 0 {
+				inner.WriteString("<br>")
+			}
+			fmt.Fprintf(&c.body, "<%s%s>%s</%s>\n", tag, attr, inner.String(), tag)
+		}
+		for _, block := range after {
+			c.closeLists(0)
+			c.body.WriteString(block)
+		}
+	}
+	c.closeLists(0)
+}
+
+// listItem returns the list level of a paragraph and the list element to use, or -1 if it isn't a list item.
+func listItem(p index.Paragraph) (int, string) {
+	ls := p.ListStyle
+	if ls == nil || len(ls.LabelTypes) == 0 {
+		return -1, ""
+	}
+	lt := ls.LabelTypes[len(ls.LabelTypes)-1]
+	if int(p.ListLevel) < len(ls.LabelTypes) {
+		lt = ls.LabelTypes[p.ListLevel]
+	}
+	switch lt {
+	case TSWP.ListStyleArchive_kNumber:
+		return int(p.ListLevel), "ol"
+	case TSWP.ListStyleArchive_kString, TSWP.ListStyleArchive_kImage:
+		return int(p.ListLevel), "ul"
+	}
+	return -1, ""
+}
+
+// openList opens or closes list elements until level is the innermost open list.
+func (c *converter) openList(level int, tag string) {
+	c.closeLists(level + 1)
+	if len(c.lists) == level+1 && c.lists[level] != tag {
+		c.closeLists(level)
+	}
+	for len(c.lists) <= level {
+		c.lists = append(c.lists, tag)
+		fmt.Fprintf(&c.body, "<%s>\n", tag)
+	}
+}
+
+// closeLists closes lists until only depth remain open.
+func (c *converter) closeLists(depth int) {
+	for len(c.lists) > depth {
+		fmt.Fprintf(&c.body, "</%s>\n", c.lists[len(c.lists)-1])
+		c.lists = c.lists[:len(c.lists)-1]
+	}
+}
+
+// text escapes run text, translating line breaks and tabs.
+func (c *converter) text(s string) string {
+	return strings.NewReplacer("\u2028", "<br>", "\u000b", "<br>", "\u000c", "", "\t", "&emsp;").Replace(html.EscapeString(s))
+}
+
+// attachment renders an inline attachment. Images are returned as inline HTML, tables as a block to write after
+// the paragraph.
+func (c *converter) attachment(v interface{}) (img, table string) {
+	att, ok := v.(*TSWP.DrawableAttachmentArchive)
+	if !ok {
+		return "", ""
+	}
+	if img, ok := c.ix.Deref(att.Drawable).(*TSD.ImageArchive); ok {
+		return c.image(img), ""
+	}
+	if t, ok := c.ix.Table(att.Drawable.GetIdentifier()); ok {
+		return "", c.table(t)
+	}
+	return "", ""
+}
+
+func (c *converter) image(img *TSD.ImageArchive) string {
+	m, ok := c.ix.MediaFor(img.Data)
+	if !ok {
+		return ""
+	}
+	src, ok := c.images[m.ID]
+	if !ok {
+		rc, err := c.ix.OpenMedia(m.ID)
+		if err != nil {
+			return ""
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return ""
+		}
+		ext := strings.ToLower(path.Ext(m.Path))
+		if c.opts.ImageDir != "" {
+			name := fmt.Sprintf("image%d%s", len(c.images)+1, ext)
+			if err := ioutil.WriteFile(filepath.Join(c.opts.ImageDir, name), data, 0644); err != nil {
+				c.err = err
+				return ""
+			}
+			src = path.Join(filepath.Base(c.opts.ImageDir), name)
+		} else {
+			typ := mime.TypeByExtension(ext)
+			if typ == "" {
+				typ = "application/octet-stream"
+			}
+			src = "data:" + typ + ";base64," + base64.StdEncoding.EncodeToString(data)
+		}
+		c.images[m.ID] = src
+	}
+
+	size := ""
+	if s := img.GetSuper().GetGeometry().GetSize(); s != nil {
+		size = fmt.Sprintf(` width="%d" height="%d"`, int(s.GetWidth()), int(s.GetHeight()))
+	}
+	return fmt.Sprintf(`<img src="%s" alt="%s"%s>`, html.EscapeString(src),
+		html.EscapeString(img.GetSuper().GetAccessibilityDescription()), size)
+}
+
+func (c *converter) table(t *index.Table) string {
+	var buf bytes.Buffer
+	buf.WriteString("<table>\n")
+	for r, row := range t.Rows {
+		tag := "td"
+		if r < t.HeaderRows {
+			tag = "th"
+		}
+		buf.WriteString("<tr>")
+		for _, cell := range row {
+			fmt.Fprintf(&buf, "<%s>%s</%s>", tag, html.EscapeString(cell.String()), tag)
+		}
+		buf.WriteString("</tr>\n")
+	}
+	buf.WriteString("</table>\n")
+	return buf.String()
+}
@@ -0,0 +1,170 @@
+package index
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+)
+
+// Transition is the effect played when a slide is shown. Effect is Keynote's identifier for it, like
+// "apple:dissolve". Durations and delays are in seconds, and Automatic is set when the transition starts on its
+// own, after Delay, rather than on a click.
+type Transition struct {
+	Effect    string  `json:"effect"`
+	Duration  float64 `json:"duration,omitempty"`
+	Delay     float64 `json:"delay,omitempty"`
+	Automatic bool    `json:"automatic,omitempty"`
+	Direction uint32  `json:"direction,omitempty"`
+}
+
+// Build is an animation of a drawable on a slide. Type is the animation type Keynote records, telling builds in,
+// builds out and actions apart, Delivery how the drawable's parts appear (like "By Paragraph") and Kind the
+// drawable kind, as in DrawableInfo. A build plays in Steps parts, each started on a click or automatically; Order
+// is its position among the builds of the slide, from 1.
+type Build struct {
+	ID        uint64  `json:"id"`
+	Drawable  uint64  `json:"drawable"`
+	Kind      string  `json:"kind"`
+	Type      string  `json:"type,omitempty"`
+	Effect    string  `json:"effect"`
+	Delivery  string  `json:"delivery,omitempty"`
+	Duration  float64 `json:"duration,omitempty"`
+	Delay     float64 `json:"delay,omitempty"`
+	Automatic bool    `json:"automatic,omitempty"`
+	Steps     int     `json:"steps"`
+	Order     int     `json:"order"`
+}
+
+// SlideAnimations are the transition and builds of a slide. Transition is nil if the slide has none.
+type SlideAnimations struct {
+	Slide      int         `json:"slide"`
+	ID         uint64      `json:"id"`
+	Transition *Transition `json:"transition,omitempty"`
+	Builds     []Build     `json:"builds,omitempty"`
+}
+
+// Animations returns the transitions and builds of the slides of a Keynote document, in presentation order. On a
+// lazily opened document the components of each slide are loaded as it's reached.
+func (ix *Index) Animations() ([]SlideAnimations, error) {
+	if ix.Type != "key" {
+		return nil, errors.New("not a Keynote document")
+	}
+	var rval []SlideAnimations
+	for n, id := range ix.Slides() {
+		if err := ix.LoadObject(id); err != nil {
+			return rval, err
+		}
+		slide, ok := ix.Records[id].(*KN.SlideArchive)
+		if !ok {
+			return rval, errors.New("missing slide archive")
+		}
+		rval = append(rval, SlideAnimations{
+			Slide:      n + 1,
+			ID:         id,
+			Transition: slideTransition(slide),
+			Builds:     ix.slideBuilds(slide),
+		})
+	}
+	return rval, nil
+}
+
+// slideTransition returns the transition of a slide, preferring the current animation attributes to the older
+// database ones.
+func slideTransition(slide *KN.SlideArchive) *Transition {
+	attrs := slide.GetTransition().GetAttributes()
+	if attrs == nil {
+		return nil
+	}
+	rval := &Transition{
+		Effect:    attrs.GetDatabaseEffect(),
+		Duration:  attrs.GetDatabaseDuration(),
+		Delay:     float64(attrs.GetDatabaseDelay()),
+		Automatic: attrs.GetIsAutomatic(),
+		Direction: attrs.GetDatabaseDirection(),
+	}
+	if aa := attrs.AnimationAttributes; aa != nil {
+		if aa.Effect != nil {
+			rval.Effect = aa.GetEffect()
+		}
+		if aa.Duration != nil {
+			rval.Duration = aa.GetDuration()
+		}
+		if aa.Delay != nil {
+			rval.Delay = aa.GetDelay()
+		}
+		if aa.IsAutomatic != nil {
+			rval.Automatic = aa.GetIsAutomatic()
+		}
+		if aa.Direction != nil {
+			rval.Direction = aa.GetDirection()
+		}
+	}
+	if rval.Effect == "" || rval.Effect == "none" {
+		return nil
+	}
+	return rval
+}
+
+// slideBuilds returns the builds of a slide in the order they play. The build chunks, one per step, give the
+// order; the delay and automatic start of a build are those of its first step.
+func (ix *Index) slideBuilds(slide *KN.SlideArchive) []Build {
+	builds := make(map[uint64]*Build)
+	var rval []*Build
+	for _, ref := range slide.Builds {
+		id := ref.GetIdentifier()
+		b, ok := ix.Deref(ref).(*KN.BuildArchive)
+		if !ok || builds[id] != nil {
+			continue
+		}
+		attrs := b.GetAttributes()
+		build := &Build{
+			ID:       id,
+			Drawable: b.GetDrawable().GetIdentifier(),
+			Kind:     drawableKind(ix.Deref(b.Drawable)),
+			Type:     attrs.GetDatabaseAnimationType(),
+			Effect:   attrs.GetDatabaseEffect(),
+			Delivery: b.GetDelivery(),
+			Duration: b.GetDuration(),
+			Delay:    attrs.GetDatabaseDelay(),
+		}
+		if aa := attrs.GetAnimationAttributes(); aa != nil {
+			if aa.AnimationType != nil {
+				build.Type = aa.GetAnimationType()
+			}
+			if aa.Effect != nil {
+				build.Effect = aa.GetEffect()
+			}
+		}
+		builds[id] = build
+		rval = append(rval, build)
+	}
+
+	first := make(map[uint64]uint32)
+	for _, chunk := range slide.BuildChunks {
+		build := builds[chunk.GetBuild().GetIdentifier()]
+		if build == nil {
+			continue
+		}
+		if build.Steps == 0 || chunk.GetIndex() < first[build.ID] {
+			first[build.ID] = chunk.GetIndex()
+			build.Delay = chunk.GetDelay()
+			build.Automatic = chunk.GetAutomatic()
+		}
+		build.Steps++
+	}
+	sort.SliceStable(rval, func(i, j int) bool {
+		a, b := rval[i], rval[j]
+		if (a.Steps == 0) != (b.Steps == 0) {
+			return b.Steps == 0
+		}
+		return first[a.ID] < first[b.ID]
+	})
+
+	var out []Build
+	for n, build := range rval {
+		build.Order = n + 1
+		out = append(out, *build)
+	}
+	return out
+}
@@ -0,0 +1,277 @@
+package index
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Attachment kinds
+const (
+	AttachmentEquation = "equation"
+	AttachmentMovie    = "movie"
+	AttachmentAudio    = "audio"
+	AttachmentWebVideo = "web video"
+	AttachmentFile     = "file"
+)
+
+// equationType is the archive type id of TSWP.EquationInfoArchive, which our protos don't have.
+const equationType = 2015
+
+// Attachment is an embedded object other than a picture: an equation, a movie or sound, a web video, or a file
+// carried in the document that nothing references. Media is the file behind it, URL the address of a web video.
+// Equations keep their source, in Format "mathml" or "latex", when it can be found in the record.
+type Attachment struct {
+	ID        uint64    `json:"id"`
+	Kind      string    `json:"kind"`
+	Media     *Media    `json:"media,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Format    string    `json:"format,omitempty"`
+	Placement Placement `json:"placement"`
+}
+
+// Placement is where an attachment sits. Slide counts from 1 and Sheet is a sheet name; an attachment anchored in
+// text has the storage and the rune offset of its placeholder, and Page is set for the body text of a Pages
+// document. The frame is in points, relative to the slide, sheet or page. Document wide attachments, like a
+// Keynote soundtrack or an unreferenced file, have none of these.
+type Placement struct {
+	Slide   int     `json:"slide,omitempty"`
+	Sheet   string  `json:"sheet,omitempty"`
+	Page    int     `json:"page,omitempty"`
+	Storage uint64  `json:"storage,omitempty"`
+	Offset  uint32  `json:"offset,omitempty"`
+	X       float32 `json:"x,omitempty"`
+	Y       float32 `json:"y,omitempty"`
+	Width   float32 `json:"width,omitempty"`
+	Height  float32 `json:"height,omitempty"`
+}
+
+// Attachments lists the equations, movies, sounds and web videos of the document ordered by identifier, then the
+// unreferenced files. Equations are read from their raw records, as the decoders don't know their type; the
+// source is the MathML or LaTeX text found in the record, which is a best guess.
+func (ix *Index) Attachments() []Attachment {
+	var rval []Attachment
+	var place func(id uint64) Placement
+	for _, id := range ix.IDs() {
+		var a *Attachment
+		switch v := ix.Records[id].(type) {
+		case *TSD.MovieArchive:
+			a = &Attachment{ID: id, Kind: AttachmentMovie}
+			switch {
+			case v.GetMovieRemoteURL() != "":
+				a.Kind, a.URL = AttachmentWebVideo, v.GetMovieRemoteURL()
+			case v.GetAudioOnly():
+				a.Kind = AttachmentAudio
+			}
+			if m, ok := ix.MediaFor(v.MovieData); ok {
+				a.Media = &m
+			}
+		case *KN.Soundtrack:
+			for _, ref := range v.MovieMedia {
+				if m, ok := ix.MediaFor(ref); ok {
+					rval = append(rval, Attachment{ID: id, Kind: AttachmentAudio, Media: &m})
+				}
+			}
+		case *RawRecord:
+			if v.Type == equationType {
+				a = ix.equation(v)
+			}
+		}
+		if a != nil {
+			if place == nil {
+				place = ix.placer()
+			}
+			a.Placement = place(id)
+			rval = append(rval, *a)
+		}
+	}
+
+	users := ix.mediaUsers()
+	for _, m := range ix.Media() {
+		if len(users[m.ID]) == 0 && m.Size >= 0 {
+			m := m
+			rval = append(rval, Attachment{ID: m.ID, Kind: AttachmentFile, Media: &m})
+		}
+	}
+	return rval
+}
+
+// equation reads an equation from its raw record. Its media is the first data it references, the rendered image.
+func (ix *Index) equation(raw *RawRecord) *Attachment {
+	a := &Attachment{ID: raw.ID, Kind: AttachmentEquation}
+	if _, datas := ix.rawReferences(raw); len(datas) > 0 {
+		for _, m := range ix.Media() {
+			if m.ID == datas[0] {
+				m := m
+				a.Media = &m
+			}
+		}
+	}
+	for _, s := range wireStrings(raw.Payload, 0) {
+		if strings.Contains(s, "<math") {
+			a.Source, a.Format = s, "mathml"
+			break
+		}
+		if a.Source == "" && latexCommand.MatchString(s) {
+			a.Source, a.Format = s, "latex"
+		}
+	}
+	return a
+}
+
+var latexCommand = regexp.MustCompile(`\\[a-zA-Z]+|[\^_]\{`)
+
+// wireStrings returns the length delimited fields of encoded protobuf data that read as text, looking into those
+// that parse as messages instead.
+func wireStrings(data []byte, depth int) []string {
+	var rval []string
+	for _, f := range wireFields(data) {
+		if f.typ != 2 || len(f.data) == 0 {
+			continue
+		}
+		if isText(f.data) {
+			rval = append(rval, string(f.data))
+		} else if depth < 8 {
+			rval = append(rval, wireStrings(f.data, depth+1)...)
+		}
+	}
+	return rval
+}
+
+func isText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if r < ' ' && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// placer returns a function finding the placement of a drawable. It follows groups and text anchors up to a slide,
+// sheet or page, and takes the frame from the drawable archive; for raw records, the first field is tried as an
+// image or drawable archive.
+func (ix *Index) placer() func(id uint64) Placement {
+	parent := make(map[uint64]uint64)
+	type anchor struct {
+		storage uint64
+		offset  uint32
+	}
+	anchors := make(map[uint64]anchor)
+	owner := make(map[uint64]uint64) // text storage to the shape holding it
+	slides := make(map[uint64]int)
+	sheets := make(map[uint64]string)
+
+	for id, v := range ix.Records {
+		for _, ref := range groupChildren(v) {
+			parent[ref.GetIdentifier()] = id
+		}
+		switch v := v.(type) {
+		case *TSWP.ShapeInfoArchive:
+			if v.ContainedStorage != nil {
+				owner[v.ContainedStorage.GetIdentifier()] = id
+			}
+		case *TSWP.StorageArchive:
+			if v.TableAttachment == nil {
+				continue
+			}
+			for _, e := range v.TableAttachment.Entries {
+				if da, ok := ix.Deref(e.Object).(*TSWP.DrawableAttachmentArchive); ok && da.Drawable != nil {
+					anchors[da.Drawable.GetIdentifier()] = anchor{id, e.GetCharacterIndex()}
+				}
+			}
+		}
+	}
+	for n, id := range ix.Slides() {
+		if slide, ok := ix.Records[id].(*KN.SlideArchive); ok {
+			for _, ref := range slide.Drawables {
+				slides[ref.GetIdentifier()] = n + 1
+			}
+		}
+	}
+	if da, ok := ix.Root().(*TN.DocumentArchive); ok {
+		for _, ref := range da.Sheets {
+			if sa, ok := ix.Deref(ref).(*TN.SheetArchive); ok {
+				for _, d := range sa.DrawableInfos {
+					sheets[d.GetIdentifier()] = sa.GetName()
+				}
+			}
+		}
+	}
+	var body uint64
+	var pages []Page
+	if da, ok := ix.Root().(*TP.DocumentArchive); ok && da.BodyStorage != nil {
+		body = da.BodyStorage.GetIdentifier()
+	}
+
+	return func(id uint64) Placement {
+		var rval Placement
+		if da := ix.frameOf(id); da != nil {
+			geom := da.GetGeometry()
+			rval.X, rval.Y = geom.GetPosition().GetX(), geom.GetPosition().GetY()
+			rval.Width, rval.Height = geom.GetSize().GetWidth(), geom.GetSize().GetHeight()
+		}
+		seen := make(map[uint64]bool)
+		for cur := id; cur != 0 && !seen[cur]; {
+			seen[cur] = true
+			if n, ok := slides[cur]; ok {
+				rval.Slide = n
+				break
+			}
+			if name, ok := sheets[cur]; ok {
+				rval.Sheet = name
+				break
+			}
+			if a, ok := anchors[cur]; ok {
+				if rval.Storage == 0 {
+					rval.Storage, rval.Offset = a.storage, a.offset
+				}
+				if a.storage == body {
+					if pages == nil {
+						pages = ix.BodyPages()
+					}
+					rval.Page = pageAt(pages, a.offset)
+					break
+				}
+				cur = owner[a.storage]
+				continue
+			}
+			cur = parent[cur]
+		}
+		return rval
+	}
+}
+
+// frameOf returns the drawable archive of a record.
+func (ix *Index) frameOf(id uint64) *TSD.DrawableArchive {
+	v := ix.Records[id]
+	raw, ok := v.(*RawRecord)
+	if !ok {
+		return drawableArchive(v)
+	}
+	for _, f := range wireFields(raw.Payload) {
+		if f.num != 1 || f.typ != 2 {
+			continue
+		}
+		var image TSD.ImageArchive
+		if proto.Unmarshal(f.data, &image) == nil && image.GetSuper().GetGeometry() != nil {
+			return image.Super
+		}
+		var da TSD.DrawableArchive
+		if proto.Unmarshal(f.data, &da) == nil && da.Geometry != nil {
+			return &da
+		}
+	}
+	return nil
+}
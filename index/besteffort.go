@@ -0,0 +1,71 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Truncation reports how far a best-effort extraction got before its deadline. Completed and Pending list the .iwa
+// files that were and weren't fully processed; they are empty for .pages-tef documents, which are read as a whole.
+type Truncation struct {
+	Truncated bool     `json:"truncated"`
+	Reason    string   `json:"reason,omitempty"`
+	Completed []string `json:"completed,omitempty"`
+	Pending   []string `json:"pending,omitempty"`
+}
+
+// canceled reports whether err is ctx giving up, rather than a problem with the document.
+func canceled(ctx context.Context, err error) bool {
+	return ctx.Err() != nil && errors.Is(err, ctx.Err())
+}
+
+// OpenBestEffort is OpenContext for deadline bound callers: if ctx is done before the document is loaded it
+// returns what was loaded so far, with a Truncation saying what is missing, instead of an error. A truncated Index
+// behaves like one from OpenLazy: it can't be saved until LoadAll has finished the job. Other errors are returned
+// as usual.
+func OpenBestEffort(ctx context.Context, doc, password string) (*Index, *Truncation, error) {
+	tr := &Truncation{}
+	ix, err := open(ctx, doc, Options{Password: password})
+	if err == nil || ix == nil || !canceled(ctx, err) {
+		if err == nil {
+			tr.Completed = ix.loadedFiles()
+		}
+		return ix, tr, err
+	}
+	tr.Truncated, tr.Reason = true, ctx.Err().Error()
+	tr.Completed = ix.loadedFiles()
+	if zf, _, zerr := openZip(doc); zerr == nil {
+		for _, f := range zf.File {
+			if strings.HasSuffix(f.Name, ".iwa") && !ix.loaded[f.Name] {
+				tr.Pending = append(tr.Pending, f.Name)
+			}
+		}
+		zf.Close()
+		ix.lazy = true
+	}
+	return ix, tr, nil
+}
+
+func (ix *Index) loadedFiles() []string {
+	var rval []string
+	for name := range ix.loaded {
+		rval = append(rval, name)
+	}
+	sort.Strings(rval)
+	return rval
+}
+
+// ExtractTextBestEffort is ExtractTextToContext for deadline bound callers: if ctx is done first, the text found so
+// far has been written to w and the Truncation says which files weren't finished, instead of an error.
+func ExtractTextBestEffort(ctx context.Context, w io.Writer, doc, password string) (*Truncation, error) {
+	tr := &Truncation{}
+	err := extractTextTo(ctx, w, doc, password, tr)
+	if err != nil && canceled(ctx, err) {
+		tr.Truncated, tr.Reason = true, ctx.Err().Error()
+		return tr, nil
+	}
+	return tr, err
+}
@@ -0,0 +1,106 @@
+package index
+
+import (
+	"sync"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+)
+
+// Cache memoizes lookups that exporters repeat for every cell or run of a large document: the keyed entries of
+// table data lists (strings, formats, styles, formulas) and whatever the caller derives from a record, such as a
+// resolved style chain. Deref itself is a map lookup and isn't cached. A Cache belongs to one Index and assumes
+// its records don't change; the editing methods and lazy loading reset it, and callers changing Records directly
+// must call Reset. It is safe for concurrent use.
+type Cache struct {
+	mu    sync.Mutex
+	lists map[uint64]map[uint32]*TST.TableDataList_ListEntry
+	memo  map[memoKey]interface{}
+}
+
+type memoKey struct {
+	id   uint64
+	kind string
+}
+
+// NewCache returns an empty cache, to be installed with SetCache.
+func NewCache() *Cache {
+	return &Cache{
+		lists: make(map[uint64]map[uint32]*TST.TableDataList_ListEntry),
+		memo:  make(map[memoKey]interface{}),
+	}
+}
+
+// Reset empties the cache.
+func (c *Cache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lists = make(map[uint64]map[uint32]*TST.TableDataList_ListEntry)
+	c.memo = make(map[memoKey]interface{})
+}
+
+// SetCache installs a cache used by Entries, Entry, Memo and the table decoding built on them. A nil cache, the
+// default, turns caching off.
+func (ix *Index) SetCache(c *Cache) {
+	ix.cache = c
+}
+
+// Entries returns the entries of the TST.TableDataList at ref, by key. The map must not be modified.
+func (ix *Index) Entries(ref *TSP.Reference) map[uint32]*TST.TableDataList_ListEntry {
+	list, ok := ix.Deref(ref).(*TST.TableDataList)
+	if !ok {
+		return nil
+	}
+	c := ix.cache
+	if c != nil {
+		c.mu.Lock()
+		rval, ok := c.lists[ref.GetIdentifier()]
+		c.mu.Unlock()
+		if ok {
+			return rval
+		}
+	}
+	rval := make(map[uint32]*TST.TableDataList_ListEntry, len(list.Entries))
+	for _, entry := range list.Entries {
+		rval[entry.GetKey()] = entry
+	}
+	if c != nil {
+		c.mu.Lock()
+		c.lists[ref.GetIdentifier()] = rval
+		c.mu.Unlock()
+	}
+	return rval
+}
+
+// Entry returns the entry with key in the TST.TableDataList at ref, or nil.
+func (ix *Index) Entry(ref *TSP.Reference, key uint32) *TST.TableDataList_ListEntry {
+	return ix.Entries(ref)[key]
+}
+
+// Memo returns the value build derives for record id, calling build only the first time for each id and kind when
+// a cache is installed. kind tells apart the values derived from the same record.
+func (ix *Index) Memo(id uint64, kind string, build func() interface{}) interface{} {
+	c := ix.cache
+	if c == nil {
+		return build()
+	}
+	k := memoKey{id, kind}
+	c.mu.Lock()
+	v, ok := c.memo[k]
+	c.mu.Unlock()
+	if ok {
+		return v
+	}
+	v = build()
+	c.mu.Lock()
+	c.memo[k] = v
+	c.mu.Unlock()
+	return v
+}
+
+// invalidate drops cached lookups after an edit.
+func (ix *Index) invalidate() {
+	if ix.cache != nil {
+		ix.cache.Reset()
+	}
+}
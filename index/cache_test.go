@@ -0,0 +1,85 @@
+package index
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dunhamsteve/iwork/proto/TSK"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// textTable returns a table of rows×cols text cells drawing on a few hundred distinct strings, like a large
+// spreadsheet of repeated labels.
+func textTable(b *testing.B, rows, cols int) (*Index, *Table) {
+	ix, table, _ := emptyTable(uint32(rows), uint32(cols))
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			text := fmt.Sprintf("label %d", (r*cols+c)%300)
+			if err := ix.SetCell(table, r, c, Cell{Type: TextCell, Text: text}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return ix, table
+}
+
+// formatTable adds a format table of n number formats to a table model.
+func formatTable(ix *Index, tm *TST.TableModelArchive, n int) {
+	list := &TST.TableDataList{}
+	for k := 1; k <= n; k++ {
+		list.Entries = append(list.Entries, &TST.TableDataList_ListEntry{
+			Key:      proto.Uint32(uint32(k)),
+			Refcount: proto.Uint32(1),
+			Format:   &TSK.FormatStructArchive{FormatType: proto.Uint32(256), DecimalPlaces: proto.Uint32(2)},
+		})
+	}
+	ix.Records[4] = list
+	tm.DataStore.FormatTable = &TSP.Reference{Identifier: proto.Uint64(4)}
+}
+
+// withCache runs a benchmark without and with a Cache installed on ix.
+func withCache(b *testing.B, ix *Index, fn func(b *testing.B)) {
+	b.Run("nocache", func(b *testing.B) {
+		ix.SetCache(nil)
+		b.ReportAllocs()
+		fn(b)
+	})
+	b.Run("cache", func(b *testing.B) {
+		ix.SetCache(NewCache())
+		b.ReportAllocs()
+		fn(b)
+	})
+}
+
+func BenchmarkCells(b *testing.B) {
+	ix, table := textTable(b, 256, 20)
+	b.ResetTimer()
+	withCache(b, ix, func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ix.Cells(table.Model)
+		}
+	})
+}
+
+// BenchmarkCellFormat looks up the format of every cell of a table, which an exporter does once per cell.
+func BenchmarkCellFormat(b *testing.B) {
+	ix, table, _ := emptyTable(1, 1)
+	formatTable(ix, table.Model, 500)
+	cells := make([]Cell, 5000)
+	for i := range cells {
+		cells[i] = Cell{Type: NumberCell, FormatKey: uint32(i%500 + 1)}
+	}
+	b.ResetTimer()
+	withCache(b, ix, func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, cell := range cells {
+				if ix.CellFormat(table.Model, cell) == nil {
+					b.Fatal("missing format")
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package index
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TSK"
+	"github.com/dunhamsteve/iwork/proto/TST"
+)
+
+// Format types, the values of CellFormat.Type
+const (
+	FormatDecimal        = 256
+	FormatCurrency       = 257
+	FormatPercent        = 258
+	FormatScientific     = 259
+	FormatText           = 260
+	FormatDate           = 261
+	FormatFraction       = 262
+	FormatCheckbox       = 263
+	FormatStepper        = 264
+	FormatSlider         = 265
+	FormatPopup          = 266
+	FormatRating         = 267
+	FormatDuration       = 268
+	FormatBase           = 269
+	FormatCustomNumber   = 270
+	FormatCustomText     = 271
+	FormatCustomDate     = 272
+	FormatCustomCurrency = 274
+)
+
+// AutoDecimals is the DecimalPlaces of a format that shows as many decimals as the value needs.
+const AutoDecimals = 253
+
+// CellFormat is the number format of a table cell, as set in the Format inspector. DatePattern is a Unicode (ICU)
+// date pattern, like "MMM d, yyyy", and Custom the format string of a custom format. NegativeStyle is 0 for
+// "-100", 1 for red, 2 for "(100)" and 3 for red "(100)".
+type CellFormat struct {
+	Type          uint32                   `json:"type"`
+	DecimalPlaces uint32                   `json:"decimal_places"`
+	Currency      string                   `json:"currency,omitempty"`
+	Thousands     bool                     `json:"thousands,omitempty"`
+	Accounting    bool                     `json:"accounting,omitempty"`
+	NegativeStyle uint32                   `json:"negative_style,omitempty"`
+	DatePattern   string                   `json:"date_pattern,omitempty"`
+	Custom        string                   `json:"custom,omitempty"`
+	Archive       *TSK.FormatStructArchive `json:"-"`
+}
+
+// CellFormat returns the number format of a cell of a table model, or nil if the cell has the default format.
+func (ix *Index) CellFormat(tm *TST.TableModelArchive, cell Cell) *CellFormat {
+	if cell.FormatKey == 0 {
+		return nil
+	}
+	entry := ix.Entry(tm.GetDataStore().GetFormatTable(), cell.FormatKey)
+	if entry == nil || entry.Format == nil {
+		return nil
+	}
+	return NewCellFormat(entry.Format)
+}
+
+// NewCellFormat converts a format archive.
+func NewCellFormat(f *TSK.FormatStructArchive) *CellFormat {
+	return &CellFormat{
+		Type:          f.GetFormatType(),
+		DecimalPlaces: f.GetDecimalPlaces(),
+		Currency:      f.GetCurrencyCode(),
+		Thousands:     f.GetShowThousandsSeparator(),
+		Accounting:    f.GetUseAccountingStyle(),
+		NegativeStyle: f.GetNegativeStyle(),
+		DatePattern:   f.GetDateTimeFormat(),
+		Custom:        f.GetCustomFormatString(),
+		Archive:       f,
+	}
+}
+
+var currencySymbols = map[string]string{"USD": "$", "EUR": "€", "GBP": "£", "JPY": "¥", "CNY": "¥", "INR": "₹"}
+
+// Format renders a cell value the way Numbers shows it with this format, like "3/14/2025" or "$1,234.00".
+// Custom number formats are shown as plain decimals, and durations as h:mm:ss. A nil format gives the cell's
+// String.
+func (f *CellFormat) Format(cell Cell) string {
+	if f == nil {
+		return cell.String()
+	}
+	switch cell.Type {
+	case NumberCell, CurrencyCell:
+		return f.number(cell.Number)
+	case DateCell:
+		if f.DatePattern != "" {
+			return formatDate(cell, f.DatePattern)
+		}
+	case DurationCell:
+		return formatDuration(cell.Number)
+	}
+	return cell.String()
+}
+
+// number formats a number by the format type.
+func (f *CellFormat) number(v float64) string {
+	switch f.Type {
+	case FormatPercent:
+		return f.negative(f.decimal(math.Abs(v)*100)+"%", v < 0)
+	case FormatScientific:
+		return strings.Replace(strconv.FormatFloat(v, 'E', f.places(), 64), "E+0", "E+", 1)
+	case FormatCurrency, FormatCustomCurrency:
+		symbol, ok := currencySymbols[f.Currency]
+		if !ok {
+			symbol = f.Currency + " "
+		}
+		s := symbol + f.decimal(math.Abs(v))
+		return f.negative(s, v < 0)
+	}
+	return f.negative(f.decimal(math.Abs(v)), v < 0)
+}
+
+// negative applies the negative style to the formatted magnitude of a number.
+func (f *CellFormat) negative(s string, negative bool) string {
+	if !negative {
+		return s
+	}
+	if f.NegativeStyle == 2 || f.NegativeStyle == 3 {
+		return "(" + s + ")"
+	}
+	return "-" + s
+}
+
+// places returns the decimal places to format with, -1 for as many as needed. Numbers offers at most 10, so larger
+// values only come from damaged files and are capped.
+func (f *CellFormat) places() int {
+	switch {
+	case f.DecimalPlaces == AutoDecimals:
+		return -1
+	case f.DecimalPlaces > maxDecimals:
+		return maxDecimals
+	}
+	return int(f.DecimalPlaces)
+}
+
+// maxDecimals is the most decimal places a format is shown with.
+const maxDecimals = 10
+
+// decimal formats a number with the decimal places and thousands separator of the format.
+func (f *CellFormat) decimal(v float64) string {
+	s := strconv.FormatFloat(v, 'f', f.places(), 64)
+	if !f.Thousands {
+		return s
+	}
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i:]
+	}
+	var sb strings.Builder
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteRune(r)
+	}
+	return sign + sb.String() + frac
+}
+
+// formatDuration writes seconds as h:mm:ss.
+func formatDuration(seconds float64) string {
+	sign := ""
+	if seconds < 0 {
+		sign, seconds = "-", -seconds
+	}
+	s := int64(math.Round(seconds))
+	return sign + strconv.FormatInt(s/3600, 10) + ":" + pad2(s/60%60) + ":" + pad2(s%60)
+}
+
+func pad2(n int64) string {
+	if n < 10 {
+		return "0" + strconv.FormatInt(n, 10)
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// formatDate renders a date cell with a Unicode (ICU) date pattern. Fields without a Go equivalent, like eras and
+// week numbers, are dropped.
+func formatDate(cell Cell, pattern string) string {
+	t := cell.Time
+	var rval strings.Builder
+	rr := []rune(pattern)
+	for i := 0; i < len(rr); {
+		r := rr[i]
+		j := i
+		for j < len(rr) && rr[j] == r {
+			j++
+		}
+		n := j - i
+		switch {
+		case r == '\'':
+			// quoted literal, '' is a single quote
+			k := i + 1
+			for k < len(rr) && rr[k] != '\'' {
+				k++
+			}
+			if k == i+1 {
+				rval.WriteByte('\'')
+			} else {
+				rval.WriteString(string(rr[i+1 : k]))
+			}
+			j = k + 1
+		case r == 'y':
+			if n == 2 {
+				rval.WriteString(t.Format("06"))
+			} else {
+				rval.WriteString(t.Format("2006"))
+			}
+		case r == 'M' || r == 'L':
+			rval.WriteString(t.Format([]string{"1", "01", "Jan", "January"}[min(n, 4)-1]))
+		case r == 'd':
+			rval.WriteString(t.Format([]string{"2", "02"}[min(n, 2)-1]))
+		case r == 'E':
+			if n >= 4 {
+				rval.WriteString(t.Format("Monday"))
+			} else {
+				rval.WriteString(t.Format("Mon"))
+			}
+		case r == 'H' || r == 'k':
+			rval.WriteString(t.Format("15"))
+		case r == 'h' || r == 'K':
+			rval.WriteString(t.Format([]string{"3", "03"}[min(n, 2)-1]))
+		case r == 'm':
+			rval.WriteString(t.Format([]string{"4", "04"}[min(n, 2)-1]))
+		case r == 's':
+			rval.WriteString(t.Format([]string{"5", "05"}[min(n, 2)-1]))
+		case r == 'a':
+			rval.WriteString(t.Format("PM"))
+		case (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			// era, quarter, week, time zone, ... are dropped
+		default:
+			rval.WriteString(string(rr[i:j]))
+		}
+		i = j
+	}
+	return strings.TrimSpace(rval.String())
+}
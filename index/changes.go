@@ -0,0 +1,122 @@
+package index
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dunhamsteve/iwork/proto/TSK"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Kinds of tracked change
+const (
+	ChangeInsertion = "insertion"
+	ChangeDeletion  = "deletion"
+)
+
+// Change is a tracked change in a text storage: text inserted or deleted while change tracking was on, and not yet
+// accepted or rejected. Start and End are rune offsets into the storage, and Text is the text in that range.
+// Deleted text stays in the storage until the change is accepted. Author and Date come from the change, falling
+// back to its editing session.
+type Change struct {
+	ID      uint64    `json:"id"`
+	Kind    string    `json:"kind"`
+	Author  string    `json:"author,omitempty"`
+	Date    time.Time `json:"date,omitempty"`
+	Hidden  bool      `json:"hidden,omitempty"`
+	Storage uint64    `json:"storage"`
+	Start   int       `json:"start"`
+	End     int       `json:"end"`
+	Text    string    `json:"text"`
+}
+
+// Changes lists the tracked changes of a storage in text order.
+func (ix *Index) Changes(id uint64, st *TSWP.StorageArchive) []Change {
+	rr := []rune(strings.Join(st.Text, ""))
+	var rval []Change
+	add := func(table *TSWP.ObjectAttributeTable, kind string) {
+		if table == nil {
+			return
+		}
+		for i, e := range table.Entries {
+			ch, ok := ix.Deref(e.Object).(*TSWP.ChangeArchive)
+			if !ok {
+				continue
+			}
+			start, end := int(e.GetCharacterIndex()), len(rr)
+			if i+1 < len(table.Entries) {
+				end = int(table.Entries[i+1].GetCharacterIndex())
+			}
+			if end > len(rr) {
+				end = len(rr)
+			}
+			if start >= end {
+				continue
+			}
+			c := Change{ID: e.Object.GetIdentifier(), Kind: kind, Hidden: ch.GetHidden(), Storage: id, Start: start, End: end, Text: string(rr[start:end])}
+			session, _ := ix.Deref(ch.Session).(*TSWP.ChangeSessionArchive)
+			if author, ok := ix.Deref(session.GetAuthor()).(*TSK.AnnotationAuthorArchive); ok {
+				c.Author = author.GetName()
+			}
+			if ch.Date != nil {
+				c.Date = appleTime(ch.Date.GetSeconds())
+			} else if session.GetDate() != nil {
+				c.Date = appleTime(session.GetDate().GetSeconds())
+			}
+			rval = append(rval, c)
+		}
+	}
+	add(st.TableInsertion, ChangeInsertion)
+	add(st.TableDeletion, ChangeDeletion)
+	sort.SliceStable(rval, func(i, j int) bool { return rval[i].Start < rval[j].Start })
+	return rval
+}
+
+// TrackedChanges lists the tracked changes of every storage in the document, ordered by storage and position.
+func (ix *Index) TrackedChanges() []Change {
+	var ids []uint64
+	for id, v := range ix.Records {
+		if _, ok := v.(*TSWP.StorageArchive); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var rval []Change
+	for _, id := range ids {
+		rval = append(rval, ix.Changes(id, ix.Records[id].(*TSWP.StorageArchive))...)
+	}
+	return rval
+}
+
+// AcceptedText returns the text of a storage with every tracked change accepted: insertions kept and deletions
+// dropped. Attachment placeholders are left out, as with the text of table cells.
+func (ix *Index) AcceptedText(id uint64, st *TSWP.StorageArchive) string {
+	return ix.changedText(id, st, ChangeDeletion)
+}
+
+// RejectedText returns the text of a storage with every tracked change rejected: deletions kept and insertions
+// dropped.
+func (ix *Index) RejectedText(id uint64, st *TSWP.StorageArchive) string {
+	return ix.changedText(id, st, ChangeInsertion)
+}
+
+// changedText returns the text of st without the changes of the given kind.
+func (ix *Index) changedText(id uint64, st *TSWP.StorageArchive, drop string) string {
+	rr := []rune(strings.Join(st.Text, ""))
+	skip := make([]bool, len(rr))
+	for _, c := range ix.Changes(id, st) {
+		if c.Kind == drop {
+			for i := c.Start; i < c.End; i++ {
+				skip[i] = true
+			}
+		}
+	}
+	var rval []rune
+	for i, r := range rr {
+		if !skip[i] && r != AttachmentChar {
+			rval = append(rval, r)
+		}
+	}
+	return string(rval)
+}
@@ -0,0 +1,127 @@
+package index
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TSCH"
+	"github.com/dunhamsteve/iwork/proto/TSCH/PreUFF"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Chart is the data behind a chart. Type is the chart type as the apps name it, less "ChartType", like "column2D"
+// or "stackedBar3D". Each series has a value per category, nil where the grid has no number. Dates are given as
+// seconds since 2001-01-01 UTC.
+type Chart struct {
+	ID         uint64   `json:"id"`
+	Type       string   `json:"type"`
+	Categories []string `json:"categories"`
+	Series     []Series `json:"series"`
+}
+
+// Series is a named row (or column) of chart data.
+type Series struct {
+	Name   string     `json:"name"`
+	Values []*float64 `json:"values"`
+}
+
+// Charts returns the data of the charts in a document, ordered by identifier. Both current charts and the
+// pre-unified ones of older documents are read.
+func (ix *Index) Charts() []Chart {
+	var rval []Chart
+	for id, v := range ix.Records {
+		switch d := v.(type) {
+		case *TSCH.ChartDrawableArchive:
+			ext, err := proto.GetExtension(d, TSCH.E_ChartArchive_Unity)
+			if err != nil {
+				continue
+			}
+			ca, ok := ext.(*TSCH.ChartArchive)
+			if !ok {
+				continue
+			}
+			grid := ca.GetGrid()
+			var rows [][]*float64
+			for _, row := range grid.GetGridRow() {
+				var values []*float64
+				for _, gv := range row.Value {
+					var value *float64
+					switch {
+					case gv.NumericValue != nil:
+						value = proto.Float64(gv.GetNumericValue())
+					case gv.DateValue != nil:
+						value = proto.Float64(gv.GetDateValue())
+					}
+					values = append(values, value)
+				}
+				rows = append(rows, values)
+			}
+			byColumn := ca.GetSeriesDirection() == TSCH.SeriesDirection_series_direction_by_column
+			rval = append(rval, chartData(id, ca.GetChartType(), grid.GetRowName(), grid.GetColumnName(), rows, byColumn))
+
+		case *PreUFF.ChartInfoArchive:
+			grid := d.GetChartModel().GetInlineGrid()
+			if grid == nil {
+				grid, _ = ix.Deref(d.GetChartModel().GetGrid()).(*PreUFF.ChartGridArchive)
+			}
+			var rows [][]*float64
+			for _, row := range grid.GetValueRow() {
+				var values []*float64
+				for _, value := range row.Value {
+					values = append(values, proto.Float64(value))
+				}
+				rows = append(rows, values)
+			}
+			byColumn := grid.GetDirection() == int32(TSCH.SeriesDirection_series_direction_by_column)
+			rval = append(rval, chartData(id, d.GetChartType(), grid.GetRowName(), grid.GetColumnName(), rows, byColumn))
+		}
+	}
+	sort.Slice(rval, func(i, j int) bool { return rval[i].ID < rval[j].ID })
+	return rval
+}
+
+// chartData turns a chart grid into series. The grid has a row per row name; when the series run by row each row
+// is a series over the column names, otherwise each column is a series over the row names.
+func chartData(id uint64, typ TSCH.ChartType, rowNames, columnNames []string, rows [][]*float64, byColumn bool) Chart {
+	c := Chart{ID: id, Type: strings.Replace(TSCH.ChartType_name[int32(typ)], "ChartType", "", 1)}
+	value := func(r, col int) *float64 {
+		if r < len(rows) && col < len(rows[r]) {
+			return rows[r][col]
+		}
+		return nil
+	}
+	columns := len(columnNames)
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	name := func(names []string, i int) string {
+		if i < len(names) {
+			return names[i]
+		}
+		return ""
+	}
+
+	if byColumn {
+		c.Categories = rowNames
+		for col := 0; col < columns; col++ {
+			s := Series{Name: name(columnNames, col)}
+			for r := range rows {
+				s.Values = append(s.Values, value(r, col))
+			}
+			c.Series = append(c.Series, s)
+		}
+		return c
+	}
+	c.Categories = columnNames
+	for r := range rows {
+		s := Series{Name: name(rowNames, r)}
+		for col := 0; col < columns; col++ {
+			s.Values = append(s.Values, value(r, col))
+		}
+		c.Series = append(c.Series, s)
+	}
+	return c
+}
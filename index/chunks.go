@@ -0,0 +1,166 @@
+package index
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Chunk is a record payload as stored in a document, without protobuf decoding, for tools that bring their own
+// decoders. File is the .iwa file it was read from, or "index.db" for .pages-tef documents. An archive holding
+// several payloads yields a Chunk for each, with the same ID. References are the identifiers the archive header
+// lists for the payload; index.db doesn't record them.
+type Chunk struct {
+	File       string   `json:"file"`
+	ID         uint64   `json:"id"`
+	Type       uint32   `json:"type"`
+	Payload    []byte   `json:"payload"`
+	References []uint64 `json:"references,omitempty"`
+}
+
+// ArchiveReader reads the chunks of a snappy compressed .iwa stream one at a time, decompressing as it goes, so
+// memory use stays around the size of the largest record.
+type ArchiveReader struct {
+	r       *bufio.Reader
+	limits  Limits
+	id      uint64
+	pending []*TSP.MessageInfo
+}
+
+// NewArchiveReader returns an ArchiveReader for the .iwa stream r, within DefaultLimits.
+func NewArchiveReader(r io.Reader) *ArchiveReader {
+	return newArchiveReader(r, DefaultLimits)
+}
+
+func newArchiveReader(r io.Reader, limits Limits) *ArchiveReader {
+	return &ArchiveReader{r: bufio.NewReader(newChunkReader(r, limits)), limits: limits}
+}
+
+// Next returns the next chunk of the stream, with File unset, or io.EOF at the end of it.
+func (ar *ArchiveReader) Next() (*Chunk, error) {
+	for len(ar.pending) == 0 {
+		l, err := binary.ReadUvarint(ar.r)
+		if err != nil {
+			return nil, err
+		}
+		if l > uint64(ar.limits.MaxChunkSize) {
+			return nil, fmt.Errorf("archive header of %d bytes: %w", l, ErrLimit)
+		}
+		header := make([]byte, l)
+		if _, err := io.ReadFull(ar.r, header); err != nil {
+			return nil, unexpected(err)
+		}
+		var ai TSP.ArchiveInfo
+		if err := proto.Unmarshal(header, &ai); err != nil {
+			return nil, err
+		}
+		ar.id, ar.pending = ai.GetIdentifier(), ai.MessageInfos
+	}
+	info := ar.pending[0]
+	ar.pending = ar.pending[1:]
+	if int64(info.GetLength()) > ar.limits.MaxChunkSize {
+		return nil, fmt.Errorf("record of %d bytes: %w", info.GetLength(), ErrLimit)
+	}
+	payload := make([]byte, info.GetLength())
+	if _, err := io.ReadFull(ar.r, payload); err != nil {
+		return nil, unexpected(err)
+	}
+	return &Chunk{ID: ar.id, Type: info.GetType(), Payload: payload, References: info.GetObjectReferences()}, nil
+}
+
+// unexpected turns an io.EOF partway through a record into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadChunks calls fn with each chunk of a document, in file order, without building an Index. Encrypted .iwa files
+// are decrypted with password as they're read. An error from fn stops the walk and is returned.
+func ReadChunks(doc, password string, fn func(*Chunk) error) error {
+	return ReadChunksContext(context.Background(), doc, password, fn)
+}
+
+// ReadChunksContext is ReadChunks with cancellation.
+func ReadChunksContext(ctx context.Context, doc, password string, fn func(*Chunk) error) error {
+	zf, verifier, err := openZip(doc)
+	if err == nil {
+		defer zf.Close()
+		crypt, err := newDecrypter(verifier, password)
+		if err != nil {
+			return err
+		}
+		for _, f := range zf.File {
+			if !strings.HasSuffix(f.Name, ".iwa") {
+				continue
+			}
+			if err := readFileChunks(ctx, f, crypt, fn); err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+		return nil
+	}
+
+	// .pages-tef files, sqlite
+	db, err := openSQL(doc, err)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return sqlStates(ctx, db, DefaultLimits, func(id uint64, class uint32, data []byte) error {
+		return fn(&Chunk{File: "index.db", ID: id, Type: class, Payload: data})
+	})
+}
+
+// readFileChunks calls fn with the chunks of an .iwa file.
+func readFileChunks(ctx context.Context, f *zip.File, crypt *decrypter, fn func(*Chunk) error) error {
+	r, closer, err := openIWAStream(f, crypt, DefaultLimits)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	ar := NewArchiveReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c, err := ar.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.File = f.Name
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+}
+
+// openIWAStream opens an .iwa file of a zip for streaming, decrypting it as it's read if the document is
+// encrypted. Neither the compressed nor the decrypted file is held whole.
+func openIWAStream(f *zip.File, crypt *decrypter, limits Limits) (io.Reader, io.Closer, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	if crypt == nil {
+		return rc, rc, nil
+	}
+	r, err := crypt.reader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	return r, rc, nil
+}
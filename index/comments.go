@@ -0,0 +1,143 @@
+package index
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSK"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Where a comment is anchored
+const (
+	AnchorText     = "text"     // a highlighted range of a text storage
+	AnchorDrawable = "drawable" // a shape, image or other drawable
+	AnchorSticky   = "sticky"   // a free standing comment shape, as Keynote puts on slides
+	AnchorTable    = "table"    // a table cell; the cell isn't decoded, only the table
+	AnchorNone     = ""         // nothing we found points at it
+)
+
+// Comment is a review comment. Object is the record the comment is attached to (the storage, drawable or table
+// model), and for text comments Start and End are the rune offsets of the highlighted range in that storage, with
+// Quote holding the highlighted text. Created is zero if the comment isn't dated.
+type Comment struct {
+	ID      uint64    `json:"id"`
+	Text    string    `json:"text"`
+	Author  string    `json:"author,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+	Anchor  string    `json:"anchor"`
+	Object  uint64    `json:"object,omitempty"`
+	Start   int       `json:"start,omitempty"`
+	End     int       `json:"end,omitempty"`
+	Quote   string    `json:"quote,omitempty"`
+}
+
+// Comments lists the review comments of a Pages, Numbers or Keynote document, ordered by identifier. A comment
+// attached in more than one place is listed once, anchored to the
+// record with the lowest identifier.
+func (ix *Index) Comments() []Comment {
+	found := make(map[uint64]*Comment)
+	add := func(ref *TSP.Reference, anchor string, object uint64) *Comment {
+		id := ref.GetIdentifier()
+		if id == 0 || found[id] != nil {
+			return nil
+		}
+		c := ix.comment(id)
+		if c == nil {
+			return nil
+		}
+		c.Anchor, c.Object = anchor, object
+		found[id] = c
+		return c
+	}
+
+	ids := make([]uint64, 0, len(ix.Records))
+	for id := range ix.Records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		v := ix.Records[id]
+		switch r := v.(type) {
+		case *TSWP.StorageArchive:
+			ix.highlights(id, r, add)
+		case *TSWP.CommentInfoArchive:
+			if r.CommentStorage != nil {
+				add(r.CommentStorage, AnchorSticky, id)
+			}
+		case *TST.TableModelArchive:
+			if list, ok := ix.Deref(r.GetDataStore().GetCommentStorageTable()).(*TST.TableDataList); ok {
+				for _, e := range list.Entries {
+					if e.CommentStorage != nil {
+						add(e.CommentStorage, AnchorTable, id)
+					}
+				}
+			}
+		}
+		if da := drawableArchive(v); da != nil && da.Comment != nil {
+			add(da.Comment, AnchorDrawable, id)
+		}
+	}
+	for _, id := range ids {
+		if _, ok := ix.Records[id].(*TSD.CommentStorageArchive); ok && found[id] == nil {
+			found[id] = ix.comment(id)
+		}
+	}
+
+	rval := make([]Comment, 0, len(found))
+	for _, c := range found {
+		rval = append(rval, *c)
+	}
+	sort.Slice(rval, func(i, j int) bool { return rval[i].ID < rval[j].ID })
+	return rval
+}
+
+// comment decodes a TSD.CommentStorageArchive, or returns nil if id isn't one.
+func (ix *Index) comment(id uint64) *Comment {
+	cs, ok := ix.Records[id].(*TSD.CommentStorageArchive)
+	if !ok {
+		return nil
+	}
+	c := &Comment{ID: id, Text: cs.GetText()}
+	if cs.CreationDate != nil {
+		c.Created = appleTime(cs.CreationDate.GetSeconds())
+	}
+	if author, ok := ix.Deref(cs.Author).(*TSK.AnnotationAuthorArchive); ok {
+		c.Author = author.GetName()
+	}
+	return c
+}
+
+// highlights adds the comments on text ranges of a storage. Each highlight entry runs until the next entry in the
+// table, or the end of the text.
+func (ix *Index) highlights(id uint64, st *TSWP.StorageArchive, add func(*TSP.Reference, string, uint64) *Comment) {
+	table := st.GetTableHighlight()
+	if table == nil {
+		return
+	}
+	rr := []rune(strings.Join(st.Text, ""))
+	for i, e := range table.Entries {
+		hl, ok := ix.Deref(e.Object).(*TSWP.HighlightArchive)
+		if !ok || hl.CommentStorage == nil {
+			continue
+		}
+		start, end := int(e.GetCharacterIndex()), len(rr)
+		if i+1 < len(table.Entries) {
+			end = int(table.Entries[i+1].GetCharacterIndex())
+		}
+		if end > len(rr) {
+			end = len(rr)
+		}
+		if start > end {
+			start = end
+		}
+		if c := add(hl.CommentStorage, AnchorText, id); c != nil {
+			c.Start, c.End = start, end
+			c.Quote = string(rr[start:end])
+		}
+	}
+}
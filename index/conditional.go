@@ -0,0 +1,143 @@
+package index
+
+import (
+	"sort"
+
+	"github.com/dunhamsteve/iwork/proto/TSCE"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// ConditionalFormat is a set of conditional highlighting rules and the cells it applies to. The rules are tried in
+// order and the first that matches styles the cell.
+type ConditionalFormat struct {
+	Ranges []CellRange                     `json:"ranges"`
+	Rules  []ConditionalRule               `json:"rules"`
+	Set    *TST.ConditionalStyleSetArchive `json:"-"`
+}
+
+// CellRange is a rectangle of table cells, Rows by Columns from the cell at Row and Column.
+type CellRange struct {
+	Row     int `json:"row"`
+	Column  int `json:"column"`
+	Rows    int `json:"rows"`
+	Columns int `json:"columns"`
+}
+
+// ConditionalRule is a highlighting rule. Condition is the predicate as the apps name it, like "ValueGreaterThan"
+// or "TextContains", and Values the arguments it compares against, as formula operands. Formula is the whole
+// predicate written for the first cell of the set. Fill and Text are the highlight applied when the rule matches;
+// Fill is nil if the rule leaves the background alone.
+type ConditionalRule struct {
+	Condition string     `json:"condition"`
+	Values    []string   `json:"values,omitempty"`
+	Formula   string     `json:"formula,omitempty"`
+	Fill      *TSP.Color `json:"fill,omitempty"`
+	Text      TextStyle  `json:"text"`
+}
+
+// ConditionalFormats returns the conditional highlighting of a table model, one entry per rule set, ordered by the
+// first cell each applies to.
+func (ix *Index) ConditionalFormats(tm *TST.TableModelArchive) []ConditionalFormat {
+	if tm.GetDataStore().GetConditionalstyletable() == nil {
+		return nil
+	}
+	return ix.conditionalFormats(tm, ix.Cells(tm))
+}
+
+// conditionalFormats is ConditionalFormats for the decoded cells of the table.
+func (ix *Index) conditionalFormats(tm *TST.TableModelArchive, cells [][]Cell) []ConditionalFormat {
+	ds := tm.GetDataStore()
+	if ds.GetConditionalstyletable() == nil {
+		return nil
+	}
+
+	// collect runs of cells with the same set along each row, then join equal runs of adjacent rows
+	ranges := make(map[uint32][]CellRange)
+	for r, row := range cells {
+		for c := 0; c < len(row); {
+			key := row[c].ConditionalKey
+			end := c + 1
+			for end < len(row) && row[end].ConditionalKey == key {
+				end++
+			}
+			if key != 0 {
+				rs := ranges[key]
+				joined := false
+				for i := range rs {
+					cr := &rs[i]
+					if cr.Column == c && cr.Columns == end-c && cr.Row+cr.Rows == r {
+						cr.Rows++
+						joined = true
+						break
+					}
+				}
+				if !joined {
+					rs = append(rs, CellRange{Row: r, Column: c, Rows: 1, Columns: end - c})
+				}
+				ranges[key] = rs
+			}
+			c = end
+		}
+	}
+
+	tables := ix.crossTable(tm)
+	var rval []ConditionalFormat
+	for key, rs := range ranges {
+		set, ok := ix.Deref(ix.Entry(ds.Conditionalstyletable, key).GetReference()).(*TST.ConditionalStyleSetArchive)
+		if !ok {
+			continue
+		}
+		cf := ConditionalFormat{Ranges: rs, Set: set}
+		for _, rule := range set.Rules {
+			cf.Rules = append(cf.Rules, ix.conditionalRule(rule, rs[0].Row, rs[0].Column, tables))
+		}
+		rval = append(rval, cf)
+	}
+	sort.Slice(rval, func(i, j int) bool {
+		a, b := rval[i].Ranges[0], rval[j].Ranges[0]
+		if a.Row != b.Row {
+			return a.Row < b.Row
+		}
+		return a.Column < b.Column
+	})
+	return rval
+}
+
+// conditionalRule converts a rule, writing its formula for the cell at row, col.
+func (ix *Index) conditionalRule(rule *TST.ConditionalStyleSetArchive_ConditionalStyleRule, row, col int, tables func(*TSCE.CFUUIDArchive) string) ConditionalRule {
+	pred := rule.GetPredicate()
+	rval := ConditionalRule{
+		Condition: TST.FormulaPredicateArchive_FormulaPredicateType_name[int32(pred.GetPredicateType())],
+	}
+	if f := pred.GetFormula(); f != nil {
+		rval.Formula = formulaText(f, row, col, tables)
+		nodes := f.GetASTNodeArray().GetASTNode()
+		// the parameter indexes point at the nodes holding the values, -1 if unused
+		for _, i := range []int32{pred.GetParamIndex1(), pred.GetParamIndex2()} {
+			if i >= 0 && int(i) < len(nodes) {
+				rval.Values = append(rval.Values, renderNodes([]*astNode{nodes[i]}, row, col, tables))
+			}
+		}
+	}
+	if cs, ok := ix.Deref(rule.GetCellStyle()).(*TST.CellStyleArchive); ok {
+		rval.Fill = cellFill(cs.GetCellProperties().GetCellFill())
+	}
+	switch s := ix.Deref(rule.GetTextStyle()).(type) {
+	case *TSWP.ParagraphStyleArchive:
+		rval.Text = ix.ResolveText(s, nil)
+	case *TSWP.CharacterStyleArchive:
+		rval.Text = ix.ResolveText(nil, s)
+	}
+	return rval
+}
+
+// cellFill returns the color of a fill, nil for gradient and image fills.
+func cellFill(fill *TSD.FillArchive) *TSP.Color {
+	if fill == nil {
+		return nil
+	}
+	return fill.Color
+}
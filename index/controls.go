@@ -0,0 +1,71 @@
+package index
+
+import (
+	"github.com/dunhamsteve/iwork/proto/TSCE"
+	"github.com/dunhamsteve/iwork/proto/TST"
+)
+
+// Control is a data entry control configured on table cells: a pop-up menu, stepper, slider or checkbox. Type is
+// the TSK format type of the control. Items are the choices of a pop-up menu in menu order, and Initial the index
+// of the one shown for new cells. Minimum, Maximum and Increment constrain steppers and sliders, and are nil when
+// not set.
+type Control struct {
+	Type      uint32   `json:"type"`
+	Items     []Cell   `json:"items,omitempty"`
+	Initial   int      `json:"initial,omitempty"`
+	Minimum   *float64 `json:"minimum,omitempty"`
+	Maximum   *float64 `json:"maximum,omitempty"`
+	Increment *float64 `json:"increment,omitempty"`
+}
+
+// Controls returns the controls of a table, keyed by the Cell.ControlKey of the cells that use them.
+func (ix *Index) Controls(tm *TST.TableModelArchive) map[uint32]*Control {
+	rval := make(map[uint32]*Control)
+	list, ok := ix.Deref(tm.GetDataStore().GetMultipleChoiceListFormatTable()).(*TST.TableDataList)
+	if !ok {
+		return rval
+	}
+	for _, entry := range list.Entries {
+		c := &Control{}
+		if f := entry.Format; f != nil {
+			c.Type = f.GetFormatType()
+			if f.ControlFormatType != nil {
+				c.Type = f.GetControlFormatType()
+			}
+			c.Initial = int(f.GetMultipleChoiceListInitialValue())
+			c.Minimum, c.Maximum, c.Increment = f.ControlMinimum, f.ControlMaximum, f.ControlIncrement
+		}
+		if menu, ok := ix.Deref(entry.Reference).(*TST.PopUpMenuModel); ok {
+			for _, item := range menu.TsceItem {
+				c.Items = append(c.Items, menuItem(int32(item.GetCellValueType()), item.BooleanValue, item.DateValue, item.NumberValue, item.StringValue))
+			}
+			if len(menu.TsceItem) == 0 {
+				for _, item := range menu.Item {
+					c.Items = append(c.Items, menuItem(int32(item.GetCellValueType()), item.BooleanValue, item.DateValue, item.NumberValue, item.StringValue))
+				}
+			}
+		}
+		rval[entry.GetKey()] = c
+	}
+	return rval
+}
+
+// menuItem converts a pop-up menu choice. The old and new menu models store choices the same way, as separate
+// messages with the same fields.
+func menuItem(typ int32, b *TSCE.BooleanCellValueArchive, d *TSCE.DateCellValueArchive, n *TSCE.NumberCellValueArchive, s *TSCE.StringCellValueArchive) Cell {
+	switch TSCE.CellValueArchive_CellValueType(typ) {
+	case TSCE.CellValueArchive_BOOLEAN_TYPE:
+		var v float64
+		if b.GetValue() {
+			v = 1
+		}
+		return Cell{Type: BoolCell, Number: v}
+	case TSCE.CellValueArchive_DATE_TYPE:
+		return Cell{Type: DateCell, Time: appleTime(d.GetValue())}
+	case TSCE.CellValueArchive_NUMBER_TYPE:
+		return Cell{Type: NumberCell, Number: n.GetValue()}
+	case TSCE.CellValueArchive_STRING_TYPE:
+		return Cell{Type: TextCell, Text: s.GetValue()}
+	}
+	return Cell{}
+}
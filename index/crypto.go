@@ -0,0 +1,251 @@
+package index
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrEncrypted matches the errors of encrypted documents that can't be opened, ErrPasswordRequired and
+// ErrWrongPassword, with errors.Is.
+var ErrEncrypted = errors.New("document is encrypted")
+
+// ErrPasswordRequired is returned when opening an encrypted document without a password.
+var ErrPasswordRequired error = &kindError{"document is encrypted, a password is required", ErrEncrypted}
+
+// ErrWrongPassword is returned when the supplied password does not match the document's password verifier.
+var ErrWrongPassword error = &kindError{"incorrect document password", ErrEncrypted}
+
+// Password protected bundles carry a verifier file and (optionally) a hint file at the top level.
+const (
+	passwordVerifierName = ".iwpv2"
+	passwordHintName     = ".iwph"
+)
+
+// Both the verifier and the encrypted files start with the same header:
+//
+//	uint16 version     (big endian, 2)
+//	uint16 format      (big endian, 1)
+//	uint32 iterations  (big endian, PBKDF2 round count)
+//	[16]byte salt
+//	[16]byte iv
+//
+// followed by AES-128-CBC ciphertext with PKCS#7 padding. The key is PBKDF2-HMAC-SHA1 of the password with the
+// header's salt and round count. The verifier plaintext is 16 random bytes followed by their SHA-256.
+const cryptoHeaderLen = 40
+
+type cryptoHeader struct {
+	version    uint16
+	format     uint16
+	iterations uint32
+	salt       []byte
+	iv         []byte
+}
+
+var errTooShort = errors.New("encrypted data too short")
+
+func parseCryptoHeader(data []byte) (*cryptoHeader, []byte, error) {
+	if len(data) < cryptoHeaderLen {
+		return nil, nil, errTooShort
+	}
+	hdr := &cryptoHeader{
+		version:    binary.BigEndian.Uint16(data[0:2]),
+		format:     binary.BigEndian.Uint16(data[2:4]),
+		iterations: binary.BigEndian.Uint32(data[4:8]),
+		salt:       data[8:24],
+		iv:         data[24:40],
+	}
+	if hdr.version != 2 || hdr.format != 1 {
+		return nil, nil, fmt.Errorf("encryption version %d format %d: %w", hdr.version, hdr.format, ErrUnsupportedVersion)
+	}
+	if hdr.iterations == 0 {
+		return nil, nil, errors.New("invalid encryption iteration count")
+	}
+	return hdr, data[cryptoHeaderLen:], nil
+}
+
+// decrypter unwraps the encrypted members of a password protected bundle. Key derivation is deliberately slow, so
+// derived keys are cached per salt and round count. It's used by the workers of loadParallel at once.
+type decrypter struct {
+	password string
+	mu       sync.Mutex // guards keys
+	keys     map[string][]byte
+}
+
+// newDecrypter checks the password against the verifier. It returns nil, nil for documents without a verifier,
+// which are not encrypted.
+func newDecrypter(verifier []byte, password string) (*decrypter, error) {
+	if verifier == nil {
+		return nil, nil
+	}
+	if password == "" {
+		return nil, ErrPasswordRequired
+	}
+	d := &decrypter{password: password, keys: make(map[string][]byte)}
+	plain, err := d.decrypt(verifier)
+	if err != nil {
+		if err == errBadPadding {
+			return nil, ErrWrongPassword
+		}
+		return nil, err
+	}
+	if len(plain) < 48 {
+		return nil, ErrWrongPassword
+	}
+	sum := sha256.Sum256(plain[:16])
+	if !bytes.Equal(sum[:], plain[16:48]) {
+		return nil, ErrWrongPassword
+	}
+	return d, nil
+}
+
+func (d *decrypter) key(hdr *cryptoHeader) ([]byte, error) {
+	k := fmt.Sprintf("%x:%d", hdr.salt, hdr.iterations)
+	// held while deriving, so workers reading files with the same salt derive its key once
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if key, ok := d.keys[k]; ok {
+		return key, nil
+	}
+	key, err := pbkdf2.Key(sha1.New, d.password, hdr.salt, int(hdr.iterations), 16)
+	if err != nil {
+		return nil, err
+	}
+	d.keys[k] = key
+	return key, nil
+}
+
+var errBadPadding = errors.New("bad padding in encrypted data")
+
+// decrypt unwraps a single encrypted file.
+func (d *decrypter) decrypt(data []byte) ([]byte, error) {
+	hdr, body, err := parseCryptoHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 || len(body)%aes.BlockSize != 0 {
+		return nil, errNotBlocks
+	}
+	key, err := d.key(hdr)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(body))
+	cipher.NewCBCDecrypter(block, hdr.iv).CryptBlocks(plain, body)
+
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errBadPadding
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, errBadPadding
+		}
+	}
+	return plain[:len(plain)-pad], nil
+}
+
+var errNotBlocks = errors.New("encrypted data is not a whole number of blocks")
+
+// reader unwraps an encrypted file as it's read, so big files needn't be held whole. Errors in the padding show up
+// at the end of the stream.
+func (d *decrypter) reader(r io.Reader) (io.Reader, error) {
+	header := make([]byte, cryptoHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errTooShort
+		}
+		return nil, err
+	}
+	hdr, _, err := parseCryptoHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	key, err := d.key(hdr)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cbcReader{r: r, mode: cipher.NewCBCDecrypter(block, hdr.iv), buf: make([]byte, aes.BlockSize+32*1024)}, nil
+}
+
+// cbcReader decrypts AES-CBC a buffer at a time. The last block is held back until the next buffer shows whether
+// it carries the padding.
+type cbcReader struct {
+	r       io.Reader
+	mode    cipher.BlockMode
+	buf     []byte // the held block, then the ciphertext read
+	held    [aes.BlockSize]byte
+	hasHeld bool
+	out     []byte
+	err     error
+}
+
+func (c *cbcReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.fill()
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *cbcReader) fill() {
+	const bs = aes.BlockSize
+	copy(c.buf[:bs], c.held[:])
+	n, err := io.ReadFull(c.r, c.buf[bs:])
+	end := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !end {
+		c.err = err
+		return
+	}
+	if n%bs != 0 {
+		c.err = errNotBlocks
+		return
+	}
+	c.mode.CryptBlocks(c.buf[bs:bs+n], c.buf[bs:bs+n])
+	data := c.buf[bs : bs+n]
+	if c.hasHeld {
+		data = c.buf[:bs+n]
+	}
+	if !end {
+		copy(c.held[:], data[len(data)-bs:])
+		c.hasHeld = true
+		c.out = data[:len(data)-bs]
+		return
+	}
+	if len(data) == 0 {
+		c.err = errNotBlocks
+		return
+	}
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > bs {
+		c.err = errBadPadding
+		return
+	}
+	for _, b := range data[len(data)-pad:] {
+		if int(b) != pad {
+			c.err = errBadPadding
+			return
+		}
+	}
+	c.out, c.err = data[:len(data)-pad], io.EOF
+}
@@ -0,0 +1,90 @@
+package index
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// encrypt is the inverse of decrypter.decrypt, with its own salt so each file derives its own key.
+func encrypt(t *testing.T, password string, salt byte, plain []byte) []byte {
+	header := make([]byte, cryptoHeaderLen)
+	binary.BigEndian.PutUint16(header[0:2], 2)
+	binary.BigEndian.PutUint16(header[2:4], 1)
+	binary.BigEndian.PutUint32(header[4:8], 1000)
+	for i := 8; i < 24; i++ {
+		header[i] = salt
+	}
+	key, err := pbkdf2.Key(sha1.New, password, header[8:24], 1000, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append(append([]byte{}, plain...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, header[24:40]).CryptBlocks(data, data)
+	return append(header, data...)
+}
+
+// encryptedDoc writes a single file document of n encrypted .iwa files and its password verifier.
+func encryptedDoc(t *testing.T, password string, n int) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name string, data []byte) {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	verifier := make([]byte, 16)
+	sum := sha256.Sum256(verifier)
+	add(passwordVerifierName, encrypt(t, password, 0, append(verifier, sum[:]...)))
+	for i := 1; i <= n; i++ {
+		add(fmt.Sprintf("Index/Tables/Tile-%d.iwa", i), encrypt(t, password, byte(i), nil))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	doc := filepath.Join(t.TempDir(), "encrypted.numbers")
+	if err := ioutil.WriteFile(doc, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// TestOpenEncryptedParallel reads the files of an encrypted document with several workers, which derive their keys
+// at the same time. Run it with -race.
+func TestOpenEncryptedParallel(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	doc := encryptedDoc(t, "secret", 16)
+	ix, err := OpenOptions(context.Background(), doc, &Options{Password: "secret", Type: Numbers, Workers: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(ix.crypt.keys); got != 17 {
+		t.Errorf("derived %d keys, want 17", got)
+	}
+}
+
+func TestOpenEncryptedWrongPassword(t *testing.T) {
+	doc := encryptedDoc(t, "secret", 1)
+	_, err := OpenOptions(context.Background(), doc, &Options{Password: "guess", Type: Numbers, Workers: 8})
+	if err != ErrWrongPassword {
+		t.Errorf("got %v, want ErrWrongPassword", err)
+	}
+}
@@ -0,0 +1,348 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kinds of Difference
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+	DiffMoved   = "moved"
+)
+
+// maxDiffCells bounds the table the paragraph and slide diffs fill in, past it the differing middle of the
+// documents is reported as removed and added rather than lined up.
+const maxDiffCells = 16 << 20
+
+// Difference is a change between two versions of a document. The location fields count from 1, and are zero if
+// they don't apply. Paragraph is a paragraph of the body of a Pages document and Slide a Keynote slide, numbered
+// as in the new document, or the old one for removals. Sheet and Table name a table, and Row and Column a cell of
+// it, again numbered as in the new document. Part says what changed about a slide ("title", "text" or "notes") or a
+// cell ("formula"); it's empty for the text of a paragraph or the value of a cell. Old and New are the text or value
+// before and after.
+type Difference struct {
+	Kind      string `json:"kind"`
+	Paragraph int    `json:"paragraph,omitempty"`
+	Slide     int    `json:"slide,omitempty"`
+	Sheet     string `json:"sheet,omitempty"`
+	Table     string `json:"table,omitempty"`
+	Row       int    `json:"row,omitempty"`
+	Column    int    `json:"column,omitempty"`
+	Part      string `json:"part,omitempty"`
+	Old       string `json:"old,omitempty"`
+	New       string `json:"new,omitempty"`
+}
+
+func (d Difference) String() string {
+	var where []string
+	if d.Paragraph > 0 {
+		where = append(where, fmt.Sprintf("paragraph %d", d.Paragraph))
+	}
+	if d.Slide > 0 {
+		where = append(where, fmt.Sprintf("slide %d", d.Slide))
+	}
+	if d.Sheet != "" {
+		where = append(where, d.Sheet)
+	}
+	if d.Table != "" {
+		where = append(where, d.Table)
+	}
+	if d.Row > 0 {
+		where = append(where, cellAddress(d.Row-1, d.Column-1, false, false))
+	}
+	if d.Part != "" {
+		where = append(where, d.Part)
+	}
+	return fmt.Sprintf("%s %s: %q -> %q", d.Kind, strings.Join(where, " "), d.Old, d.New)
+}
+
+// Diff compares two versions of a document: the body text of Pages documents paragraph by paragraph, the slides of
+// Keynote documents, and the cells of the tables of any of them. Slides are matched by identifier, so moves are
+// found in versions of the same document but two unrelated presentations differ on every slide. Tables are matched
+// by sheet and name, or identifier if they're unnamed.
+func Diff(old, new *Index) ([]Difference, error) {
+	if old.Type != new.Type {
+		return nil, fmt.Errorf("cannot compare a %s document with a %s document", old.Type, new.Type)
+	}
+	rval := diffParagraphs(bodyText(old), bodyText(new))
+	slides, err := diffSlides(old, new)
+	if err != nil {
+		return nil, err
+	}
+	rval = append(rval, slides...)
+	rval = append(rval, diffTables(old, new)...)
+	return rval, nil
+}
+
+// bodyText returns the paragraphs of the body of a Pages document, without their trailing breaks.
+func bodyText(ix *Index) []string {
+	var rval []string
+	for _, s := range ix.Sections() {
+		for _, p := range s.Paragraphs {
+			rval = append(rval, strings.TrimRight(p.Text, "\n\u000c"))
+		}
+	}
+	return rval
+}
+
+// diffParagraphs lines up two lists of paragraphs. A run of removed paragraphs followed by added ones is reported as
+// changed paragraphs, as far as they pair up.
+func diffParagraphs(old, new []string) []Difference {
+	var rval []Difference
+	ops := diffSequences(old, new)
+	for k := 0; k < len(ops); {
+		if ops[k].kind == '=' {
+			k++
+			continue
+		}
+		var removed, added []diffOp
+		for ; k < len(ops) && ops[k].kind == '-'; k++ {
+			removed = append(removed, ops[k])
+		}
+		for ; k < len(ops) && ops[k].kind == '+'; k++ {
+			added = append(added, ops[k])
+		}
+		for n := 0; n < len(removed) || n < len(added); n++ {
+			switch {
+			case n < len(removed) && n < len(added):
+				rval = append(rval, Difference{Kind: DiffChanged, Paragraph: added[n].new + 1,
+					Old: old[removed[n].old], New: new[added[n].new]})
+			case n < len(removed):
+				rval = append(rval, Difference{Kind: DiffRemoved, Paragraph: removed[n].old + 1, Old: old[removed[n].old]})
+			default:
+				rval = append(rval, Difference{Kind: DiffAdded, Paragraph: added[n].new + 1, New: new[added[n].new]})
+			}
+		}
+	}
+	return rval
+}
+
+// diffSlides compares the slides of two Keynote documents.
+func diffSlides(old, new *Index) ([]Difference, error) {
+	if old.Type != "key" {
+		return nil, nil
+	}
+	oldIDs, newIDs := old.Slides(), new.Slides()
+	oldPos := make(map[uint64]int)
+	for n, id := range oldIDs {
+		oldPos[id] = n
+	}
+	newPos := make(map[uint64]int)
+	for n, id := range newIDs {
+		newPos[id] = n
+	}
+
+	// the slides in both are in order if they're part of the longest common run, otherwise they moved
+	var oldKeys, newKeys []string
+	for _, id := range oldIDs {
+		if _, ok := newPos[id]; ok {
+			oldKeys = append(oldKeys, fmt.Sprint(id))
+		}
+	}
+	for _, id := range newIDs {
+		if _, ok := oldPos[id]; ok {
+			newKeys = append(newKeys, fmt.Sprint(id))
+		}
+	}
+	moved := make(map[string]bool)
+	for _, op := range diffSequences(oldKeys, newKeys) {
+		if op.kind == '+' {
+			moved[newKeys[op.new]] = true
+		}
+	}
+
+	var rval []Difference
+	for n, id := range oldIDs {
+		if _, ok := newPos[id]; !ok {
+			s, err := old.Slide(n + 1)
+			if err != nil {
+				return nil, err
+			}
+			rval = append(rval, Difference{Kind: DiffRemoved, Slide: n + 1, Part: "title", Old: s.Title})
+		}
+	}
+	for n, id := range newIDs {
+		s, err := new.Slide(n + 1)
+		if err != nil {
+			return nil, err
+		}
+		o, ok := oldPos[id]
+		if !ok {
+			rval = append(rval, Difference{Kind: DiffAdded, Slide: n + 1, Part: "title", New: s.Title})
+			continue
+		}
+		if moved[fmt.Sprint(id)] {
+			rval = append(rval, Difference{Kind: DiffMoved, Slide: n + 1, Old: fmt.Sprint(o + 1), New: fmt.Sprint(n + 1)})
+		}
+		p, err := old.Slide(o + 1)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range []struct{ name, old, new string }{
+			{"title", p.Title, s.Title},
+			{"text", strings.Join(p.Text, "\n"), strings.Join(s.Text, "\n")},
+			{"notes", p.Notes, s.Notes},
+		} {
+			if part.old != part.new {
+				rval = append(rval, Difference{Kind: DiffChanged, Slide: n + 1, Part: part.name, Old: part.old, New: part.new})
+			}
+		}
+	}
+	return rval, nil
+}
+
+// diffTables compares the cells of the tables of two documents.
+func diffTables(old, new *Index) []Difference {
+	key := func(sheets map[uint64]string, t *Table) string {
+		if t.Name == "" {
+			return fmt.Sprint(t.ID)
+		}
+		return sheets[t.ID] + "::" + t.Name
+	}
+	oldSheets, newSheets := old.tableSheets(), new.tableSheets()
+	oldTables := make(map[string]*Table)
+	for _, t := range old.Tables() {
+		oldTables[key(oldSheets, t)] = t
+	}
+
+	var rval []Difference
+	seen := make(map[string]bool)
+	for _, t := range new.Tables() {
+		k := key(newSheets, t)
+		seen[k] = true
+		at := Difference{Sheet: newSheets[t.ID], Table: t.Name}
+		o, ok := oldTables[k]
+		if !ok {
+			at.Kind = DiffAdded
+			rval = append(rval, at)
+			continue
+		}
+		rows := len(t.Rows)
+		if len(o.Rows) > rows {
+			rows = len(o.Rows)
+		}
+		for r := 0; r < rows; r++ {
+			cols := 0
+			if r < len(t.Rows) {
+				cols = len(t.Rows[r])
+			}
+			if r < len(o.Rows) && len(o.Rows[r]) > cols {
+				cols = len(o.Rows[r])
+			}
+			for c := 0; c < cols; c++ {
+				was, is := tableCell(o, r, c), tableCell(t, r, c)
+				d := at
+				d.Row, d.Column = r+1, c+1
+				if a, b := old.cellText(o, was), new.cellText(t, is); a != b {
+					d.Kind, d.Old, d.New = DiffChanged, a, b
+					switch {
+					case was.Type == EmptyCell:
+						d.Kind = DiffAdded
+					case is.Type == EmptyCell:
+						d.Kind = DiffRemoved
+					}
+					rval = append(rval, d)
+				}
+				if was.Formula != is.Formula {
+					d.Kind, d.Part, d.Old, d.New = DiffChanged, "formula", was.Formula, is.Formula
+					rval = append(rval, d)
+				}
+			}
+		}
+	}
+	for _, t := range old.Tables() {
+		if k := key(oldSheets, t); !seen[k] {
+			rval = append(rval, Difference{Kind: DiffRemoved, Sheet: oldSheets[t.ID], Table: t.Name})
+		}
+	}
+	return rval
+}
+
+// tableCell returns a cell of a table, or an empty cell if it's outside the table.
+func tableCell(t *Table, row, col int) Cell {
+	if row < len(t.Rows) && col < len(t.Rows[row]) {
+		return t.Rows[row][col]
+	}
+	return Cell{}
+}
+
+// cellText is a cell value as Numbers shows it, empty for empty cells.
+func (ix *Index) cellText(t *Table, cell Cell) string {
+	if cell.Type == EmptyCell {
+		return ""
+	}
+	return ix.CellFormat(t.Model, cell).Format(cell)
+}
+
+// diffOp is a step of an edit script: '=' keeps old[old] as new[new], '-' removes old[old] and '+' adds new[new].
+type diffOp struct {
+	kind     byte
+	old, new int
+}
+
+// diffSequences returns the edit script from a to b that keeps their longest common subsequence. The common prefix
+// and suffix are matched directly; if what's left is too big to compare it's all removed and added.
+func diffSequences(a, b []string) []diffOp {
+	var rval []diffOp
+	start := 0
+	for start < len(a) && start < len(b) && a[start] == b[start] {
+		rval = append(rval, diffOp{'=', start, start})
+		start++
+	}
+	endA, endB := len(a), len(b)
+	for endA > start && endB > start && a[endA-1] == b[endB-1] {
+		endA--
+		endB--
+	}
+	n, m := endA-start, endB-start
+
+	if n*m > maxDiffCells {
+		for i := start; i < endA; i++ {
+			rval = append(rval, diffOp{'-', i, 0})
+		}
+		for j := start; j < endB; j++ {
+			rval = append(rval, diffOp{'+', 0, j})
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence of a[start+i:endA] and b[start+j:endB]
+		lcs := make([][]int32, n+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, m+1)
+		}
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				switch {
+				case a[start+i] == b[start+j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < n || j < m {
+			switch {
+			case i < n && j < m && a[start+i] == b[start+j]:
+				rval = append(rval, diffOp{'=', start + i, start + j})
+				i++
+				j++
+			case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+				rval = append(rval, diffOp{'-', start + i, 0})
+				i++
+			default:
+				rval = append(rval, diffOp{'+', 0, start + j})
+				j++
+			}
+		}
+	}
+
+	for k := 0; k < len(a)-endA; k++ {
+		rval = append(rval, diffOp{'=', endA + k, endB + k})
+	}
+	return rval
+}
@@ -0,0 +1,162 @@
+package index
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"errors"
+	"path"
+	"strings"
+)
+
+// Type is the kind of document, the value of Index.Type.
+type Type string
+
+// Document types
+const (
+	Pages   Type = "pages"
+	Numbers Type = "numbers"
+	Keynote Type = "key"
+)
+
+// templateTypes are the bundle extensions of templates, which are stored like documents of their type. Keynote
+// themes (.kth) hold master slides and usually no slides.
+var templateTypes = map[string]Type{
+	".template":    Pages,
+	".nmbtemplate": Numbers,
+	".kth":         Keynote,
+}
+
+// IsTemplate reports whether doc is named like a Pages, Numbers or Keynote template.
+func IsTemplate(doc string) bool {
+	_, ok := templateTypes[strings.ToLower(path.Ext(strings.TrimSuffix(doc, "/")))]
+	return ok
+}
+
+// valid reports whether t is a known type, or empty for detection.
+func (t Type) valid() bool {
+	switch t {
+	case "", Pages, Numbers, Keynote:
+		return true
+	}
+	return false
+}
+
+// OpenAs loads a document of a known type, skipping the detection Open does by reading the archives. The type is
+// trusted: a document of another type decodes to garbage or fails.
+func OpenAs(doc string, docType Type) (*Index, error) {
+	if docType == "" {
+		return nil, errors.New("no document type")
+	}
+	return open(context.Background(), doc, Options{Type: docType})
+}
+
+// DetectType works out the type of a document the way Open does, from its extension and document archive or
+// failing that the archive types it contains, without loading it. The password is needed for encrypted documents,
+// which are otherwise typed by their extension.
+func DetectType(doc, password string) (Type, error) {
+	zf, verifier, err := openZip(doc)
+	if err == nil {
+		defer zf.Close()
+		crypt, err := newDecrypter(verifier, password)
+		if err == ErrPasswordRequired {
+			crypt, err = nil, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		t, err := detectZip(doc, &zf.Reader, crypt, DefaultLimits)
+		return Type(t), err
+	}
+
+	db, err := openSQL(doc, err)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	t, err := detectSQL(doc, db)
+	return Type(t), err
+}
+
+// detectZip detects the type of a zip based document, falling back on the extension when the content doesn't
+// tell.
+func detectZip(doc string, zr *zip.Reader, crypt *decrypter, limits Limits) (string, error) {
+	if t := detectRoot(doc, zr, crypt, limits); t != "" {
+		return t, nil
+	}
+	t, err := detectTypeFromZip(zr, crypt, limits)
+	if err == errUnknownType && extensionType(doc) != "" {
+		return extensionType(doc), nil
+	}
+	if err == ErrNoContent && zipHasFile(zr, "index.xml") {
+		return "", ErrLegacyFormat
+	}
+	if err == ErrNoContent {
+		return "", &NoContentError{doc, bundleFiles(doc, zr)}
+	}
+	if err != nil {
+		return "", &detectError{err}
+	}
+	return t, nil
+}
+
+// detectError is a document whose type couldn't be worked out. It matches ErrNotIWork with errors.Is, as well as
+// the error that stopped detection.
+type detectError struct {
+	err error
+}
+
+func (e *detectError) Error() string {
+	return "failed to detect file type: " + e.err.Error()
+}
+
+func (e *detectError) Is(target error) bool {
+	return target == ErrNotIWork
+}
+
+func (e *detectError) Unwrap() error {
+	return e.err
+}
+
+// detectRoot is the fast path of detectZip. Rather than decompressing .iwa files until a telling archive type turns
+// up, it checks the extension against the first record of Index/Document.iwa, the document archive, reading just
+// the start of the file. Keynote and Numbers document archives are both type 1, so the extension tells those
+// apart. It returns "" if the extension is unknown or the record doesn't match it, leaving it to the content.
+func detectRoot(doc string, zr *zip.Reader, crypt *decrypter, limits Limits) string {
+	ext := extensionType(doc)
+	if ext == "" {
+		return ""
+	}
+	for _, f := range zr.File {
+		if f.Name != "Index/Document.iwa" {
+			continue
+		}
+		r, closer, err := openIWAStream(f, crypt, limits)
+		if err != nil {
+			return ""
+		}
+		defer closer.Close()
+		c, err := newArchiveReader(r, limits).Next()
+		if err != nil {
+			return ""
+		}
+		switch {
+		case c.Type == 10000 && ext == "pages", c.Type == 1 && (ext == "key" || ext == "numbers"):
+			return ext
+		}
+		return ""
+	}
+	return ""
+}
+
+// detectSQL detects the type of a .pages-tef document.
+func detectSQL(doc string, db *sql.DB) (string, error) {
+	t, err := detectTypeFromSQL(db)
+	if err == ErrNoContent {
+		return "", &NoContentError{doc, bundleFiles(doc, nil)}
+	}
+	if err != nil {
+		return "", &detectError{err}
+	}
+	return t, nil
+}
@@ -0,0 +1,59 @@
+package index
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// WriteDOT writes the reference graph of the loaded records in Graphviz DOT format, e.g. for
+// `dot -Tsvg doc.dot > doc.svg`. Each record is a node labeled with its identifier and message name, and each
+// TSP.Reference an edge. Records are grouped in a cluster per .iwa file. Records that weren't decoded are drawn
+// dashed, and references to records that aren't loaded point to plain identifiers.
+func (ix *Index) WriteDOT(w io.Writer) error {
+	ids := ix.IDs()
+	files := make(map[string][]uint64)
+	for _, id := range ids {
+		files[ix.File(id)] = append(files[ix.File(id)], id)
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("digraph iwork {\n\tnode [shape=box, fontname=\"Helvetica\", fontsize=10];\n")
+	for n, name := range names {
+		indent := "\t"
+		if name != "" {
+			fmt.Fprintf(bw, "\tsubgraph cluster_%d {\n\t\tlabel=%s;\n", n, strconv.Quote(name))
+			indent = "\t\t"
+		}
+		for _, id := range files[name] {
+			style := ""
+			if _, ok := ix.Records[id].(*RawRecord); ok {
+				style = ", style=dashed"
+			}
+			fmt.Fprintf(bw, "%s%d [label=%s%s];\n", indent, id, strconv.Quote(fmt.Sprintf("%d\n%s", id, ix.recordName(id))), style)
+		}
+		if name != "" {
+			bw.WriteString("\t}\n")
+		}
+	}
+	for _, id := range ids {
+		var objects []uint64
+		if raw, ok := ix.Records[id].(*RawRecord); ok {
+			objects, _ = ix.rawReferences(raw)
+		} else {
+			objects, _ = references(ix.Records[id])
+		}
+		for _, ref := range objects {
+			fmt.Fprintf(bw, "\t%d -> %d;\n", id, ref)
+		}
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
@@ -0,0 +1,243 @@
+package index
+
+import (
+	"sort"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSCH"
+	"github.com/dunhamsteve/iwork/proto/TSCH/PreUFF"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// DrawableInfo describes a drawable: its kind, where it sits in the group hierarchy, its geometry and whether it
+// is locked. X and Y are the top left corner in points, relative to the parent group or else the page or slide,
+// and Angle is the rotation in degrees. Z is the stacking position among its siblings, back to front; drawables
+// missing from the stacking lists get 0. Media is the path of the image or movie data in the bundle.
+type DrawableInfo struct {
+	ID                uint64   `json:"id"`
+	Kind              string   `json:"kind"`
+	Parent            uint64   `json:"parent,omitempty"`
+	Children          []uint64 `json:"children,omitempty"`
+	Locked            bool     `json:"locked"`
+	AspectRatioLocked bool     `json:"aspect_ratio_locked"`
+	X                 float32  `json:"x"`
+	Y                 float32  `json:"y"`
+	Width             float32  `json:"width"`
+	Height            float32  `json:"height"`
+	Angle             float32  `json:"angle,omitempty"`
+	Z                 int      `json:"z"`
+	Media             string   `json:"media,omitempty"`
+}
+
+// Drawable kinds
+const (
+	KindShape       = "shape"
+	KindImage       = "image"
+	KindMovie       = "movie"
+	KindGroup       = "group"
+	KindLine        = "line"
+	KindTable       = "table"
+	KindChart       = "chart"
+	KindPlaceholder = "placeholder"
+	KindComment     = "comment"
+	KindOther       = "other"
+)
+
+// drawableKind classifies a drawable record.
+func drawableKind(v interface{}) string {
+	switch v.(type) {
+	case *TSD.ShapeArchive, *TSWP.ShapeInfoArchive:
+		return KindShape
+	case *TSD.ImageArchive, *TSD.MaskArchive:
+		return KindImage
+	case *TSD.MovieArchive:
+		return KindMovie
+	case *TSD.GroupArchive, *TSD.ContainerArchive:
+		return KindGroup
+	case *TSD.ConnectionLineArchive:
+		return KindLine
+	case *TST.TableInfoArchive, *TST.WPTableInfoArchive:
+		return KindTable
+	case *TSCH.ChartDrawableArchive, *PreUFF.ChartInfoArchive:
+		return KindChart
+	case *KN.PlaceholderArchive, *TP.PlaceholderArchive, *TN.PlaceholderArchive:
+		return KindPlaceholder
+	case *TSWP.CommentInfoArchive:
+		return KindComment
+	}
+	return KindOther
+}
+
+// stacking returns the position of each drawable in the z-order lists: group children, slide drawables and the
+// Pages z-order.
+func (ix *Index) stacking() map[uint64]int {
+	rval := make(map[uint64]int)
+	add := func(refs []*TSP.Reference) {
+		for i, ref := range refs {
+			rval[ref.GetIdentifier()] = i
+		}
+	}
+	for _, v := range ix.Records {
+		switch d := v.(type) {
+		case *KN.SlideArchive:
+			add(d.Drawables)
+		case *TP.DrawablesZOrderArchive:
+			add(d.Drawables)
+		}
+	}
+	// group order wins for grouped drawables
+	for _, v := range ix.Records {
+		add(groupChildren(v))
+	}
+	return rval
+}
+
+// drawableArchive digs the TSD.DrawableArchive out of the various drawable types. It returns nil for records
+// that are not drawables.
+func drawableArchive(v interface{}) *TSD.DrawableArchive {
+	switch d := v.(type) {
+	case *TSD.DrawableArchive:
+		return d
+	case *TSD.ShapeArchive:
+		return d.GetSuper()
+	case *TSD.GroupArchive:
+		return d.GetSuper()
+	case *TSD.ImageArchive:
+		return d.GetSuper()
+	case *TSD.MaskArchive:
+		return d.GetSuper()
+	case *TSD.MovieArchive:
+		return d.GetSuper()
+	case *TSD.ConnectionLineArchive:
+		return d.GetSuper().GetSuper()
+	case *TSWP.ShapeInfoArchive:
+		return d.GetSuper().GetSuper()
+	case *TSWP.CommentInfoArchive:
+		return d.GetSuper().GetSuper().GetSuper()
+	case *TSWP.TOCInfoArchive:
+		return d.GetSuper().GetSuper().GetSuper()
+	case *KN.PlaceholderArchive:
+		return d.GetSuper().GetSuper().GetSuper()
+	case *TP.PlaceholderArchive:
+		return d.GetSuper().GetSuper().GetSuper()
+	case *TN.PlaceholderArchive:
+		return d.GetSuper().GetSuper().GetSuper()
+	case *TST.TableInfoArchive:
+		return d.GetSuper()
+	case *TST.WPTableInfoArchive:
+		return d.GetSuper().GetSuper()
+	case *TSCH.ChartDrawableArchive:
+		return d.GetSuper()
+	case *PreUFF.ChartInfoArchive:
+		return d.GetSuper()
+	}
+	return nil
+}
+
+// groupChildren returns the children of a group or container record.
+func groupChildren(v interface{}) []*TSP.Reference {
+	switch d := v.(type) {
+	case *TSD.GroupArchive:
+		return d.Children
+	case *TSD.ContainerArchive:
+		return d.Children
+	}
+	return nil
+}
+
+// Drawables returns the kind, group hierarchy, geometry and lock metadata of every drawable in the document,
+// ordered by identifier.
+func (ix *Index) Drawables() []DrawableInfo {
+	infos := make(map[uint64]*DrawableInfo)
+	z := ix.stacking()
+	for id, v := range ix.Records {
+		da := drawableArchive(v)
+		if da == nil {
+			if _, ok := v.(*TSD.ContainerArchive); !ok {
+				continue
+			}
+		}
+		info := &DrawableInfo{ID: id, Kind: drawableKind(v), Z: z[id]}
+		if da != nil {
+			info.Locked = da.GetLocked()
+			info.AspectRatioLocked = da.GetAspectRatioLocked()
+			if da.Parent != nil {
+				info.Parent = da.Parent.GetIdentifier()
+			}
+			g := da.GetGeometry()
+			info.X, info.Y = g.GetPosition().GetX(), g.GetPosition().GetY()
+			info.Width, info.Height = g.GetSize().GetWidth(), g.GetSize().GetHeight()
+			info.Angle = g.GetAngle()
+		}
+		var data *TSP.DataReference
+		switch d := v.(type) {
+		case *TSD.ImageArchive:
+			data = d.Data
+		case *TSD.MovieArchive:
+			data = d.MovieData
+		}
+		if m, ok := ix.MediaFor(data); ok {
+			info.Media = m.Path
+		}
+		if c, ok := v.(*TSD.ContainerArchive); ok && c.Parent != nil {
+			info.Parent = c.Parent.GetIdentifier()
+		}
+		for _, ref := range groupChildren(v) {
+			info.Children = append(info.Children, ref.GetIdentifier())
+		}
+		infos[id] = info
+	}
+
+	// Older documents don't always set the parent on children, so fill it in from the group side.
+	for _, info := range infos {
+		for _, child := range info.Children {
+			if ci, ok := infos[child]; ok && ci.Parent == 0 {
+				ci.Parent = info.ID
+			}
+		}
+	}
+
+	rval := make([]DrawableInfo, 0, len(infos))
+	for _, info := range infos {
+		rval = append(rval, *info)
+	}
+	sort.Slice(rval, func(i, j int) bool { return rval[i].ID < rval[j].ID })
+	return rval
+}
+
+// Drawable returns the metadata of a single drawable.
+func (ix *Index) Drawable(id uint64) (DrawableInfo, bool) {
+	for _, info := range ix.Drawables() {
+		if info.ID == id {
+			return info, true
+		}
+	}
+	return DrawableInfo{}, false
+}
+
+// IsLocked reports whether a drawable, or any group containing it, is locked. Editors should refuse to move or
+// modify such objects.
+func (ix *Index) IsLocked(id uint64) bool {
+	infos := make(map[uint64]DrawableInfo)
+	for _, info := range ix.Drawables() {
+		infos[info.ID] = info
+	}
+	seen := make(map[uint64]bool)
+	for id != 0 && !seen[id] {
+		seen[id] = true
+		info, ok := infos[id]
+		if !ok {
+			return false
+		}
+		if info.Locked {
+			return true
+		}
+		id = info.Parent
+	}
+	return false
+}
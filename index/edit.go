@@ -0,0 +1,1113 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSCE"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The mutators below edit the records in place, Save or an Encoder writes the result. They only touch the parts
+// of a document they need to; layout, thumbnails and other caches are left for the app to rebuild on open.
+
+// NewID allocates an identifier for a new record and records it in the package metadata.
+func (ix *Index) NewID() uint64 {
+	meta := ix.packageMetadata()
+	last := meta.GetLastObjectIdentifier()
+	for id := range ix.Records {
+		if id > last {
+			last = id
+		}
+	}
+	for id := range ix.infos {
+		if id > last {
+			last = id
+		}
+	}
+	last++
+	if meta != nil {
+		meta.LastObjectIdentifier = proto.Uint64(last)
+	}
+	return last
+}
+
+// Body returns the body storage of a Pages document, or nil for other documents.
+func (ix *Index) Body() *TSWP.StorageArchive {
+	da, ok := ix.Root().(*TP.DocumentArchive)
+	if !ok {
+		return nil
+	}
+	st, _ := ix.Deref(da.BodyStorage).(*TSWP.StorageArchive)
+	return st
+}
+
+// AppendParagraph adds a paragraph to the end of a storage. The new paragraph carries on the styles of the last
+// one. Newlines in text become line breaks, so it stays a single paragraph.
+func (ix *Index) AppendParagraph(st *TSWP.StorageArchive, text string) error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	defer ix.invalidate()
+	if st == nil {
+		return errors.New("no storage")
+	}
+	text = strings.NewReplacer("\r\n", "\u2028", "\n", "\u2028", "\r", "\u2028").Replace(text)
+	var length int
+	for _, s := range st.Text {
+		length += utf8.RuneCountInString(s)
+	}
+	if length == 0 {
+		st.Text = []string{text}
+		return nil
+	}
+	st.Text = append(st.Text, "\n"+text)
+
+	// Paragraph starts have one entry per paragraph, the other tables are inherited from the previous entry.
+	if t := st.TableParaStarts; t != nil && len(t.Entries) > 0 {
+		last := t.Entries[len(t.Entries)-1]
+		t.Entries = append(t.Entries, &TSWP.ParaDataAttributeTable_ParaDataAttribute{
+			CharacterIndex: proto.Uint32(uint32(length + 1)),
+			First:          proto.Uint32(last.GetFirst()),
+			Second:         proto.Uint32(last.GetSecond()),
+		})
+	}
+	return nil
+}
+
+// AppendStorage appends the text of src to dst, with its styles, attachments and other attributes, starting a new
+// paragraph. src should belong to the same document, see Import, and isn't used by dst afterwards.
+func (ix *Index) AppendStorage(dst, src *TSWP.StorageArchive) error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	defer ix.invalidate()
+	if dst == nil || src == nil {
+		return errors.New("no storage")
+	}
+	text := strings.Join(dst.Text, "")
+	if text != "" && !isParagraphEnd([]rune(text)[utf8.RuneCountInString(text)-1]) {
+		text += "\n"
+	}
+	offset := uint32(utf8.RuneCountInString(text))
+	dst.Text = []string{text + strings.Join(src.Text, "")}
+
+	for _, t := range [][2]**TSWP.ObjectAttributeTable{{&dst.TableParaStyle, &src.TableParaStyle},
+		{&dst.TableListStyle, &src.TableListStyle}, {&dst.TableCharStyle, &src.TableCharStyle},
+		{&dst.TableAttachment, &src.TableAttachment}, {&dst.TableSmartfield, &src.TableSmartfield},
+		{&dst.TableLayoutStyle, &src.TableLayoutStyle}, {&dst.TableBookmark, &src.TableBookmark},
+		{&dst.TableFootnote, &src.TableFootnote}, {&dst.TableSection, &src.TableSection},
+		{&dst.TableRubyfield, &src.TableRubyfield}, {&dst.TableInsertion, &src.TableInsertion},
+		{&dst.TableDeletion, &src.TableDeletion}, {&dst.TableHighlight, &src.TableHighlight}} {
+		from := *t[1]
+		if from == nil {
+			continue
+		}
+		if *t[0] == nil {
+			*t[0] = &TSWP.ObjectAttributeTable{}
+		}
+		for _, e := range from.Entries {
+			e.CharacterIndex = proto.Uint32(e.GetCharacterIndex() + offset)
+			(*t[0]).Entries = append((*t[0]).Entries, e)
+		}
+	}
+	for _, t := range [][2]**TSWP.ParaDataAttributeTable{{&dst.TableParaData, &src.TableParaData},
+		{&dst.TableParaStarts, &src.TableParaStarts}, {&dst.TableParaBidi, &src.TableParaBidi}} {
+		from := *t[1]
+		if from == nil {
+			continue
+		}
+		if *t[0] == nil {
+			*t[0] = &TSWP.ParaDataAttributeTable{}
+		}
+		for _, e := range from.Entries {
+			e.CharacterIndex = proto.Uint32(e.GetCharacterIndex() + offset)
+			(*t[0]).Entries = append((*t[0]).Entries, e)
+		}
+	}
+	for _, t := range [][2]**TSWP.StringAttributeTable{{&dst.TableLanguage, &src.TableLanguage},
+		{&dst.TableDictation, &src.TableDictation}} {
+		from := *t[1]
+		if from == nil {
+			continue
+		}
+		if *t[0] == nil {
+			*t[0] = &TSWP.StringAttributeTable{}
+		}
+		for _, e := range from.Entries {
+			e.CharacterIndex = proto.Uint32(e.GetCharacterIndex() + offset)
+			(*t[0]).Entries = append((*t[0]).Entries, e)
+		}
+	}
+	return nil
+}
+
+// setStorageText replaces the text of a storage. The first entry of each style table is kept so the text takes
+// the storage's leading style, and attachments, fields and the like are dropped.
+func setStorageText(st *TSWP.StorageArchive, text string) {
+	st.Text = []string{strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(text)}
+	for _, t := range []*TSWP.ObjectAttributeTable{st.TableParaStyle, st.TableListStyle, st.TableCharStyle, st.TableLayoutStyle} {
+		if t != nil && len(t.Entries) > 1 {
+			t.Entries = t.Entries[:1]
+		}
+	}
+	for _, t := range []*TSWP.ParaDataAttributeTable{st.TableParaData, st.TableParaBidi} {
+		if t != nil && len(t.Entries) > 1 {
+			t.Entries = t.Entries[:1]
+		}
+	}
+	for _, t := range []*TSWP.StringAttributeTable{st.TableLanguage, st.TableDictation} {
+		if t != nil && len(t.Entries) > 1 {
+			t.Entries = t.Entries[:1]
+		}
+	}
+	if t := st.TableParaStarts; t != nil && len(t.Entries) > 0 {
+		first := t.Entries[0]
+		t.Entries = nil
+		index := 0
+		for i, para := range strings.Split(st.Text[0], "\n") {
+			if i > 0 {
+				index++ // the newline
+			}
+			t.Entries = append(t.Entries, &TSWP.ParaDataAttributeTable_ParaDataAttribute{
+				CharacterIndex: proto.Uint32(uint32(index)),
+				First:          proto.Uint32(first.GetFirst()),
+				Second:         proto.Uint32(first.GetSecond()),
+			})
+			index += utf8.RuneCountInString(para)
+		}
+	}
+	st.TableAttachment = nil
+	st.TableSmartfield = nil
+	st.TableBookmark = nil
+	st.TableFootnote = nil
+	st.TableRubyfield = nil
+	st.TableInsertion = nil
+	st.TableDeletion = nil
+	st.TableHighlight = nil
+}
+
+// ReplaceText replaces the runes [start, end) of a storage with text. The attribute tables are shifted to match;
+// styles and other attributes starting inside the range move to its end, so the text after it keeps them. A range
+// spanning paragraph breaks joins the paragraphs around it into the first, and attachments inside it are dropped.
+// The new text can't hold paragraph breaks or attachments.
+func (ix *Index) ReplaceText(st *TSWP.StorageArchive, start, end int, text string) error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	defer ix.invalidate()
+	rr := []rune(strings.Join(st.Text, ""))
+	if start < 0 || start > end || end > len(rr) {
+		return errors.New("range outside of the text")
+	}
+	for _, r := range text {
+		if isBreak(r) {
+			return errors.New("can't insert paragraph breaks or attachments")
+		}
+	}
+	rr = append(append(append([]rune{}, rr[:start]...), []rune(text)...), rr[end:]...)
+	st.Text = []string{string(rr)}
+
+	// paragraph attributes can only start paragraphs, the first always applies
+	paraStart := func(i int, p *uint32) bool {
+		return i == 0 || *p == 0 || (int(*p) <= len(rr) && isParagraphEnd(rr[*p-1]))
+	}
+	from, to, n := uint32(start), uint32(end), uint32(utf8.RuneCountInString(text))
+	for _, t := range []*TSWP.ObjectAttributeTable{st.TableParaStyle, st.TableListStyle, st.TableCharStyle,
+		st.TableAttachment, st.TableSmartfield, st.TableLayoutStyle, st.TableBookmark, st.TableFootnote,
+		st.TableSection, st.TableRubyfield, st.TableInsertion, st.TableDeletion, st.TableHighlight} {
+		if t == nil {
+			continue
+		}
+		para := t == st.TableParaStyle || t == st.TableListStyle || t == st.TableLayoutStyle || t == st.TableSection
+		indexes := make([]*uint32, len(t.Entries))
+		for i, e := range t.Entries {
+			// attachments sit on their placeholder, which goes with the range
+			if t == st.TableAttachment && e.GetCharacterIndex() >= from && e.GetCharacterIndex() < to {
+				continue
+			}
+			indexes[i] = e.CharacterIndex
+		}
+		keep := shiftIndexes(indexes, from, to, n)
+		entries := t.Entries[:0]
+		for i, e := range t.Entries {
+			if keep[i] && (!para || paraStart(len(entries), e.CharacterIndex)) {
+				entries = append(entries, e)
+			}
+		}
+		t.Entries = entries
+	}
+	for _, t := range []*TSWP.ParaDataAttributeTable{st.TableParaData, st.TableParaStarts, st.TableParaBidi} {
+		if t == nil {
+			continue
+		}
+		indexes := make([]*uint32, len(t.Entries))
+		for i, e := range t.Entries {
+			indexes[i] = e.CharacterIndex
+		}
+		keep := shiftIndexes(indexes, from, to, n)
+		entries := t.Entries[:0]
+		for i, e := range t.Entries {
+			if keep[i] && paraStart(len(entries), e.CharacterIndex) {
+				entries = append(entries, e)
+			}
+		}
+		t.Entries = entries
+	}
+	for _, t := range []*TSWP.StringAttributeTable{st.TableLanguage, st.TableDictation} {
+		if t == nil {
+			continue
+		}
+		indexes := make([]*uint32, len(t.Entries))
+		for i, e := range t.Entries {
+			indexes[i] = e.CharacterIndex
+		}
+		keep := shiftIndexes(indexes, from, to, n)
+		entries := t.Entries[:0]
+		for i, e := range t.Entries {
+			if keep[i] {
+				entries = append(entries, e)
+			}
+		}
+		t.Entries = entries
+	}
+	return nil
+}
+
+// ReplaceAll replaces every occurrence of old in the text storages of the document with new, using ReplaceText, and
+// returns the number replaced. Matches don't span paragraph breaks or attachments. Replacement text takes the
+// style of the text it replaces, and smart fields around or inside a match keep their place. Newlines in new become
+// line breaks.
+func (ix *Index) ReplaceAll(old, new string) (int, error) {
+	if old == "" {
+		return 0, errors.New("nothing to replace")
+	}
+	new = strings.NewReplacer("\r\n", "\u2028", "\n", "\u2028", "\r", "\u2028").Replace(new)
+	oldLen := utf8.RuneCountInString(old)
+	var count int
+	for _, id := range ix.IDs() {
+		st, ok := ix.Records[id].(*TSWP.StorageArchive)
+		if !ok {
+			continue
+		}
+		var starts []int
+		var pos int // rune offset of text
+		text := strings.Join(st.Text, "")
+		for len(text) > 0 {
+			end := strings.IndexFunc(text, isBreak)
+			if end < 0 {
+				end = len(text)
+			}
+			seg := text[:end]
+			for i, from := 0, 0; ; {
+				if i = strings.Index(seg[from:], old); i < 0 {
+					break
+				}
+				starts = append(starts, pos+utf8.RuneCountInString(seg[:from+i]))
+				from += i + len(old)
+			}
+			pos += utf8.RuneCountInString(seg)
+			if end < len(text) {
+				_, size := utf8.DecodeRuneInString(text[end:])
+				end += size
+				pos++
+			}
+			text = text[end:]
+		}
+		// from the end, so the offsets of the earlier matches still hold
+		for i := len(starts) - 1; i >= 0; i-- {
+			if err := ix.ReplaceText(st, starts[i], starts[i]+oldLen, new); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// isParagraphEnd reports whether r ends a paragraph.
+func isParagraphEnd(r rune) bool {
+	return r == '\n' || r == '\u2029' || r == '\u000c'
+}
+
+// isBreak reports whether r is a paragraph break or attachment, which ReplaceText can't insert.
+func isBreak(r rune) bool {
+	return isParagraphEnd(r) || r == AttachmentChar
+}
+
+// shiftIndexes moves the character indexes of an attribute table for the replacement of [start, end) by n runes.
+// It returns the entries to keep: of several entries that end up at the same index only the last applies, and nil
+// indexes are dropped.
+func shiftIndexes(indexes []*uint32, start, end, n uint32) []bool {
+	keep := make([]bool, len(indexes))
+	for _, p := range indexes {
+		if p == nil {
+			continue
+		}
+		switch {
+		case *p >= end:
+			*p = *p - end + start + n
+		case *p > start:
+			*p = start + n
+		}
+	}
+	var next *uint32
+	for i := len(indexes) - 1; i >= 0; i-- {
+		if p := indexes[i]; p != nil {
+			keep[i] = next == nil || *next != *p
+			next = p
+		}
+	}
+	return keep
+}
+
+// AppendTableRow adds a row to the end of the body of a table, above its footer rows. Values past the last column
+// are ignored; text, number, currency, date, duration and bool cells are supported. t.Rows is updated to match.
+func (ix *Index) AppendTableRow(t *Table, values []Cell) error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	defer ix.invalidate()
+	tm := t.Model
+	ds := tm.GetDataStore()
+	if ds == nil || ds.Tiles == nil {
+		return errors.New("table has no data store")
+	}
+	nrows := tm.GetNumberOfRows()
+	row := nrows
+	if footers := tm.GetNumberOfFooterRows(); footers <= nrows {
+		row = nrows - footers
+	}
+	cols := int(tm.GetNumberOfColumns())
+	if len(values) > cols {
+		values = values[:cols]
+	}
+
+	strs, _ := ix.Deref(ds.StringTable).(*TST.TableDataList)
+	cells := make([]Cell, cols)
+	var buffer []byte
+	offsets := make([]byte, 2*cols)
+	var count uint32
+	for c := 0; c < cols; c++ {
+		binary.LittleEndian.PutUint16(offsets[2*c:], 0xffff)
+		if c >= len(values) || values[c].Type == EmptyCell {
+			continue
+		}
+		cell := values[c]
+		var textKey uint32
+		if cell.Type == TextCell {
+			if strs == nil {
+				return errors.New("table has no string table")
+			}
+			textKey = addString(strs, cell.Text)
+		}
+		data, err := encodeCellV5(cell, textKey)
+		if err != nil {
+			return err
+		}
+		if len(buffer) > 0xfffe {
+			return errors.New("row too large")
+		}
+		binary.LittleEndian.PutUint16(offsets[2*c:], uint16(len(buffer)))
+		buffer = append(buffer, data...)
+		cells[c] = Cell{Type: cell.Type, Number: cell.Number, Text: cell.Text, Time: cell.Time}
+		count++
+	}
+
+	if err := ix.shiftRows(tm, row); err != nil {
+		return err
+	}
+	tile, start, err := ix.rowTile(ds, row)
+	if err != nil {
+		return err
+	}
+	var unknown []byte
+	unknown = appendBytesField(unknown, 6, buffer)
+	unknown = appendBytesField(unknown, 7, offsets)
+	tile.RowInfos = append(tile.RowInfos, &TST.TileRowInfo{
+		StorageVersion:    proto.Uint32(5),
+		TileRowIndex:      proto.Uint32(row - start),
+		CellCount:         proto.Uint32(count),
+		CellStorageBuffer: []byte{},
+		CellOffsets:       []byte{},
+		XXX_unrecognized:  unknown,
+	})
+	tile.NumCells = proto.Uint32(tile.GetNumCells() + count)
+	tile.Numrows = proto.Uint32(tile.GetNumrows() + 1)
+	if row-start > tile.GetMaxRow() {
+		tile.MaxRow = proto.Uint32(row - start)
+	}
+	if n := uint32(len(values)); n > 0 && n-1 > tile.GetMaxColumn() {
+		tile.MaxColumn = proto.Uint32(n - 1)
+	}
+	tm.NumberOfRows = proto.Uint32(nrows + 1)
+	if int(row) <= len(t.Rows) {
+		t.Rows = append(t.Rows, nil)
+		copy(t.Rows[row+1:], t.Rows[row:])
+		t.Rows[row] = cells
+	}
+	return nil
+}
+
+// shiftRows moves the rows of a table from row on down by one, to make room for a new row. Their sizes, merged
+// ranges and the references of their formulas go with them; formulas in other rows referring to them are left
+// alone. It fails, before changing anything, if a formula of a moved row is shared with a row that stays.
+func (ix *Index) shiftRows(tm *TST.TableModelArchive, row uint32) error {
+	ds := tm.GetDataStore()
+	end := tm.GetNumberOfRows()
+	if row >= end {
+		return nil
+	}
+
+	type move struct {
+		row   uint32
+		tile  *TST.Tile
+		rinfo *TST.TileRowInfo
+	}
+	var moves []move
+	hosts := make(map[uint32]int) // formula keys of the moved rows, with the row of their first cell
+	uses := make(map[uint32]uint32)
+	for r := row; r < end; r++ {
+		tile, start, err := ix.findTile(ds, r)
+		if err != nil {
+			return err
+		}
+		if tile == nil {
+			continue
+		}
+		for _, rinfo := range tile.RowInfos {
+			if rinfo.GetTileRowIndex() != r-start {
+				continue
+			}
+			moves = append(moves, move{r, tile, rinfo})
+			for _, cell := range decodeRow(rinfo) {
+				if cell.FormulaKey == 0 {
+					continue
+				}
+				if _, ok := hosts[cell.FormulaKey]; !ok {
+					hosts[cell.FormulaKey] = int(r)
+				}
+				uses[cell.FormulaKey]++
+			}
+		}
+	}
+	formulas := ix.Entries(ds.FormulaTable)
+	for key, n := range uses {
+		if entry := formulas[key]; entry != nil && entry.GetRefcount() > n {
+			return errors.New("a formula of the rows to move is shared with other rows")
+		}
+	}
+
+	for _, m := range moves {
+		tile := m.tile
+		infos := tile.RowInfos[:0]
+		var max uint32
+		for _, rinfo := range tile.RowInfos {
+			if rinfo != m.rinfo {
+				infos = append(infos, rinfo)
+				if rinfo.GetTileRowIndex() > max {
+					max = rinfo.GetTileRowIndex()
+				}
+			}
+		}
+		tile.RowInfos = infos
+		tile.Numrows = proto.Uint32(tile.GetNumrows() - 1)
+		tile.NumCells = proto.Uint32(tile.GetNumCells() - m.rinfo.GetCellCount())
+		tile.MaxRow = proto.Uint32(max)
+	}
+	for _, m := range moves {
+		tile, start, err := ix.rowTile(ds, m.row+1)
+		if err != nil {
+			return err
+		}
+		m.rinfo.TileRowIndex = proto.Uint32(m.row + 1 - start)
+		tile.RowInfos = append(tile.RowInfos, m.rinfo)
+		tile.Numrows = proto.Uint32(tile.GetNumrows() + 1)
+		tile.NumCells = proto.Uint32(tile.GetNumCells() + m.rinfo.GetCellCount())
+		if m.row+1-start > tile.GetMaxRow() {
+			tile.MaxRow = proto.Uint32(m.row + 1 - start)
+		}
+		if m.tile.GetMaxColumn() > tile.GetMaxColumn() {
+			tile.MaxColumn = proto.Uint32(m.tile.GetMaxColumn())
+		}
+	}
+	for key, host := range hosts {
+		if entry := formulas[key]; entry.GetFormula() != nil {
+			shiftReferences(entry.Formula.GetASTNodeArray().GetASTNode(), host, int(row))
+		}
+	}
+
+	if hs := ds.GetRowHeaders(); hs != nil {
+		for _, ref := range hs.Buckets {
+			if bucket, ok := ix.Deref(ref).(*TST.HeaderStorageBucket); ok {
+				for _, h := range bucket.Headers {
+					if h.GetIndex() >= row {
+						h.Index = proto.Uint32(h.GetIndex() + 1)
+					}
+				}
+			}
+		}
+	}
+	if mm, ok := ix.Deref(ds.GetMergeRegionMap()).(*TST.MergeRegionMapArchive); ok {
+		for _, cr := range mm.CellRange {
+			if origin := cr.GetOrigin().GetPackedData(); origin>>16 >= row && cr.Origin != nil {
+				cr.Origin.PackedData = proto.Uint32(origin + 1<<16)
+			}
+		}
+	}
+	return nil
+}
+
+// shiftReferences updates the row references of a formula whose cell at host moves down a row along with the
+// rows from row on: relative references to rows that stay now reach one further up, absolute references to rows
+// that move one further down. References to other tables only have their relative rows updated.
+func shiftReferences(nodes []*astNode, host, row int) {
+	shift := func(v int32, absolute, local bool) int32 {
+		switch {
+		case !absolute && host+int(v) < row:
+			return v - 1
+		case absolute && local && int(v) >= row:
+			return v + 1
+		}
+		return v
+	}
+	for _, node := range nodes {
+		switch node.GetASTNodeType() {
+		case TSCE.ASTNodeArrayArchive_CELL_REFERENCE_NODE:
+			if r := node.ASTRow; r != nil {
+				r.Row = proto.Int32(shift(r.GetRow(), r.GetAbsolute(), node.ASTCrossTableReferenceExtraInfo == nil))
+			}
+		case TSCE.ASTNodeArrayArchive_LOCAL_CELL_REFERENCE_NODE:
+			if ref := node.ASTLocalCellReferenceNodeReference; ref != nil {
+				ref.RowHandle = proto.Uint32(uint32(shift(int32(ref.GetRowHandle()), ref.GetRowIsSticky() != 0, true)))
+			}
+		case TSCE.ASTNodeArrayArchive_CROSS_TABLE_CELL_REFERENCE_NODE:
+			if ref := node.ASTCrossTableCellReferenceNodeReference; ref != nil {
+				ref.RowHandle = proto.Uint32(uint32(shift(int32(ref.GetRowHandle()), ref.GetRowIsSticky() != 0, false)))
+			}
+		case TSCE.ASTNodeArrayArchive_THUNK_NODE:
+			shiftReferences(node.GetASTThunkNodeArray().GetASTNode(), host, row)
+		}
+	}
+}
+
+// SetCell sets the value of a cell of a table, or clears it for an EmptyCell. Text, number, currency, date,
+// duration and bool values are supported. The cell loses its style, formats and formula, and what it held of the
+// data store tables is released; formulas depending on it keep their cached results until the app recalculates
+// them. t.Rows is updated to match.
+func (ix *Index) SetCell(t *Table, row, col int, value Cell) error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	defer ix.invalidate()
+	tm := t.Model
+	ds := tm.GetDataStore()
+	if ds == nil || ds.Tiles == nil {
+		return errors.New("table has no data store")
+	}
+	if row < 0 || row >= int(tm.GetNumberOfRows()) || col < 0 || col >= int(tm.GetNumberOfColumns()) {
+		return errors.New("cell outside of the table")
+	}
+	strs, _ := ix.Deref(ds.StringTable).(*TST.TableDataList)
+	var data []byte
+	if value.Type != EmptyCell {
+		var textKey uint32
+		if value.Type == TextCell {
+			if strs == nil {
+				return errors.New("table has no string table")
+			}
+			textKey = addString(strs, value.Text)
+		}
+		var err error
+		if data, err = encodeCellV5(value, textKey); err != nil {
+			return err
+		}
+	}
+
+	tile, start, err := ix.rowTile(ds, uint32(row))
+	if err != nil {
+		return err
+	}
+	var rinfo *TST.TileRowInfo
+	for _, ri := range tile.RowInfos {
+		if ri.GetTileRowIndex() == uint32(row)-start {
+			rinfo = ri
+		}
+	}
+	if rinfo == nil {
+		if data == nil {
+			return nil
+		}
+		rinfo = &TST.TileRowInfo{
+			StorageVersion:    proto.Uint32(5),
+			TileRowIndex:      proto.Uint32(uint32(row) - start),
+			CellCount:         proto.Uint32(0),
+			CellStorageBuffer: []byte{},
+			CellOffsets:       []byte{},
+		}
+		tile.RowInfos = append(tile.RowInfos, rinfo)
+		tile.Numrows = proto.Uint32(tile.GetNumrows() + 1)
+		if uint32(row)-start > tile.GetMaxRow() {
+			tile.MaxRow = proto.Uint32(uint32(row) - start)
+		}
+	}
+	cells, err := rowCells(rinfo)
+	if err != nil {
+		return err
+	}
+	for len(cells) <= col {
+		cells = append(cells, nil)
+	}
+	if old := cells[col]; old != nil {
+		ix.releaseCell(ds, old)
+	}
+	cells[col] = data
+	count, err := packRow(rinfo, cells)
+	if err != nil {
+		return err
+	}
+	tile.NumCells = proto.Uint32(tile.GetNumCells() - rinfo.GetCellCount() + count)
+	rinfo.CellCount = proto.Uint32(count)
+	if data != nil && uint32(col) > tile.GetMaxColumn() {
+		tile.MaxColumn = proto.Uint32(uint32(col))
+	}
+
+	if row < len(t.Rows) && col < len(t.Rows[row]) {
+		t.Rows[row][col] = Cell{Type: value.Type, Number: value.Number, Text: value.Text, Time: value.Time}
+	}
+	return nil
+}
+
+// rowCells splits the storage buffer of a tile row into the encoded cells, indexed by column. A cell runs to the
+// start of the next one in the buffer. Rows in the storage format older than version 5 can't be rewritten.
+func rowCells(rinfo *TST.TileRowInfo) ([][]byte, error) {
+	var buffer, offsets []byte
+	var wide, found bool
+	for _, f := range wireFields(rinfo.XXX_unrecognized) {
+		switch f.num {
+		case 6:
+			buffer, found = f.data, true
+		case 7:
+			offsets = f.data
+		case 8:
+			wide = f.value != 0
+		}
+	}
+	if !found {
+		if len(rinfo.CellStorageBuffer) > 0 {
+			return nil, errors.New("can't edit cells in the old storage format")
+		}
+		return nil, nil
+	}
+	starts := make([]int, len(offsets)/2)
+	var sorted []int
+	for c := range starts {
+		starts[c] = int(binary.LittleEndian.Uint16(offsets[2*c:]))
+		if starts[c] == 0xffff {
+			starts[c] = -1
+			continue
+		}
+		if wide {
+			starts[c] *= 4
+		}
+		sorted = append(sorted, starts[c])
+	}
+	sort.Ints(sorted)
+	rval := make([][]byte, len(starts))
+	for c, start := range starts {
+		if start < 0 || start > len(buffer) {
+			continue
+		}
+		end := len(buffer)
+		if i := sort.SearchInts(sorted, start+1); i < len(sorted) {
+			end = sorted[i]
+		}
+		rval[c] = buffer[start:end]
+	}
+	return rval, nil
+}
+
+// packRow writes the cells of a tile row back to its storage buffer and returns their number. Offsets are stored
+// in units of four bytes, with each cell padded to match, when the buffer is too large for plain ones.
+func packRow(rinfo *TST.TileRowInfo, cells [][]byte) (uint32, error) {
+	var size int
+	for _, data := range cells {
+		size += len(data)
+	}
+	wide := size > 0xfffe
+	var buffer []byte
+	offsets := make([]byte, 2*len(cells))
+	var count uint32
+	for c, data := range cells {
+		offset := uint32(0xffff)
+		if data != nil {
+			offset = uint32(len(buffer))
+			if wide {
+				offset /= 4
+			}
+			buffer = append(buffer, data...)
+			for wide && len(buffer)%4 != 0 {
+				buffer = append(buffer, 0)
+			}
+			count++
+		}
+		if offset > 0xfffe && data != nil {
+			return 0, errors.New("row too large")
+		}
+		binary.LittleEndian.PutUint16(offsets[2*c:], uint16(offset))
+	}
+
+	var unknown []byte
+	for _, f := range wireFields(rinfo.XXX_unrecognized) {
+		if f.num < 6 || f.num > 8 {
+			unknown = append(unknown, f.raw...)
+		}
+	}
+	unknown = appendBytesField(unknown, 6, buffer)
+	unknown = appendBytesField(unknown, 7, offsets)
+	if wide {
+		unknown = append(unknown, 8<<3, 1)
+	}
+	rinfo.XXX_unrecognized = unknown
+	rinfo.StorageVersion = proto.Uint32(5)
+	return count, nil
+}
+
+// releaseCell drops the references an encoded cell holds to the entries of the data store tables: its text, style,
+// conditional style, formula, control, error and formats. A formula entry no other cell uses is removed with it.
+func (ix *Index) releaseCell(ds *TST.DataStore, data []byte) {
+	cell, ok := decodeCellV5(data, 0)
+	if !ok {
+		return
+	}
+	release := func(ref *TSP.Reference, key uint32) {
+		if list, ok := ix.Deref(ref).(*TST.TableDataList); ok && key != 0 {
+			releaseEntry(list, key)
+		}
+	}
+	release(ds.StringTable, cell.textKey)
+	release(ds.RichTextPayloadTable, cell.richKey)
+	release(ds.StyleTable, cell.StyleKey)
+	release(ds.StyleTable, cell.textStyleKey)
+	release(ds.Conditionalstyletable, cell.ConditionalKey)
+	release(ds.FormulaTable, cell.FormulaKey)
+	release(ds.MultipleChoiceListFormatTable, cell.ControlKey)
+	release(ds.FormulaErrorTable, cell.errorKey)
+	for _, key := range cell.formats {
+		release(ds.FormatTable, key)
+	}
+}
+
+// releaseEntry drops a reference to an entry of a table's data list, removing the entry when it's unused.
+func releaseEntry(list *TST.TableDataList, key uint32) {
+	for i, entry := range list.Entries {
+		if entry.GetKey() != key {
+			continue
+		}
+		if entry.GetRefcount() > 1 {
+			entry.Refcount = proto.Uint32(entry.GetRefcount() - 1)
+		} else {
+			list.Entries = append(list.Entries[:i], list.Entries[i+1:]...)
+		}
+		return
+	}
+}
+
+// findTile returns the tile that holds a row and the row the tile starts at, or a nil tile if there is none.
+func (ix *Index) findTile(ds *TST.DataStore, row uint32) (*TST.Tile, uint32, error) {
+	tileStart := make(map[uint32]uint32)
+	if ds.RowTileTree != nil {
+		for _, node := range ds.RowTileTree.Nodes {
+			tileStart[node.GetValue()] = node.GetKey()
+		}
+	}
+	for _, tinfo := range ds.Tiles.Tiles {
+		start, ok := tileStart[tinfo.GetTileid()]
+		if !ok {
+			start = tinfo.GetTileid() * tileRows
+		}
+		if row >= start && row < start+tileRows {
+			tile, ok := ix.Deref(tinfo.Tile).(*TST.Tile)
+			if !ok {
+				return nil, 0, errors.New("missing table tile")
+			}
+			return tile, start, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+// rowTile returns the tile that holds a row and the row the tile starts at, adding a tile if the row is past the
+// end of the last one.
+func (ix *Index) rowTile(ds *TST.DataStore, row uint32) (*TST.Tile, uint32, error) {
+	if tile, start, err := ix.findTile(ds, row); tile != nil || err != nil {
+		return tile, start, err
+	}
+	var last *TST.TileStorage_Tile
+	var next uint32
+	for _, tinfo := range ds.Tiles.Tiles {
+		if tinfo.GetTileid() >= next {
+			next = tinfo.GetTileid() + 1
+		}
+		last = tinfo
+	}
+
+	start := row
+	if ds.RowTileTree == nil {
+		next, start = row/tileRows, row/tileRows*tileRows
+	}
+	id := ix.NewID()
+	tile := &TST.Tile{
+		MaxColumn: proto.Uint32(0),
+		MaxRow:    proto.Uint32(0),
+		NumCells:  proto.Uint32(0),
+		Numrows:   proto.Uint32(0),
+	}
+	ix.Records[id] = tile
+	if last != nil {
+		ix.setFile(id, ix.File(last.Tile.GetIdentifier()))
+	}
+	ds.Tiles.Tiles = append(ds.Tiles.Tiles, &TST.TileStorage_Tile{
+		Tileid: proto.Uint32(next),
+		Tile:   &TSP.Reference{Identifier: proto.Uint64(id)},
+	})
+	if ds.RowTileTree != nil {
+		ds.RowTileTree.Nodes = append(ds.RowTileTree.Nodes, &TST.TableRBTree_Node{
+			Key:   proto.Uint32(start),
+			Value: proto.Uint32(next),
+		})
+	}
+	return tile, start, nil
+}
+
+// addString returns the key of a string in a table's string list, adding it if needed.
+func addString(list *TST.TableDataList, s string) uint32 {
+	for _, entry := range list.Entries {
+		if entry.String_ != nil && *entry.String_ == s {
+			entry.Refcount = proto.Uint32(entry.GetRefcount() + 1)
+			return entry.GetKey()
+		}
+	}
+	key := list.GetNextListID()
+	for _, entry := range list.Entries {
+		if entry.GetKey() >= key {
+			key = entry.GetKey() + 1
+		}
+	}
+	if key == 0 {
+		key = 1
+	}
+	list.Entries = append(list.Entries, &TST.TableDataList_ListEntry{
+		Key:      proto.Uint32(key),
+		Refcount: proto.Uint32(1),
+		String_:  proto.String(s),
+	})
+	list.NextListID = proto.Uint32(key + 1)
+	return key
+}
+
+// encodeCellV5 is the inverse of decodeCellV5, for the value types we can write.
+func encodeCellV5(cell Cell, textKey uint32) ([]byte, error) {
+	b := make([]byte, 12, 32)
+	b[0] = 5
+	var flags uint32
+	f64 := func(v float64) {
+		b = b[:len(b)+8]
+		binary.LittleEndian.PutUint64(b[len(b)-8:], math.Float64bits(v))
+	}
+	switch cell.Type {
+	case NumberCell, CurrencyCell:
+		b[1] = 2
+		if cell.Type == CurrencyCell {
+			b[1] = 10
+		}
+		flags = 0x1
+		d := encodeDecimal128(cell.Number)
+		b = append(b, d[:]...)
+	case TextCell:
+		b[1] = 3
+		flags = 0x8
+		b = b[:len(b)+4]
+		binary.LittleEndian.PutUint32(b[len(b)-4:], textKey)
+	case DateCell:
+		b[1] = 5
+		flags = 0x4
+		f64(float64(cell.Time.Unix() - appleEpoch))
+	case BoolCell:
+		b[1] = 6
+		flags = 0x2
+		v := 0.0
+		if cell.Number != 0 {
+			v = 1
+		}
+		f64(v)
+	case DurationCell:
+		b[1] = 7
+		flags = 0x2
+		f64(cell.Number)
+	default:
+		return nil, errors.New("can't write " + cell.Type.String() + " cells")
+	}
+	binary.LittleEndian.PutUint32(b[8:12], flags)
+	return b, nil
+}
+
+// encodeDecimal128 is the inverse of decimal128. It keeps the shortest decimal representation of v.
+func encodeDecimal128(v float64) [16]byte {
+	var b [16]byte
+	neg := v < 0
+	if neg {
+		v = -v
+	}
+	exp := 0
+	var mantissa uint64
+	if v != 0 && !math.IsInf(v, 0) && !math.IsNaN(v) {
+		s := strconv.FormatFloat(v, 'e', -1, 64) // d.ddde±xx
+		e := strings.IndexByte(s, 'e')
+		digits := strings.Replace(s[:e], ".", "", 1)
+		exp, _ = strconv.Atoi(s[e+1:])
+		exp -= len(digits) - 1
+		mantissa, _ = strconv.ParseUint(digits, 10, 64)
+	}
+	binary.LittleEndian.PutUint64(b[:8], mantissa)
+	e := exp + 0x1820
+	b[14] = byte(e&0x7f) << 1
+	b[15] = byte(e>>7) & 0x7f
+	if neg {
+		b[15] |= 0x80
+	}
+	return b
+}
+
+// appendBytesField appends a length delimited protobuf field.
+func appendBytesField(buf []byte, num int, data []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(num)<<3|2)
+	buf = append(buf, tmp[:n]...)
+	n = binary.PutUvarint(tmp[:], uint64(len(data)))
+	buf = append(buf, tmp[:n]...)
+	return append(buf, data...)
+}
+
+// AppendSlide adds a slide with a title and body text to the end of a Keynote document and returns its id. The
+// slide is a copy of the last slide's master and placeholders; its other drawables, notes and builds are not
+// copied.
+func (ix *Index) AppendSlide(title, body string) (uint64, error) {
+	if err := ix.writable(); err != nil {
+		return 0, err
+	}
+	defer ix.invalidate()
+	da, ok := ix.Root().(*KN.DocumentArchive)
+	if !ok {
+		return 0, errors.New("not a Keynote document")
+	}
+	show, ok := ix.Deref(da.Show).(*KN.ShowArchive)
+	if !ok {
+		return 0, errors.New("missing show")
+	}
+	root, ok := ix.Deref(show.GetSlideTree().GetRootSlideNode()).(*KN.SlideNodeArchive)
+	if !ok {
+		return 0, errors.New("missing slide tree")
+	}
+	nodes := ix.SlideTree()
+	for len(nodes) > 0 && len(nodes[len(nodes)-1].Children) > 0 {
+		nodes = nodes[len(nodes)-1].Children
+	}
+	if len(nodes) == 0 {
+		return 0, errors.New("document has no slides to copy")
+	}
+	last := nodes[len(nodes)-1]
+	src, ok := ix.Records[last.Slide].(*KN.SlideArchive)
+	if !ok {
+		return 0, errors.New("missing slide")
+	}
+	srcNode, ok := ix.Records[last.ID].(*KN.SlideNodeArchive)
+	if !ok {
+		return 0, errors.New("missing slide node")
+	}
+
+	id := ix.NewID()
+	file := ix.File(last.Slide)
+	slide := proto.Clone(src).(*KN.SlideArchive)
+	slide.Drawables = nil
+	slide.Builds = nil
+	slide.BuildChunks = nil
+	slide.SageTagToInfoMap = nil
+	slide.Note = nil
+	slide.ObjectPlaceholder = nil
+	slide.SlideNumberPlaceholder = nil
+	slide.InfoUsingObjectPlaceholderGeometry = nil
+	slide.UserDefinedGuideStorage = nil
+	slide.Name = nil
+	slide.ThumbnailTextForTitlePlaceholder = proto.String(title)
+	slide.ThumbnailTextForBodyPlaceholder = proto.String(body)
+	slide.TitlePlaceholder = ix.copyPlaceholder(src.TitlePlaceholder, id, file, title)
+	slide.BodyPlaceholder = ix.copyPlaceholder(src.BodyPlaceholder, id, file, body)
+	for _, ref := range []*TSP.Reference{slide.TitlePlaceholder, slide.BodyPlaceholder} {
+		if ref != nil {
+			slide.Drawables = append(slide.Drawables, ref)
+		}
+	}
+	ix.Records[id] = slide
+	ix.setFile(id, file)
+
+	nodeID := ix.NewID()
+	node := proto.Clone(srcNode).(*KN.SlideNodeArchive)
+	node.Children = nil
+	node.Slide = &TSP.Reference{Identifier: proto.Uint64(id)}
+	node.Thumbnails = nil
+	node.ThumbnailSizes = nil
+	node.ThumbnailsAreDirty = proto.Bool(true)
+	node.DatabaseThumbnail = nil
+	node.DatabaseThumbnails = nil
+	node.IsHidden = proto.Bool(false)
+	node.IsCollapsed = proto.Bool(false)
+	node.HasBuilds = proto.Bool(false)
+	node.HasNote = proto.Bool(false)
+	node.UniqueIdentifier = nil
+	node.CopyFromSlideIdentifier = nil
+	node.SlideSpecificHyperlinkCount = nil
+	node.EventCount = nil
+	ix.Records[nodeID] = node
+	ix.setFile(nodeID, ix.File(last.ID))
+	root.Children = append(root.Children, &TSP.Reference{Identifier: proto.Uint64(nodeID)})
+	return id, nil
+}
+
+// copyPlaceholder copies a placeholder and its storage for a new slide, with the storage holding text.
+func (ix *Index) copyPlaceholder(ref *TSP.Reference, slide uint64, file, text string) *TSP.Reference {
+	ph, ok := ix.Deref(ref).(*KN.PlaceholderArchive)
+	if !ok {
+		return nil
+	}
+	st, ok := ix.Deref(ph.GetSuper().GetContainedStorage()).(*TSWP.StorageArchive)
+	if !ok {
+		return nil
+	}
+	st = proto.Clone(st).(*TSWP.StorageArchive)
+	setStorageText(st, text)
+	stID := ix.NewID()
+	ix.Records[stID] = st
+	ix.setFile(stID, file)
+
+	ph = proto.Clone(ph).(*KN.PlaceholderArchive)
+	ph.Super.ContainedStorage = &TSP.Reference{Identifier: proto.Uint64(stID)}
+	if d := drawableArchive(ph); d != nil {
+		d.Parent = &TSP.Reference{Identifier: proto.Uint64(slide)}
+	}
+	id := ix.NewID()
+	ix.Records[id] = ph
+	ix.setFile(id, file)
+	return &TSP.Reference{Identifier: proto.Uint64(id)}
+}
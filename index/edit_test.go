@@ -0,0 +1,152 @@
+package index
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// emptyTable returns an index holding a single table with no stored cells: one tile with no row infos.
+func emptyTable(rows, cols uint32) (*Index, *Table, *TST.Tile) {
+	tile := &TST.Tile{}
+	ix := &Index{Records: map[uint64]interface{}{
+		2: tile,
+		3: &TST.TableDataList{},
+	}}
+	tm := &TST.TableModelArchive{
+		NumberOfRows:    proto.Uint32(rows),
+		NumberOfColumns: proto.Uint32(cols),
+		DataStore: &TST.DataStore{
+			Tiles: &TST.TileStorage{Tiles: []*TST.TileStorage_Tile{
+				{Tileid: proto.Uint32(0), Tile: &TSP.Reference{Identifier: proto.Uint64(2)}},
+			}},
+			StringTable: &TSP.Reference{Identifier: proto.Uint64(3)},
+		},
+	}
+	return ix, &Table{ID: 1, Model: tm}, tile
+}
+
+func TestSetCellEmptyRow(t *testing.T) {
+	ix, table, tile := emptyTable(3, 4)
+	if err := ix.SetCell(table, 1, 2, Cell{Type: NumberCell, Number: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if len(tile.RowInfos) != 1 {
+		t.Fatalf("got %d row infos, want 1", len(tile.RowInfos))
+	}
+	cells, err := rowCells(tile.RowInfos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 3 || cells[0] != nil || cells[1] != nil {
+		t.Fatalf("unexpected cells %v", cells)
+	}
+	cell, ok := decodeCellV5(cells[2], 0)
+	if !ok || cell.Type != NumberCell || cell.Number != 42 {
+		t.Fatalf("got %+v, want the number 42", cell)
+	}
+
+	// past the last stored cell of an existing row
+	if err := ix.SetCell(table, 1, 3, Cell{Type: TextCell, Text: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if cells, _ = rowCells(tile.RowInfos[0]); len(cells) != 4 || cells[3] == nil {
+		t.Fatalf("unexpected cells %v", cells)
+	}
+	if got := tile.GetNumCells(); got != 2 {
+		t.Errorf("tile has %d cells, want 2", got)
+	}
+}
+
+// dataList returns a table data list with one entry per key, each with the given refcount.
+func dataList(refcount uint32, keys ...uint32) *TST.TableDataList {
+	list := &TST.TableDataList{}
+	for _, key := range keys {
+		list.Entries = append(list.Entries, &TST.TableDataList_ListEntry{
+			Key:      proto.Uint32(key),
+			Refcount: proto.Uint32(refcount),
+		})
+	}
+	return list
+}
+
+func TestSetCellReleasesKeys(t *testing.T) {
+	ix, table, tile := emptyTable(1, 1)
+	ds := table.Model.DataStore
+	ix.Records[4] = dataList(2, 7)     // styles, shared with another cell
+	ix.Records[5] = dataList(1, 8)     // formulas
+	ix.Records[6] = dataList(1, 9, 10) // formats
+	ds.StyleTable = &TSP.Reference{Identifier: proto.Uint64(4)}
+	ds.FormulaTable = &TSP.Reference{Identifier: proto.Uint64(5)}
+	ds.FormatTable = &TSP.Reference{Identifier: proto.Uint64(6)}
+
+	// a number cell with a style, a formula, and number and date formats
+	old, err := encodeCellV5(Cell{Type: NumberCell, Number: 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []uint32{7, 8, 9, 10} {
+		old = binary.LittleEndian.AppendUint32(old, key)
+	}
+	binary.LittleEndian.PutUint32(old[8:12], 0x1|0x20|0x200|0x2000|0x8000)
+	rinfo := &TST.TileRowInfo{StorageVersion: proto.Uint32(5), TileRowIndex: proto.Uint32(0)}
+	count, err := packRow(rinfo, [][]byte{old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rinfo.CellCount = proto.Uint32(count)
+	tile.RowInfos = append(tile.RowInfos, rinfo)
+	tile.Numrows, tile.NumCells = proto.Uint32(1), proto.Uint32(count)
+
+	if err := ix.SetCell(table, 0, 0, Cell{Type: NumberCell, Number: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := ix.Records[4].(*TST.TableDataList).Entries; len(entries) != 1 || entries[0].GetRefcount() != 1 {
+		t.Errorf("style entries %v, want one with a refcount of 1", entries)
+	}
+	if entries := ix.Records[5].(*TST.TableDataList).Entries; len(entries) != 0 {
+		t.Errorf("the formula was kept: %v", entries)
+	}
+	if entries := ix.Records[6].(*TST.TableDataList).Entries; len(entries) != 0 {
+		t.Errorf("formats were kept: %v", entries)
+	}
+}
+
+func TestSetCellOutside(t *testing.T) {
+	ix, table, _ := emptyTable(3, 4)
+	if err := ix.SetCell(table, 3, 0, Cell{Type: NumberCell, Number: 1}); err == nil {
+		t.Error("expected an error for a row past the end of the table")
+	}
+}
+
+func TestAppendTableRowFooter(t *testing.T) {
+	ix, table, tile := emptyTable(3, 2)
+	table.Model.NumberOfFooterRows = proto.Uint32(1)
+	table.Rows = [][]Cell{make([]Cell, 2), make([]Cell, 2), make([]Cell, 2)}
+	if err := ix.SetCell(table, 2, 0, Cell{Type: TextCell, Text: "total"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.AppendTableRow(table, []Cell{{Type: NumberCell, Number: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := table.Model.GetNumberOfRows(); got != 4 {
+		t.Fatalf("table has %d rows, want 4", got)
+	}
+	rows := make(map[uint32]rawCell)
+	for _, rinfo := range tile.RowInfos {
+		rows[rinfo.GetTileRowIndex()] = decodeRow(rinfo)[0]
+	}
+	if cell := rows[2]; cell.Type != NumberCell || cell.Number != 7 {
+		t.Errorf("row 2 holds %+v, want the new row", cell)
+	}
+	if cell := rows[3]; cell.Type != TextCell {
+		t.Errorf("row 3 holds %+v, want the footer", cell)
+	}
+	if len(table.Rows) != 4 || table.Rows[2][0].Number != 7 || table.Rows[3][0].Text != "total" {
+		t.Errorf("unexpected rows %v", table.Rows)
+	}
+}
@@ -0,0 +1,647 @@
+package index
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+)
+
+// recordInfo remembers where a record came from, so it can be written back out.
+type recordInfo struct {
+	file    string
+	archive *TSP.ArchiveInfo
+	seq     int
+
+	// An archive can hold several messages, Records only one of them: the one at slot. The others are kept in
+	// extra and written back as they were.
+	slot  int
+	extra []iwaMessage
+}
+
+// iwaMessage is a message of an archive, its header and payload.
+type iwaMessage struct {
+	info *TSP.MessageInfo
+	data []byte
+}
+
+// DefaultFile is the .iwa file that records without a known home are written to.
+const DefaultFile = "Index/Document.iwa"
+
+// defaultVersion is used for the MessageInfo of records created in memory.
+var defaultVersion = []uint32{1, 0, 5}
+
+func (ix *Index) noteArchive(file string, ai *TSP.ArchiveInfo) {
+	if ix.infos == nil {
+		ix.infos = make(map[uint64]*recordInfo)
+	}
+	ix.infos[ai.GetIdentifier()] = &recordInfo{file: file, archive: ai, seq: len(ix.infos)}
+}
+
+// noteMessages keeps the messages of an archive other than the one that went into Records: the last one decoded,
+// or the last one if none was (see addRaw).
+func (ix *Index) noteMessages(id uint64, payloads []iwaPayload) {
+	info := ix.infos[id]
+	info.slot = len(payloads) - 1
+	for i, p := range payloads {
+		if !p.skipped && p.err == nil {
+			info.slot = i
+		}
+	}
+	info.extra = nil
+	for i, p := range payloads {
+		if i != info.slot {
+			info.extra = append(info.extra, iwaMessage{info.archive.MessageInfos[i], p.data})
+		}
+	}
+}
+
+// File returns the name of the .iwa file holding a record, or "" if it isn't known.
+func (ix *Index) File(id uint64) string {
+	if info := ix.infos[id]; info != nil {
+		return info.file
+	}
+	return ""
+}
+
+// SetFile sets the .iwa file a record will be written to, e.g. "Index/Slide-123.iwa".
+func (ix *Index) SetFile(id uint64, file string) error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	ix.setFile(id, file)
+	return nil
+}
+
+func (ix *Index) setFile(id uint64, file string) {
+	if ix.infos == nil {
+		ix.infos = make(map[uint64]*recordInfo)
+	}
+	if info := ix.infos[id]; info != nil {
+		info.file = file
+		return
+	}
+	ix.infos[id] = &recordInfo{file: file, seq: len(ix.infos)}
+}
+
+// typeIDs maps Go types back to archive type ids, per document type. Some Go types are registered under more than
+// one id; the lowest one wins here, records loaded from a file keep their original id. goTypes is the other way
+// round.
+var (
+	typeIDsMu sync.Mutex
+	typeIDs   = map[string]map[reflect.Type]uint32{}
+	goTypes   = map[string]map[uint32]reflect.Type{}
+)
+
+// typeMaps returns typeIDs and goTypes for the document type, working them out the first time.
+func (ix *Index) typeMaps() (map[reflect.Type]uint32, map[uint32]reflect.Type) {
+	typeIDsMu.Lock()
+	defer typeIDsMu.Unlock()
+	ids, types := typeIDs[ix.Type], goTypes[ix.Type]
+	if ids == nil {
+		ids, types = make(map[reflect.Type]uint32), make(map[uint32]reflect.Type)
+		// Probe the decoders with an empty payload, they hand back a zero value for every id they know.
+		for typ := uint32(0); typ < 20000; typ++ {
+			value, _ := ix.decode(typ, nil)
+			if value == nil {
+				continue
+			}
+			types[typ] = reflect.TypeOf(value)
+			if _, ok := ids[types[typ]]; !ok {
+				ids[types[typ]] = typ
+			}
+		}
+		typeIDs[ix.Type], goTypes[ix.Type] = ids, types
+	}
+	return ids, types
+}
+
+// typeIDFor returns the archive type id for a record value.
+func (ix *Index) typeIDFor(v interface{}) (uint32, bool) {
+	ids, _ := ix.typeMaps()
+	typ, ok := ids[reflect.TypeOf(v)]
+	return typ, ok
+}
+
+// goType returns the Go type payloads of an archive type id decode to, or nil if the id isn't known.
+func (ix *Index) goType(typ uint32) reflect.Type {
+	_, types := ix.typeMaps()
+	return types[typ]
+}
+
+var (
+	referenceType     = reflect.TypeOf(TSP.Reference{})
+	dataReferenceType = reflect.TypeOf(TSP.DataReference{})
+)
+
+// references collects the object and data identifiers referenced from a decoded record.
+func references(v interface{}) (objects, datas []uint64) {
+	var walk func(rv reflect.Value)
+	walk = func(rv reflect.Value) {
+		switch rv.Kind() {
+		case reflect.Ptr:
+			if rv.IsNil() {
+				return
+			}
+			walk(rv.Elem())
+		case reflect.Slice:
+			if rv.Type().Elem().Kind() == reflect.Uint8 {
+				return
+			}
+			for i := 0; i < rv.Len(); i++ {
+				walk(rv.Index(i))
+			}
+		case reflect.Struct:
+			switch rv.Type() {
+			case referenceType:
+				ref := rv.Addr().Interface().(*TSP.Reference)
+				objects = append(objects, ref.GetIdentifier())
+				return
+			case dataReferenceType:
+				ref := rv.Addr().Interface().(*TSP.DataReference)
+				datas = append(datas, ref.GetIdentifier())
+				return
+			}
+			for i := 0; i < rv.NumField(); i++ {
+				if rv.Type().Field(i).PkgPath != "" {
+					continue
+				}
+				walk(rv.Field(i))
+			}
+		}
+	}
+	walk(reflect.ValueOf(v))
+	return
+}
+
+// encodeRecord returns the ArchiveInfo header and payload for a record.
+func (ix *Index) encodeRecord(id uint64) (*TSP.ArchiveInfo, []byte, error) {
+	info := ix.infos[id]
+	v, ok := ix.Records[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("record %d has no content", id)
+	}
+	if raw, ok := v.(*RawRecord); ok {
+		// Pass undecoded records through untouched.
+		typ := raw.Type
+		mi := TSP.MessageInfo{Type: &typ, Version: defaultVersion}
+		if m := info.message(); m != nil && m.GetType() == raw.Type {
+			mi = *m
+		}
+		length := uint32(len(raw.Payload))
+		mi.Length = &length
+		ai, payload := info.wrap(id, &mi, raw.Payload)
+		return ai, payload, nil
+	}
+
+	var payload []byte
+	var err error
+	switch v := v.(type) {
+	case proto.Message:
+		payload, err = proto.Marshal(v)
+	case interface{ Marshal() ([]byte, error) }:
+		// records of a RegisterDecoder decoder
+		payload, err = v.Marshal()
+	default:
+		return nil, nil, fmt.Errorf("record %d: %T is not a protobuf message", id, v)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("record %d: %w", id, err)
+	}
+
+	// Reuse the original MessageInfo if the record came from a file, otherwise make one up.
+	var mi TSP.MessageInfo
+	if m := info.message(); m != nil && ix.goType(m.GetType()) == reflect.TypeOf(v) {
+		mi = *m
+	}
+	if mi.Type == nil {
+		typ, ok := ix.typeIDFor(v)
+		if !ok {
+			return nil, nil, fmt.Errorf("record %d: no type id for %T", id, v)
+		}
+		mi.Type = &typ
+		mi.Version = defaultVersion
+	}
+	length := uint32(len(payload))
+	mi.Length = &length
+	mi.ObjectReferences, mi.DataReferences = references(v)
+
+	ai, payload := info.wrap(id, &mi, payload)
+	return ai, payload, nil
+}
+
+// message returns the original header of the message in Records, or nil for records created in memory.
+func (info *recordInfo) message() *TSP.MessageInfo {
+	if info == nil || info.archive == nil || info.slot >= len(info.archive.MessageInfos) {
+		return nil
+	}
+	return info.archive.MessageInfos[info.slot]
+}
+
+// wrap returns the archive header and payload of a record, with the other messages of its archive back in their
+// places.
+func (info *recordInfo) wrap(id uint64, mi *TSP.MessageInfo, payload []byte) (*TSP.ArchiveInfo, []byte) {
+	ai := &TSP.ArchiveInfo{Identifier: &id}
+	if info == nil || len(info.extra) == 0 {
+		ai.MessageInfos = []*TSP.MessageInfo{mi}
+		return ai, payload
+	}
+	// keeps the should_merge flag, which matters for archives like these
+	ai.XXX_unrecognized = info.archive.XXX_unrecognized
+	var data []byte
+	for i := 0; i <= len(info.extra); i++ {
+		m, part := mi, payload
+		if i < info.slot {
+			m, part = info.extra[i].info, info.extra[i].data
+		} else if i > info.slot {
+			m, part = info.extra[i-1].info, info.extra[i-1].data
+		}
+		ai.MessageInfos = append(ai.MessageInfos, m)
+		data = append(data, part...)
+	}
+	return ai, data
+}
+
+// files groups the record identifiers by the .iwa file they belong in, in their original order.
+func (ix *Index) files() map[string][]uint64 {
+	ids := make([]uint64, 0, len(ix.Records))
+	for id := range ix.Records {
+		ids = append(ids, id)
+	}
+	seq := func(id uint64) int {
+		if info := ix.infos[id]; info != nil {
+			return info.seq
+		}
+		return len(ix.infos)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if seq(ids[i]) != seq(ids[j]) {
+			return seq(ids[i]) < seq(ids[j])
+		}
+		return ids[i] < ids[j]
+	})
+
+	rval := make(map[string][]uint64)
+	for _, id := range ids {
+		file := ix.File(id)
+		if file == "" {
+			file = DefaultFile
+		}
+		rval[file] = append(rval[file], id)
+	}
+	return rval
+}
+
+// encodeIWA writes the records as a snappy framed .iwa stream.
+func (ix *Index) encodeIWA(ids []uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	for _, id := range ids {
+		ai, payload, err := ix.encodeRecord(id)
+		if err != nil {
+			return nil, err
+		}
+		header, err := proto.Marshal(ai)
+		if err != nil {
+			return nil, err
+		}
+		n := binary.PutUvarint(tmp[:], uint64(len(header)))
+		buf.Write(tmp[:n])
+		buf.Write(header)
+		buf.Write(payload)
+	}
+	return snap(buf.Bytes()), nil
+}
+
+// snap is the inverse of unsnap. iWork expects bare compressed chunks of at most 64k, without the stream
+// identifier or checksums of the framing format.
+func snap(data []byte) []byte {
+	const maxChunk = 65536
+	var rval bytes.Buffer
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxChunk {
+			n = maxChunk
+		}
+		enc := snappy.Encode(nil, data[:n])
+		l := len(enc)
+		rval.Write([]byte{0, byte(l), byte(l >> 8), byte(l >> 16)})
+		rval.Write(enc)
+		data = data[n:]
+	}
+	return rval.Bytes()
+}
+
+// Encoder writes an Index out as an Index.zip archive.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w}
+}
+
+// Encode writes every record of ix to the archive, grouped into their original .iwa files. Lazily opened documents
+// have to be loaded with LoadAll first.
+func (e *Encoder) Encode(ix *Index) error {
+	if ix.lazy {
+		return ErrPartial
+	}
+	files := ix.files()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	zw := zip.NewWriter(e.w)
+	for _, name := range names {
+		data, err := ix.encodeIWA(files[name])
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := writeStored(zw, name, data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeStored adds an uncompressed member to a zip file. iWork only reads stored entries without data descriptors,
+// so the sizes and checksum go in the local header.
+func writeStored(zw *zip.Writer, name string, data []byte) error {
+	fh := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(len(data)),
+		UncompressedSize64: uint64(len(data)),
+	}
+	w, err := zw.CreateRaw(fh)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Save writes the Index as a package (directory) document. Everything outside of Index.zip (Data, Metadata,
+// previews) is copied over from the document the Index was opened from, except files dropped with RemovePreviews,
+// which are deleted from doc if it has them.
+// Documents opened from an index.db (.pages-tef) are written back to one, updated in place when doc is the
+// document they came from. Lazily opened documents have to be loaded with LoadAll first. Save only reads the Index,
+// so it works on a frozen one too.
+func (ix *Index) Save(doc string) error {
+	if ix.crypt != nil {
+		return errors.New("writing encrypted documents is not supported")
+	}
+	if ix.lazy {
+		return ErrPartial
+	}
+	if err := os.MkdirAll(doc, 0755); err != nil {
+		return err
+	}
+	if ix.path != "" && !(ix.sqlite && sameFile(ix.path, doc)) {
+		if err := copyBundle(ix.path, doc, ix.omit); err != nil {
+			return err
+		}
+	}
+	for name, data := range ix.added {
+		if err := writeFile(filepath.Join(doc, filepath.FromSlash(name)), data); err != nil {
+			return err
+		}
+	}
+	var err error
+	if ix.sqlite {
+		err = ix.saveSQL(doc)
+	} else {
+		err = ix.saveZip(doc)
+	}
+	if err != nil {
+		return err
+	}
+	return ix.removeOmitted(doc)
+}
+
+// saveZip writes the records to the Index.zip of doc. It encodes to a temporary file first, so a failed save leaves
+// the original Index.zip alone.
+func (ix *Index) saveZip(doc string) error {
+	f, err := ioutil.TempFile(doc, "Index.zip.tmp")
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(0644)
+	if err == nil {
+		err = NewEncoder(f).Encode(ix)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path.Join(doc, "Index.zip"))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// removeOmitted deletes the files left out with omitFile from doc, which still has them when it's the original
+// document or was saved to before.
+func (ix *Index) removeOmitted(doc string) error {
+	for name := range ix.omit {
+		err := os.Remove(filepath.Join(doc, filepath.FromSlash(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameFile reports whether two paths name the same file or directory.
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
+
+// saveSQL writes the records to the index.db of doc, copying the database of the original document first if doc
+// is a new one. Each record's state is replaced by its encoding, records that were removed are deleted, and new
+// ones get new objects and dataStates rows. Everything happens in one transaction.
+func (ix *Index) saveSQL(doc string) error {
+	fn := path.Join(doc, "index.db")
+	if ix.path != "" && !sameFile(ix.path, doc) {
+		data, err := ioutil.ReadFile(path.Join(ix.path, "index.db"))
+		if err != nil {
+			return err
+		}
+		if err := writeFile(fn, data); err != nil {
+			return err
+		}
+	}
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := ix.writeSQL(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ix *Index) writeSQL(tx *sql.Tx) error {
+	states := make(map[uint64]sql.NullInt64)
+	rows, err := tx.Query("select identifier, state from objects")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id uint64
+		var state sql.NullInt64
+		if err := rows.Scan(&id, &state); err != nil {
+			rows.Close()
+			return err
+		}
+		states[id] = state
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// only delete objects that were loaded and have since been removed, objects without a state never were
+	for id, state := range states {
+		if _, ok := ix.Records[id]; ok || ix.infos[id] == nil {
+			continue
+		}
+		if state.Valid {
+			if _, err := tx.Exec("delete from dataStates where identifier = ?", state.Int64); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("delete from objects where identifier = ?", id); err != nil {
+			return err
+		}
+	}
+
+	var next int64
+	if err := tx.QueryRow("select coalesce(max(identifier), 0) from dataStates").Scan(&next); err != nil {
+		return err
+	}
+	for _, id := range ix.IDs() {
+		ai, payload, err := ix.encodeRecord(id)
+		if err != nil {
+			return err
+		}
+		class := ai.MessageInfos[0].GetType()
+		state, ok := states[id]
+		if ok && state.Valid {
+			if _, err := tx.Exec("delete from dataStates where identifier = ?", state.Int64); err != nil {
+				return err
+			}
+		} else {
+			next++
+			state = sql.NullInt64{Int64: next, Valid: true}
+		}
+		if _, err := tx.Exec("insert into dataStates (identifier, state) values (?, ?)", state.Int64, payload); err != nil {
+			return err
+		}
+		if ok {
+			_, err = tx.Exec("update objects set class = ?, state = ? where identifier = ?", class, state.Int64, id)
+		} else {
+			_, err = tx.Exec("insert into objects (identifier, class, state) values (?, ?, ?)", id, class, state.Int64)
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// copyBundle copies the non-index parts of a document into the package directory dst, leaving out the files in
+// omit. Single file documents are read like openFlatZip does, without a wrapper directory.
+func copyBundle(src, dst string, omit map[string]bool) error {
+	skip := func(name string) bool {
+		return name == "Index.zip" || name == "index.db" || strings.HasPrefix(name, "Index/") ||
+			strings.HasPrefix(name, "__MACOSX/") || omit[name]
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		zf, err := openFlatZip(src)
+		if err != nil {
+			return err
+		}
+		defer zf.Close()
+		for _, f := range zf.File {
+			if skip(f.Name) || strings.HasSuffix(f.Name, "/") {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := writeFile(filepath.Join(dst, filepath.FromSlash(f.Name)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return filepath.Walk(src, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fn)
+		if err != nil || rel == "." || fi.IsDir() || skip(filepath.ToSlash(rel)) {
+			return err
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		return writeFile(filepath.Join(dst, rel), data)
+	})
+}
+
+func writeFile(fn string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, data, 0644)
+}
@@ -0,0 +1,41 @@
+package index
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// TestEncodeMessages saves a record whose archive held a second message that didn't decode.
+func TestEncodeMessages(t *testing.T) {
+	ix := &Index{Type: "pages", Records: make(map[uint64]interface{}), limits: DefaultLimits}
+	a := &iwaArchive{
+		info: TSP.ArchiveInfo{Identifier: proto.Uint64(7), MessageInfos: []*TSP.MessageInfo{
+			{Type: proto.Uint32(2001), Length: proto.Uint32(0)},
+			{Type: proto.Uint32(2001), Length: proto.Uint32(2)},
+		}},
+		payloads: []iwaPayload{
+			{typ: 2001, value: &TSWP.StorageArchive{}},
+			{typ: 2001, data: []byte("ab"), err: errors.New("bad payload")},
+		},
+	}
+	if err := ix.addArchives(DefaultFile, []*iwaArchive{a}); err != nil {
+		t.Fatal(err)
+	}
+	ix.Records[7].(*TSWP.StorageArchive).Text = []string{"edited"}
+	ai, payload, err := ix.encodeRecord(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ai.MessageInfos) != 2 || ai.MessageInfos[1].GetLength() != 2 {
+		t.Fatalf("got message infos %v, want the second one kept", ai.MessageInfos)
+	}
+	first := ai.MessageInfos[0].GetLength()
+	if first != uint32(len(payload)-2) || string(payload[first:]) != "ab" {
+		t.Errorf("payload %q doesn't end with the second message", payload)
+	}
+}
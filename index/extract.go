@@ -0,0 +1,167 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MediaQuota limits what ExtractMedia will write, so a document stuffed with media can't exhaust the disk or the
+// time spent generating a preview. Zero values mean no limit.
+type MediaQuota struct {
+	MaxBytes int64 // total bytes written
+	MaxFiles int   // number of files written
+	// Types lists the allowed media, as extensions (".png"), MIME types ("image/png") or MIME type prefixes
+	// ("image/*"). An empty list allows everything.
+	Types []string
+}
+
+// Reasons a media file was skipped
+const (
+	SkipType    = "type"    // not in MediaQuota.Types
+	SkipCount   = "count"   // MaxFiles reached
+	SkipSize    = "size"    // would exceed MaxBytes
+	SkipMissing = "missing" // not present in the bundle
+	SkipError   = "error"   // failed to read or write
+)
+
+// SkippedMedia is a media file left out by ExtractMedia.
+type SkippedMedia struct {
+	Media
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// MediaExtraction reports the outcome of ExtractMedia.
+type MediaExtraction struct {
+	Extracted []Media        `json:"extracted"`
+	Skipped   []SkippedMedia `json:"skipped,omitempty"`
+	Bytes     int64          `json:"bytes"`
+}
+
+// ExtractMedia writes the document's media files into dir, named after their file names, until the quota runs
+// out. Files that don't fit or can't be read are skipped and listed in the report rather than failing the call,
+// so the result may be partial. An error is only returned if dir can't be created.
+func (ix *Index) ExtractMedia(dir string, quota MediaQuota) (*MediaExtraction, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	rval := &MediaExtraction{}
+	skip := func(m Media, reason string, err error) {
+		s := SkippedMedia{Media: m, Reason: reason}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		rval.Skipped = append(rval.Skipped, s)
+	}
+	names := make(map[string]bool)
+	for _, m := range ix.Media() {
+		switch {
+		case !quota.allows(m.Path):
+			skip(m, SkipType, nil)
+			continue
+		case m.Size < 0:
+			skip(m, SkipMissing, nil)
+			continue
+		case quota.MaxFiles > 0 && len(rval.Extracted) >= quota.MaxFiles:
+			skip(m, SkipCount, nil)
+			continue
+		case quota.MaxBytes > 0 && rval.Bytes+m.Size > quota.MaxBytes:
+			skip(m, SkipSize, nil)
+			continue
+		}
+
+		name := uniqueName(names, path.Base(m.Path))
+		n, err := ix.extractMedia(m, filepath.Join(dir, name), quota.MaxBytes-rval.Bytes, quota.MaxBytes > 0)
+		if err == errQuota {
+			skip(m, SkipSize, nil)
+			continue
+		}
+		if err != nil {
+			skip(m, SkipError, err)
+			continue
+		}
+		names[strings.ToLower(name)] = true
+		rval.Bytes += n
+		rval.Extracted = append(rval.Extracted, m)
+	}
+	return rval, nil
+}
+
+var errQuota = errors.New("media quota exceeded")
+
+// extractMedia copies a media file to fn, giving up with errQuota if it is larger than remaining. The size
+// recorded for encrypted or compressed files isn't the size written, so the limit is enforced while copying.
+func (ix *Index) extractMedia(m Media, fn string, remaining int64, limited bool) (int64, error) {
+	rc, err := ix.OpenMedia(m.ID)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	f, err := os.Create(fn)
+	if err != nil {
+		return 0, err
+	}
+	var r io.Reader = rc
+	if limited {
+		r = io.LimitReader(rc, remaining+1)
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && limited && n > remaining {
+		err = errQuota
+	}
+	if err == nil && limited {
+		// make sure the digest is checked
+		_, err = io.Copy(ioutil.Discard, rc)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fn)
+		return 0, err
+	}
+	return n, nil
+}
+
+// allows reports whether the quota's type filter lets a file through.
+func (q MediaQuota) allows(name string) bool {
+	if len(q.Types) == 0 {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(name))
+	typ, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	for _, t := range q.Types {
+		t = strings.ToLower(t)
+		switch {
+		case strings.HasPrefix(t, "."):
+			if t == ext {
+				return true
+			}
+		case strings.HasSuffix(t, "/*"):
+			if typ != "" && strings.HasPrefix(typ, t[:len(t)-1]) {
+				return true
+			}
+		case t == typ:
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueName adds a number to name if it is already taken. Names are compared case insensitively, for the sake
+// of macOS and Windows file systems.
+func uniqueName(taken map[string]bool, name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; taken[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return name
+}
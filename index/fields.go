@@ -0,0 +1,121 @@
+package index
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Smart field kinds
+const (
+	FieldDate       = "date"
+	FieldPageNumber = "page number"
+	FieldPageCount  = "page count"
+	FieldFilename   = "filename"
+	FieldMerge      = "merge"
+)
+
+// SmartField is a decoded smart field or page number attachment of a run. Text is what the field shows: the text
+// saved for it, or a rendering of the field when none was saved. Page numbers depend on layout, so they show the
+// value saved with the document, or "#". Merge fields are placeholders, Text is their label between « and ».
+// Date is set for date fields that hold one, Key and Label for merge fields.
+type SmartField struct {
+	Kind  string    `json:"kind"`
+	Text  string    `json:"text"`
+	Date  time.Time `json:"date,omitempty"`
+	Key   string    `json:"key,omitempty"`
+	Label string    `json:"label,omitempty"`
+}
+
+// RunField returns the smart field of a run, or nil if it has none. Hyperlinks and other fields that don't change
+// the text aren't reported.
+func (ix *Index) RunField(run Run) *SmartField {
+	if na, ok := run.Attachment.(*TSWP.NumberAttachmentArchive); ok {
+		rval := &SmartField{Kind: FieldPageNumber, Text: na.GetStringValue()}
+		if na.GetSuper().GetKind() == TSWP.TextualAttachmentArchive_kKindPageCount {
+			rval.Kind = FieldPageCount
+		}
+		if rval.Text == "" {
+			rval.Text = "#"
+		}
+		return rval
+	}
+	text := strings.Replace(run.Text, string(AttachmentChar), "", -1)
+	switch f := run.Field.(type) {
+	case *TSWP.DateTimeSmartFieldArchive:
+		rval := &SmartField{Kind: FieldDate, Text: text}
+		if f.Date != nil {
+			rval.Date = appleTime(f.Date.GetSeconds())
+			if rval.Text == "" {
+				rval.Text = rval.Date.Format(dateLayout(f.GetDateStyle(), f.GetTimeStyle()))
+			}
+		}
+		return rval
+	case *TSWP.FilenameSmartFieldArchive:
+		if text == "" && ix.path != "" {
+			text = filepath.Base(ix.path)
+		}
+		return &SmartField{Kind: FieldFilename, Text: text}
+	case *TSWP.MergeSmartFieldArchive:
+		rval := &SmartField{Kind: FieldMerge, Key: f.GetKey(), Label: f.GetLabel()}
+		label := strings.Trim(strings.TrimSpace(text), "«»")
+		if label == "" {
+			label = rval.Label
+		}
+		if label == "" {
+			label = rval.Key
+		}
+		rval.Text = "«" + label + "»"
+		return rval
+	}
+	return nil
+}
+
+// RunText returns the text a run shows: the text of its smart field if it has one, nothing for other attachments,
+// and the run text otherwise.
+func (ix *Index) RunText(run Run) string {
+	if f := ix.RunField(run); f != nil {
+		return f.Text
+	}
+	if run.Attachment != nil {
+		return ""
+	}
+	return run.Text
+}
+
+// ParagraphText is the text of a paragraph as RunText shows it, without the paragraph terminator.
+func (ix *Index) ParagraphText(p Paragraph) string {
+	var sb strings.Builder
+	for _, run := range p.Runs {
+		sb.WriteString(ix.RunText(run))
+	}
+	return strings.TrimRight(sb.String(), "\n\u2029")
+}
+
+// dateLayout approximates the formatter styles of a date field, for fields saved without their text.
+func dateLayout(date, tm TSWP.DateTimeSmartFieldArchive_DateTimeFormatterStyle) string {
+	var parts []string
+	switch date {
+	case TSWP.DateTimeSmartFieldArchive_kDateTimeFormatterStyleShort:
+		parts = append(parts, "1/2/06")
+	case TSWP.DateTimeSmartFieldArchive_kDateTimeFormatterStyleMedium:
+		parts = append(parts, "Jan 2, 2006")
+	case TSWP.DateTimeSmartFieldArchive_kDateTimeFormatterStyleLong:
+		parts = append(parts, "January 2, 2006")
+	case TSWP.DateTimeSmartFieldArchive_kDateTimeFormatterStyleFull:
+		parts = append(parts, "Monday, January 2, 2006")
+	}
+	switch tm {
+	case TSWP.DateTimeSmartFieldArchive_kDateTimeFormatterStyleNone:
+	case TSWP.DateTimeSmartFieldArchive_kDateTimeFormatterStyleShort:
+		parts = append(parts, "3:04 PM")
+	default:
+		parts = append(parts, "3:04:05 PM")
+	}
+	if len(parts) == 0 {
+		return "January 2, 2006"
+	}
+	return strings.Join(parts, " ")
+}
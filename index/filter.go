@@ -0,0 +1,101 @@
+package index
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var (
+	typeNamesMu sync.Mutex
+	typeNames   = map[string]map[uint32]string{}
+)
+
+// typeName returns the name of a record's protobuf message, like "TST.TableModelArchive".
+func typeName(v interface{}) string {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	pkg := t.PkgPath()
+	if i := strings.LastIndex(pkg, "/proto/"); i >= 0 {
+		pkg = pkg[i+len("/proto/"):]
+	}
+	return strings.Replace(pkg, "/", ".", -1) + "." + t.Name()
+}
+
+// typeNamesFor maps the archive type ids of a document type to their message names.
+func typeNamesFor(docType string) map[uint32]string {
+	typeNamesMu.Lock()
+	defer typeNamesMu.Unlock()
+	if m := typeNames[docType]; m != nil {
+		return m
+	}
+	m := make(map[uint32]string)
+	probe := &Index{Type: docType}
+	// Probe the decoders with an empty payload, as typeIDFor does.
+	for typ := uint32(0); typ < 20000; typ++ {
+		if value, _ := probe.decode(typ, nil); value != nil {
+			m[typ] = typeName(value)
+		}
+	}
+	typeNames[docType] = m
+	return m
+}
+
+// TypeName returns the message name archive type id typ decodes to in documents of type docType, like
+// "TST.TableModelArchive", or "" if the type id isn't known.
+func TypeName(docType Type, typ uint32) string {
+	return typeNamesFor(string(docType))[typ]
+}
+
+// TypeID is the reverse of TypeName, returning the archive type id of a message name. A few messages are
+// decoded from more than one type id, for those it's the lowest.
+func TypeID(docType Type, name string) (uint32, bool) {
+	var rval uint32
+	found := false
+	for typ, n := range typeNamesFor(string(docType)) {
+		if n == name && (!found || typ < rval) {
+			rval, found = typ, true
+		}
+	}
+	return rval, found
+}
+
+// matchType reports whether a message name matches a pattern of Options.Types.
+func matchType(name, pattern string) bool {
+	if strings.HasSuffix(pattern, ".*") {
+		return strings.HasPrefix(name, pattern[:len(pattern)-1])
+	}
+	if !strings.Contains(pattern, ".") {
+		return strings.HasPrefix(name, pattern+".")
+	}
+	return name == pattern
+}
+
+// typeFilter returns the type ids of a document type allowed by patterns, or nil to allow everything. The TSP
+// package, with the package metadata, is always allowed.
+func typeFilter(docType string, patterns []string) map[uint32]bool {
+	if len(patterns) == 0 {
+		return nil
+	}
+	rval := make(map[uint32]bool)
+	for typ, name := range typeNamesFor(docType) {
+		if matchType(name, "TSP.*") {
+			rval[typ] = true
+			continue
+		}
+		for _, p := range patterns {
+			if matchType(name, p) {
+				rval[typ] = true
+				break
+			}
+		}
+	}
+	return rval
+}
+
+// wants reports whether records of type typ are decoded.
+func (ix *Index) wants(typ uint32) bool {
+	return ix.types == nil || ix.types[typ]
+}
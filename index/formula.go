@@ -0,0 +1,317 @@
+package index
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TSCE"
+	"github.com/dunhamsteve/iwork/proto/TST"
+)
+
+type astNode = TSCE.ASTNodeArrayArchive_ASTNodeArchive
+
+// operand is a rendered piece of a formula with the precedence of its outermost operator. prefix is the
+// "Sheet::Table::" part of a cross-table reference.
+type operand struct {
+	text   string
+	prec   int
+	prefix string
+}
+
+const precAtom = 100
+
+var binaryOps = map[TSCE.ASTNodeArrayArchive_ASTNodeType]struct {
+	op   string
+	prec int
+}{
+	TSCE.ASTNodeArrayArchive_EQUAL_TO_NODE:                 {"=", 1},
+	TSCE.ASTNodeArrayArchive_NOT_EQUAL_TO_NODE:             {"<>", 1},
+	TSCE.ASTNodeArrayArchive_LESS_THAN_NODE:                {"<", 1},
+	TSCE.ASTNodeArrayArchive_LESS_THAN_OR_EQUAL_TO_NODE:    {"<=", 1},
+	TSCE.ASTNodeArrayArchive_GREATER_THAN_NODE:             {">", 1},
+	TSCE.ASTNodeArrayArchive_GREATER_THAN_OR_EQUAL_TO_NODE: {">=", 1},
+	TSCE.ASTNodeArrayArchive_CONCATENATION_NODE:            {"&", 2},
+	TSCE.ASTNodeArrayArchive_ADDITION_NODE:                 {"+", 3},
+	TSCE.ASTNodeArrayArchive_SUBTRACTION_NODE:              {"-", 3},
+	TSCE.ASTNodeArrayArchive_MULTIPLICATION_NODE:           {"*", 4},
+	TSCE.ASTNodeArrayArchive_DIVISION_NODE:                 {"/", 4},
+	TSCE.ASTNodeArrayArchive_POWER_NODE:                    {"^", 6},
+	TSCE.ASTNodeArrayArchive_COLON_NODE:                    {":", 8},
+}
+
+// formulaText reconstructs the text of a formula, in the usual spreadsheet notation, for the cell at row, col. The
+// nodes are stored in postfix order, so they are rendered with a stack. table gives the "Sheet::Table::" prefix of
+// references to other tables, and may be nil.
+func formulaText(f *TSCE.FormulaArchive, row, col int, table func(*TSCE.CFUUIDArchive) string) string {
+	return "=" + renderNodes(f.GetASTNodeArray().GetASTNode(), row, col, table)
+}
+
+func renderNodes(nodes []*astNode, row, col int, table func(*TSCE.CFUUIDArchive) string) string {
+	var stack []operand
+	pop := func() operand {
+		if len(stack) == 0 {
+			return operand{"", precAtom, ""}
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	// counts come from the file, so never take more than the stack holds
+	popN := func(n int) []string {
+		if n < 0 || n > len(stack) {
+			n = len(stack)
+		}
+		args := make([]string, n)
+		for i := n - 1; i >= 0; i-- {
+			args[i] = pop().text
+		}
+		return args
+	}
+	push := func(text string, prec int) {
+		stack = append(stack, operand{text, prec, ""})
+	}
+	pushRef := func(id *TSCE.CFUUIDArchive, address string) {
+		var prefix string
+		if id != nil && table != nil {
+			prefix = table(id)
+		}
+		stack = append(stack, operand{prefix + address, precAtom, prefix})
+	}
+
+	for _, node := range nodes {
+		typ := node.GetASTNodeType()
+		if bin, ok := binaryOps[typ]; ok {
+			b, a := pop(), pop()
+			// Numbers writes a range in another table as Table::A1:B2
+			if typ == TSCE.ASTNodeArrayArchive_COLON_NODE && a.prefix != "" && a.prefix == b.prefix {
+				b.text = strings.TrimPrefix(b.text, b.prefix)
+			}
+			push(paren(a, bin.prec, false)+bin.op+paren(b, bin.prec, true), bin.prec)
+			continue
+		}
+		switch typ {
+		case TSCE.ASTNodeArrayArchive_NEGATION_NODE:
+			push("-"+paren(pop(), 5, false), 5)
+		case TSCE.ASTNodeArrayArchive_PLUS_SIGN_NODE:
+			push("+"+paren(pop(), 5, false), 5)
+		case TSCE.ASTNodeArrayArchive_PERCENT_NODE:
+			push(paren(pop(), 7, false)+"%", 7)
+		case TSCE.ASTNodeArrayArchive_FUNCTION_NODE:
+			args := popN(int(node.GetASTFunctionNodeNumArgs()))
+			push(functionName(node.GetASTFunctionNodeIndex())+"("+strings.Join(args, ",")+")", precAtom)
+		case TSCE.ASTNodeArrayArchive_UNKNOWN_FUNCTION_NODE:
+			args := popN(int(node.GetASTUnknownFunctionNodeNumArgs()))
+			push(node.GetASTUnknownFunctionNodeString()+"("+strings.Join(args, ",")+")", precAtom)
+		case TSCE.ASTNodeArrayArchive_NUMBER_NODE:
+			push(strconv.FormatFloat(node.GetASTNumberNodeNumber(), 'f', -1, 64), precAtom)
+		case TSCE.ASTNodeArrayArchive_BOOLEAN_NODE:
+			push(strings.ToUpper(strconv.FormatBool(node.GetASTBooleanNodeBoolean())), precAtom)
+		case TSCE.ASTNodeArrayArchive_TOKEN_NODE:
+			push(strings.ToUpper(strconv.FormatBool(node.GetASTTokenNodeBoolean())), precAtom)
+		case TSCE.ASTNodeArrayArchive_STRING_NODE:
+			push(`"`+strings.Replace(node.GetASTStringNodeString(), `"`, `""`, -1)+`"`, precAtom)
+		case TSCE.ASTNodeArrayArchive_DATE_NODE:
+			push(appleTime(node.GetASTDateNodeDateNum()).Format("1/2/2006"), precAtom)
+		case TSCE.ASTNodeArrayArchive_DURATION_NODE:
+			push(strconv.FormatFloat(node.GetASTDurationNodeUnitNum(), 'f', -1, 64), precAtom)
+		case TSCE.ASTNodeArrayArchive_EMPTY_ARGUMENT_NODE:
+			push("", precAtom)
+		case TSCE.ASTNodeArrayArchive_ARRAY_NODE:
+			cols, rows := int(node.GetASTArrayNodeNumCol()), int(node.GetASTArrayNodeNumRow())
+			if cols <= 0 || rows <= 0 || cols > len(stack) || rows > len(stack)/cols {
+				push("#ARRAY!", precAtom)
+				continue
+			}
+			args := popN(cols * rows)
+			var lines []string
+			for r := 0; r < rows; r++ {
+				lines = append(lines, strings.Join(args[r*cols:(r+1)*cols], ","))
+			}
+			push("{"+strings.Join(lines, ";")+"}", precAtom)
+		case TSCE.ASTNodeArrayArchive_LIST_NODE:
+			push("("+strings.Join(popN(int(node.GetASTListNodeNumArgs())), ",")+")", precAtom)
+		case TSCE.ASTNodeArrayArchive_THUNK_NODE:
+			push(renderNodes(node.GetASTThunkNodeArray().GetASTNode(), row, col, table), precAtom)
+		case TSCE.ASTNodeArrayArchive_LOCAL_CELL_REFERENCE_NODE:
+			ref := node.GetASTLocalCellReferenceNodeReference()
+			push(cellAddress(
+				coordinate(row, int32(ref.GetRowHandle()), ref.GetRowIsSticky() != 0),
+				coordinate(col, int32(ref.GetColumnHandle()), ref.GetColumnIsSticky() != 0),
+				ref.GetRowIsSticky() != 0, ref.GetColumnIsSticky() != 0), precAtom)
+		case TSCE.ASTNodeArrayArchive_CROSS_TABLE_CELL_REFERENCE_NODE:
+			ref := node.GetASTCrossTableCellReferenceNodeReference()
+			pushRef(ref.GetTableId(), cellAddress(
+				coordinate(row, int32(ref.GetRowHandle()), ref.GetRowIsSticky() != 0),
+				coordinate(col, int32(ref.GetColumnHandle()), ref.GetColumnIsSticky() != 0),
+				ref.GetRowIsSticky() != 0, ref.GetColumnIsSticky() != 0))
+		case TSCE.ASTNodeArrayArchive_CELL_REFERENCE_NODE:
+			r, c := node.GetASTRow(), node.GetASTColumn()
+			pushRef(node.GetASTCrossTableReferenceExtraInfo().GetTableId(), cellAddress(
+				coordinate(row, r.GetRow(), r.GetAbsolute()),
+				coordinate(col, c.GetColumn(), c.GetAbsolute()),
+				r.GetAbsolute(), c.GetAbsolute()))
+		case TSCE.ASTNodeArrayArchive_REFERENCE_ERROR_NODE:
+			push("#REF!", precAtom)
+		case TSCE.ASTNodeArrayArchive_APPEND_WHITESPACE_NODE:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += node.GetASTWhitespace()
+			}
+		case TSCE.ASTNodeArrayArchive_PREPEND_WHITESPACE_NODE:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text = node.GetASTWhitespace() + stack[len(stack)-1].text
+			}
+		case TSCE.ASTNodeArrayArchive_BEGIN_THUNK_NODE, TSCE.ASTNodeArrayArchive_END_THUNK_NODE:
+		default:
+			push(fmt.Sprintf("#%v", typ), precAtom)
+		}
+	}
+
+	var parts []string
+	for _, v := range stack {
+		parts = append(parts, v.text)
+	}
+	return strings.Join(parts, ",")
+}
+
+// paren wraps an operand in parentheses if it binds less tightly than the operator it is used with. The right hand
+// side also needs them at equal precedence, since operators are left associative.
+func paren(v operand, prec int, right bool) string {
+	if v.prec < prec || (right && v.prec == prec) {
+		return "(" + v.text + ")"
+	}
+	return v.text
+}
+
+// coordinate resolves a row or column reference, which is relative to the formula's cell unless absolute.
+func coordinate(host int, v int32, absolute bool) int {
+	if absolute {
+		return int(v)
+	}
+	return host + int(v)
+}
+
+// cellAddress formats a zero based row and column in A1 notation.
+func cellAddress(row, col int, rowAbs, colAbs bool) string {
+	if row < 0 || col < 0 {
+		return "#REF!"
+	}
+	name := ""
+	for c := col + 1; c > 0; c = (c - 1) / 26 {
+		name = string(rune('A'+(c-1)%26)) + name
+	}
+	if colAbs {
+		name = "$" + name
+	}
+	if rowAbs {
+		name += "$"
+	}
+	return name + strconv.Itoa(row+1)
+}
+
+// uuidKey normalizes a table identifier for comparison. Formulas store it as a CFUUIDArchive, either as bytes or
+// as four words, most significant last; table models as a string.
+func uuidKey(id *TSCE.CFUUIDArchive) string {
+	b := id.GetUuidBytes()
+	if len(b) != 16 {
+		b = make([]byte, 16)
+		for i, w := range []uint32{id.GetUuidW3(), id.GetUuidW2(), id.GetUuidW1(), id.GetUuidW0()} {
+			binary.BigEndian.PutUint32(b[i*4:], w)
+		}
+	}
+	return hex.EncodeToString(b)
+}
+
+func tableKey(id string) string {
+	return strings.ToLower(strings.Replace(id, "-", "", -1))
+}
+
+// tableLocation is the name of a table and of the sheet it is on, if any.
+type tableLocation struct {
+	table, sheet string
+}
+
+// tableLocations maps the identifiers of the tables in the document, as tableKey returns them, to their names and
+// sheets.
+func (ix *Index) tableLocations() map[string]tableLocation {
+	return ix.Memo(0, "tables", func() interface{} {
+		rval := make(map[string]tableLocation)
+		for _, v := range ix.Records {
+			if tm, ok := v.(*TST.TableModelArchive); ok {
+				rval[tableKey(tm.GetTableId())] = tableLocation{table: tm.GetTableName()}
+			}
+		}
+		for _, v := range ix.Records {
+			sheet, ok := v.(*TN.SheetArchive)
+			if !ok {
+				continue
+			}
+			for _, ref := range sheet.DrawableInfos {
+				if ti, ok := ix.Deref(ref).(*TST.TableInfoArchive); ok {
+					if tm, ok := ix.Deref(ti.TableModel).(*TST.TableModelArchive); ok {
+						rval[tableKey(tm.GetTableId())] = tableLocation{tm.GetTableName(), sheet.GetName()}
+					}
+				}
+			}
+		}
+		return rval
+	}).(map[string]tableLocation)
+}
+
+// crossTable returns the function formulaText uses to name the tables referenced from formulas in host. Tables on
+// the same sheet are named by table, others by sheet and table, as Numbers shows them. A table that can't be found
+// is named by its identifier.
+func (ix *Index) crossTable(host *TST.TableModelArchive) func(*TSCE.CFUUIDArchive) string {
+	return func(id *TSCE.CFUUIDArchive) string {
+		key := uuidKey(id)
+		if key == tableKey(host.GetTableId()) {
+			return ""
+		}
+		locations := ix.tableLocations()
+		loc, ok := locations[key]
+		if !ok {
+			return key + "::"
+		}
+		if here := locations[tableKey(host.GetTableId())]; loc.sheet != "" && loc.sheet != here.sheet {
+			return loc.sheet + "::" + loc.table + "::"
+		}
+		return loc.table + "::"
+	}
+}
+
+func functionName(index uint32) string {
+	if name, ok := functionNames[index]; ok {
+		return name
+	}
+	return fmt.Sprintf("FUNCTION%d", index)
+}
+
+// functionNames maps the function index used in FUNCTION_NODE to the function name.
+var functionNames = map[uint32]string{
+	1: "ABS", 2: "ACCRINT", 3: "ACCRINTM", 4: "ACOS", 5: "ACOSH", 6: "ADDRESS", 7: "AND", 8: "AREAS",
+	9: "ASIN", 10: "ASINH", 11: "ATAN", 12: "ATAN2", 13: "ATANH", 14: "AVEDEV", 15: "AVERAGE", 16: "AVERAGEA",
+	17: "CEILING", 18: "CHAR", 19: "CHOOSE", 20: "CLEAN", 21: "CODE", 22: "COLUMN", 23: "COLUMNS", 24: "COMBIN",
+	25: "CONCATENATE", 26: "CONFIDENCE", 27: "CORREL", 28: "COS", 29: "COSH", 30: "COUNT", 31: "COUNTA",
+	32: "COUNTBLANK", 33: "COUNTIF", 34: "COUPDAYBS", 35: "COUPDAYS", 36: "COUPDAYSNC", 37: "COUPNUM", 38: "COVAR",
+	39: "DATE", 40: "DATEDIF", 41: "DAY", 42: "DB", 43: "DDB", 44: "DEGREES", 45: "DISC", 46: "DOLLAR",
+	47: "EDATE", 48: "EVEN", 49: "EXACT", 50: "EXP", 51: "FACT", 52: "FALSE", 53: "FIND", 54: "FIXED",
+	55: "FLOOR", 56: "FORECAST", 57: "FREQUENCY", 58: "GCD", 59: "HLOOKUP", 60: "HOUR", 61: "HYPERLINK", 62: "IF",
+	63: "INDEX", 64: "INDIRECT", 65: "INT", 66: "INTERCEPT", 67: "IPMT", 68: "IRR", 69: "ISBLANK", 70: "ISERROR",
+	71: "ISEVEN", 72: "ISODD", 73: "ISPMT", 74: "LARGE", 75: "LCM", 76: "LEFT", 77: "LEN", 78: "LN",
+	79: "LOG", 80: "LOG10", 81: "LOOKUP", 82: "LOWER", 83: "MATCH", 84: "MAX", 85: "MAXA", 86: "MEDIAN",
+	87: "MID", 88: "MIN", 89: "MINA", 90: "MINUTE", 91: "MIRR", 92: "MOD", 93: "MODE", 94: "MONTH",
+	95: "MROUND", 96: "NOT", 97: "NOW", 98: "NPER", 99: "NPV", 100: "OFFSET", 101: "ODD", 102: "OR",
+	103: "PERCENTILE", 104: "PI", 105: "PMT", 106: "POISSON", 107: "POWER", 108: "PPMT", 109: "PRICE",
+	110: "PRICEDISC", 111: "PRICEMAT", 112: "PROB", 113: "PRODUCT", 114: "PROPER", 115: "PV", 116: "QUOTIENT",
+	117: "RADIANS", 118: "RAND", 119: "RANDBETWEEN", 120: "RANK", 121: "RATE", 122: "REPLACE", 123: "REPT",
+	124: "RIGHT", 125: "ROMAN", 126: "ROUND", 127: "ROUNDDOWN", 128: "ROUNDUP", 129: "ROW", 130: "ROWS",
+	131: "SEARCH", 132: "SECOND", 133: "SIGN", 134: "SIN", 135: "SINH", 136: "SLN", 137: "SLOPE", 138: "SMALL",
+	139: "SQRT", 140: "STDEV", 141: "STDEVA", 142: "STDEVP", 143: "STDEVPA", 144: "SUBSTITUTE", 145: "SUMIF",
+	146: "SUMPRODUCT", 147: "SUMSQ", 148: "SYD", 149: "T", 150: "TAN", 151: "TANH", 152: "TIME",
+	153: "TIMEVALUE", 154: "TODAY", 155: "TRIM", 156: "TRUE", 157: "TRUNC", 158: "UPPER", 159: "VALUE",
+	160: "VAR", 161: "VARA", 162: "VARP", 163: "VARPA", 164: "VDB", 165: "VLOOKUP", 166: "WEEKDAY", 167: "YEAR",
+	168: "SUM",
+}
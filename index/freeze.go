@@ -0,0 +1,35 @@
+package index
+
+import "errors"
+
+// ErrFrozen is returned by the editing methods of an Index after Freeze.
+var ErrFrozen = errors.New("document is frozen")
+
+// Freeze loads the rest of a lazily opened document and makes the Index read only: the editing methods, including
+// RemovePreviews and SetFile, fail with ErrFrozen from then on. A frozen Index doesn't change, so any number of
+// goroutines can read it at once, which lets a server open a document once and share it across requests. Callers must
+// still leave Records and the records in it alone, and a Cache installed with SetCache is safe for concurrent use.
+func (ix *Index) Freeze() error {
+	if err := ix.LoadAll(); err != nil {
+		return err
+	}
+	ix.frozen = true
+	return nil
+}
+
+// Frozen reports whether Freeze was called.
+func (ix *Index) Frozen() bool {
+	return ix.frozen
+}
+
+// writable returns the error an editing method fails with, or nil. Lazily opened documents have to be loaded in
+// full before they're changed.
+func (ix *Index) writable() error {
+	if ix.frozen {
+		return ErrFrozen
+	}
+	if ix.lazy {
+		return ErrPartial
+	}
+	return nil
+}
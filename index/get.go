@@ -0,0 +1,35 @@
+package index
+
+import (
+	"sort"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+)
+
+// Get returns the record with identifier id if it is a T, e.g. index.Get[*TP.DocumentArchive](ix, 1).
+func Get[T any](ix *Index, id uint64) (T, bool) {
+	v, ok := ix.Records[id].(T)
+	return v, ok
+}
+
+// DerefAs returns the record ref points to if it is a T.
+func DerefAs[T any](ix *Index, ref *TSP.Reference) (T, bool) {
+	v, ok := ix.Deref(ref).(T)
+	return v, ok
+}
+
+// FindAll returns every record that is a T, ordered by identifier.
+func FindAll[T any](ix *Index) []T {
+	var ids []uint64
+	for id, v := range ix.Records {
+		if _, ok := v.(T); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	rval := make([]T, len(ids))
+	for i, id := range ids {
+		rval[i] = ix.Records[id].(T)
+	}
+	return rval
+}
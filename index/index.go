@@ -2,7 +2,9 @@ package index
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/binary"
 	"errors"
@@ -11,82 +13,309 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/dunhamsteve/iwork/proto/TSP"
 
 	"github.com/golang/protobuf/proto"
-	"github.com/golang/snappy"
 
 	// register sqlite3 driver
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// Index holds the content of an iwork file
+// Index holds the content of an iwork file.
+//
+// Reading an Index from several goroutines is safe once nothing changes it. The editing methods, and the loading
+// a lazily opened document does as it's read, are not: use Freeze to share an Index between goroutines.
 type Index struct {
 	Type    string                 `json:"type"`
 	Records map[uint64]interface{} `json:"records"`
+
+	// Template is set for templates and Keynote themes, which are otherwise read like documents of their Type.
+	Template bool `json:"template,omitempty"`
+
+	path   string
+	crypt  *decrypter
+	infos  map[uint64]*recordInfo
+	sqlite bool // loaded from an index.db, which Save writes back
+
+	// lazily opened documents load .iwa files as they are needed
+	lazy   bool
+	loaded map[string]bool
+	frozen bool // set by Freeze
+
+	limits  Limits
+	onError func(*DecodeError)
+	strict  ParseStrictness
+	workers int
+	types   map[uint32]bool // decoded types, nil for all of them
+	cache   *Cache
+
+	progress func(Progress)
+	loading  Progress // reported to progress
+
+	omit  map[string]bool   // bundle files Save leaves out
+	added map[string][]byte // bundle files Save adds, like media imported from another document
+
+	// decode problems seen while loading, keyed by type id
+	unknown map[uint32]int
+	failed  map[uint32]int
+}
+
+// ErrNoContent is returned when a bundle has no object archives at all, such as an Index.zip with no .iwa
+// files. Open returns a *NoContentError, which matches ErrNoContent with errors.Is.
+var ErrNoContent = errors.New("document has no content")
+
+// ErrNotIWork is returned for files and directories that aren't iWork documents, or whose content doesn't tell
+// which application wrote them.
+var ErrNotIWork = errors.New("not an iWork document")
+
+// ErrUnsupportedVersion matches the errors of documents in a format this package doesn't read: ErrLegacyFormat,
+// *UnsupportedVersionError, and encryption schemes other than the one iWork uses today.
+var ErrUnsupportedVersion = errors.New("unsupported document format version")
+
+// ErrLegacyFormat is returned for iWork '08 and '09 documents, which store their content as XML. The iwork09
+// package reads those. It matches ErrUnsupportedVersion with errors.Is.
+var ErrLegacyFormat error = &kindError{"iWork '09 XML document", ErrUnsupportedVersion}
+
+// kindError is a sentinel error that also matches a broader one with errors.Is, like ErrWrongPassword and
+// ErrEncrypted.
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
 }
 
-// Open loads a document into an Index structure
+// Is makes errors.Is(err, e.kind) true.
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// NoContentError reports an empty or stripped document, along with the files still present in the bundle.
+type NoContentError struct {
+	Path  string
+	Files []string
+}
+
+func (e *NoContentError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, ErrNoContent)
+}
+
+// Is makes errors.Is(err, ErrNoContent) true for a NoContentError.
+func (e *NoContentError) Is(target error) bool {
+	return target == ErrNoContent
+}
+
+// Open loads a document into an Index structure. Encrypted documents fail with ErrPasswordRequired, use
+// OpenWithPassword for those.
 func Open(doc string) (*Index, error) {
-	fn := path.Join(doc, "Index.zip")
-	zf, err := zip.OpenReader(fn)
+	return OpenWithPassword(doc, "")
+}
+
+// OpenWithPassword loads a possibly encrypted document into an Index structure. The password is ignored for
+// documents that aren't encrypted, and ErrWrongPassword is returned if it doesn't match.
+func OpenWithPassword(doc, password string) (*Index, error) {
+	return open(context.Background(), doc, Options{Password: password})
+}
+
+// OpenContext is OpenWithPassword with cancellation. Loading stops with ctx.Err() once ctx is done, which lets
+// servers put a deadline on enormous or adversarial documents.
+func OpenContext(ctx context.Context, doc, password string) (*Index, error) {
+	return open(ctx, doc, Options{Password: password})
+}
+
+// openZip opens the zip holding the .iwa files of a package document, or the single file document itself, and
+// returns the password verifier if the document is encrypted. It fails with a *LayoutError if doc is neither,
+// see openSQL for the other layouts.
+func openZip(doc string) (*zip.ReadCloser, []byte, error) {
+	fi, err := os.Stat(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		zf, err := zip.OpenReader(path.Join(doc, "Index.zip"))
+		if err != nil {
+			return nil, nil, &LayoutError{doc, []LayoutAttempt{{LayoutPackage, missingFile(err, "Index.zip")}}}
+		}
+		verifier, _ := ioutil.ReadFile(path.Join(doc, passwordVerifierName))
+		return zf, verifier, nil
+	}
+	// iWork 5.5
+	zf, err := openFlatZip(doc)
+	if err != nil {
+		return nil, nil, &LayoutError{doc, []LayoutAttempt{{LayoutFile, err}}}
+	}
+	verifier, _ := readZipFile(&zf.Reader, passwordVerifierName)
+	return zf, verifier, nil
+}
+
+// openFlatZip opens a single file document. Some of these, like files downloaded from iCloud, wrap the package in
+// a top level directory ("Name.pages/Index/Document.iwa"); the directory is stripped from the entry names so they
+// read like the usual layout.
+func openFlatZip(doc string) (*zip.ReadCloser, error) {
+	zf, err := zip.OpenReader(doc)
 	if err != nil {
-		// iWork 5.5
-		zf, err = zip.OpenReader(doc)
+		return nil, err
+	}
+	var prefix string
+	for _, f := range zf.File {
+		if strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		slash := strings.Index(f.Name, "/")
+		if slash < 0 {
+			return zf, nil
+		}
+		if prefix == "" {
+			prefix = f.Name[:slash+1]
+		} else if !strings.HasPrefix(f.Name, prefix) {
+			return zf, nil
+		}
 	}
+	switch prefix {
+	case "", "Index/", "Data/", "Metadata/":
+		return zf, nil
+	}
+	files := zf.File[:0]
+	for _, f := range zf.File {
+		if strings.HasPrefix(f.Name, prefix) && f.Name != prefix {
+			f.Name = f.Name[len(prefix):]
+			files = append(files, f)
+		}
+	}
+	zf.File = files
+	return zf, nil
+}
+
+func open(ctx context.Context, doc string, opts Options) (*Index, error) {
+	limits := opts.Limits.withDefaults()
+	if !opts.Type.valid() {
+		return nil, fmt.Errorf("unknown document type %q", opts.Type)
+	}
+	zf, verifier, err := openZip(doc)
 	if err == nil {
 		defer zf.Close()
-		// Detect type from content
-		indexType, err := detectTypeFromZip(&zf.Reader)
+		crypt, err := newDecrypter(verifier, opts.Password)
 		if err != nil {
-			return nil, fmt.Errorf("failed to detect file type: %w", err)
+			return nil, err
+		}
+		indexType := string(opts.Type)
+		if indexType == "" {
+			indexType, err = detectZip(doc, &zf.Reader, crypt, limits)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ix := &Index{Type: indexType, Template: IsTemplate(doc), path: doc, crypt: crypt, lazy: opts.Lazy,
+			limits: limits, onError: opts.ErrorHandler, strict: opts.Strictness, workers: opts.Workers,
+			types: typeFilter(indexType, opts.Types), progress: opts.Progress}
+		var want func(string) bool
+		if opts.Lazy {
+			want = func(name string) bool { return rootFiles[name] }
+		}
+		err = ix.loadZip(ctx, &zf.Reader, want)
+		if verr := ix.checkVersion(); verr != nil {
+			return nil, verr
 		}
-		ix := &Index{indexType, nil}
-		err = ix.loadZip(zf)
 		return ix, err
 	}
 
 	// .pages-tef files, sqlite
-	fn = path.Join(doc, "index.db")
-	_, err = os.Stat(fn)
-	if err == nil {
-		db, err := sql.Open("sqlite3", fn)
-		if err == nil {
-			defer db.Close()
-			indexType, err := detectTypeFromSQL(db)
+	db, err := openSQL(doc, err)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	indexType := string(opts.Type)
+	if indexType == "" {
+		indexType, err = detectSQL(doc, db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ix := &Index{Type: indexType, Template: IsTemplate(doc), path: doc, limits: limits, onError: opts.ErrorHandler, strict: opts.Strictness,
+		workers: opts.Workers, types: typeFilter(indexType, opts.Types), progress: opts.Progress}
+	err = ix.loadSQL(ctx, db)
+	if verr := ix.checkVersion(); verr != nil {
+		return nil, verr
+	}
+	return ix, err
+}
+
+func zipHasFile(zr *zip.Reader, name string) bool {
+	for _, f := range zr.File {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readZipFile returns the contents of the named zip member, or nil if it isn't present.
+func readZipFile(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if f.Name == name {
+			rc, err := f.Open()
 			if err != nil {
-				return nil, fmt.Errorf("failed to detect file type: %w", err)
+				return nil, err
 			}
-			ix := &Index{indexType, nil}
-			err = ix.loadSQL(db)
-			return ix, err
+			defer rc.Close()
+			return ioutil.ReadAll(rc)
 		}
 	}
+	return nil, nil
+}
 
-	return nil, err
+// bundleFiles lists the files of a document bundle, or the members of a single file document when zr is the
+// document itself. Index.zip members are listed under "Index.zip/".
+func bundleFiles(doc string, zr *zip.Reader) []string {
+	var rval []string
+	if fi, err := os.Stat(doc); err == nil && !fi.IsDir() {
+		for _, f := range zr.File {
+			rval = append(rval, f.Name)
+		}
+		return rval
+	}
+	filepath.Walk(doc, func(fn string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			rel, _ := filepath.Rel(doc, fn)
+			rval = append(rval, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if zr != nil {
+		for _, f := range zr.File {
+			rval = append(rval, "Index.zip/"+f.Name)
+		}
+	}
+	return rval
 }
 
-// detectTypeFromZip probes the zip contents to determine the iWork document type
-func detectTypeFromZip(zr *zip.Reader) (string, error) {
+// detectTypeFromZip probes the zip contents to determine the iWork document type. It returns ErrNoContent if
+// there are no .iwa files.
+func detectTypeFromZip(zr *zip.Reader, crypt *decrypter, limits Limits) (string, error) {
 	typeIDs := make(map[uint32]bool)
 
 	// Find and parse the first .iwa file to collect type IDs
+	found := false
 	for _, f := range zr.File {
 		if strings.HasSuffix(f.Name, ".iwa") {
-			rc, err := f.Open()
-			if err != nil {
-				continue
-			}
-			data, err := ioutil.ReadAll(rc)
-			rc.Close()
+			found = true
+			r, closer, err := openIWAStream(f, crypt, limits)
 			if err != nil {
 				continue
 			}
 
 			// Collect type IDs from this .iwa file
-			ids, err := extractTypeIDs(data)
+			ids, err := scanTypeIDs(r, limits)
+			closer.Close()
+			if errors.Is(err, ErrLimit) {
+				return "", fmt.Errorf("%s: %w", f.Name, err)
+			}
 			if err != nil {
 				continue
 			}
@@ -105,8 +334,30 @@ func detectTypeFromZip(zr *zip.Reader) (string, error) {
 	if docType := determineTypeFromIDs(typeIDs); docType != "" {
 		return docType, nil
 	}
+	if !found {
+		return "", ErrNoContent
+	}
 
-	return "", errors.New("unable to determine document type from content")
+	return "", errUnknownType
+}
+
+var errUnknownType error = &kindError{"unable to determine document type from content", ErrNotIWork}
+
+// extensionType returns the document type implied by the file extension, or "".
+func extensionType(doc string) string {
+	ext := strings.ToLower(path.Ext(strings.TrimSuffix(doc, "/")))
+	if t, ok := templateTypes[ext]; ok {
+		return string(t)
+	}
+	switch ext {
+	case ".pages":
+		return "pages"
+	case ".numbers":
+		return "numbers"
+	case ".key":
+		return "key"
+	}
+	return ""
 }
 
 // detectTypeFromSQL probes the SQLite database to determine the iWork document type
@@ -127,49 +378,47 @@ func detectTypeFromSQL(db *sql.DB) (string, error) {
 		}
 		typeIDs[class] = true
 	}
+	if len(typeIDs) == 0 {
+		return "", ErrNoContent
+	}
 
 	if docType := determineTypeFromIDs(typeIDs); docType != "" {
 		return docType, nil
 	}
 
-	return "", errors.New("unable to determine document type from content")
+	return "", errUnknownType
 }
 
-// extractTypeIDs extracts protobuf type IDs from an .iwa file without fully decoding
-func extractTypeIDs(data []byte) ([]uint32, error) {
-	data, err := unsnap(data)
-	if err != nil {
-		return nil, err
-	}
-
+// scanTypeIDs reads the type ids of an .iwa stream from the archive headers, skipping the payloads undecoded.
+func scanTypeIDs(r io.Reader, limits Limits) ([]uint32, error) {
+	cr := newChunkReader(r, limits)
+	defer cr.release()
+	br := bufio.NewReader(cr)
 	var ids []uint32
-	r := bytes.NewBuffer(data)
 	for {
-		l, err := binary.ReadUvarint(r)
+		l, err := binary.ReadUvarint(br)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return ids, err
 		}
-
-		chunk := make([]byte, l)
-		_, err = r.Read(chunk)
-		if err != nil {
-			return ids, err
+		if l > uint64(limits.MaxChunkSize) {
+			return ids, fmt.Errorf("archive header of %d bytes: %w", l, ErrLimit)
+		}
+		header := make([]byte, l)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return ids, unexpected(err)
 		}
-
 		var ai TSP.ArchiveInfo
-		err = proto.Unmarshal(chunk, &ai)
-		if err != nil {
+		if err := proto.Unmarshal(header, &ai); err != nil {
 			return ids, err
 		}
-
 		for _, info := range ai.MessageInfos {
-			ids = append(ids, *info.Type)
-			// Skip the payload
-			payload := make([]byte, *info.Length)
-			r.Read(payload)
+			ids = append(ids, info.GetType())
+			if _, err := br.Discard(int(info.GetLength())); err != nil {
+				return ids, unexpected(err)
+			}
 		}
 	}
 	return ids, nil
@@ -209,133 +458,441 @@ func determineTypeFromIDs(typeIDs map[uint32]bool) string {
 	return ""
 }
 
-func (ix *Index) loadSQL(db *sql.DB) error {
+// loadSQL loads the records of an index.db.
+func (ix *Index) loadSQL(ctx context.Context, db *sql.DB) error {
 	ix.Records = make(map[uint64]interface{})
-	stmt := `select o.identifier, o.class, ds.state from objects o join dataStates ds on o.state = ds.identifier`
-	rows, err := db.Query(stmt)
+	ix.sqlite = true
+	if ix.progress != nil {
+		if err := db.QueryRowContext(ctx, "select count(*) from objects").Scan(&ix.loading.TotalRecords); err != nil {
+			return err
+		}
+	}
+	return sqlStates(ctx, db, ix.limits, func(id uint64, class uint32, data []byte) error {
+		if len(ix.infos) >= ix.limits.MaxRecords {
+			return fmt.Errorf("more than %d records: %w", ix.limits.MaxRecords, ErrLimit)
+		}
+		if err := ix.decodePayload(id, class, data); err != nil {
+			return err
+		}
+		ix.addRaw(id, class, data)
+
+		length := uint32(len(data))
+		ai := &TSP.ArchiveInfo{
+			Identifier:   &id,
+			MessageInfos: []*TSP.MessageInfo{{Type: &class, Length: &length}},
+		}
+		ix.noteArchive("", ai)
+		ix.loading.Records++
+		ix.reportProgress()
+		return nil
+	})
+}
+
+// sqlStates calls fn with the state of each object of an index.db, in identifier order. A state may be split over
+// several dataStates rows with the same identifier, which are joined in row order, and may be snappy framed like an
+// .iwa file. Objects whose state is missing or NULL are skipped.
+func sqlStates(ctx context.Context, db *sql.DB, limits Limits, fn func(id uint64, class uint32, data []byte) error) error {
+	stmt := `select o.identifier, o.class, ds.state from objects o left join dataStates ds on o.state = ds.identifier
+		order by o.identifier, ds.rowid`
+	rows, err := db.QueryContext(ctx, stmt)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
+
+	var cur uint64
+	var curClass uint32
+	var state []byte
+	flush := func() error {
+		if state == nil {
+			return nil
+		}
+		data, err := sqlState(state, limits)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", cur, err)
+		}
+		return fn(cur, curClass, data)
+	}
 	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		var id uint64
 		var class uint32
 		var data []byte
-		err = rows.Scan(&id, &class, &data)
-		if err != nil {
+		if err := rows.Scan(&id, &class, &data); err != nil {
+			return err
+		}
+		if id != cur || state == nil {
+			if err := flush(); err != nil {
+				return err
+			}
+			cur, curClass, state = id, class, nil
+		}
+		if data != nil {
+			if state == nil {
+				state = []byte{}
+			}
+			state = append(state, data...)
+		}
+		if int64(len(state)) > limits.MaxChunkSize {
+			return fmt.Errorf("record %d of %d bytes: %w", id, len(state), ErrLimit)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// sqlState returns the payload of an index.db state, decompressing it if it's snappy framed. A protobuf message
+// can't start with a zero byte, so one that does is taken to be a chunk header.
+func sqlState(data []byte, limits Limits) ([]byte, error) {
+	if len(data) == 0 || data[0] != 0 {
+		return data, nil
+	}
+	return unsnap(data, limits)
+}
+
+// loadZip loads the .iwa files of an Index.zip that want accepts, or all of them if want is nil. Files that are
+// already loaded are skipped, a file is only marked loaded once all of it has been read. With more than one worker
+// the files are read and decoded concurrently, and added to the Index in zip order.
+func (ix *Index) loadZip(ctx context.Context, zr *zip.Reader, want func(name string) bool) error {
+	if ix.Records == nil {
+		ix.Records = make(map[uint64]interface{})
+	}
+	if ix.loaded == nil {
+		ix.loaded = make(map[string]bool)
+	}
+	var files []*zip.File
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, ".iwa") && !ix.loaded[f.Name] && (want == nil || want(f.Name)) {
+			files = append(files, f)
+		}
+	}
+	ix.loading = Progress{TotalFiles: len(files)}
+	if ix.workers > 1 && len(files) > 1 {
+		return ix.loadParallel(ctx, files)
+	}
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := ix.loadIWA(ctx, f); err != nil {
 			return err
 		}
-		ix.decodePayload(id, class, data)
+		ix.loaded[f.Name] = true
+		ix.invalidate()
+		ix.fileLoaded()
 	}
 	return nil
 }
 
-func (ix *Index) loadZip(zf *zip.ReadCloser) error {
-	ix.Records = make(map[uint64]interface{})
-	for _, f := range zf.File {
-		if strings.HasSuffix(f.Name, ".iwa") {
-			rc, err := f.Open()
-			if err != nil {
-				return err
-			}
-			defer rc.Close()
+// readZipIWA decrypts, decompresses and decodes an .iwa file, streaming it through the decompressor so neither the
+// compressed nor the decompressed file is held whole. After an error the archives before it are returned with it.
+func (ix *Index) readZipIWA(ctx context.Context, f *zip.File) ([]*iwaArchive, error) {
+	r, closer, err := openIWAStream(f, ix.crypt, ix.limits)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name, err)
+	}
+	defer closer.Close()
+	return ix.readIWA(ctx, f.Name, r)
+}
 
-			data, err := ioutil.ReadAll(rc)
-			if err != nil {
-				return err
+// loadParallel reads and decodes files with a pool of ix.workers goroutines. The results are added in order as
+// they become available; after an error the files before it are still added, the ones after it aren't.
+func (ix *Index) loadParallel(ctx context.Context, files []*zip.File) error {
+	type result struct {
+		archives []*iwaArchive
+		err      error
+		done     chan struct{}
+	}
+	results := make([]*result, len(files))
+	for i := range results {
+		results[i] = &result{done: make(chan struct{})}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for i := range files {
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return
 			}
-			err = ix.loadIWA(data)
-			if err != nil {
-				return err
+		}
+	}()
+	workers := ix.workers
+	if workers > len(files) {
+		workers = len(files)
+	}
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range next {
+				r := results[i]
+				r.archives, r.err = ix.readZipIWA(ctx, files[i])
+				close(r.done)
 			}
+		}()
+	}
+
+	for i, f := range files {
+		r := results[i]
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if r.err != nil {
+			return r.err
 		}
+		if err := ix.addArchives(f.Name, r.archives); err != nil {
+			return err
+		}
+		ix.loaded[f.Name] = true
+		ix.invalidate()
+		ix.fileLoaded()
 	}
 	return nil
 }
 
+// reportProgress passes the loading progress to the Progress option, if there is one.
+func (ix *Index) reportProgress() {
+	if ix.progress != nil {
+		ix.progress(ix.loading)
+	}
+}
+
+// fileLoaded counts an .iwa file as loaded and reports it.
+func (ix *Index) fileLoaded() {
+	ix.loading.Files++
+	ix.loading.File = ""
+	ix.loading.Records, ix.loading.TotalRecords = 0, 0
+	ix.reportProgress()
+}
+
 // Deref returns the object pointed to by a TSP.Reference
 func (ix *Index) Deref(ref *TSP.Reference) interface{} {
 	if ref == nil {
 		return nil
 	}
-	return ix.Records[*ref.Identifier]
+	return ix.Records[ref.GetIdentifier()]
 }
 
-func (ix *Index) loadIWA(data []byte) error {
-	data, err := unsnap(data)
+func (ix *Index) loadIWA(ctx context.Context, f *zip.File) error {
+	archives, err := ix.readZipIWA(ctx, f)
 	if err != nil {
 		return err
 	}
+	return ix.addArchives(f.Name, archives)
+}
 
-	r := bytes.NewBuffer(data)
+// iwaArchive is an archive read from an .iwa file, with its payloads decoded.
+type iwaArchive struct {
+	info     TSP.ArchiveInfo
+	payloads []iwaPayload
+}
+
+type iwaPayload struct {
+	typ     uint32
+	data    []byte
+	value   interface{}
+	err     error
+	skipped bool // filtered out by Options.Types
+}
+
+// readIWA decompresses a snappy compressed .iwa stream and decodes its archives. It doesn't change the Index, so
+// several files can be read at once.
+func (ix *Index) readIWA(ctx context.Context, name string, r io.Reader) ([]*iwaArchive, error) {
+	cr := newChunkReader(r, ix.limits)
+	defer cr.release()
+	return ix.parseIWA(ctx, name, bufio.NewReader(cr))
+}
+
+// parseIWA decodes the archives of a decompressed .iwa stream. After an error the archives before it are returned
+// with it.
+func (ix *Index) parseIWA(ctx context.Context, name string, r *bufio.Reader) ([]*iwaArchive, error) {
+	var rval []*iwaArchive
+	header := getBuf()
+	defer putBuf(header)
 	for {
+		if err := ctx.Err(); err != nil {
+			return rval, err
+		}
 		l, err := binary.ReadUvarint(r)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			return rval, fmt.Errorf("%s: %w", name, err)
 		}
 
-		chunk := make([]byte, l)
-		_, err = r.Read(chunk)
+		chunk, err := ix.limits.readLength(r, "archive header", l, header)
 		if err != nil {
-			return err
+			return rval, fmt.Errorf("%s: %w", name, err)
 		}
-		var ai TSP.ArchiveInfo
-		err = proto.Unmarshal(chunk, &ai)
+		a := &iwaArchive{}
+		err = proto.Unmarshal(chunk, &a.info)
 		if err != nil {
-			return err
+			return rval, fmt.Errorf("%s: %w", name, err)
+		}
+		if len(rval) >= ix.limits.MaxRecords {
+			return rval, fmt.Errorf("more than %d records: %w", ix.limits.MaxRecords, ErrLimit)
 		}
 
-		for _, info := range ai.MessageInfos {
-			payload := make([]byte, *info.Length)
-			_, err := r.Read(payload)
+		for _, info := range a.info.MessageInfos {
+			buf := getBuf()
+			data, err := ix.limits.readLength(r, "record", uint64(info.GetLength()), buf)
 			if err != nil {
-				return err
+				putBuf(buf)
+				return rval, fmt.Errorf("%s: %w", name, err)
 			}
+			p := iwaPayload{typ: info.GetType(), data: data}
+			if ix.wants(p.typ) {
+				p.value, p.err = ix.decode(p.typ, p.data)
+			} else {
+				p.skipped = true
+			}
+			if !p.skipped && p.err == nil && len(a.info.MessageInfos) == 1 {
+				// only payloads left raw, and those of archives with several messages, are kept
+				p.data = nil
+				putBuf(buf)
+			}
+			a.payloads = append(a.payloads, p)
+		}
+		rval = append(rval, a)
+	}
+	return rval, nil
+}
 
-			id, typ := *ai.Identifier, *info.Type
-
-			ix.decodePayload(id, typ, payload)
+// addArchives adds the archives read by readIWA to the Index.
+func (ix *Index) addArchives(name string, archives []*iwaArchive) error {
+	ix.loading.File, ix.loading.Records, ix.loading.TotalRecords = name, 0, len(archives)
+	for _, a := range archives {
+		if len(ix.infos) >= ix.limits.MaxRecords {
+			return fmt.Errorf("more than %d records: %w", ix.limits.MaxRecords, ErrLimit)
 		}
+		id := a.info.GetIdentifier()
+		for _, p := range a.payloads {
+			if p.skipped {
+				continue
+			}
+			if err := ix.addRecord(id, p.typ, p.value, p.err); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if n := len(a.payloads); n > 0 {
+			ix.addRaw(id, a.payloads[n-1].typ, a.payloads[n-1].data)
+		}
+		ix.noteArchive(name, &a.info)
+		if len(a.payloads) > 1 {
+			ix.noteMessages(id, a.payloads)
+		}
+		ix.loading.Records++
+		ix.reportProgress()
 	}
 	return nil
 }
 
-func (ix *Index) decodePayload(id uint64, typ uint32, payload []byte) {
-	var value interface{}
-	var err error
-	if ix.Type == "pages" {
-		value, err = decodePages(typ, payload)
-	} else if ix.Type == "numbers" {
-		value, err = decodeNumbers(typ, payload)
-	} else if ix.Type == "key" {
-		value, err = decodeKeynote(typ, payload)
-	} else {
-		fmt.Fprintln(os.Stderr, "Cannot decode files of type", ix.Type)
+// decodePayload decodes a record into Records. Records that fail to decode are reported to the error handler and
+// left to addRaw, unless the strictness makes them an error: ParseStrict for payloads of known types, ParsePedantic
+// for all.
+func (ix *Index) decodePayload(id uint64, typ uint32, payload []byte) error {
+	if !ix.wants(typ) {
+		return nil
 	}
+	value, err := ix.decode(typ, payload)
+	return ix.addRecord(id, typ, value, err)
+}
 
+// addRecord adds a decoded record to Records, or handles its decode error as decodePayload describes.
+func (ix *Index) addRecord(id uint64, typ uint32, value interface{}, err error) error {
 	if err != nil {
-		// These we don't care as much about
-		fmt.Fprintln(os.Stderr, "ERR", id, typ, err)
-		return
+		derr := &DecodeError{ID: id, Type: typ, Name: TypeName(Type(ix.Type), typ), Unknown: value == nil, Err: err}
+		ix.noteFailure(typ, derr.Unknown)
+		if ix.strict == ParsePedantic || (ix.strict == ParseStrict && !derr.Unknown) {
+			return derr
+		}
+		if ix.onError != nil {
+			ix.onError(derr)
+		}
+		return nil
 	}
 
 	ix.Records[id] = value
+	return nil
 }
 
-func unsnap(data []byte) ([]byte, error) {
+// decode unmarshals a payload with the registered decoder for its type, or the built in one for the document
+// type.
+func (ix *Index) decode(typ uint32, payload []byte) (interface{}, error) {
+	if d := registered(ix.Type, typ); d != nil {
+		return d.Decode(payload)
+	}
+	switch ix.Type {
+	case "pages":
+		return decodePages(typ, payload)
+	case "numbers":
+		return decodeNumbers(typ, payload)
+	case "key":
+		return decodeKeynote(typ, payload)
+	}
+	return nil, fmt.Errorf("cannot decode files of type %s", ix.Type)
+}
+
+// noteFailure records a payload we couldn't decode. The decoders return a nil value for type ids they don't know.
+func (ix *Index) noteFailure(typ uint32, unknown bool) {
+	if ix.unknown == nil {
+		ix.unknown = make(map[uint32]int)
+		ix.failed = make(map[uint32]int)
+	}
+	if unknown {
+		ix.unknown[typ]++
+	} else {
+		ix.failed[typ]++
+	}
+}
+
+// UnknownTypes returns the number of records skipped for each type id the decoder doesn't know.
+func (ix *Index) UnknownTypes() map[uint32]int {
+	return ix.unknown
+}
+
+// FailedTypes returns the number of records of known types whose payload failed to decode, keyed by type id.
+func (ix *Index) FailedTypes() map[uint32]int {
+	return ix.failed
+}
+
+var (
+	errTruncatedHeader = errors.New("truncated snappy chunk header")
+	errTruncatedChunk  = errors.New("truncated snappy chunk")
+)
+
+// unsnap decompresses an .iwa file, within the chunk and file size limits. After an error the chunks before it are
+// returned with it.
+func unsnap(data []byte, limits Limits) ([]byte, error) {
 	rval := bytes.NewBuffer(nil)
 	for len(data) > 0 {
+		if len(data) < 4 {
+			return rval.Bytes(), errTruncatedHeader
+		}
 		typ := int(data[0])
 		if typ != 0 {
-			return nil, errors.New("snap header type not 0")
+			return rval.Bytes(), errors.New("snap header type not 0")
 		}
 		l := int(data[1]) | int(data[2])<<8 | int(data[3])<<16
-		tmp, err := snappy.Decode(nil, data[4:4+l])
+		if 4+l > len(data) {
+			return rval.Bytes(), errTruncatedChunk
+		}
+		tmp, err := limits.decodeChunk(nil, data[4:4+l])
 		if err != nil {
-			return nil, err
+			return rval.Bytes(), err
+		}
+		if int64(rval.Len()+len(tmp)) > limits.MaxDecompressedSize {
+			return rval.Bytes(), fmt.Errorf("more than %d bytes decompressed: %w", limits.MaxDecompressedSize, ErrLimit)
 		}
 		rval.Write(tmp)
 		data = data[4+l:]
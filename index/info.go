@@ -0,0 +1,53 @@
+package index
+
+import "github.com/dunhamsteve/iwork/proto/TSP"
+
+// Info is the archive header a record was read with. A record is usually a single message; one saved as a base
+// message and changes to apply to it has several, and ShouldMerge set.
+type Info struct {
+	ID          uint64           `json:"id"`
+	File        string           `json:"file,omitempty"`
+	ShouldMerge bool             `json:"should_merge,omitempty"`
+	Messages    []MessageInfo    `json:"messages"`
+	Archive     *TSP.ArchiveInfo `json:"-"`
+}
+
+// MessageInfo describes a message of a record: its type id, the app version that wrote it, its encoded length and
+// the records and data it references.
+type MessageInfo struct {
+	Type             uint32   `json:"type"`
+	Version          []uint32 `json:"version,omitempty"`
+	Length           uint32   `json:"length"`
+	ObjectReferences []uint64 `json:"object_references,omitempty"`
+	DataReferences   []uint64 `json:"data_references,omitempty"`
+}
+
+// Info returns the archive header of a record. It returns false for records created in memory, which have none.
+func (ix *Index) Info(id uint64) (Info, bool) {
+	info := ix.infos[id]
+	if info == nil || info.archive == nil {
+		return Info{}, false
+	}
+	ai := info.archive
+	rval := Info{ID: id, File: info.file, ShouldMerge: shouldMerge(ai), Archive: ai}
+	for _, mi := range ai.MessageInfos {
+		rval.Messages = append(rval.Messages, MessageInfo{
+			Type:             mi.GetType(),
+			Version:          mi.Version,
+			Length:           mi.GetLength(),
+			ObjectReferences: mi.ObjectReferences,
+			DataReferences:   mi.DataReferences,
+		})
+	}
+	return rval, true
+}
+
+// shouldMerge reads the should_merge flag (field 3), which our ArchiveInfo proto predates.
+func shouldMerge(ai *TSP.ArchiveInfo) bool {
+	for _, f := range wireFields(ai.XXX_unrecognized) {
+		if f.num == 3 && f.typ == 0 {
+			return f.value != 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Record is a record of an Index with its identifier, message name and the .iwa file it was read from.
+type Record struct {
+	ID    uint64      `json:"id"`
+	Type  string      `json:"type"`
+	File  string      `json:"file,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// IDs returns the identifiers of the records, in order.
+func (ix *Index) IDs() []uint64 {
+	rval := make([]uint64, 0, len(ix.Records))
+	for id := range ix.Records {
+		rval = append(rval, id)
+	}
+	sort.Slice(rval, func(i, j int) bool { return rval[i] < rval[j] })
+	return rval
+}
+
+// SortedRecords returns the records ordered by identifier, for output that shouldn't depend on map order.
+func (ix *Index) SortedRecords() []Record {
+	ids := ix.IDs()
+	rval := make([]Record, len(ids))
+	for i, id := range ids {
+		rval[i] = Record{ID: id, Type: ix.recordName(id), File: ix.File(id), Value: ix.Records[id]}
+	}
+	return rval
+}
+
+// MarshalJSON writes the Index with its records as a list ordered by identifier, each with its message name, so
+// the output is the same from run to run.
+func (ix *Index) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string   `json:"type"`
+		Template bool     `json:"template,omitempty"`
+		Records  []Record `json:"records"`
+	}{ix.Type, ix.Template, ix.SortedRecords()})
+}
+
+// recordName returns the message name of a record. For records that weren't decoded it's the name the type id
+// would decode to, if any.
+func (ix *Index) recordName(id uint64) string {
+	v := ix.Records[id]
+	if raw, ok := v.(*RawRecord); ok {
+		if name := TypeName(Type(ix.Type), raw.Type); name != "" {
+			return name
+		}
+		return fmt.Sprintf("type %d", raw.Type)
+	}
+	if v == nil {
+		return ""
+	}
+	return typeName(v)
+}
@@ -0,0 +1,89 @@
+package index
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Document layouts, as reported by LayoutError.
+const (
+	LayoutPackage = "package"     // a directory holding Index.zip
+	LayoutFile    = "single file" // a zip file, as iCloud and iWork 5.5 and later save
+	LayoutSQLite  = "index.db"    // a directory holding index.db, .pages-tef
+	LayoutLegacy  = "iWork '09"   // a directory holding index.xml.gz
+)
+
+// LayoutAttempt is a document layout that was tried, and why the document didn't fit it.
+type LayoutAttempt struct {
+	Layout string
+	Err    error
+}
+
+// LayoutError reports a path that isn't a document in any of the layouts we read, with what was tried. Directories
+// are tried as packages, .pages-tef and iWork '09 documents, files as single file documents. It matches ErrNotIWork
+// with errors.Is.
+type LayoutError struct {
+	Path  string
+	Tried []LayoutAttempt
+}
+
+func (e *LayoutError) Error() string {
+	var parts []string
+	for _, a := range e.Tried {
+		parts = append(parts, fmt.Sprintf("%s: %v", a.Layout, a.Err))
+	}
+	return fmt.Sprintf("%s: %v (%s)", e.Path, ErrNotIWork, strings.Join(parts, "; "))
+}
+
+func (e *LayoutError) Unwrap() error {
+	return ErrNotIWork
+}
+
+func (e *LayoutError) add(layout string, err error) {
+	e.Tried = append(e.Tried, LayoutAttempt{layout, err})
+}
+
+// openSQL opens the index.db of a .pages-tef document, the fallback once openZip fails with err. The attempts are
+// added to the LayoutError, which is returned if there's no database. iWork '09 documents fail with ErrLegacyFormat.
+func openSQL(doc string, err error) (*sql.DB, error) {
+	lerr, ok := err.(*LayoutError)
+	if !ok {
+		return nil, err
+	}
+	if fi, err := os.Stat(doc); err != nil || !fi.IsDir() {
+		return nil, lerr
+	}
+
+	fn := path.Join(doc, "index.db")
+	if _, err := os.Stat(fn); err == nil {
+		db, err := sql.Open("sqlite3", fn)
+		if err == nil {
+			if err = db.Ping(); err == nil {
+				return db, nil
+			}
+			db.Close()
+		}
+		lerr.add(LayoutSQLite, err)
+	} else {
+		lerr.add(LayoutSQLite, missingFile(err, "index.db"))
+	}
+
+	if _, err := os.Stat(path.Join(doc, "index.xml.gz")); err == nil {
+		return nil, ErrLegacyFormat
+	} else {
+		lerr.add(LayoutLegacy, missingFile(err, "index.xml.gz"))
+	}
+	return nil, lerr
+}
+
+// missingFile shortens the error of a file that isn't there.
+func missingFile(err error, name string) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no %s", name)
+	}
+	return err
+}
@@ -0,0 +1,224 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSS"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// rootFiles are loaded up front by OpenLazy. They hold the package metadata (the component manifest) and the
+// document archive with the slide list or sheet list.
+var rootFiles = map[string]bool{
+	"Index/Metadata.iwa": true,
+	"Index/Document.iwa": true,
+}
+
+// ErrPartial is returned when writing a lazily opened document that hasn't been fully loaded.
+var ErrPartial = errors.New("document is only partially loaded")
+
+// OpenLazy opens a document without decoding most of it. Only the manifest and the document archive are loaded,
+// further components are read on demand by LoadObject, which the scoped accessors like Slide call. .pages-tef
+// documents are loaded in full.
+func OpenLazy(doc, password string) (*Index, error) {
+	return open(context.Background(), doc, Options{Password: password, Lazy: true})
+}
+
+// Partial reports whether some of the document's components have not been loaded yet.
+func (ix *Index) Partial() bool {
+	return ix.lazy
+}
+
+// LoadAll loads every component of a lazily opened document.
+func (ix *Index) LoadAll() error {
+	if !ix.lazy {
+		return nil
+	}
+	err := ix.loadFiles(nil)
+	if err == nil {
+		ix.lazy = false
+	}
+	return err
+}
+
+// LoadObject makes sure a record and everything it references is loaded. The component manifest says which .iwa
+// file holds a component and which other components it points to. If the record can't be found that way the
+// whole document is loaded.
+func (ix *Index) LoadObject(id uint64) error {
+	if !ix.lazy {
+		return nil
+	}
+	components := make(map[uint64]*TSP.ComponentInfo)
+	if meta := ix.packageMetadata(); meta != nil {
+		for _, c := range meta.Components {
+			components[c.GetIdentifier()] = c
+		}
+	}
+
+	// Load the component with the record's id and the components it depends on, then follow references from
+	// the loaded records to anything still missing, until nothing changes.
+	seen := make(map[uint64]bool)
+	for pending := []uint64{id}; len(pending) > 0; {
+		files := make(map[string]bool)
+		for _, id := range pending {
+			ix.componentFiles(components, id, files, make(map[uint64]bool))
+		}
+		if err := ix.loadFiles(func(name string) bool { return files[name] }); err != nil {
+			return err
+		}
+		var next []uint64
+		for _, id := range pending {
+			next = append(next, ix.missing(id, seen)...)
+		}
+		if len(next) > 0 && len(files) == 0 {
+			break
+		}
+		pending = next
+	}
+	if _, ok := ix.Records[id]; !ok {
+		return ix.LoadAll()
+	}
+	return nil
+}
+
+// componentFiles adds the .iwa file of component id and the components it depends on to files. The document
+// component is skipped, it points at everything and is loaded up front.
+func (ix *Index) componentFiles(components map[uint64]*TSP.ComponentInfo, id uint64, files map[string]bool, seen map[uint64]bool) {
+	c := components[id]
+	if c == nil || seen[id] {
+		return
+	}
+	seen[id] = true
+	locator := c.GetLocator()
+	if locator == "" {
+		locator = c.GetPreferredLocator()
+	}
+	name := path.Join("Index", locator+".iwa")
+	if rootFiles[name] {
+		return
+	}
+	if !ix.loaded[name] {
+		files[name] = true
+	}
+	for _, ref := range c.ExternalReferences {
+		if !ref.GetIsWeak() {
+			ix.componentFiles(components, ref.GetComponentIdentifier(), files, seen)
+		}
+	}
+}
+
+// missing walks the loaded records reachable from id and returns the referenced ids that aren't loaded.
+func (ix *Index) missing(id uint64, seen map[uint64]bool) []uint64 {
+	var rval []uint64
+	var walk func(id uint64)
+	walk = func(id uint64) {
+		if seen[id] {
+			return
+		}
+		v, ok := ix.Records[id]
+		if !ok {
+			rval = append(rval, id)
+			return
+		}
+		seen[id] = true
+		objects, _ := references(v)
+		for _, ref := range objects {
+			walk(ref)
+		}
+	}
+	walk(id)
+	return rval
+}
+
+// loadFiles loads the not yet loaded .iwa files accepted by want, or all of them if want is nil.
+func (ix *Index) loadFiles(want func(name string) bool) error {
+	zf, _, err := openZip(ix.path)
+	if err != nil {
+		return err
+	}
+	defer zf.Close()
+	return ix.loadZip(context.Background(), &zf.Reader, want)
+}
+
+// SlideContent is the text and media of a single slide.
+type SlideContent struct {
+	ID    uint64   `json:"id"`
+	Title string   `json:"title,omitempty"`
+	Text  []string `json:"text,omitempty"` // paragraphs of the slide's placeholders, text boxes and shapes
+	Notes string   `json:"notes,omitempty"`
+	Media []Media  `json:"media,omitempty"`
+}
+
+// Slide returns the content of the nth slide (counting from 1) in presentation order. On a lazily opened document
+// only the components of that slide are loaded. Media lists the files used by the slide itself, not its master.
+func (ix *Index) Slide(n int) (*SlideContent, error) {
+	if ix.Type != "key" {
+		return nil, errors.New("not a Keynote document")
+	}
+	slides := ix.Slides()
+	if n < 1 || n > len(slides) {
+		return nil, errors.New("no such slide")
+	}
+	id := slides[n-1]
+	if err := ix.LoadObject(id); err != nil {
+		return nil, err
+	}
+	slide, ok := ix.Records[id].(*KN.SlideArchive)
+	if !ok {
+		return nil, errors.New("missing slide archive")
+	}
+
+	rval := &SlideContent{ID: id, Title: ix.slideTitle(slide)}
+	var storages []*TSWP.StorageArchive
+	datas := make(map[uint64]bool)
+	seen := make(map[uint64]bool)
+	var walk func(id uint64)
+	walk = func(id uint64) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		v := ix.Records[id]
+		switch d := v.(type) {
+		case *KN.SlideArchive, *KN.NoteArchive, *TSS.StylesheetArchive:
+			// other slides, the notes (handled below) and the styles shared with the rest of the document
+			return
+		case *TSWP.StorageArchive:
+			storages = append(storages, d)
+		}
+		objects, ds := references(v)
+		for _, data := range ds {
+			datas[data] = true
+		}
+		for _, ref := range objects {
+			walk(ref)
+		}
+	}
+	for _, ref := range append([]*TSP.Reference{slide.TitlePlaceholder, slide.BodyPlaceholder, slide.ObjectPlaceholder}, slide.Drawables...) {
+		if ref != nil {
+			walk(ref.GetIdentifier())
+		}
+	}
+
+	for _, st := range storages {
+		for _, p := range ix.StorageParagraphs(st) {
+			if text := strings.TrimSpace(strings.Replace(p.Text, string(AttachmentChar), "", -1)); text != "" {
+				rval.Text = append(rval.Text, text)
+			}
+		}
+	}
+	if st := ix.NotesStorage(slide); st != nil {
+		rval.Notes = strings.TrimSpace(storageText(st))
+	}
+	for _, m := range ix.Media() {
+		if datas[m.ID] {
+			rval.Media = append(rval.Media, m)
+		}
+	}
+	return rval, nil
+}
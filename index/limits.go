@@ -0,0 +1,116 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// Limits bound what a document may make the parser allocate. The sizes in an .iwa file come straight from the
+// file, so without them a crafted document can exhaust memory. Zero fields take the value from DefaultLimits.
+type Limits struct {
+	MaxChunkSize        int64 // largest decompressed snappy chunk, archive header or record payload
+	MaxDecompressedSize int64 // largest .iwa file, after decompression
+	MaxRecords          int   // most records in the whole document
+	MaxCells            int   // most cells decoded per table, rows past it are dropped
+}
+
+// DefaultLimits are used for the zero fields of Limits and by the functions that don't take Limits. They are far
+// above what real documents need.
+var DefaultLimits = Limits{
+	MaxChunkSize:        256 << 20,
+	MaxDecompressedSize: 1 << 30,
+	MaxRecords:          10000000,
+	MaxCells:            10000000,
+}
+
+// ErrLimit is returned, wrapped with the details, when a document exceeds its Limits.
+var ErrLimit = errors.New("document exceeds parse limits")
+
+// OpenWithLimits is OpenContext with explicit parse limits.
+func OpenWithLimits(ctx context.Context, doc, password string, limits Limits) (*Index, error) {
+	return open(ctx, doc, Options{Password: password, Limits: limits})
+}
+
+// withDefaults fills in the zero fields from DefaultLimits.
+func (l Limits) withDefaults() Limits {
+	if l.MaxChunkSize <= 0 {
+		l.MaxChunkSize = DefaultLimits.MaxChunkSize
+	}
+	if l.MaxDecompressedSize <= 0 {
+		l.MaxDecompressedSize = DefaultLimits.MaxDecompressedSize
+	}
+	if l.MaxRecords <= 0 {
+		l.MaxRecords = DefaultLimits.MaxRecords
+	}
+	if l.MaxCells <= 0 {
+		l.MaxCells = DefaultLimits.MaxCells
+	}
+	return l
+}
+
+// checkLength checks a length read from the file against the chunk limit and the bytes actually left.
+func (l Limits) checkLength(what string, n uint64, remaining int) error {
+	if n > uint64(l.MaxChunkSize) {
+		return fmt.Errorf("%s of %d bytes: %w", what, n, ErrLimit)
+	}
+	if n > uint64(remaining) {
+		return fmt.Errorf("%s of %d bytes runs past the end of the file", what, n)
+	}
+	return nil
+}
+
+// readLength reads n bytes, a length read from the file, from a stream after checking it against the chunk limit.
+// They're read into buf if it's big enough, otherwise into a buffer that grows as the bytes arrive, so a length
+// running past the end of a small file can't allocate much, and that replaces buf.
+func (l Limits) readLength(r io.Reader, what string, n uint64, buf *[]byte) ([]byte, error) {
+	if n > uint64(l.MaxChunkSize) {
+		return nil, fmt.Errorf("%s of %d bytes: %w", what, n, ErrLimit)
+	}
+	var data []byte
+	if uint64(cap(*buf)) >= n {
+		m, err := io.ReadFull(r, (*buf)[:n])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		data = (*buf)[:m]
+	} else {
+		var err error
+		if data, err = ioutil.ReadAll(io.LimitReader(r, int64(n))); err != nil {
+			return nil, err
+		}
+		*buf = data
+	}
+	if uint64(len(data)) < n {
+		return nil, fmt.Errorf("%s of %d bytes runs past the end of the file", what, n)
+	}
+	return data, nil
+}
+
+// readLimited reads all of r, failing once it passes max bytes.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("file larger than %d bytes: %w", max, ErrLimit)
+	}
+	return data, nil
+}
+
+// decodeChunk decompresses a snappy chunk after checking its declared size, into dst if it's big enough.
+func (l Limits) decodeChunk(dst, chunk []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(chunk)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) > l.MaxChunkSize {
+		return nil, fmt.Errorf("snappy chunk of %d bytes: %w", n, ErrLimit)
+	}
+	return snappy.Decode(dst[:cap(dst)], chunk)
+}
@@ -0,0 +1,169 @@
+package index
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// listCounter numbers the items of a run of list paragraphs. A paragraph outside a list, or with another list
+// style, starts the numbering over.
+type listCounter struct {
+	style  *TSWP.ListStyleArchive
+	counts []int
+}
+
+// label returns the bullet or number of a paragraph, "" if it isn't a list item, and advances the count.
+func (lc *listCounter) label(p Paragraph) string {
+	ls, level := p.ListStyle, int(p.ListLevel)
+	lt := TSWP.ListStyleArchive_kNone
+	if ls != nil && len(ls.LabelTypes) > 0 {
+		lt = ls.LabelTypes[len(ls.LabelTypes)-1]
+		if level < len(ls.LabelTypes) {
+			lt = ls.LabelTypes[level]
+		}
+	}
+	if lt == TSWP.ListStyleArchive_kNone {
+		lc.style, lc.counts = nil, nil
+		return ""
+	}
+	if ls != lc.style {
+		lc.style, lc.counts = ls, nil
+	}
+	for len(lc.counts) <= level {
+		lc.counts = append(lc.counts, 0)
+	}
+	lc.counts = lc.counts[:level+1]
+	lc.counts[level]++
+
+	switch lt {
+	case TSWP.ListStyleArchive_kString:
+		if s := listAt(ls.Strings, level); s != "" {
+			return s
+		}
+	case TSWP.ListStyleArchive_kNumber:
+		nt := numberTypeAt(ls.NumberTypes, level)
+		number := formatListNumber(lc.counts[level], nt)
+		if level < len(ls.TieredNumbers) && ls.TieredNumbers[level] {
+			parts := make([]string, level+1)
+			for i := range parts {
+				parts[i] = formatListNumber(lc.counts[i], numberTypeAt(ls.NumberTypes, i))
+			}
+			number = strings.Join(parts, ".")
+		}
+		name := TSWP.ListStyleArchive_NumberType_name[int32(nt)]
+		switch {
+		case strings.Contains(name, "DoubleParen"):
+			return "(" + number + ")"
+		case strings.Contains(name, "RightParen"):
+			return number + ")"
+		}
+		return number + "."
+	}
+	return "•"
+}
+
+// listAt returns the entry of a per level list for level, the last entry standing in for deeper levels.
+func listAt(list []string, level int) string {
+	if len(list) == 0 {
+		return ""
+	}
+	if level < len(list) {
+		return list[level]
+	}
+	return list[len(list)-1]
+}
+
+func numberTypeAt(types []TSWP.ListStyleArchive_NumberType, level int) TSWP.ListStyleArchive_NumberType {
+	if len(types) == 0 {
+		return TSWP.ListStyleArchive_kNumericDecimal
+	}
+	if level < len(types) {
+		return types[level]
+	}
+	return types[len(types)-1]
+}
+
+// formatListNumber writes n in the digits of a number type, without its punctuation. Scripts other than latin
+// fall back to arabic numerals.
+func formatListNumber(n int, nt TSWP.ListStyleArchive_NumberType) string {
+	if nt > TSWP.ListStyleArchive_kAlphaLowerRightParen {
+		return strconv.Itoa(n)
+	}
+	switch nt / 3 {
+	case 1:
+		return roman(n)
+	case 2:
+		return strings.ToLower(roman(n))
+	case 3:
+		return alpha(n)
+	case 4:
+		return strings.ToLower(alpha(n))
+	}
+	return strconv.Itoa(n)
+}
+
+// alpha writes n as letters: A to Z, then AA, AB and so on.
+func alpha(n int) string {
+	var rval []byte
+	for n > 0 {
+		n--
+		rval = append([]byte{byte('A' + n%26)}, rval...)
+		n /= 26
+	}
+	return string(rval)
+}
+
+// OutlineLevel returns the heading level of a paragraph style, following the style's parents, or 0 for body text.
+func (ix *Index) OutlineLevel(ps *TSWP.ParagraphStyleArchive) uint32 {
+	for i := 0; ps != nil && i < 32; i++ {
+		if level := ps.GetParaProperties().OutlineLevel; level != nil {
+			if *level > 6 {
+				return 0
+			}
+			return *level
+		}
+		ps, _ = ix.Deref(ps.GetSuper().GetParent()).(*TSWP.ParagraphStyleArchive)
+	}
+	return 0
+}
+
+// Heading is an entry of a document outline: a heading paragraph of the body, at rune offset Start, and the
+// headings below it.
+type Heading struct {
+	Level    int        `json:"level"`
+	Text     string     `json:"text"`
+	Start    uint32     `json:"start"`
+	Children []*Heading `json:"children,omitempty"`
+}
+
+// Outline returns the headings of a Pages document body as a tree, for building a table of contents. It returns
+// nil for other documents. A heading whose level skips one is put under the nearest heading above it.
+func (ix *Index) Outline() []*Heading {
+	body := ix.Body()
+	if body == nil {
+		return nil
+	}
+	var rval []*Heading
+	var stack []*Heading
+	for _, p := range ix.StorageParagraphs(body) {
+		level := int(ix.OutlineLevel(p.Style))
+		text := strings.TrimSpace(strings.Replace(p.Text, string(AttachmentChar), "", -1))
+		if level == 0 || text == "" {
+			continue
+		}
+		h := &Heading{Level: level, Text: text, Start: p.Start}
+		for len(stack) > 0 && stack[len(stack)-1].Level >= level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			rval = append(rval, h)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, h)
+		}
+		stack = append(stack, h)
+	}
+	return rval
+}
@@ -0,0 +1,285 @@
+package index
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+)
+
+// ErrDigestMismatch is returned when the bytes of a media file don't match the digest recorded in the document.
+var ErrDigestMismatch = errors.New("media digest mismatch")
+
+// Media describes a file stored in the document's Data directory.
+type Media struct {
+	ID     uint64 `json:"id"`
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Digest []byte `json:"digest,omitempty"`
+	Size   int64  `json:"size"`
+}
+
+// packageMetadata returns the TSP.PackageMetadata record, which is normally identifier 2.
+func (ix *Index) packageMetadata() *TSP.PackageMetadata {
+	if meta, ok := ix.Records[2].(*TSP.PackageMetadata); ok {
+		return meta
+	}
+	for _, v := range ix.Records {
+		if meta, ok := v.(*TSP.PackageMetadata); ok {
+			return meta
+		}
+	}
+	return nil
+}
+
+func mediaFileName(data *TSP.DataInfo) string {
+	if data.FileName != nil {
+		return *data.FileName
+	}
+	return data.GetPreferredFileName()
+}
+
+// Media lists the media files (images, movies, audio) referenced by the document, ordered by identifier. Size is
+// -1 if the file is missing from the bundle.
+func (ix *Index) Media() []Media {
+	meta := ix.packageMetadata()
+	if meta == nil {
+		return nil
+	}
+	size := ix.mediaSizes()
+	var rval []Media
+	for _, data := range meta.Datas {
+		m := Media{
+			ID:     data.GetIdentifier(),
+			Name:   data.GetPreferredFileName(),
+			Path:   path.Join("Data", mediaFileName(data)),
+			Digest: data.Digest,
+		}
+		m.Size = size(m.Path)
+		rval = append(rval, m)
+	}
+	sort.Slice(rval, func(i, j int) bool { return rval[i].ID < rval[j].ID })
+	return rval
+}
+
+// MediaFor returns the media file pointed to by a TSP.DataReference. The media list is built once per Cache, so
+// exporters resolving many images should install one.
+func (ix *Index) MediaFor(ref *TSP.DataReference) (Media, bool) {
+	if ref == nil {
+		return Media{}, false
+	}
+	byID := ix.Memo(0, "media", func() interface{} {
+		rval := make(map[uint64]Media)
+		for _, m := range ix.Media() {
+			rval[m.ID] = m
+		}
+		return rval
+	}).(map[uint64]Media)
+	m, ok := byID[ref.GetIdentifier()]
+	return m, ok
+}
+
+// MediaUsage is a media file together with the objects that reference it.
+type MediaUsage struct {
+	Media
+	References []uint64 `json:"references"`
+}
+
+// MediaUsage lists every media file with the identifiers of the objects referencing it, ordered by media
+// identifier. A file with no references is no longer used by the document and can be dropped.
+func (ix *Index) MediaUsage() []MediaUsage {
+	users := ix.mediaUsers()
+	var rval []MediaUsage
+	for _, m := range ix.Media() {
+		rval = append(rval, MediaUsage{m, users[m.ID]})
+	}
+	return rval
+}
+
+// MediaReferences returns the identifiers of the objects referencing a media file.
+func (ix *Index) MediaReferences(id uint64) []uint64 {
+	return ix.mediaUsers()[id]
+}
+
+// mediaUsers maps data identifiers to the sorted identifiers of the records that reference them. A record that
+// points at the same data twice is counted once.
+func (ix *Index) mediaUsers() map[uint64][]uint64 {
+	rval := make(map[uint64][]uint64)
+	for id, v := range ix.Records {
+		_, datas := references(v)
+		if raw, ok := v.(*RawRecord); ok {
+			_, datas = ix.rawReferences(raw)
+		}
+		seen := make(map[uint64]bool)
+		for _, data := range datas {
+			if !seen[data] {
+				seen[data] = true
+				rval[data] = append(rval[data], id)
+			}
+		}
+	}
+	for _, ids := range rval {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	return rval
+}
+
+// mediaSizes returns a function giving the size of a file of the bundle, or -1 if it's missing. A single file
+// document is opened once, for all of the lookups. Files added by Import count before they're saved.
+func (ix *Index) mediaSizes() func(name string) int64 {
+	var members map[string]int64
+	if fi, err := os.Stat(ix.path); ix.path != "" && err == nil && !fi.IsDir() {
+		members = make(map[string]int64)
+		if zf, err := openFlatZip(ix.path); err == nil {
+			for _, f := range zf.File {
+				members[f.Name] = int64(f.UncompressedSize64)
+			}
+			zf.Close()
+		}
+	}
+	return func(name string) int64 {
+		if data, ok := ix.added[name]; ok {
+			return int64(len(data))
+		}
+		if ix.path == "" {
+			return -1
+		}
+		if members != nil {
+			if size, ok := members[name]; ok {
+				return size
+			}
+			return -1
+		}
+		fi, err := os.Stat(path.Join(ix.path, name))
+		if err != nil {
+			return -1
+		}
+		return fi.Size()
+	}
+}
+
+// OpenMedia streams the bytes of a media file, including files added by Import that aren't saved yet. The digest
+// recorded in the document is checked as the data is read, and the final Read returns ErrDigestMismatch instead of
+// io.EOF if it doesn't match.
+func (ix *Index) OpenMedia(id uint64) (io.ReadCloser, error) {
+	meta := ix.packageMetadata()
+	if meta == nil {
+		return nil, errors.New("document has no package metadata")
+	}
+	var data *TSP.DataInfo
+	for _, d := range meta.Datas {
+		if d.GetIdentifier() == id {
+			data = d
+		}
+	}
+	if data == nil {
+		return nil, fmt.Errorf("no media with identifier %d", id)
+	}
+	name := path.Join("Data", mediaFileName(data))
+	if content, ok := ix.added[name]; ok {
+		return newDigestReader(ioutil.NopCloser(bytes.NewReader(content)), data.Digest), nil
+	}
+	if ix.path == "" {
+		return nil, errors.New("document was not opened from disk")
+	}
+
+	var rc io.ReadCloser
+	if fi, err := os.Stat(ix.path); err == nil && !fi.IsDir() {
+		zf, err := openFlatZip(ix.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zf.File {
+			if f.Name == name {
+				r, err := f.Open()
+				if err != nil {
+					zf.Close()
+					return nil, err
+				}
+				rc = &zipMember{r, zf}
+			}
+		}
+		if rc == nil {
+			zf.Close()
+			return nil, fmt.Errorf("%s: not found in document", name)
+		}
+	} else {
+		f, err := os.Open(path.Join(ix.path, name))
+		if err != nil {
+			return nil, err
+		}
+		rc = f
+	}
+
+	if ix.crypt != nil {
+		r, err := ix.crypt.reader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		rc = &decryptedMember{r, rc}
+	}
+
+	return newDigestReader(rc, data.Digest), nil
+}
+
+// decryptedMember reads an encrypted member through its decrypter.
+type decryptedMember struct {
+	io.Reader
+	io.Closer
+}
+
+// zipMember closes the enclosing zip file along with the member.
+type zipMember struct {
+	io.ReadCloser
+	zf *zip.ReadCloser
+}
+
+func (z *zipMember) Close() error {
+	z.ReadCloser.Close()
+	return z.zf.Close()
+}
+
+// digestReader hashes data as it is read and checks it against the expected digest at EOF.
+type digestReader struct {
+	rc     io.ReadCloser
+	h      hash.Hash
+	digest []byte
+}
+
+func newDigestReader(rc io.ReadCloser, digest []byte) io.ReadCloser {
+	var h hash.Hash
+	switch len(digest) {
+	case sha1.Size:
+		h = sha1.New()
+	case sha256.Size:
+		h = sha256.New()
+	default:
+		// Unknown digest, nothing to check
+		return rc
+	}
+	return &digestReader{rc, h, digest}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.rc.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(d.h.Sum(nil), d.digest) {
+		return n, ErrDigestMismatch
+	}
+	return n, err
+}
+
+func (d *digestReader) Close() error {
+	return d.rc.Close()
+}
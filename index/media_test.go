@@ -0,0 +1,30 @@
+package index
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// TestMediaAdded looks up a media file added by Import, before the document is saved.
+func TestMediaAdded(t *testing.T) {
+	ix := &Index{Type: "pages", Records: map[uint64]interface{}{
+		2: &TSP.PackageMetadata{Datas: []*TSP.DataInfo{{Identifier: proto.Uint64(5), FileName: proto.String("a.png")}}},
+	}}
+	ix.added = map[string][]byte{"Data/a.png": []byte("png")}
+	m, ok := ix.MediaFor(&TSP.DataReference{Identifier: proto.Uint64(5)})
+	if !ok || m.Size != 3 {
+		t.Fatalf("got %+v, want the added file", m)
+	}
+	rc, err := ix.OpenMedia(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, err := ioutil.ReadAll(rc); err != nil || string(data) != "png" {
+		t.Errorf("read %q, %v", data, err)
+	}
+}
@@ -0,0 +1,272 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSS"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Import copies the records of src reachable from roots into ix under new identifiers, and returns the identifiers
+// they were given, keyed by their identifiers in src. Records in known first map to those records instead and
+// aren't copied, which is how callers tie the copy to parts of ix, like a master slide.
+//
+// Named styles map to the style of ix with the same type and name, so the copy takes on the look of ix; unnamed
+// ones are copied. The document archive, stylesheets, themes and other records a document has one of map to
+// those of ix. Media is copied into ix unless ix already holds a file with the same digest, and is written out by
+// Save. Components of src that are copied whole get components of their own in ix, other records go in
+// DefaultFile. Undecoded records are copied as they are, and Import fails if one of them references others, since
+// its references can't be rewritten.
+func (ix *Index) Import(src *Index, roots []uint64, known map[uint64]uint64) (map[uint64]uint64, error) {
+	if err := ix.writable(); err != nil {
+		return nil, err
+	}
+	if src.lazy {
+		return nil, ErrPartial
+	}
+	defer ix.invalidate()
+	ids := make(map[uint64]uint64)
+	for k, v := range known {
+		ids[k] = v
+	}
+	styles := make(map[string]uint64)
+	singles := make(map[reflect.Type]uint64)
+	for _, id := range ix.IDs() {
+		v := ix.Records[id]
+		if key := styleKey(v); key != "" {
+			if _, ok := styles[key]; !ok {
+				styles[key] = id
+			}
+		}
+		if isSingle(v) {
+			if _, ok := singles[reflect.TypeOf(v)]; !ok {
+				singles[reflect.TypeOf(v)] = id
+			}
+		}
+	}
+
+	// walk the references, deciding where each record goes
+	var copied []uint64
+	queue := append([]uint64{}, roots...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if _, ok := ids[id]; ok {
+			continue
+		}
+		v, ok := src.Records[id]
+		if !ok {
+			continue
+		}
+		if to, ok := styles[styleKey(v)]; ok {
+			ids[id] = to
+			continue
+		}
+		if to, ok := singles[reflect.TypeOf(v)]; ok && isSingle(v) {
+			ids[id] = to
+			continue
+		}
+		switch v := v.(type) {
+		case proto.Message:
+		case *RawRecord:
+			// the payload is copied as is, so its references can't be rewritten
+			if objects, datas := src.rawReferences(v); len(objects) > 0 || len(datas) > 0 {
+				return nil, fmt.Errorf("record %d: can't copy an undecoded record with references", id)
+			}
+		default:
+			return nil, fmt.Errorf("record %d: can't copy a %T", id, v)
+		}
+		ids[id] = ix.NewID()
+		copied = append(copied, id)
+		objects, _ := references(v)
+		queue = append(queue, objects...)
+	}
+
+	datas, err := ix.importData(src, copied)
+	if err != nil {
+		return nil, err
+	}
+	files := ix.importComponents(src, ids, datas)
+	for _, id := range copied {
+		switch v := src.Records[id].(type) {
+		case *RawRecord:
+			ix.Records[ids[id]] = &RawRecord{ID: ids[id], Type: v.Type, Payload: append([]byte(nil), v.Payload...)}
+		case proto.Message:
+			v = proto.Clone(v)
+			remapReferences(v, ids, datas)
+			ix.Records[ids[id]] = v
+		}
+		file := files[src.File(id)]
+		if file == "" {
+			file = DefaultFile
+		}
+		ix.setFile(ids[id], file)
+	}
+	return ids, nil
+}
+
+// styleKey returns the type and name of a named style, or "".
+func styleKey(v interface{}) string {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+	f := rv.Elem().FieldByName("Super")
+	if !f.IsValid() {
+		return ""
+	}
+	style, ok := f.Interface().(*TSS.StyleArchive)
+	if !ok || style.GetName() == "" || style.GetIsVariation() {
+		return ""
+	}
+	return fmt.Sprintf("%T/%s", v, style.GetName())
+}
+
+// isSingle reports whether a record is one of those a document has one of.
+func isSingle(v interface{}) bool {
+	switch v.(type) {
+	case *TSP.PackageMetadata, *TSS.StylesheetArchive, *TSS.ThemeArchive, *KN.ThemeArchive, *TN.ThemeArchive,
+		*TP.ThemeArchive, *KN.ShowArchive, *KN.UIStateArchive:
+		return true
+	}
+	return isRoot(v)
+}
+
+// importData returns new identifiers for the media referenced by the records, adding the files to ix.
+func (ix *Index) importData(src *Index, records []uint64) (map[uint64]uint64, error) {
+	rval := make(map[uint64]uint64)
+	srcMeta, meta := src.packageMetadata(), ix.packageMetadata()
+	if srcMeta == nil || meta == nil {
+		return rval, nil
+	}
+	taken := make(map[string]bool)
+	for _, d := range meta.Datas {
+		taken[strings.ToLower(mediaFileName(d))] = true
+	}
+	for name := range ix.added {
+		taken[strings.ToLower(path.Base(name))] = true
+	}
+	for _, id := range records {
+		_, refs := references(src.Records[id])
+		for _, ref := range refs {
+			if _, ok := rval[ref]; ok {
+				continue
+			}
+			var data *TSP.DataInfo
+			for _, d := range srcMeta.Datas {
+				if d.GetIdentifier() == ref {
+					data = d
+				}
+			}
+			if data == nil {
+				continue
+			}
+			for _, d := range meta.Datas {
+				if len(data.Digest) > 0 && bytes.Equal(d.Digest, data.Digest) {
+					rval[ref] = d.GetIdentifier()
+				}
+			}
+			if _, ok := rval[ref]; ok {
+				continue
+			}
+
+			rc, err := src.OpenMedia(ref)
+			if err != nil {
+				return nil, err
+			}
+			content, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			name := uniqueName(taken, mediaFileName(data))
+			taken[strings.ToLower(name)] = true
+			if ix.added == nil {
+				ix.added = make(map[string][]byte)
+			}
+			ix.added[path.Join("Data", name)] = content
+
+			dup := proto.Clone(data).(*TSP.DataInfo)
+			dup.Identifier = proto.Uint64(ix.NewID())
+			dup.FileName = proto.String(name)
+			dup.PreferredFileName = proto.String(name)
+			meta.Datas = append(meta.Datas, dup)
+			rval[ref] = dup.GetIdentifier()
+		}
+	}
+	return rval, nil
+}
+
+// importComponents adds a component to ix for each component of src whose root record is copied, and returns the
+// .iwa file the records of each src file go to.
+func (ix *Index) importComponents(src *Index, ids, datas map[uint64]uint64) map[string]string {
+	rval := make(map[string]string)
+	srcMeta, meta := src.packageMetadata(), ix.packageMetadata()
+	if srcMeta == nil || meta == nil {
+		return rval
+	}
+	for _, c := range srcMeta.Components {
+		to, ok := ids[c.GetIdentifier()]
+		if !ok || ix.Records[to] != nil {
+			continue
+		}
+		dup := proto.Clone(c).(*TSP.ComponentInfo)
+		dup.Identifier = proto.Uint64(to)
+		dup.Locator = proto.String(fmt.Sprintf("%s-%d", c.GetPreferredLocator(), to))
+		refs := dup.ExternalReferences[:0]
+		for _, ref := range dup.ExternalReferences {
+			if id, ok := ids[ref.GetComponentIdentifier()]; ok {
+				ref.ComponentIdentifier = proto.Uint64(id)
+				if id, ok := ids[ref.GetObjectIdentifier()]; ok {
+					ref.ObjectIdentifier = proto.Uint64(id)
+				}
+				refs = append(refs, ref)
+			}
+		}
+		dup.ExternalReferences = refs
+		drefs := dup.DataReferences[:0]
+		for _, ref := range dup.DataReferences {
+			if id, ok := datas[ref.GetDataIdentifier()]; ok {
+				ref.DataIdentifier = proto.Uint64(id)
+				drefs = append(drefs, ref)
+			}
+		}
+		dup.DataReferences = drefs
+		meta.Components = append(meta.Components, dup)
+
+		// the components pointing at c in src point at the copy in ix
+		for _, other := range srcMeta.Components {
+			owner := ix.component(ix.File(ids[other.GetIdentifier()]))
+			if owner == nil || owner.GetIdentifier() != ids[other.GetIdentifier()] {
+				continue
+			}
+			for _, ref := range other.ExternalReferences {
+				if ref.GetComponentIdentifier() == c.GetIdentifier() {
+					ref = proto.Clone(ref).(*TSP.ComponentExternalReference)
+					ref.ComponentIdentifier = dup.Identifier
+					if id, ok := ids[ref.GetObjectIdentifier()]; ok {
+						ref.ObjectIdentifier = proto.Uint64(id)
+					}
+					owner.ExternalReferences = append(owner.ExternalReferences, ref)
+				}
+			}
+		}
+
+		locator := c.GetLocator()
+		if locator == "" {
+			locator = c.GetPreferredLocator()
+		}
+		rval[path.Join("Index", locator+".iwa")] = path.Join("Index", dup.GetLocator()+".iwa")
+	}
+	return rval
+}
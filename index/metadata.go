@@ -0,0 +1,174 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSA"
+	"github.com/dunhamsteve/iwork/proto/TSK"
+)
+
+// Metadata describes a document, gathered from Metadata/Properties.plist, Metadata/BuildVersionHistory.plist and
+// the document archive. iWork doesn't store a title or creation author, so Title is the file name and Authors
+// are the names of the people who left comments. Fields that aren't present are left empty.
+type Metadata struct {
+	Title    string    `json:"title"`
+	Authors  []string  `json:"authors,omitempty"`
+	Created  time.Time `json:"created,omitempty"`
+	Modified time.Time `json:"modified,omitempty"`
+
+	// AppVersion is the build that last saved the document, the last entry of BuildVersionHistory.
+	AppVersion     string   `json:"app_version,omitempty"`
+	VersionHistory []string `json:"version_history,omitempty"`
+
+	// ReadVersion and WriteVersion are the file format versions from the package metadata, like "2.0.0". See
+	// SupportedVersions for the ones we decode.
+	ReadVersion  string `json:"read_version,omitempty"`
+	WriteVersion string `json:"write_version,omitempty"`
+
+	// FormatVersion is the app version whose file format the document uses, the oldest app that opens it without
+	// conversion, from Properties.plist.
+	FormatVersion string `json:"format_version,omitempty"`
+
+	DocumentUUID string `json:"document_uuid,omitempty"`
+	VersionUUID  string `json:"version_uuid,omitempty"`
+	Template     string `json:"template,omitempty"`
+	Language     string `json:"language,omitempty"`
+	Locale       string `json:"locale,omitempty"`
+
+	// Properties holds everything in Properties.plist, including the keys above.
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+// Metadata returns the document's metadata. Missing or unreadable metadata files are skipped, an error is only
+// returned if one can't be parsed.
+func (ix *Index) Metadata() (*Metadata, error) {
+	rval := &Metadata{}
+	if ix.path != "" {
+		base := filepath.Base(filepath.Clean(ix.path))
+		rval.Title = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+
+	if data, err := ix.readBundleFile("Metadata/Properties.plist"); err == nil {
+		v, err := parsePlist(data)
+		if err != nil {
+			return nil, fmt.Errorf("Properties.plist: %w", err)
+		}
+		if props, ok := v.(map[string]interface{}); ok {
+			rval.Properties = props
+			rval.DocumentUUID, _ = props["documentUUID"].(string)
+			rval.VersionUUID, _ = props["versionUUID"].(string)
+			rval.FormatVersion, _ = props["fileFormatVersion"].(string)
+			rval.Created, _ = props["creationDate"].(time.Time)
+			rval.Modified, _ = props["modificationDate"].(time.Time)
+		}
+	}
+	if data, err := ix.readBundleFile("Metadata/BuildVersionHistory.plist"); err == nil {
+		v, err := parsePlist(data)
+		if err != nil {
+			return nil, fmt.Errorf("BuildVersionHistory.plist: %w", err)
+		}
+		list, _ := v.([]interface{})
+		for _, item := range list {
+			if s, ok := item.(string); ok {
+				rval.VersionHistory = append(rval.VersionHistory, s)
+			}
+		}
+		if n := len(rval.VersionHistory); n > 0 {
+			rval.AppVersion = rval.VersionHistory[n-1]
+		}
+	}
+	if rval.Modified.IsZero() && ix.path != "" {
+		if fi, err := os.Stat(ix.path); err == nil {
+			rval.Modified = fi.ModTime()
+		}
+	}
+
+	if meta := ix.packageMetadata(); meta != nil {
+		rval.ReadVersion = formatVersion(meta.ReadVersion)
+		rval.WriteVersion = formatVersion(meta.WriteVersion)
+	}
+	if da := ix.documentArchive(); da != nil {
+		rval.Template = da.GetTemplateIdentifier()
+		rval.Language = ix.documentLanguage()
+		rval.Locale = da.GetSuper().GetLocaleIdentifier()
+		if settings := ix.pagesSettings(); rval.Locale == "" && settings != nil {
+			rval.Locale = settings.GetLastLocale()
+		}
+		if as, ok := ix.Deref(da.GetSuper().GetAnnotationAuthorStorage()).(*TSK.AnnotationAuthorStorageArchive); ok {
+			for _, ref := range as.AnnotationAuthor {
+				if author, ok := ix.Deref(ref).(*TSK.AnnotationAuthorArchive); ok && author.GetName() != "" {
+					rval.Authors = append(rval.Authors, author.GetName())
+				}
+			}
+		}
+	}
+	return rval, nil
+}
+
+// documentArchive returns the TSA.DocumentArchive shared by the document records of all three apps.
+func (ix *Index) documentArchive() *TSA.DocumentArchive {
+	switch da := ix.Root().(type) {
+	case *TP.DocumentArchive:
+		return da.Super
+	case *KN.DocumentArchive:
+		return da.Super
+	case *TN.DocumentArchive:
+		return da.Super
+	}
+	return nil
+}
+
+// pagesSettings returns the settings of a Pages document, nil for other documents.
+func (ix *Index) pagesSettings() *TP.SettingsArchive {
+	if da, ok := ix.Root().(*TP.DocumentArchive); ok {
+		settings, _ := ix.Deref(da.Settings).(*TP.SettingsArchive)
+		return settings
+	}
+	return nil
+}
+
+// documentLanguage returns the language a document was created in. Pages documents may set another in their
+// settings, which wins.
+func (ix *Index) documentLanguage() string {
+	if lang := ix.pagesSettings().GetLanguage(); lang != "" {
+		return lang
+	}
+	return ix.documentArchive().GetCreationLanguage()
+}
+
+func formatVersion(v []uint32) string {
+	var parts []string
+	for _, n := range v {
+		parts = append(parts, fmt.Sprint(n))
+	}
+	return strings.Join(parts, ".")
+}
+
+// readBundleFile reads a file from the document, which may be a package directory or a single zip file.
+func (ix *Index) readBundleFile(name string) ([]byte, error) {
+	if ix.path == "" {
+		return nil, os.ErrNotExist
+	}
+	if fi, err := os.Stat(ix.path); err == nil && !fi.IsDir() {
+		zf, err := openFlatZip(ix.path)
+		if err != nil {
+			return nil, err
+		}
+		defer zf.Close()
+		data, err := readZipFile(&zf.Reader, name)
+		if err == nil && data == nil {
+			err = os.ErrNotExist
+		}
+		return data, err
+	}
+	return ioutil.ReadFile(path.Join(ix.path, name))
+}
@@ -0,0 +1,55 @@
+package index
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// SlideNotes are the presenter notes of a slide. Text is the plain text, Paragraphs the same text with its styles,
+// lists and runs for formatted output, see RunStyle. Both are empty for slides without notes.
+type SlideNotes struct {
+	Slide      int         `json:"slide"`
+	ID         uint64      `json:"id"`
+	Title      string      `json:"title,omitempty"`
+	Text       string      `json:"text,omitempty"`
+	Paragraphs []Paragraph `json:"paragraphs,omitempty"`
+}
+
+// Notes returns the presenter notes of every slide of a Keynote document, in presentation order. On a lazily
+// opened document the components of each slide are loaded as it's reached.
+func (ix *Index) Notes() ([]SlideNotes, error) {
+	if ix.Type != "key" {
+		return nil, errors.New("not a Keynote document")
+	}
+	var rval []SlideNotes
+	for n, id := range ix.Slides() {
+		if err := ix.LoadObject(id); err != nil {
+			return rval, err
+		}
+		slide, ok := ix.Records[id].(*KN.SlideArchive)
+		if !ok {
+			return rval, errors.New("missing slide archive")
+		}
+		notes := SlideNotes{Slide: n + 1, ID: id, Title: ix.slideTitle(slide)}
+		if st := ix.NotesStorage(slide); st != nil {
+			if notes.Text = strings.TrimSpace(storageText(st)); notes.Text != "" {
+				notes.Paragraphs = ix.StorageParagraphs(st)
+			}
+		}
+		rval = append(rval, notes)
+	}
+	return rval, nil
+}
+
+// NotesStorage returns the text storage of the presenter notes of a slide, or nil if it has none.
+func (ix *Index) NotesStorage(slide *KN.SlideArchive) *TSWP.StorageArchive {
+	note, ok := ix.Deref(slide.Note).(*KN.NoteArchive)
+	if !ok {
+		return nil
+	}
+	st, _ := ix.Deref(note.ContainedStorage).(*TSWP.StorageArchive)
+	return st
+}
@@ -0,0 +1,89 @@
+package index
+
+import (
+	"context"
+	"fmt"
+)
+
+// Options control how a document is opened. The zero value opens it like Open.
+type Options struct {
+	Password string // for encrypted documents
+	Lazy     bool   // load components on demand, as OpenLazy does
+	Type     Type   // the document type, to skip detecting it, as OpenAs does
+	Limits   Limits
+
+	// ErrorHandler is called for each record that fails to decode, and the record is kept as a RawRecord.
+	// Without one, failures are only counted, in FailedTypes and UnknownTypes.
+	ErrorHandler func(*DecodeError)
+
+	// Strictness says which records that fail to decode make opening fail, see ParseStrictness.
+	Strictness ParseStrictness
+
+	// Workers is the number of .iwa files read and decoded at once. Values below 2 read them one at a time.
+	// runtime.NumCPU() is a good choice for large documents.
+	Workers int
+
+	// Types limits decoding to the listed message types, to save time and memory when only some of the document
+	// is needed. Entries are message names ("TSWP.StorageArchive") or packages ("TST" or "TST.*"), which match
+	// all of their types. The TSP package, with the package metadata, is always decoded. Other records are kept as
+	// RawRecords, so the document can still be saved.
+	Types []string
+
+	// Progress is called as the document loads: after each record, and after each .iwa file. It runs on the
+	// loading goroutine, so it should return quickly.
+	Progress func(Progress)
+}
+
+// Progress is how far loading a document has got. For an Index.zip the files are counted, along with the records
+// of the file being loaded. An index.db has no files, and Records counts all of its records.
+type Progress struct {
+	File         string `json:"file,omitempty"` // the .iwa file being loaded
+	Files        int    `json:"files"`          // .iwa files loaded
+	TotalFiles   int    `json:"total_files"`    // .iwa files to load
+	Records      int    `json:"records"`        // records loaded from File, or from the index.db
+	TotalRecords int    `json:"total_records"`  // records in File, or in the index.db
+}
+
+// ParseStrictness is how a document with damaged records is handled. Whatever the strictness, damaged input gives
+// errors or RawRecords, never panics.
+type ParseStrictness int
+
+const (
+	// ParseLenient keeps records that fail to decode as RawRecords and reports them to the ErrorHandler.
+	ParseLenient ParseStrictness = iota
+	// ParseStrict fails on the first record of a known type that fails to decode. Records of types the decoder
+	// doesn't know are still only reported, newer documents are full of them.
+	ParseStrict
+	// ParsePedantic fails on any record that isn't decoded, known type or not, for callers that would rather
+	// reject a document than handle part of it.
+	ParsePedantic
+)
+
+// DecodeError is a record that failed to decode.
+type DecodeError struct {
+	ID      uint64
+	Type    uint32
+	Name    string // the message name of the type id, see TypeName
+	Unknown bool   // the decoder doesn't know the type id
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("record %d (%s, type %d): %v", e.ID, e.Name, e.Type, e.Err)
+	}
+	return fmt.Sprintf("record %d (type %d): %v", e.ID, e.Type, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// OpenOptions loads a document with the given options, see Options. Loading stops with ctx.Err() once ctx is done.
+// A nil opts is the same as the zero Options.
+func OpenOptions(ctx context.Context, doc string, opts *Options) (*Index, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return open(ctx, doc, *opts)
+}
@@ -0,0 +1,123 @@
+package index
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// TextOptions selects the text PagesText returns.
+type TextOptions struct {
+	// Floating adds the text of the shapes, text boxes and tables placed on the pages rather than in the body.
+	Floating bool
+}
+
+// TextBlock is a stretch of the text of a Pages document: body text, or the text of a shape, text box or table.
+// ID is the body storage or the drawable, Page is the page a floating drawable is on, counting from 1.
+type TextBlock struct {
+	ID       uint64 `json:"id"`
+	Kind     string `json:"kind"` // "body", KindShape or KindTable
+	Floating bool   `json:"floating,omitempty"`
+	Page     int    `json:"page,omitempty"`
+	Text     string `json:"text"`
+}
+
+// PagesText returns the text of a Pages document in reading order. The body text is split around its inline
+// shapes, text boxes and tables, which follow the paragraph holding them, groups giving the text of their members.
+// With opts.Floating the text of the drawables floating on the pages comes after, page by page. Table rows are
+// lines with the cells separated by tabs.
+func (ix *Index) PagesText(opts TextOptions) ([]TextBlock, error) {
+	da, ok := ix.Root().(*TP.DocumentArchive)
+	if !ok {
+		return nil, errors.New("not a Pages document")
+	}
+	body, ok := ix.Deref(da.BodyStorage).(*TSWP.StorageArchive)
+	if !ok {
+		return nil, errors.New("missing body storage")
+	}
+	t := &textWalker{ix: ix, seen: make(map[uint64]bool)}
+	t.storage(da.BodyStorage.GetIdentifier(), "body", body)
+	if !opts.Floating {
+		return t.blocks, nil
+	}
+	if fd, ok := ix.Deref(da.FloatingDrawables).(*TP.FloatingDrawablesArchive); ok {
+		for _, pg := range fd.PageGroups {
+			t.floating, t.page = true, int(pg.GetPageIndex())+1
+			for _, entries := range [][]*TP.FloatingDrawablesArchive_DrawableEntry{pg.BackgroundDrawables, pg.Drawables, pg.ForegroundDrawables} {
+				for _, e := range entries {
+					t.drawable(e.Drawable)
+				}
+			}
+		}
+	}
+	return t.blocks, nil
+}
+
+// textWalker gathers the text blocks of PagesText.
+type textWalker struct {
+	ix       *Index
+	seen     map[uint64]bool
+	floating bool
+	page     int
+	blocks   []TextBlock
+}
+
+func (t *textWalker) add(id uint64, kind, text string) {
+	if text = strings.TrimSpace(text); text != "" {
+		t.blocks = append(t.blocks, TextBlock{ID: id, Kind: kind, Floating: t.floating, Page: t.page, Text: text})
+	}
+}
+
+// storage adds the text of a storage, breaking it at the drawables attached inline.
+func (t *textWalker) storage(id uint64, kind string, st *TSWP.StorageArchive) {
+	var lines []string
+	for _, p := range t.ix.StorageParagraphs(st) {
+		lines = append(lines, t.ix.ParagraphText(p))
+		for _, run := range p.Runs {
+			att, ok := run.Attachment.(*TSWP.DrawableAttachmentArchive)
+			if !ok || att.Drawable == nil {
+				continue
+			}
+			t.add(id, kind, strings.Join(lines, "\n"))
+			lines = nil
+			t.drawable(att.Drawable)
+		}
+	}
+	t.add(id, kind, strings.Join(lines, "\n"))
+}
+
+// drawable adds the text of a shape, text box, table or group.
+func (t *textWalker) drawable(ref *TSP.Reference) {
+	id := ref.GetIdentifier()
+	if t.seen[id] {
+		return
+	}
+	t.seen[id] = true
+	switch d := t.ix.Records[id].(type) {
+	case *TSWP.ShapeInfoArchive:
+		if st, ok := t.ix.Deref(d.ContainedStorage).(*TSWP.StorageArchive); ok {
+			t.storage(id, KindShape, st)
+		}
+	case *TST.TableInfoArchive, *TST.WPTableInfoArchive:
+		if table, ok := t.ix.Table(id); ok {
+			var rows []string
+			for _, row := range table.Rows {
+				cells := make([]string, len(row))
+				for i, cell := range row {
+					cells[i] = strings.Join(strings.Fields(cell.String()), " ")
+				}
+				rows = append(rows, strings.TrimRight(strings.Join(cells, "\t"), "\t"))
+			}
+			t.add(id, KindTable, strings.Join(rows, "\n"))
+		}
+	case *TSD.GroupArchive, *TSD.ContainerArchive:
+		for _, child := range groupChildren(d) {
+			t.drawable(child)
+		}
+	}
+}
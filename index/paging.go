@@ -0,0 +1,187 @@
+package index
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Page is the body text laid out on a page of a Pages document. Start and End are the rune offsets of the text in
+// the body storage, and Section the section it belongs to, counting from 1. Estimated is set when the page breaks
+// weren't saved with the document and were worked out from the page size and the text size instead, which can
+// put them a few lines off.
+type Page struct {
+	Number    int    `json:"number"`
+	Section   int    `json:"section"`
+	Start     uint32 `json:"start"`
+	End       uint32 `json:"end"`
+	Text      string `json:"text"`
+	Estimated bool   `json:"estimated,omitempty"`
+}
+
+// Page sizes in points, for documents that don't set them: US Letter with inch margins.
+const (
+	defaultPageWidth  = 612
+	defaultPageHeight = 792
+	defaultMargin     = 72
+	defaultTextSize   = 12
+)
+
+// BodyPages splits the body of a Pages document into pages, or returns nil for other documents. The page breaks
+// are those of the layout Pages saved with the document. The breaks past the end of that layout, or all of them if
+// there's none, are estimated, laying out lines of average width and starting new pages at page and section
+// breaks.
+func (ix *Index) BodyPages() []Page {
+	da, ok := ix.Root().(*TP.DocumentArchive)
+	if !ok {
+		return nil
+	}
+	body, ok := ix.Deref(da.BodyStorage).(*TSWP.StorageArchive)
+	if !ok {
+		return nil
+	}
+	text := []rune(strings.Join(body.Text, ""))
+	sections := ix.Sections()
+
+	rval := ix.hintedPages(da, uint32(len(text)))
+	from := uint32(0)
+	if n := len(rval); n > 0 {
+		from = rval[n-1].End
+	}
+	if from < uint32(len(text)) || len(rval) == 0 {
+		rval = append(rval, ix.estimatePages(da, sections, text, from)...)
+	}
+
+	for i := range rval {
+		p := &rval[i]
+		p.Number = i + 1
+		p.Text = string(text[p.Start:p.End])
+		for n, s := range sections {
+			if p.Start >= s.Start {
+				p.Section = n + 1
+			}
+		}
+	}
+	return rval
+}
+
+// hintedPages returns the pages of the layout saved with the document, as far as it goes. Each page covers the
+// text ranges of its columns; text between pages goes with the later one.
+func (ix *Index) hintedPages(da *TP.DocumentArchive, length uint32) []Page {
+	ls, ok := ix.Deref(da.DeprecatedLayoutState).(*TP.LayoutStateArchive)
+	if !ok {
+		var best uint64
+		for id, v := range ix.Records {
+			if l, ok := v.(*TP.LayoutStateArchive); ok && (ls == nil || id < best) {
+				ls, best = l, id
+			}
+		}
+	}
+	hints := append([]*TP.SectionHintArchive{}, ls.GetSectionHints()...)
+	sort.SliceStable(hints, func(i, j int) bool { return hints[i].GetStartPageIndex() < hints[j].GetStartPageIndex() })
+
+	var rval []Page
+	end := uint32(0)
+	for _, sh := range hints {
+		for _, ph := range sh.PageHints {
+			if ph.GetPageKind() == TP.PageHintArchive_kPageKindDirty {
+				// the layout is stale from here on
+				return rval
+			}
+			last := end
+			for _, th := range ph.TargetHints {
+				if r := th.Range; r != nil && r.GetLocation()+r.GetLength() > last {
+					last = r.GetLocation() + r.GetLength()
+				}
+			}
+			if last > length {
+				last = length
+			}
+			rval = append(rval, Page{Start: end, End: last})
+			end = last
+		}
+	}
+	return rval
+}
+
+// estimatePages lays out the body text from offset from. Lines hold as many characters of the paragraph's text
+// size as fit the text width at half an em each, and are 1.2 times the text size tall.
+func (ix *Index) estimatePages(da *TP.DocumentArchive, sections []Section, text []rune, from uint32) []Page {
+	width, height := float64(da.GetPageWidth()), float64(da.GetPageHeight())
+	if width <= 0 || height <= 0 {
+		width, height = defaultPageWidth, defaultPageHeight
+	}
+	margin := func(v *float32) float64 {
+		if v == nil || *v < 0 {
+			return defaultMargin
+		}
+		return float64(*v)
+	}
+	width -= margin(da.LeftMargin) + margin(da.RightMargin)
+	height -= margin(da.TopMargin) + margin(da.BottomMargin)
+	if width < defaultTextSize || height < defaultTextSize {
+		width, height = defaultPageWidth-2*defaultMargin, defaultPageHeight-2*defaultMargin
+	}
+
+	var rval []Page
+	start, used := from, 0.0
+	newPage := func(at uint32) {
+		if at > start {
+			rval = append(rval, Page{Start: start, End: at, Estimated: true})
+			start = at
+		}
+		used = 0
+	}
+	for n, s := range sections {
+		if n > 0 && s.Start > from {
+			newPage(s.Start)
+		}
+		for _, p := range s.Paragraphs {
+			if p.End <= from {
+				continue
+			}
+			size := float64(ix.ResolveText(p.Style, nil).Size)
+			if size <= 0 {
+				size = defaultTextSize
+			}
+			format := ix.ResolveParagraph(p.Style)
+			perLine := int(math.Max(1, (width-float64(format.LeftIndent)-float64(format.RightIndent))/(size/2)))
+			runes := int(p.End - p.Start)
+			lines := (runes + perLine - 1) / perLine
+			if lines == 0 {
+				lines = 1
+			}
+			used += float64(format.SpaceBefore)
+			for k := 0; k < lines; k++ {
+				if used+size*1.2 > height && used > 0 {
+					if at := p.Start + uint32(k*perLine); at > from {
+						newPage(at)
+					} else {
+						used = 0
+					}
+				}
+				used += size * 1.2
+			}
+			used += float64(format.SpaceAfter)
+			if p.End > 0 && int(p.End) <= len(text) && text[p.End-1] == '\u000c' {
+				newPage(p.End)
+			}
+		}
+	}
+	if end := uint32(len(text)); end > start || len(rval) == 0 {
+		rval = append(rval, Page{Start: start, End: end, Estimated: true})
+	}
+	return rval
+}
+
+// pageAt returns the number of the page holding a body offset, or 0.
+func pageAt(pages []Page, offset uint32) int {
+	n := sort.Search(len(pages), func(i int) bool { return pages[i].End > offset })
+	if n < len(pages) {
+		return pages[n].Number
+	}
+	return 0
+}
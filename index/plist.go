@@ -0,0 +1,293 @@
+package index
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// parsePlist decodes a binary or XML property list. Dictionaries come back as map[string]interface{}, arrays as
+// []interface{}, and the scalars as string, int64, float64, bool, time.Time and []byte.
+func parsePlist(data []byte) (interface{}, error) {
+	if bytes.HasPrefix(data, []byte("bplist00")) {
+		return parseBinaryPlist(data)
+	}
+	return parseXMLPlist(data)
+}
+
+type bplist struct {
+	data    []byte
+	offsets []uint64
+	refSize int
+	depth   int
+	visits  int
+}
+
+// maxPlistObjects bounds the objects read from a binary plist, counting shared ones each time they're reached.
+const maxPlistObjects = 1000000
+
+func parseBinaryPlist(data []byte) (interface{}, error) {
+	if len(data) < 40 {
+		return nil, errors.New("plist: truncated")
+	}
+	trailer := data[len(data)-32:]
+	offSize, refSize := int(trailer[6]), int(trailer[7])
+	count := binary.BigEndian.Uint64(trailer[8:])
+	top := binary.BigEndian.Uint64(trailer[16:])
+	table := binary.BigEndian.Uint64(trailer[24:])
+	if offSize < 1 || offSize > 8 || refSize < 1 || refSize > 8 || count > uint64(len(data)) ||
+		table > uint64(len(data)) || count*uint64(offSize) > uint64(len(data))-table {
+		return nil, errors.New("plist: bad trailer")
+	}
+	p := &bplist{data: data, refSize: refSize}
+	for i := uint64(0); i < count; i++ {
+		start := table + i*uint64(offSize)
+		p.offsets = append(p.offsets, bigEndian(data[start:start+uint64(offSize)]))
+	}
+	return p.object(top)
+}
+
+func bigEndian(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func (p *bplist) object(ref uint64) (interface{}, error) {
+	if ref >= uint64(len(p.offsets)) || p.offsets[ref] >= uint64(len(p.data)) {
+		return nil, fmt.Errorf("plist: bad object reference %d", ref)
+	}
+	if p.depth > 64 {
+		return nil, errors.New("plist: nested too deeply")
+	}
+	// objects can be shared, so a small file can still expand exponentially
+	if p.visits++; p.visits > maxPlistObjects {
+		return nil, errors.New("plist: too many objects")
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+
+	pos := p.offsets[ref]
+	marker := p.data[pos]
+	pos++
+	kind, n := marker>>4, uint64(marker&0xf)
+	switch kind {
+	case 0x0:
+		switch marker {
+		case 0x08:
+			return false, nil
+		case 0x09:
+			return true, nil
+		}
+		return nil, nil
+	case 0x1:
+		b, err := p.bytes(pos, 1<<n)
+		if err != nil {
+			return nil, err
+		}
+		return int64(bigEndian(b)), nil
+	case 0x2, 0x3:
+		size := uint64(1) << n
+		if kind == 0x3 {
+			size = 8
+		}
+		b, err := p.bytes(pos, size)
+		if err != nil {
+			return nil, err
+		}
+		var f float64
+		if size == 4 {
+			f = float64(math.Float32frombits(uint32(bigEndian(b))))
+		} else {
+			f = math.Float64frombits(bigEndian(b))
+		}
+		if kind == 0x3 {
+			return appleTime(f), nil
+		}
+		return f, nil
+	}
+
+	// the remaining kinds have a length, which is a following int object if it doesn't fit in the marker
+	if n == 0xf {
+		b, err := p.bytes(pos, 1)
+		if err != nil || b[0]>>4 != 0x1 {
+			return nil, errors.New("plist: bad length")
+		}
+		size := uint64(1) << (b[0] & 0xf)
+		if b, err = p.bytes(pos+1, size); err != nil {
+			return nil, err
+		}
+		n = bigEndian(b)
+		pos += 1 + size
+	}
+	if n > uint64(len(p.data)) {
+		return nil, errors.New("plist: bad length")
+	}
+	switch kind {
+	case 0x4:
+		b, err := p.bytes(pos, n)
+		return append([]byte(nil), b...), err
+	case 0x5:
+		b, err := p.bytes(pos, n)
+		return string(b), err
+	case 0x6:
+		b, err := p.bytes(pos, 2*n)
+		if err != nil {
+			return nil, err
+		}
+		units := make([]uint16, n)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	case 0x8:
+		b, err := p.bytes(pos, n+1)
+		return int64(bigEndian(b)), err
+	case 0xa, 0xc:
+		refs, err := p.refs(pos, n)
+		if err != nil {
+			return nil, err
+		}
+		var rval []interface{}
+		for _, r := range refs {
+			v, err := p.object(r)
+			if err != nil {
+				return nil, err
+			}
+			rval = append(rval, v)
+		}
+		return rval, nil
+	case 0xd:
+		refs, err := p.refs(pos, 2*n)
+		if err != nil {
+			return nil, err
+		}
+		rval := make(map[string]interface{})
+		for i := uint64(0); i < n; i++ {
+			k, err := p.object(refs[i])
+			if err != nil {
+				return nil, err
+			}
+			v, err := p.object(refs[n+i])
+			if err != nil {
+				return nil, err
+			}
+			if key, ok := k.(string); ok {
+				rval[key] = v
+			}
+		}
+		return rval, nil
+	}
+	return nil, fmt.Errorf("plist: unknown marker %#x", marker)
+}
+
+func (p *bplist) bytes(pos, n uint64) ([]byte, error) {
+	if n > uint64(len(p.data)) || pos > uint64(len(p.data))-n {
+		return nil, errors.New("plist: truncated")
+	}
+	return p.data[pos : pos+n], nil
+}
+
+func (p *bplist) refs(pos, n uint64) ([]uint64, error) {
+	b, err := p.bytes(pos, n*uint64(p.refSize))
+	if err != nil {
+		return nil, err
+	}
+	rval := make([]uint64, n)
+	for i := range rval {
+		rval[i] = bigEndian(b[i*p.refSize : (i+1)*p.refSize])
+	}
+	return rval, nil
+}
+
+func parseXMLPlist(data []byte) (interface{}, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local != "plist" {
+			return xmlPlistValue(dec, se)
+		}
+	}
+}
+
+func xmlPlistValue(dec *xml.Decoder, se xml.StartElement) (interface{}, error) {
+	switch se.Name.Local {
+	case "dict":
+		rval := make(map[string]interface{})
+		key := ""
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				if t.Name.Local == "key" {
+					if err := dec.DecodeElement(&key, &t); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				v, err := xmlPlistValue(dec, t)
+				if err != nil {
+					return nil, err
+				}
+				rval[key] = v
+			case xml.EndElement:
+				return rval, nil
+			}
+		}
+	case "array":
+		rval := []interface{}{}
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				v, err := xmlPlistValue(dec, t)
+				if err != nil {
+					return nil, err
+				}
+				rval = append(rval, v)
+			case xml.EndElement:
+				return rval, nil
+			}
+		}
+	case "true":
+		return true, dec.Skip()
+	case "false":
+		return false, dec.Skip()
+	}
+
+	var text string
+	if err := dec.DecodeElement(&text, &se); err != nil {
+		return nil, err
+	}
+	text = strings.TrimSpace(text)
+	switch se.Name.Local {
+	case "integer":
+		return strconv.ParseInt(text, 10, 64)
+	case "real":
+		return strconv.ParseFloat(text, 64)
+	case "date":
+		return time.Parse(time.RFC3339, text)
+	case "data":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	}
+	return text, nil
+}
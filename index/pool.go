@@ -0,0 +1,28 @@
+package index
+
+import "sync"
+
+// maxPooled is the largest buffer kept for reuse, so one huge record doesn't stay in memory after loading.
+const maxPooled = 1 << 20
+
+// bufPool holds the buffers .iwa files are read into: snappy chunks, archive headers and payloads. A buffer only
+// goes back once nothing refers to it, as for a payload that decoded, whose message holds copies of what it needs.
+var bufPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+func getBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func putBuf(b *[]byte) {
+	if cap(*b) <= maxPooled {
+		bufPool.Put(b)
+	}
+}
+
+// grow returns b with length n, reallocating it if it's too small.
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
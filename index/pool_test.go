@@ -0,0 +1,44 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// iwaStream returns a compressed .iwa stream of n text storages, as Save writes them.
+func iwaStream(b *testing.B, n int) []byte {
+	ix := &Index{Type: "pages", Records: make(map[uint64]interface{})}
+	ids := make([]uint64, n)
+	for i := range ids {
+		ids[i] = uint64(i + 1)
+		ix.Records[ids[i]] = &TSWP.StorageArchive{Text: []string{strings.Repeat("lorem ipsum ", 50)}}
+	}
+	data, err := ix.encodeIWA(ids)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+// BenchmarkReadIWA decompresses and decodes an .iwa stream, reusing the pooled chunk, header and payload buffers
+// from one run to the next.
+func BenchmarkReadIWA(b *testing.B) {
+	data := iwaStream(b, 2000)
+	ix := &Index{Type: "pages", limits: DefaultLimits}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		archives, err := ix.readIWA(context.Background(), "Index/Document.iwa", bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(archives) != 2000 {
+			b.Fatalf("got %d archives, want 2000", len(archives))
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package index
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ErrNoPreview is returned by Preview when the document has no preview image.
+var ErrNoPreview = errors.New("document has no preview")
+
+// previewFiles are the preview images the apps save, largest first. The preview*.jpg files are written by current
+// versions, the QuickLook directory by iWork '09 era ones.
+var previewFiles = []string{
+	"preview.jpg",
+	"QuickLook/Thumbnail.jpg",
+	"preview-web.jpg",
+	"preview-micro.jpg",
+	"QuickLook/Preview.pdf",
+}
+
+// Preview returns the largest preview image saved with the document, and its MIME type. Previews of encrypted
+// documents are decrypted with the document password. It returns ErrNoPreview if there is none.
+func (ix *Index) Preview() (io.ReadCloser, string, error) {
+	for _, name := range previewFiles {
+		data, err := ix.readBundleFile(name)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		if ix.crypt != nil {
+			if plain, err := ix.crypt.decrypt(data); err == nil {
+				data = plain
+			}
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), mime.TypeByExtension(path.Ext(name)), nil
+	}
+	return nil, "", ErrNoPreview
+}
+
+// RemovePreviews drops the preview images of the document and the slide thumbnails of a Keynote document, which
+// show the content as it was saved. Save leaves them out and the apps draw new ones, so they can't give away text
+// that has since been edited out.
+func (ix *Index) RemovePreviews() error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	defer ix.invalidate()
+	for _, name := range previewFiles {
+		ix.omitFile(name)
+	}
+	thumbnails := make(map[uint64]bool)
+	for _, v := range ix.Records {
+		node, ok := v.(*KN.SlideNodeArchive)
+		if !ok {
+			continue
+		}
+		for _, ref := range node.Thumbnails {
+			thumbnails[ref.GetIdentifier()] = true
+		}
+		node.Thumbnails = nil
+		node.ThumbnailSizes = nil
+		node.DatabaseThumbnail = nil
+		node.DatabaseThumbnails = nil
+		node.ThumbnailsAreDirty = proto.Bool(true)
+	}
+	users := ix.mediaUsers()
+	for id := range thumbnails {
+		if len(users[id]) == 0 {
+			ix.removeData(id)
+		}
+	}
+	return nil
+}
+
+// omitFile leaves a bundle file out of the documents written by Save.
+func (ix *Index) omitFile(name string) {
+	if ix.omit == nil {
+		ix.omit = make(map[string]bool)
+	}
+	ix.omit[name] = true
+}
+
+// removeData drops a data file from the package metadata, and its file from the bundle.
+func (ix *Index) removeData(id uint64) {
+	meta := ix.packageMetadata()
+	if meta == nil {
+		return
+	}
+	datas := meta.Datas[:0]
+	for _, data := range meta.Datas {
+		if data.GetIdentifier() == id {
+			ix.omitFile(path.Join("Data", mediaFileName(data)))
+			continue
+		}
+		datas = append(datas, data)
+	}
+	meta.Datas = datas
+}
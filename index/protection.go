@@ -0,0 +1,144 @@
+package index
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+)
+
+// Why an object is restricted or couldn't be read
+const (
+	ProtectionLocked     = "locked"     // locked against editing, the content is still readable
+	ProtectionEncrypted  = "encrypted"  // encrypted, and the password is missing or wrong
+	ProtectionExternal   = "external"   // a resource kept outside the document package, such as a downloadable asset
+	ProtectionMissing    = "missing"    // listed in the document but absent from the bundle
+	ProtectionNotLoaded  = "not loaded" // not read yet, by OpenLazy or a truncated OpenBestEffort
+	ProtectionCorrupt    = "corrupt"    // present but failing its digest check
+	ProtectionUnreadable = "unreadable" // present but failing to read for another reason
+)
+
+// Protection is an object that is restricted or couldn't be read. Kind is "drawable", "media" or "component", and
+// ID the identifier of the record, data or component. Inaccessible is set when the content itself is unavailable,
+// rather than merely locked, and Error carries the underlying failure, if any.
+type Protection struct {
+	ID           uint64 `json:"id"`
+	Kind         string `json:"kind"`
+	Name         string `json:"name,omitempty"`
+	Reason       string `json:"reason"`
+	Inaccessible bool   `json:"inaccessible"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Protections lists the locked drawables and the media and components that couldn't be read, ordered by kind and
+// identifier. Callers of partial extraction can use it to say which parts of a document are missing from the result
+// and why. Media is read in full to check it, so this is slow for large documents.
+func (ix *Index) Protections() []Protection {
+	var rval []Protection
+	for _, info := range ix.Drawables() {
+		if info.Locked {
+			rval = append(rval, Protection{ID: info.ID, Kind: "drawable", Reason: ProtectionLocked})
+		}
+	}
+	rval = append(rval, ix.mediaProtections()...)
+	rval = append(rval, ix.componentProtections()...)
+
+	kinds := map[string]int{"drawable": 0, "media": 1, "component": 2}
+	sort.SliceStable(rval, func(i, j int) bool {
+		if rval[i].Kind != rval[j].Kind {
+			return kinds[rval[i].Kind] < kinds[rval[j].Kind]
+		}
+		return rval[i].ID < rval[j].ID
+	})
+	return rval
+}
+
+// Inaccessible is Protections limited to the objects whose content couldn't be read.
+func (ix *Index) Inaccessible() []Protection {
+	var rval []Protection
+	for _, p := range ix.Protections() {
+		if p.Inaccessible {
+			rval = append(rval, p)
+		}
+	}
+	return rval
+}
+
+func (ix *Index) mediaProtections() []Protection {
+	meta := ix.packageMetadata()
+	if meta == nil {
+		return nil
+	}
+	external := make(map[uint64]bool)
+	for _, data := range meta.Datas {
+		if data.GetDocumentResourceLocator() != "" {
+			external[data.GetIdentifier()] = true
+		}
+	}
+	var rval []Protection
+	for _, m := range ix.Media() {
+		p := Protection{ID: m.ID, Kind: "media", Name: m.Name, Inaccessible: true}
+		switch {
+		case m.Size < 0 && external[m.ID]:
+			p.Reason = ProtectionExternal
+		case m.Size < 0:
+			p.Reason = ProtectionMissing
+		default:
+			err := ix.readMedia(m.ID)
+			if err == nil {
+				continue
+			}
+			p.Reason, p.Error = mediaReason(err), err.Error()
+		}
+		rval = append(rval, p)
+	}
+	return rval
+}
+
+// readMedia reads a media file through to the end, so decryption and the digest are checked.
+func (ix *Index) readMedia(id uint64) error {
+	rc, err := ix.OpenMedia(id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(ioutil.Discard, rc)
+	return err
+}
+
+func mediaReason(err error) string {
+	switch {
+	case errors.Is(err, ErrPasswordRequired), errors.Is(err, ErrWrongPassword):
+		return ProtectionEncrypted
+	case errors.Is(err, ErrDigestMismatch):
+		return ProtectionCorrupt
+	}
+	return ProtectionUnreadable
+}
+
+// componentProtections lists the components whose .iwa file wasn't loaded. Documents read from sqlite don't track
+// loaded files and have nothing to report.
+func (ix *Index) componentProtections() []Protection {
+	meta := ix.packageMetadata()
+	if meta == nil || ix.loaded == nil {
+		return nil
+	}
+	var rval []Protection
+	for _, c := range meta.Components {
+		locator := c.GetLocator()
+		if locator == "" {
+			locator = c.GetPreferredLocator()
+		}
+		name := path.Join("Index", locator+".iwa")
+		if rootFiles[name] || ix.loaded[name] {
+			continue
+		}
+		p := Protection{ID: c.GetIdentifier(), Kind: "component", Name: name, Reason: ProtectionMissing, Inaccessible: true}
+		if ix.lazy {
+			p.Reason = ProtectionNotLoaded
+		}
+		rval = append(rval, p)
+	}
+	return rval
+}
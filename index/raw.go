@@ -0,0 +1,46 @@
+package index
+
+import "sort"
+
+// RawRecord stands in Records for a record that wasn't decoded: its type id is unknown to the decoders, its payload
+// is malformed, or it was left out by Options.Types. Exporters skip it like any other record they don't handle,
+// and Save writes the payload back unchanged.
+type RawRecord struct {
+	ID      uint64
+	Type    uint32
+	Payload []byte
+}
+
+// addRaw keeps the payload of record id as a RawRecord if nothing was decoded for it.
+func (ix *Index) addRaw(id uint64, typ uint32, payload []byte) {
+	if _, ok := ix.Records[id]; !ok {
+		ix.Records[id] = &RawRecord{ID: id, Type: typ, Payload: payload}
+	}
+}
+
+// RawRecords returns the records that weren't decoded, ordered by identifier.
+func (ix *Index) RawRecords() []*RawRecord {
+	var rval []*RawRecord
+	for _, v := range ix.Records {
+		if raw, ok := v.(*RawRecord); ok {
+			rval = append(rval, raw)
+		}
+	}
+	sort.Slice(rval, func(i, j int) bool { return rval[i].ID < rval[j].ID })
+	return rval
+}
+
+// rawReferences returns the identifiers of the records and data a raw record references, as listed in its archive
+// header.
+func (ix *Index) rawReferences(raw *RawRecord) (objects, datas []uint64) {
+	info := ix.infos[raw.ID]
+	if info == nil || info.archive == nil {
+		return nil, nil
+	}
+	for _, mi := range info.archive.MessageInfos {
+		if mi.GetType() == raw.Type {
+			return mi.ObjectReferences, mi.DataReferences
+		}
+	}
+	return nil, nil
+}
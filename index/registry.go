@@ -0,0 +1,91 @@
+package index
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// registryKey is a registered archive type: a document type ("" for all of them) and a type id.
+type registryKey struct {
+	doc Type
+	typ uint32
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[registryKey]Decoder{}
+)
+
+// Decoder decodes the payloads of an archive type, for private or newly worked out archives that have no proto
+// in this module. See RegisterDecoder.
+type Decoder interface {
+	// Decode returns the record for a payload. It's also called with an empty payload to learn the Go type of the
+	// records, and must return a zero value then. A nil value with an error marks the type as unknown, a value with
+	// an error a known type that failed, see DecodeError. Protobuf messages save like the built in records; other
+	// values need a Marshal() ([]byte, error) method for Save.
+	Decode(payload []byte) (interface{}, error)
+}
+
+// DecoderFunc adapts a function to a Decoder.
+type DecoderFunc func(payload []byte) (interface{}, error)
+
+// Decode calls f.
+func (f DecoderFunc) Decode(payload []byte) (interface{}, error) {
+	return f(payload)
+}
+
+// messageDecoder unmarshals payloads into new messages, the Decoder of RegisterType.
+type messageDecoder func() proto.Message
+
+func (f messageDecoder) Decode(payload []byte) (interface{}, error) {
+	value := f()
+	return value, proto.Unmarshal(payload, value)
+}
+
+// RegisterDecoder adds a decoder for an archive type id, for one document type or for all of them if docType is
+// empty. Registered decoders take precedence over the built in ones. Decoders must copy what they keep of a
+// payload, its buffer is reused. Register them before opening documents, typically from an init function.
+func RegisterDecoder(docType Type, typ uint32, d Decoder) {
+	registryMu.Lock()
+	registry[registryKey{docType, typ}] = d
+	registryMu.Unlock()
+	resetTypeCaches()
+}
+
+// RegisterType is RegisterDecoder for protobuf messages. newMessage returns an empty message that payloads of that
+// type are unmarshaled into, so a type can also be replaced by a message from newer protos.
+func RegisterType(docType Type, typ uint32, newMessage func() proto.Message) {
+	RegisterDecoder(docType, typ, messageDecoder(newMessage))
+}
+
+// resetTypeCaches drops the type names and ids worked out from the decoders, after a registration.
+func resetTypeCaches() {
+	typeNamesMu.Lock()
+	typeNames = map[string]map[uint32]string{}
+	typeNamesMu.Unlock()
+	typeIDsMu.Lock()
+	typeIDs = map[string]map[reflect.Type]uint32{}
+	goTypes = map[string]map[uint32]reflect.Type{}
+	typeIDsMu.Unlock()
+}
+
+// registered returns the registered decoder for a type id, if any.
+func registered(docType string, typ uint32) Decoder {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if f := registry[registryKey{Type(docType), typ}]; f != nil {
+		return f
+	}
+	return registry[registryKey{"", typ}]
+}
+
+// NewMessage returns an empty message of the Go type that payloads of an archive type id decode to, or nil if the
+// type id isn't known for the document type.
+func NewMessage(docType Type, typ uint32) proto.Message {
+	ix := &Index{Type: string(docType)}
+	value, _ := ix.decode(typ, nil)
+	msg, _ := value.(proto.Message)
+	return msg
+}
@@ -0,0 +1,56 @@
+package index
+
+import (
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TP"
+)
+
+// RootID returns the identifier of the document's top level archive. It is the identifier of the "Document"
+// component in the package metadata, which is 1 in every document we've seen, so 1 is assumed when the metadata is
+// missing.
+func (ix *Index) RootID() uint64 {
+	if meta := ix.packageMetadata(); meta != nil {
+		for _, c := range meta.Components {
+			if c.GetPreferredLocator() == "Document" || c.GetLocator() == "Document" {
+				return c.GetIdentifier()
+			}
+		}
+	}
+	return 1
+}
+
+// Root returns the top level archive of the document: a *TP.DocumentArchive, *TN.DocumentArchive or
+// *KN.DocumentArchive. If nothing of those types is found at RootID, the records are searched for one. Root
+// returns nil if the document has none.
+func (ix *Index) Root() interface{} {
+	if v := ix.Records[ix.RootID()]; isRoot(v) {
+		return v
+	}
+	var rval interface{}
+	var best uint64
+	for id, v := range ix.Records {
+		if isRoot(v) && (rval == nil || id < best) {
+			rval, best = v, id
+		}
+	}
+	return rval
+}
+
+func isRoot(v interface{}) bool {
+	switch v.(type) {
+	case *TP.DocumentArchive, *TN.DocumentArchive, *KN.DocumentArchive:
+		return true
+	}
+	return false
+}
+
+// Show returns the show archive of a Keynote document, which holds the slide tree, or nil for other documents.
+func (ix *Index) Show() *KN.ShowArchive {
+	da, ok := ix.Root().(*KN.DocumentArchive)
+	if !ok {
+		return nil
+	}
+	show, _ := ix.Deref(da.Show).(*KN.ShowArchive)
+	return show
+}
@@ -0,0 +1,181 @@
+package index
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dunhamsteve/iwork/proto/TP"
+)
+
+// SearchOptions control how Search matches. The zero value finds the query as plain text, ignoring case.
+type SearchOptions struct {
+	CaseSensitive bool
+	WholeWord     bool // only match whole words
+	Regexp        bool // the query is a regular expression, in the syntax of the regexp package
+	Limit         int  // stop after this many matches, 0 for all of them
+	Context       int  // runes of text shown each side of a match in the snippet, 30 if zero
+}
+
+// SearchMatch is a place the query was found. ID is the record holding the text: the body storage of a Pages
+// document, a table drawable or a Keynote slide. Offset is the position of the match in the text of its paragraph
+// or cell, in runes. The location fields count from 1, and are zero if they don't apply: Section, Paragraph and
+// Page (see BodyPages) for the body of a Pages document, Slide and Paragraph for a slide (Notes if it's in the
+// presenter notes), and Sheet, Table, Row and Column for a table cell.
+type SearchMatch struct {
+	ID        uint64 `json:"id"`
+	Text      string `json:"text"`
+	Snippet   string `json:"snippet"`
+	Offset    int    `json:"offset"`
+	Section   int    `json:"section,omitempty"`
+	Paragraph int    `json:"paragraph,omitempty"`
+	Page      int    `json:"page,omitempty"`
+	Slide     int    `json:"slide,omitempty"`
+	Notes     bool   `json:"notes,omitempty"`
+	Sheet     string `json:"sheet,omitempty"`
+	Table     string `json:"table,omitempty"`
+	Row       int    `json:"row,omitempty"`
+	Column    int    `json:"column,omitempty"`
+}
+
+// Search finds a query in the text of a document: the body of a Pages document, the text and notes of Keynote
+// slides and the cells of tables, which are matched as Numbers shows them. Matches are returned in document order,
+// the body or slides first and then the tables. A nil opts is the same as the zero SearchOptions.
+func (ix *Index) Search(query string, opts *SearchOptions) ([]SearchMatch, error) {
+	if opts == nil {
+		opts = &SearchOptions{}
+	}
+	if query == "" {
+		return nil, errors.New("empty search query")
+	}
+	pattern := query
+	if !opts.Regexp {
+		pattern = regexp.QuoteMeta(query)
+	}
+	if opts.WholeWord {
+		pattern = `\b(?:` + pattern + `)\b`
+	}
+	if !opts.CaseSensitive {
+		pattern = `(?i)` + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	context := opts.Context
+	if context <= 0 {
+		context = 30
+	}
+
+	var rval []SearchMatch
+	full := func() bool { return opts.Limit > 0 && len(rval) >= opts.Limit }
+	find := func(text string, at SearchMatch) {
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			if full() {
+				return
+			}
+			if loc[0] == loc[1] {
+				continue
+			}
+			m := at
+			m.Text = text[loc[0]:loc[1]]
+			m.Offset = utf8.RuneCountInString(text[:loc[0]])
+			m.Snippet = snippet(text, loc[0], loc[1], context)
+			rval = append(rval, m)
+		}
+	}
+
+	if da, ok := ix.Root().(*TP.DocumentArchive); ok {
+		body := da.GetBodyStorage().GetIdentifier()
+		first := len(rval)
+		var starts []uint32 // of the paragraphs of the matches
+		for i, s := range ix.Sections() {
+			for j, p := range s.Paragraphs {
+				find(p.Text, SearchMatch{ID: body, Section: i + 1, Paragraph: j + 1})
+				for len(starts) < len(rval)-first {
+					starts = append(starts, p.Start)
+				}
+			}
+		}
+		if len(starts) > 0 {
+			pages := ix.BodyPages()
+			for k, start := range starts {
+				m := &rval[first+k]
+				m.Page = pageAt(pages, start+uint32(m.Offset))
+			}
+		}
+	}
+
+	if ix.Type == "key" {
+		for n := range ix.Slides() {
+			if full() {
+				break
+			}
+			slide, err := ix.Slide(n + 1)
+			if err != nil {
+				return rval, err
+			}
+			for j, text := range slide.Text {
+				find(text, SearchMatch{ID: slide.ID, Slide: n + 1, Paragraph: j + 1})
+			}
+			if slide.Notes != "" {
+				find(slide.Notes, SearchMatch{ID: slide.ID, Slide: n + 1, Notes: true})
+			}
+		}
+	}
+
+	sheets := ix.tableSheets()
+	for _, t := range ix.Tables() {
+		for r, row := range t.Rows {
+			for c, cell := range row {
+				if cell.Type == EmptyCell {
+					continue
+				}
+				text := ix.CellFormat(t.Model, cell).Format(cell)
+				find(text, SearchMatch{ID: t.ID, Sheet: sheets[t.ID], Table: t.Name, Row: r + 1, Column: c + 1})
+			}
+		}
+	}
+	return rval, nil
+}
+
+// tableSheets maps the table drawables of a Numbers document to the names of their sheets.
+func (ix *Index) tableSheets() map[uint64]string {
+	rval := make(map[uint64]string)
+	for _, sheet := range ix.Sheets() {
+		for _, id := range sheet.Tables {
+			rval[id] = sheet.Name
+		}
+	}
+	return rval
+}
+
+// snippet returns the text around text[start:end], with up to context runes each side. Line breaks are shown as
+// spaces and cut text is marked with an ellipsis.
+func snippet(text string, start, end, context int) string {
+	from := start
+	for n := 0; n < context && from > 0; n++ {
+		_, size := utf8.DecodeLastRuneInString(text[:from])
+		from -= size
+	}
+	to := end
+	for n := 0; n < context && to < len(text); n++ {
+		_, size := utf8.DecodeRuneInString(text[to:])
+		to += size
+	}
+	rval := strings.TrimSpace(text[from:to])
+	if from > 0 {
+		rval = "…" + rval
+	}
+	if to < len(text) {
+		rval += "…"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\n', '\r', '\t', '\u000c', '\u2028', '\u2029':
+			return ' '
+		}
+		return r
+	}, rval)
+}
@@ -0,0 +1,215 @@
+package index
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Section is a section of a Pages document body. Start and End are the rune offsets of its text in the body
+// storage. First, Even and Odd are the headers and footers of its first, even and odd pages; First and Even are
+// nil unless the section sets them apart, Odd applies to every other page.
+type Section struct {
+	ID         uint64       `json:"id"`
+	Name       string       `json:"name,omitempty"`
+	Start      uint32       `json:"start"`
+	End        uint32       `json:"end"`
+	Paragraphs []Paragraph  `json:"paragraphs"`
+	First      *PageHeaders `json:"first,omitempty"`
+	Even       *PageHeaders `json:"even,omitempty"`
+	Odd        *PageHeaders `json:"odd,omitempty"`
+}
+
+// PageHeaders are the headers and footers of a kind of page. Each holds the paragraphs of the fields Pages lays out
+// left to right, nil for an empty field.
+type PageHeaders struct {
+	Headers [][]Paragraph `json:"headers,omitempty"`
+	Footers [][]Paragraph `json:"footers,omitempty"`
+}
+
+// Footnote is a footnote or endnote. Storage and Offset locate its reference mark, Section is the index of the
+// section holding the mark, or -1 if it's outside the body (in a text box, say). Mark is the custom mark if the
+// note has one, else its number in the document's footnote format.
+type Footnote struct {
+	ID         uint64      `json:"id"`
+	Mark       string      `json:"mark"`
+	Endnote    bool        `json:"endnote,omitempty"`
+	Storage    uint64      `json:"storage"`
+	Offset     uint32      `json:"offset"`
+	Section    int         `json:"section"`
+	Paragraphs []Paragraph `json:"paragraphs"`
+}
+
+// Sections returns the sections of a Pages document body, in order, or nil for other documents. A body without
+// section breaks is a single section.
+func (ix *Index) Sections() []Section {
+	da, ok := ix.Root().(*TP.DocumentArchive)
+	if !ok {
+		return nil
+	}
+	body, ok := ix.Deref(da.BodyStorage).(*TSWP.StorageArchive)
+	if !ok {
+		return nil
+	}
+
+	type mark struct {
+		start uint32
+		ref   *TSP.Reference
+	}
+	var marks []mark
+	if body.TableSection != nil {
+		for _, e := range body.TableSection.Entries {
+			marks = append(marks, mark{e.GetCharacterIndex(), e.Object})
+		}
+	}
+	if len(marks) == 0 || marks[0].start != 0 {
+		marks = append([]mark{{0, da.Section}}, marks...)
+	}
+
+	paras := ix.StorageParagraphs(body)
+	length := uint32(len([]rune(strings.Join(body.Text, ""))))
+	var rval []Section
+	for i, m := range marks {
+		s := Section{ID: m.ref.GetIdentifier(), Start: m.start, End: length}
+		if i+1 < len(marks) {
+			s.End = marks[i+1].start
+		}
+		for _, p := range paras {
+			if p.Start >= s.Start && p.Start < s.End {
+				s.Paragraphs = append(s.Paragraphs, p)
+			}
+		}
+		if sa, ok := ix.Deref(m.ref).(*TP.SectionArchive); ok {
+			s.Name = sa.GetName()
+			if sa.GetInheritPreviousHeaderFooter() && len(rval) > 0 {
+				prev := rval[len(rval)-1]
+				s.First, s.Even, s.Odd = prev.First, prev.Even, prev.Odd
+			} else {
+				if sa.GetPageMasterFirstPageDifferent() {
+					s.First = ix.pageHeaders(sa.FirstPageMaster)
+				}
+				if sa.GetPageMasterEvenOddPagesDifferent() {
+					s.Even = ix.pageHeaders(sa.EvenPageMaster)
+				}
+				s.Odd = ix.pageHeaders(sa.OddPageMaster)
+			}
+		}
+		rval = append(rval, s)
+	}
+	return rval
+}
+
+// pageHeaders reads the headers and footers of a page master.
+func (ix *Index) pageHeaders(ref *TSP.Reference) *PageHeaders {
+	pm, ok := ix.Deref(ref).(*TP.PageMasterArchive)
+	if !ok {
+		return nil
+	}
+	fields := func(refs []*TSP.Reference) [][]Paragraph {
+		var rval [][]Paragraph
+		for _, ref := range refs {
+			rval = append(rval, ix.Paragraphs(ref))
+		}
+		return rval
+	}
+	return &PageHeaders{Headers: fields(pm.Headers), Footers: fields(pm.Footers)}
+}
+
+// Footnotes returns the footnotes or endnotes of a Pages document in the order their marks appear, the body first
+// and then the other storages by identifier. It returns nil for other documents.
+func (ix *Index) Footnotes() []Footnote {
+	da, ok := ix.Root().(*TP.DocumentArchive)
+	if !ok {
+		return nil
+	}
+	settings, _ := ix.Deref(da.Settings).(*TP.SettingsArchive)
+	kind := settings.GetFootnoteKind()
+	endnote := kind != TP.SettingsArchive_kFootnoteKindFootnotes
+
+	bodyID := da.BodyStorage.GetIdentifier()
+	ids := []uint64{bodyID}
+	var others []uint64
+	for id, v := range ix.Records {
+		if st, ok := v.(*TSWP.StorageArchive); ok && id != bodyID && st.TableFootnote != nil {
+			others = append(others, id)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i] < others[j] })
+	ids = append(ids, others...)
+
+	sections := ix.Sections()
+	var rval []Footnote
+	n, section := 0, -1
+	for _, id := range ids {
+		st, ok := ix.Records[id].(*TSWP.StorageArchive)
+		if !ok || st.TableFootnote == nil {
+			continue
+		}
+		for _, e := range st.TableFootnote.Entries {
+			att, ok := ix.Deref(e.Object).(*TSWP.FootnoteReferenceAttachmentArchive)
+			if !ok {
+				continue
+			}
+			f := Footnote{
+				ID:         e.Object.GetIdentifier(),
+				Endnote:    endnote,
+				Storage:    id,
+				Offset:     e.GetCharacterIndex(),
+				Section:    -1,
+				Paragraphs: ix.Paragraphs(att.ContainedStorage),
+			}
+			if id == bodyID {
+				for i, s := range sections {
+					if f.Offset >= s.Start && f.Offset < s.End {
+						f.Section = i
+					}
+				}
+			}
+			// Section endnotes are numbered from one in each section.
+			if kind == TP.SettingsArchive_kFootnoteKindSectionEndnotes && f.Section != section {
+				n, section = 0, f.Section
+			}
+			if att.CustomMarkString != nil {
+				f.Mark = att.GetCustomMarkString()
+			} else {
+				n++
+				f.Mark = footnoteMark(n, settings.GetFootnoteFormat())
+			}
+			rval = append(rval, f)
+		}
+	}
+	return rval
+}
+
+// footnoteSymbols are the marks of the symbolic footnote format, doubled up after the first round.
+var footnoteSymbols = []string{"*", "†", "‡", "§", "‖", "¶"}
+
+// footnoteMark formats the number of a footnote. The Japanese formats fall back to numbers.
+func footnoteMark(n int, format TP.SettingsArchive_FootnoteFormat) string {
+	switch format {
+	case TP.SettingsArchive_kFootnoteFormatRoman:
+		return strings.ToLower(roman(n))
+	case TP.SettingsArchive_kFootnoteFormatSymbolic:
+		s := footnoteSymbols[(n-1)%len(footnoteSymbols)]
+		return strings.Repeat(s, (n-1)/len(footnoteSymbols)+1)
+	}
+	return strconv.Itoa(n)
+}
+
+// roman writes n in roman numerals.
+func roman(n int) string {
+	values := []int{1000, 900, 500, 400, 100, 90, 50, 40, 10, 9, 5, 4, 1}
+	digits := []string{"M", "CM", "D", "CD", "C", "XC", "L", "XL", "X", "IX", "V", "IV", "I"}
+	var sb strings.Builder
+	for i, v := range values {
+		for n >= v {
+			sb.WriteString(digits[i])
+			n -= v
+		}
+	}
+	return sb.String()
+}
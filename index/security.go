@@ -0,0 +1,74 @@
+package index
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// SecurityInfo summarizes how a document is protected.
+type SecurityInfo struct {
+	Encrypted       bool   `json:"encrypted"`
+	HasHint         bool   `json:"has_hint"`
+	Hint            string `json:"hint,omitempty"`
+	ProtectionClass string `json:"protection_class,omitempty"`
+}
+
+// Security reports the protection posture of a document without attempting to decrypt it.
+func Security(doc string) (*SecurityInfo, error) {
+	var verifier, hint []byte
+	fn := path.Join(doc, "Index.zip")
+	if _, err := os.Stat(fn); err == nil {
+		verifier, _ = ioutil.ReadFile(path.Join(doc, passwordVerifierName))
+		hint, _ = ioutil.ReadFile(path.Join(doc, passwordHintName))
+		return newSecurityInfo(verifier, hint), nil
+	}
+
+	if zf, err := openFlatZip(doc); err == nil {
+		defer zf.Close()
+		verifier, _ = readZipFile(&zf.Reader, passwordVerifierName)
+		hint, _ = readZipFile(&zf.Reader, passwordHintName)
+		return newSecurityInfo(verifier, hint), nil
+	}
+
+	fn = path.Join(doc, "index.db")
+	if _, err := os.Stat(fn); err == nil {
+		verifier, _ = ioutil.ReadFile(path.Join(doc, passwordVerifierName))
+		hint, _ = ioutil.ReadFile(path.Join(doc, passwordHintName))
+		info := newSecurityInfo(verifier, hint)
+		db, err := sql.Open("sqlite3", fn)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		info.ProtectionClass = protectionClass(db)
+		return info, nil
+	}
+
+	return nil, fmt.Errorf("%s: %w", doc, ErrNotIWork)
+}
+
+func newSecurityInfo(verifier, hint []byte) *SecurityInfo {
+	info := &SecurityInfo{}
+	if verifier != nil {
+		info.Encrypted = true
+	}
+	if len(hint) > 0 {
+		info.HasHint = true
+		info.Hint = strings.TrimSpace(string(hint))
+	}
+	return info
+}
+
+// protectionClass reads the data protection class recorded in a .pages-tef database, if there is one.
+func protectionClass(db *sql.DB) string {
+	var class string
+	err := db.QueryRow(`select value from properties where name = 'protectionClass'`).Scan(&class)
+	if err != nil {
+		return ""
+	}
+	return class
+}
@@ -0,0 +1,109 @@
+package index
+
+import (
+	"errors"
+
+	"github.com/dunhamsteve/iwork/proto/TN"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// DeleteSheet removes a sheet of a Numbers document with the records only it reaches: its tables, their cell
+// storage and its drawables. Records the rest of the document also reaches, like the stylesheet, are kept.
+// Components left without their root record are dropped from the manifest. The last sheet can't be removed.
+func (ix *Index) DeleteSheet(sheet uint64) error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	if ix.lazy {
+		return ErrPartial
+	}
+	defer ix.invalidate()
+	da, ok := ix.Root().(*TN.DocumentArchive)
+	if !ok {
+		return errors.New("not a Numbers document")
+	}
+	at := -1
+	for i, ref := range da.Sheets {
+		if ref.GetIdentifier() == sheet {
+			at = i
+		}
+	}
+	if at < 0 {
+		return errors.New("no such sheet")
+	}
+	if len(da.Sheets) < 2 {
+		return errors.New("can't delete the last sheet")
+	}
+	da.Sheets = append(da.Sheets[:at], da.Sheets[at+1:]...)
+	if ui := da.Uistate; ui != nil {
+		ui.SheetUistateDictionaryEntry = dropSheetState(ui.SheetUistateDictionaryEntry, sheet)
+		ui.EditModeSheetUistateDictionaryEntry = dropSheetState(ui.EditModeSheetUistateDictionaryEntry, sheet)
+		ui.ActiveSheetIndex = proto.Uint32(sheetIndexAfter(ui.GetActiveSheetIndex(), uint32(at)))
+		if ui.EditingSheetIndex != nil {
+			ui.EditingSheetIndex = proto.Uint32(sheetIndexAfter(ui.GetEditingSheetIndex(), uint32(at)))
+		}
+	}
+
+	// the records reachable from the sheet, less those also reachable from records outside of it
+	held := make(map[uint64]bool)
+	ix.Walk(sheet, 0, func(id uint64, v interface{}, parent uint64, depth int) error {
+		if v == nil {
+			return SkipReferences
+		}
+		held[id] = true
+		return nil
+	})
+	var queue []uint64
+	for id := range ix.Records {
+		if !held[id] {
+			queue = append(queue, id)
+		}
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		var objects []uint64
+		if raw, ok := ix.Records[id].(*RawRecord); ok {
+			objects, _ = ix.rawReferences(raw)
+		} else {
+			objects, _ = references(ix.Records[id])
+		}
+		for _, ref := range objects {
+			if held[ref] && ref != sheet {
+				delete(held, ref)
+				queue = append(queue, ref)
+			}
+		}
+	}
+
+	for id := range held {
+		if c := ix.component(ix.File(id)); c != nil && held[c.GetIdentifier()] {
+			ix.removeComponent(c)
+		}
+	}
+	for id := range held {
+		delete(ix.Records, id)
+	}
+	return nil
+}
+
+// dropSheetState removes the view state kept for a sheet.
+func dropSheetState(entries []*TN.SheetUIStateDictionaryEntryArchive, sheet uint64) []*TN.SheetUIStateDictionaryEntryArchive {
+	rval := entries[:0]
+	for _, entry := range entries {
+		if entry.GetSheet().GetIdentifier() != sheet {
+			rval = append(rval, entry)
+		}
+	}
+	return rval
+}
+
+// sheetIndexAfter returns the position of the sheet at index once the sheet at removed is gone. The removed sheet
+// itself gives way to the one before it.
+func sheetIndexAfter(index, removed uint32) uint32 {
+	if index < removed || index == 0 {
+		return index
+	}
+	return index - 1
+}
@@ -0,0 +1,56 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func ref(id uint64) *TSP.Reference {
+	return &TSP.Reference{Identifier: proto.Uint64(id)}
+}
+
+func TestDeleteSheet(t *testing.T) {
+	// two sheets, each with a table, sharing a stylesheet
+	ix := &Index{Type: "numbers", Records: map[uint64]interface{}{
+		1: &TN.DocumentArchive{
+			Sheets:     []*TSP.Reference{ref(10), ref(20)},
+			Stylesheet: ref(5),
+			Uistate: &TN.UIStateArchive{
+				ActiveSheetIndex:            proto.Uint32(1),
+				SheetUistateDictionaryEntry: []*TN.SheetUIStateDictionaryEntryArchive{{Sheet: ref(10)}, {Sheet: ref(20)}},
+			},
+		},
+		5:  &TST.TableStyleArchive{},
+		10: &TN.SheetArchive{DrawableInfos: []*TSP.Reference{ref(11)}},
+		11: &TST.TableInfoArchive{TableModel: ref(12)},
+		12: &TST.TableModelArchive{TableStyle: ref(5)},
+		20: &TN.SheetArchive{DrawableInfos: []*TSP.Reference{ref(21)}},
+		21: &TST.TableInfoArchive{TableModel: ref(22)},
+		22: &TST.TableModelArchive{TableStyle: ref(5)},
+	}}
+	if err := ix.DeleteSheet(20); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint64{20, 21, 22} {
+		if _, ok := ix.Records[id]; ok {
+			t.Errorf("record %d of the deleted sheet was kept", id)
+		}
+	}
+	for _, id := range []uint64{1, 5, 10, 11, 12} {
+		if _, ok := ix.Records[id]; !ok {
+			t.Errorf("record %d was deleted", id)
+		}
+	}
+	ui := ix.Records[1].(*TN.DocumentArchive).Uistate
+	if len(ui.SheetUistateDictionaryEntry) != 1 || ui.GetActiveSheetIndex() != 0 {
+		t.Errorf("unexpected view state %v", ui)
+	}
+	if err := ix.DeleteSheet(10); err == nil {
+		t.Error("deleted the last sheet")
+	}
+}
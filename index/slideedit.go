@@ -0,0 +1,342 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The slide mutators take slide ids, as returned by Slides, and keep the slide tree, the navigator state and the
+// component manifest in step. The records a slide holds are those reachable from it in its own .iwa file: its
+// drawables, text, notes and builds, but not its master or the shared styles.
+
+// slidePosition finds the slide tree node of a slide, the node it sits under and its index there.
+func (ix *Index) slidePosition(slide uint64) (nodeID uint64, parent *KN.SlideNodeArchive, at int, err error) {
+	show := ix.Show()
+	if show == nil {
+		return 0, nil, 0, errors.New("not a Keynote document")
+	}
+	root, ok := ix.Deref(show.GetSlideTree().GetRootSlideNode()).(*KN.SlideNodeArchive)
+	if !ok {
+		return 0, nil, 0, errors.New("missing slide tree")
+	}
+	seen := make(map[*KN.SlideNodeArchive]bool)
+	var find func(sn *KN.SlideNodeArchive) bool
+	find = func(sn *KN.SlideNodeArchive) bool {
+		if seen[sn] {
+			return false
+		}
+		seen[sn] = true
+		for i, ref := range sn.Children {
+			child, ok := ix.Deref(ref).(*KN.SlideNodeArchive)
+			if !ok {
+				continue
+			}
+			if child.GetSlide().GetIdentifier() == slide {
+				nodeID, parent, at = ref.GetIdentifier(), sn, i
+				return true
+			}
+			if find(child) {
+				return true
+			}
+		}
+		return false
+	}
+	if !find(root) {
+		return 0, nil, 0, fmt.Errorf("no slide %d", slide)
+	}
+	return nodeID, parent, at, nil
+}
+
+// MoveSlide moves a slide, with the slides grouped under it, in front of the slide before and to its level. With
+// before 0 the slide moves to the end of the top level.
+func (ix *Index) MoveSlide(slide, before uint64) error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	defer ix.invalidate()
+	if slide == before {
+		return nil
+	}
+	nodeID, parent, at, err := ix.slidePosition(slide)
+	if err != nil {
+		return err
+	}
+	if before != 0 {
+		if _, _, _, err := ix.slidePosition(before); err != nil {
+			return err
+		}
+		if ix.slideUnder(ix.Records[nodeID].(*KN.SlideNodeArchive), before) {
+			return errors.New("can't move a slide into its own group")
+		}
+	}
+	ref := parent.Children[at]
+	parent.Children = append(parent.Children[:at], parent.Children[at+1:]...)
+
+	if before == 0 {
+		root := ix.Deref(ix.Show().GetSlideTree().GetRootSlideNode()).(*KN.SlideNodeArchive)
+		root.Children = append(root.Children, ref)
+		return nil
+	}
+	_, dest, at, _ := ix.slidePosition(before)
+	dest.Children = append(dest.Children[:at], append([]*TSP.Reference{ref}, dest.Children[at:]...)...)
+	return nil
+}
+
+// slideUnder reports whether a slide is grouped under a slide tree node, at any depth.
+func (ix *Index) slideUnder(node *KN.SlideNodeArchive, slide uint64) bool {
+	for _, ref := range node.Children {
+		if child, ok := ix.Deref(ref).(*KN.SlideNodeArchive); ok {
+			if child.GetSlide().GetIdentifier() == slide || ix.slideUnder(child, slide) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetSlideSkipped sets whether a slide is skipped when the presentation plays.
+func (ix *Index) SetSlideSkipped(slide uint64, skipped bool) error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	defer ix.invalidate()
+	nodeID, _, _, err := ix.slidePosition(slide)
+	if err != nil {
+		return err
+	}
+	ix.Records[nodeID].(*KN.SlideNodeArchive).IsHidden = proto.Bool(skipped)
+	return nil
+}
+
+// DuplicateSlide copies a slide and the records it holds, puts the copy right after it and returns the id of the
+// copy. Slides grouped under it aren't copied. If the slide has a component of its own the copy gets a new one, in
+// its own .iwa file; otherwise the copy goes in the same file.
+func (ix *Index) DuplicateSlide(slide uint64) (uint64, error) {
+	if err := ix.writable(); err != nil {
+		return 0, err
+	}
+	defer ix.invalidate()
+	nodeID, parent, at, err := ix.slidePosition(slide)
+	if err != nil {
+		return 0, err
+	}
+	owned := ix.slideRecords(slide)
+	ids := make(map[uint64]uint64, len(owned))
+	for _, id := range owned {
+		ids[id] = ix.NewID()
+	}
+	newNode := ix.NewID()
+	ids[nodeID] = newNode
+
+	file := ix.File(slide)
+	if c := ix.component(file); c != nil && c.GetIdentifier() == slide {
+		meta := ix.packageMetadata()
+		dup := proto.Clone(c).(*TSP.ComponentInfo)
+		dup.Identifier = proto.Uint64(ids[slide])
+		dup.Locator = proto.String(fmt.Sprintf("%s-%d", c.GetPreferredLocator(), ids[slide]))
+		meta.Components = append(meta.Components, dup)
+		for _, other := range meta.Components {
+			for _, ref := range other.ExternalReferences {
+				if ref.GetComponentIdentifier() == c.GetIdentifier() && other != dup {
+					ref = proto.Clone(ref).(*TSP.ComponentExternalReference)
+					ref.ComponentIdentifier = dup.Identifier
+					if id, ok := ids[ref.GetObjectIdentifier()]; ok {
+						ref.ObjectIdentifier = proto.Uint64(id)
+					}
+					other.ExternalReferences = append(other.ExternalReferences, ref)
+					break
+				}
+			}
+		}
+		file = path.Join("Index", dup.GetLocator()+".iwa")
+	}
+	for _, id := range owned {
+		v, ok := ix.Records[id].(proto.Message)
+		if !ok {
+			return 0, fmt.Errorf("can't copy record %d", id)
+		}
+		v = proto.Clone(v)
+		remapReferences(v, ids, nil)
+		ix.Records[ids[id]] = v
+		ix.setFile(ids[id], file)
+	}
+
+	node := proto.Clone(ix.Records[nodeID].(*KN.SlideNodeArchive)).(*KN.SlideNodeArchive)
+	node.Children = nil
+	node.Slide = &TSP.Reference{Identifier: proto.Uint64(ids[slide])}
+	node.Thumbnails = nil
+	node.ThumbnailSizes = nil
+	node.ThumbnailsAreDirty = proto.Bool(true)
+	node.DatabaseThumbnail = nil
+	node.DatabaseThumbnails = nil
+	node.UniqueIdentifier = nil
+	node.CopyFromSlideIdentifier = nil
+	ix.Records[newNode] = node
+	ix.setFile(newNode, ix.File(nodeID))
+	ref := &TSP.Reference{Identifier: proto.Uint64(newNode)}
+	parent.Children = append(parent.Children[:at+1], append([]*TSP.Reference{ref}, parent.Children[at+1:]...)...)
+	return ids[slide], nil
+}
+
+// DeleteSlide removes a slide and the records it holds. The slides grouped under it move up to take its place.
+// The last slide of a document can't be removed.
+func (ix *Index) DeleteSlide(slide uint64) error {
+	if err := ix.writable(); err != nil {
+		return err
+	}
+	defer ix.invalidate()
+	if len(ix.Slides()) < 2 {
+		return errors.New("can't delete the last slide")
+	}
+	nodeID, parent, at, err := ix.slidePosition(slide)
+	if err != nil {
+		return err
+	}
+	node := ix.Records[nodeID].(*KN.SlideNodeArchive)
+	parent.Children = append(parent.Children[:at], append(node.Children, parent.Children[at+1:]...)...)
+
+	deleted := map[uint64]bool{nodeID: true}
+	for _, id := range ix.slideRecords(slide) {
+		deleted[id] = true
+	}
+	if c := ix.component(ix.File(slide)); c != nil && deleted[c.GetIdentifier()] {
+		ix.removeComponent(c)
+	}
+	for id := range deleted {
+		delete(ix.Records, id)
+	}
+
+	// the navigator state points at slide nodes
+	if ui, ok := ix.Deref(ix.Show().UiState).(*KN.UIStateArchive); ok {
+		ui.SelectedSlideNodes = dropReferences(ui.SelectedSlideNodes, deleted)
+		ui.CollapsedSlideNodes = dropReferences(ui.CollapsedSlideNodes, deleted)
+		if deleted[ui.GetSlideNodeToEdit().GetIdentifier()] {
+			ui.SlideNodeToEdit = nil
+			if len(parent.Children) > 0 {
+				ui.SlideNodeToEdit = parent.Children[0]
+			}
+		}
+	}
+	return nil
+}
+
+// slideRecords returns the slide and the records reachable from it in its .iwa file, stopping at other slides.
+// Records we couldn't decode are left out, their references can't be rewritten.
+func (ix *Index) slideRecords(slide uint64) []uint64 {
+	file := ix.File(slide)
+	seen := map[uint64]bool{slide: true}
+	rval := []uint64{slide}
+	for i := 0; i < len(rval); i++ {
+		objects, _ := references(ix.Records[rval[i]])
+		for _, id := range objects {
+			if seen[id] || ix.File(id) != file {
+				continue
+			}
+			seen[id] = true
+			switch ix.Records[id].(type) {
+			case nil, *RawRecord, *KN.SlideArchive, *KN.SlideNodeArchive:
+				continue
+			}
+			rval = append(rval, id)
+		}
+	}
+	return rval
+}
+
+// component returns the manifest entry of the component stored in an .iwa file, or nil.
+func (ix *Index) component(file string) *TSP.ComponentInfo {
+	meta := ix.packageMetadata()
+	if meta == nil || file == "" {
+		return nil
+	}
+	for _, c := range meta.Components {
+		locator := c.GetLocator()
+		if locator == "" {
+			locator = c.GetPreferredLocator()
+		}
+		if path.Join("Index", locator+".iwa") == file {
+			return c
+		}
+	}
+	return nil
+}
+
+// removeComponent drops a component from the manifest, along with the references other components make to it.
+func (ix *Index) removeComponent(c *TSP.ComponentInfo) {
+	meta := ix.packageMetadata()
+	components := meta.Components[:0]
+	for _, other := range meta.Components {
+		if other == c {
+			continue
+		}
+		refs := other.ExternalReferences[:0]
+		for _, ref := range other.ExternalReferences {
+			if ref.GetComponentIdentifier() != c.GetIdentifier() {
+				refs = append(refs, ref)
+			}
+		}
+		other.ExternalReferences = refs
+		components = append(components, other)
+	}
+	meta.Components = components
+}
+
+// dropReferences removes the references to the given ids.
+func dropReferences(refs []*TSP.Reference, ids map[uint64]bool) []*TSP.Reference {
+	rval := refs[:0]
+	for _, ref := range refs {
+		if !ids[ref.GetIdentifier()] {
+			rval = append(rval, ref)
+		}
+	}
+	return rval
+}
+
+// remapReferences rewrites the object references of a record that point to the keys of ids, and the data
+// references that point to the keys of datas.
+func remapReferences(v interface{}, ids, datas map[uint64]uint64) {
+	var walk func(rv reflect.Value)
+	walk = func(rv reflect.Value) {
+		switch rv.Kind() {
+		case reflect.Ptr:
+			if !rv.IsNil() {
+				walk(rv.Elem())
+			}
+		case reflect.Slice:
+			if rv.Type().Elem().Kind() == reflect.Uint8 {
+				return
+			}
+			for i := 0; i < rv.Len(); i++ {
+				walk(rv.Index(i))
+			}
+		case reflect.Struct:
+			switch rv.Type() {
+			case referenceType:
+				ref := rv.Addr().Interface().(*TSP.Reference)
+				if id, ok := ids[ref.GetIdentifier()]; ok {
+					ref.Identifier = proto.Uint64(id)
+				}
+				return
+			case dataReferenceType:
+				ref := rv.Addr().Interface().(*TSP.DataReference)
+				if id, ok := datas[ref.GetIdentifier()]; ok {
+					ref.Identifier = proto.Uint64(id)
+				}
+				return
+			}
+			for i := 0; i < rv.NumField(); i++ {
+				if rv.Type().Field(i).PkgPath == "" {
+					walk(rv.Field(i))
+				}
+			}
+		}
+	}
+	walk(reflect.ValueOf(v))
+}
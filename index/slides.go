@@ -0,0 +1,135 @@
+package index
+
+import (
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// SlideNode is an entry in the Keynote slide navigator. Slides indented under another slide in the navigator are
+// its Children, and Collapsed is set when the author has folded the group.
+type SlideNode struct {
+	ID        uint64       `json:"id"`
+	Slide     uint64       `json:"slide"`
+	Title     string       `json:"title,omitempty"`
+	Hidden    bool         `json:"hidden,omitempty"`
+	Collapsed bool         `json:"collapsed,omitempty"`
+	Children  []*SlideNode `json:"children,omitempty"`
+}
+
+// SlideTree returns the top level slides of a Keynote document in navigator order, with their groups below them.
+// It returns nil for other document types.
+func (ix *Index) SlideTree() []*SlideNode {
+	da, ok := ix.Root().(*KN.DocumentArchive)
+	if !ok {
+		return nil
+	}
+	show, ok := ix.Deref(da.Show).(*KN.ShowArchive)
+	if !ok {
+		return nil
+	}
+	root, ok := ix.Deref(show.GetSlideTree().GetRootSlideNode()).(*KN.SlideNodeArchive)
+	if !ok {
+		return nil
+	}
+
+	collapsed := make(map[uint64]bool)
+	if ui, ok := ix.Deref(show.UiState).(*KN.UIStateArchive); ok {
+		for _, ref := range ui.CollapsedSlideNodes {
+			collapsed[ref.GetIdentifier()] = true
+		}
+	}
+	seen := map[uint64]bool{show.GetSlideTree().GetRootSlideNode().GetIdentifier(): true}
+	return ix.slideNodes(root.Children, collapsed, seen)
+}
+
+func (ix *Index) slideNodes(refs []*TSP.Reference, collapsed, seen map[uint64]bool) []*SlideNode {
+	var rval []*SlideNode
+	for _, ref := range refs {
+		id := ref.GetIdentifier()
+		sn, ok := ix.Deref(ref).(*KN.SlideNodeArchive)
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		node := &SlideNode{
+			ID:        id,
+			Slide:     sn.GetSlide().GetIdentifier(),
+			Hidden:    sn.GetIsHidden(),
+			Collapsed: collapsed[id] || sn.GetIsCollapsedInOutlineView(),
+		}
+		if slide, ok := ix.Deref(sn.Slide).(*KN.SlideArchive); ok {
+			node.Title = ix.slideTitle(slide)
+		}
+		node.Children = ix.slideNodes(sn.Children, collapsed, seen)
+		rval = append(rval, node)
+	}
+	return rval
+}
+
+// slideTitle returns the text of the title placeholder, falling back to the text Keynote caches for thumbnails.
+func (ix *Index) slideTitle(slide *KN.SlideArchive) string {
+	if ph, ok := ix.Deref(slide.TitlePlaceholder).(*KN.PlaceholderArchive); ok {
+		if st, ok := ix.Deref(ph.GetSuper().GetContainedStorage()).(*TSWP.StorageArchive); ok {
+			if title := strings.TrimSpace(storageText(st)); title != "" {
+				return title
+			}
+		}
+	}
+	return slide.GetThumbnailTextForTitlePlaceholder()
+}
+
+// Slides returns the slide ids of a Keynote document in presentation order, including hidden slides.
+func (ix *Index) Slides() []uint64 {
+	var rval []uint64
+	var walk func(nodes []*SlideNode)
+	walk = func(nodes []*SlideNode) {
+		for _, node := range nodes {
+			if node.Slide != 0 {
+				rval = append(rval, node.Slide)
+			}
+			walk(node.Children)
+		}
+	}
+	walk(ix.SlideTree())
+	return rval
+}
+
+// Masters returns the master slide ids of a Keynote document or theme, in the order of the theme's master list. A
+// theme (.kth) lists its masters here and usually has no Slides.
+func (ix *Index) Masters() []uint64 {
+	theme := ix.theme()
+	if theme == nil {
+		return nil
+	}
+	var rval []uint64
+	for _, ref := range theme.Masters {
+		if sn, ok := ix.Deref(ref).(*KN.SlideNodeArchive); ok && sn.Slide != nil {
+			rval = append(rval, sn.GetSlide().GetIdentifier())
+		}
+	}
+	return rval
+}
+
+// theme returns the theme of a Keynote document. Files holding a theme without a show, which Root doesn't find,
+// fall back on the first theme archive.
+func (ix *Index) theme() *KN.ThemeArchive {
+	if show := ix.Show(); show != nil {
+		if theme, ok := ix.Deref(show.Theme).(*KN.ThemeArchive); ok {
+			return theme
+		}
+	}
+	if ix.Type != "key" {
+		return nil
+	}
+	var rval *KN.ThemeArchive
+	var best uint64
+	for id, v := range ix.Records {
+		if theme, ok := v.(*KN.ThemeArchive); ok && (rval == nil || id < best) {
+			rval, best = theme, id
+		}
+	}
+	return rval
+}
@@ -0,0 +1,98 @@
+package index
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/dunhamsteve/iwork/proto/TN"
+)
+
+// wordsPerPage is the number of words assumed to fill a page when estimating the page count of a Pages document.
+const wordsPerPage = 500
+
+// Stats are the counts of a document, for reporting. Words, Characters and Paragraphs count the body text of a
+// Pages document; Characters leaves out paragraph breaks and attachments, and Paragraphs blank paragraphs. Pages is
+// an estimate, since the layout isn't stored: each section and page break starts a page, and a page holds about
+// 500 words. Cells counts the non-empty cells of all the tables.
+type Stats struct {
+	Type       string `json:"type"`
+	Words      int    `json:"words,omitempty"`
+	Characters int    `json:"characters,omitempty"`
+	Paragraphs int    `json:"paragraphs,omitempty"`
+	Pages      int    `json:"pages,omitempty"`
+	Sheets     int    `json:"sheets,omitempty"`
+	Tables     int    `json:"tables,omitempty"`
+	Cells      int    `json:"cells,omitempty"`
+	Slides     int    `json:"slides,omitempty"`
+	Hidden     int    `json:"hidden,omitempty"`
+}
+
+// Stats counts the words, paragraphs and pages of a Pages document, the sheets of a Numbers document and the
+// slides of a Keynote document, and the tables and cells of any of them.
+func (ix *Index) Stats() Stats {
+	rval := Stats{Type: ix.Type}
+
+	for _, s := range ix.Sections() {
+		words := 0
+		for _, p := range s.Paragraphs {
+			text := strings.Replace(p.Text, string(AttachmentChar), "", -1)
+			if strings.TrimSpace(text) != "" {
+				rval.Paragraphs++
+			}
+			for _, r := range text {
+				if r != '\n' {
+					rval.Characters++
+				}
+			}
+			// a page break ends the page, whatever its length
+			for i, part := range strings.Split(text, "\u000c") {
+				if i > 0 {
+					rval.Pages += pagesFor(words)
+					words = 0
+				}
+				n := len(strings.FieldsFunc(part, unicode.IsSpace))
+				words += n
+				rval.Words += n
+			}
+		}
+		rval.Pages += pagesFor(words)
+	}
+
+	if da, ok := ix.Root().(*TN.DocumentArchive); ok {
+		rval.Sheets = len(da.Sheets)
+	}
+
+	var hidden func(nodes []*SlideNode)
+	hidden = func(nodes []*SlideNode) {
+		for _, node := range nodes {
+			if node.Slide != 0 {
+				rval.Slides++
+				if node.Hidden {
+					rval.Hidden++
+				}
+			}
+			hidden(node.Children)
+		}
+	}
+	hidden(ix.SlideTree())
+
+	for _, t := range ix.Tables() {
+		rval.Tables++
+		for _, row := range t.Rows {
+			for _, cell := range row {
+				if cell.Type != EmptyCell {
+					rval.Cells++
+				}
+			}
+		}
+	}
+	return rval
+}
+
+// pagesFor estimates the pages taken by a run of words, at least one.
+func pagesFor(words int) int {
+	if words <= wordsPerPage {
+		return 1
+	}
+	return (words + wordsPerPage - 1) / wordsPerPage
+}
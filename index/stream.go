@@ -0,0 +1,229 @@
+package index
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ExtractTextTo streams the text of a document to w without building an Index. Each .iwa file is decompressed a
+// snappy chunk at a time and only text storages and table strings are decoded, so memory use stays around the size
+// of the largest record rather than the whole document. Text comes out in storage order, which is not always
+// reading order, and is meant for indexing rather than display.
+func ExtractTextTo(w io.Writer, doc, password string) error {
+	return ExtractTextToContext(context.Background(), w, doc, password)
+}
+
+// ExtractTextToContext is ExtractTextTo with cancellation. It returns ctx.Err() once ctx is done, having written
+// the text found up to that point.
+func ExtractTextToContext(ctx context.Context, w io.Writer, doc, password string) error {
+	return extractTextTo(ctx, w, doc, password, nil)
+}
+
+// extractTextTo does the work of ExtractTextToContext, noting the .iwa files it finished and those it didn't in tr
+// if it isn't nil.
+func extractTextTo(ctx context.Context, w io.Writer, doc, password string, tr *Truncation) error {
+	bw := bufio.NewWriter(w)
+	zf, verifier, err := openZip(doc)
+	if err == nil {
+		defer zf.Close()
+		crypt, err := newDecrypter(verifier, password)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, f := range zf.File {
+			if strings.HasSuffix(f.Name, ".iwa") {
+				names = append(names, f.Name)
+			}
+		}
+		if tr != nil {
+			tr.Pending = names
+		}
+		for _, f := range zf.File {
+			if !strings.HasSuffix(f.Name, ".iwa") {
+				continue
+			}
+			r, closer, err := openIWAStream(f, crypt, DefaultLimits)
+			if err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			err = streamText(ctx, bw, r)
+			closer.Close()
+			if err != nil {
+				bw.Flush()
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			if tr != nil {
+				tr.Completed = append(tr.Completed, f.Name)
+				tr.Pending = names[len(tr.Completed):]
+			}
+		}
+		return bw.Flush()
+	}
+
+	// .pages-tef files, sqlite
+	db, err := openSQL(doc, err)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = sqlStates(ctx, db, DefaultLimits, func(_ uint64, class uint32, data []byte) error {
+		writeText(bw, class, data)
+		return nil
+	})
+	if err != nil {
+		bw.Flush()
+		return err
+	}
+	return bw.Flush()
+}
+
+// streamText writes the text found in an .iwa stream.
+func streamText(ctx context.Context, w *bufio.Writer, r io.Reader) error {
+	br := bufio.NewReader(newChunkReader(r, DefaultLimits))
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if l > uint64(DefaultLimits.MaxChunkSize) {
+			return fmt.Errorf("archive header of %d bytes: %w", l, ErrLimit)
+		}
+		header := make([]byte, l)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return err
+		}
+		var ai TSP.ArchiveInfo
+		if err := proto.Unmarshal(header, &ai); err != nil {
+			return err
+		}
+		for _, info := range ai.MessageInfos {
+			typ := info.GetType()
+			if !textTypes[typ] {
+				if _, err := io.CopyN(ioutil.Discard, br, int64(info.GetLength())); err != nil {
+					return err
+				}
+				continue
+			}
+			if int64(info.GetLength()) > DefaultLimits.MaxChunkSize {
+				return fmt.Errorf("record of %d bytes: %w", info.GetLength(), ErrLimit)
+			}
+			payload := make([]byte, info.GetLength())
+			if _, err := io.ReadFull(br, payload); err != nil {
+				return err
+			}
+			writeText(w, typ, payload)
+		}
+	}
+}
+
+// textTypes are the archive types holding document text: text storages and table data lists.
+var textTypes = map[uint32]bool{2001: true, 2005: true, 6005: true, 6201: true}
+
+func writeText(w *bufio.Writer, typ uint32, payload []byte) {
+	if !textTypes[typ] {
+		return
+	}
+	v, err := decodeCommon(typ, payload)
+	if err != nil {
+		return
+	}
+	switch v := v.(type) {
+	case *TSWP.StorageArchive:
+		if text := strings.TrimSpace(storageText(v)); text != "" {
+			w.WriteString(text)
+			w.WriteString("\n")
+		}
+	case *TST.TableDataList:
+		if v.GetListType() != TST.TableDataList_STRING {
+			return
+		}
+		for _, entry := range v.Entries {
+			if s := entry.GetString_(); s != "" {
+				w.WriteString(s)
+				w.WriteString("\n")
+			}
+		}
+	}
+}
+
+// chunkReader decompresses the snappy chunks of an .iwa file one at a time, within the chunk and file size limits,
+// so a file never has to be held whole, compressed or not.
+type chunkReader struct {
+	r      *bufio.Reader
+	limits Limits
+	buf    []byte
+	total  int64
+
+	chunk, out *[]byte // pooled buffers for the compressed and decompressed chunk
+}
+
+func newChunkReader(r io.Reader, limits Limits) *chunkReader {
+	return &chunkReader{r: bufio.NewReader(r), limits: limits}
+}
+
+// release returns the buffers of a chunkReader to the pool. It mustn't be read after.
+func (c *chunkReader) release() {
+	if c.chunk != nil {
+		putBuf(c.chunk)
+		putBuf(c.out)
+		c.chunk, c.out, c.buf = nil, nil, nil
+	}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.chunk == nil {
+		c.chunk, c.out = getBuf(), getBuf()
+	}
+	for len(c.buf) == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errTruncatedHeader
+			}
+			return 0, err
+		}
+		if header[0] != 0 {
+			return 0, errors.New("snap header type not 0")
+		}
+		l := int(header[1]) | int(header[2])<<8 | int(header[3])<<16
+		chunk := grow(*c.chunk, l)
+		*c.chunk = chunk
+		if _, err := io.ReadFull(c.r, chunk); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errTruncatedChunk
+			}
+			return 0, err
+		}
+		var err error
+		if c.buf, err = c.limits.decodeChunk(*c.out, chunk); err != nil {
+			return 0, err
+		}
+		*c.out = c.buf
+		c.total += int64(len(c.buf))
+		if c.total > c.limits.MaxDecompressedSize {
+			return 0, fmt.Errorf("more than %d bytes decompressed: %w", c.limits.MaxDecompressedSize, ErrLimit)
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,126 @@
+package index
+
+import (
+	"sort"
+
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSK"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// historyFiles are the bundle files recording the app versions that saved the document.
+var historyFiles = []string{"Metadata/BuildVersionHistory.plist"}
+
+// Stripped counts what StripMetadata removed. Files are the bundle files Save leaves out.
+type Stripped struct {
+	Authors  int      `json:"authors"`
+	Comments int      `json:"comments"`
+	Changes  int      `json:"changes"`
+	Files    []string `json:"files,omitempty"`
+}
+
+// StripMetadata removes what a document records about the people who worked on it, for sharing it: comments are
+// emptied and detached from the text, drawables and slides they were on, tracked changes are accepted and change
+// tracking turned off, and the names of comment and change authors are cleared. The build version history and the
+// previews, which can show comments, are left out of the bundle Save writes.
+func (ix *Index) StripMetadata() (*Stripped, error) {
+	if err := ix.writable(); err != nil {
+		return nil, err
+	}
+	defer ix.invalidate()
+	rval := &Stripped{}
+	ids := make([]uint64, 0, len(ix.Records))
+	for id := range ix.Records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		st, ok := ix.Records[id].(*TSWP.StorageArchive)
+		if !ok {
+			continue
+		}
+		changes := ix.Changes(id, st)
+		rval.Changes += len(changes)
+		// from the end, so the offsets of the earlier changes still hold
+		for i := len(changes) - 1; i >= 0; i-- {
+			if c := changes[i]; c.Kind == ChangeDeletion {
+				if err := ix.ReplaceText(st, c.Start, c.End, ""); err != nil {
+					return nil, err
+				}
+			}
+		}
+		st.TableInsertion = nil
+		st.TableDeletion = nil
+	}
+	if da, ok := ix.Root().(*TP.DocumentArchive); ok {
+		da.ChangeTrackingEnabled = proto.Bool(false)
+		da.ChangeTrackingPaused = nil
+	}
+
+	isComment := func(ref *TSP.Reference) bool {
+		_, ok := ix.Deref(ref).(*TSWP.CommentInfoArchive)
+		return ok
+	}
+	detach := func(refs []*TSP.Reference) []*TSP.Reference {
+		rval := refs[:0]
+		for _, ref := range refs {
+			if !isComment(ref) {
+				rval = append(rval, ref)
+			}
+		}
+		return rval
+	}
+	for _, id := range ids {
+		v := ix.Records[id]
+		if da := drawableArchive(v); da != nil {
+			da.Comment = nil
+		}
+		switch r := v.(type) {
+		case *TSWP.StorageArchive:
+			if t := r.TableHighlight; t != nil {
+				for _, e := range t.Entries {
+					if hl, ok := ix.Deref(e.Object).(*TSWP.HighlightArchive); ok && hl.CommentStorage != nil {
+						e.Object = nil
+					}
+				}
+			}
+		case *KN.SlideArchive:
+			r.Drawables = detach(r.Drawables)
+		case *TN.SheetArchive:
+			r.DrawableInfos = detach(r.DrawableInfos)
+		case *TSD.GroupArchive:
+			r.Children = detach(r.Children)
+		case *TSD.CommentStorageArchive:
+			r.Text = proto.String("")
+			r.Author = nil
+			r.CreationDate = nil
+			rval.Comments++
+		case *TSK.AnnotationAuthorArchive:
+			if r.GetName() != "" {
+				rval.Authors++
+			}
+			r.Name = proto.String("")
+		case *TSWP.ChangeSessionArchive:
+			r.Author = nil
+		}
+	}
+
+	for _, name := range historyFiles {
+		ix.omitFile(name)
+	}
+	if err := ix.RemovePreviews(); err != nil {
+		return nil, err
+	}
+	for name := range ix.omit {
+		rval.Files = append(rval.Files, name)
+	}
+	sort.Strings(rval.Files)
+	return rval, nil
+}
@@ -0,0 +1,160 @@
+package index
+
+import (
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Paragraph alignments, the values of ParagraphFormat.Alignment
+const (
+	AlignLeft    = 0
+	AlignRight   = 1
+	AlignCenter  = 2
+	AlignJustify = 3
+	AlignNatural = 4 // left or right following the writing direction
+)
+
+// TextStyle is the effective character formatting of a run. Size is in points, 0 if no style sets it, and Color is
+// nil for the default text color. Baseline is 1 for superscript and 2 for subscript. Language is the language tag of
+// the style, empty if it sets none.
+type TextStyle struct {
+	Font          string     `json:"font,omitempty"`
+	Size          float32    `json:"size,omitempty"`
+	Bold          bool       `json:"bold,omitempty"`
+	Italic        bool       `json:"italic,omitempty"`
+	Underline     bool       `json:"underline,omitempty"`
+	Strikethrough bool       `json:"strikethrough,omitempty"`
+	Color         *TSP.Color `json:"color,omitempty"`
+	Baseline      int32      `json:"baseline,omitempty"`
+	Language      string     `json:"language,omitempty"`
+}
+
+// ParagraphFormat is the effective formatting of a paragraph. Indents and spacing are in points, FirstLineIndent
+// is measured from the left edge like LeftIndent.
+type ParagraphFormat struct {
+	Alignment       int32   `json:"alignment,omitempty"`
+	OutlineLevel    uint32  `json:"outline_level,omitempty"`
+	LeftIndent      float32 `json:"left_indent,omitempty"`
+	RightIndent     float32 `json:"right_indent,omitempty"`
+	FirstLineIndent float32 `json:"first_line_indent,omitempty"`
+	SpaceBefore     float32 `json:"space_before,omitempty"`
+	SpaceAfter      float32 `json:"space_after,omitempty"`
+}
+
+// paraChain returns a paragraph style and its ancestors, root first.
+func (ix *Index) paraChain(ps *TSWP.ParagraphStyleArchive) []*TSWP.ParagraphStyleArchive {
+	var chain []*TSWP.ParagraphStyleArchive
+	for ps != nil && len(chain) < 32 {
+		chain = append([]*TSWP.ParagraphStyleArchive{ps}, chain...)
+		ps, _ = ix.Deref(ps.GetSuper().GetParent()).(*TSWP.ParagraphStyleArchive)
+	}
+	return chain
+}
+
+// charChain returns a character style and its ancestors, root first.
+func (ix *Index) charChain(cs *TSWP.CharacterStyleArchive) []*TSWP.CharacterStyleArchive {
+	var chain []*TSWP.CharacterStyleArchive
+	for cs != nil && len(chain) < 32 {
+		chain = append([]*TSWP.CharacterStyleArchive{cs}, chain...)
+		cs, _ = ix.Deref(cs.GetSuper().GetParent()).(*TSWP.CharacterStyleArchive)
+	}
+	return chain
+}
+
+// ResolveText computes the formatting of a run from its paragraph and character styles, either of which may be
+// nil. The character style wins over the paragraph style, and each style over its parents.
+func (ix *Index) ResolveText(ps *TSWP.ParagraphStyleArchive, cs *TSWP.CharacterStyleArchive) TextStyle {
+	var rval TextStyle
+	for _, s := range ix.paraChain(ps) {
+		rval.apply(s.CharProperties)
+	}
+	for _, s := range ix.charChain(cs) {
+		rval.apply(s.CharProperties)
+	}
+	return rval
+}
+
+// RunStyle is ResolveText for a run of a paragraph.
+func (ix *Index) RunStyle(p Paragraph, run Run) TextStyle {
+	return ix.ResolveText(p.Style, run.Style)
+}
+
+// RunLanguage returns the language of a run: the one set on its text, else the one of its styles, else the
+// document's language (see Metadata). It returns "" if none is known.
+func (ix *Index) RunLanguage(p Paragraph, run Run) string {
+	if run.Language != "" {
+		return run.Language
+	}
+	if lang := ix.RunStyle(p, run).Language; lang != "" {
+		return lang
+	}
+	return ix.documentLanguage()
+}
+
+func (s *TextStyle) apply(cp *TSWP.CharacterStylePropertiesArchive) {
+	if cp == nil {
+		return
+	}
+	if cp.Bold != nil {
+		s.Bold = *cp.Bold
+	}
+	if cp.Italic != nil {
+		s.Italic = *cp.Italic
+	}
+	if cp.FontSize != nil {
+		s.Size = *cp.FontSize
+	}
+	if cp.FontName != nil {
+		s.Font = *cp.FontName
+	}
+	if cp.FontColor != nil {
+		s.Color = cp.FontColor
+	}
+	if cp.Underline != nil {
+		s.Underline = *cp.Underline != TSWP.CharacterStylePropertiesArchive_kNoUnderline
+	}
+	if cp.Strikethru != nil {
+		s.Strikethrough = *cp.Strikethru != TSWP.CharacterStylePropertiesArchive_kNoStrikethru
+	}
+	if cp.Superscript != nil {
+		s.Baseline = int32(*cp.Superscript)
+	}
+	if cp.Language != nil {
+		s.Language = *cp.Language
+	} else if cp.GetLanguageNull() {
+		s.Language = ""
+	}
+}
+
+// ResolveParagraph computes the formatting of a paragraph style, each style winning over its parents.
+func (ix *Index) ResolveParagraph(ps *TSWP.ParagraphStyleArchive) ParagraphFormat {
+	var rval ParagraphFormat
+	for _, s := range ix.paraChain(ps) {
+		pp := s.ParaProperties
+		if pp == nil {
+			continue
+		}
+		if pp.Alignment != nil {
+			rval.Alignment = int32(*pp.Alignment)
+		}
+		if pp.OutlineLevel != nil {
+			rval.OutlineLevel = *pp.OutlineLevel
+		}
+		if pp.LeftIndent != nil {
+			rval.LeftIndent = *pp.LeftIndent
+		}
+		if pp.RightIndent != nil {
+			rval.RightIndent = *pp.RightIndent
+		}
+		if pp.FirstLineIndent != nil {
+			rval.FirstLineIndent = *pp.FirstLineIndent
+		}
+		if pp.SpaceBefore != nil {
+			rval.SpaceBefore = *pp.SpaceBefore
+		}
+		if pp.SpaceAfter != nil {
+			rval.SpaceAfter = *pp.SpaceAfter
+		}
+	}
+	return rval
+}
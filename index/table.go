@@ -0,0 +1,445 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// CellType is the kind of value held in a table cell.
+type CellType int
+
+// Cell types
+const (
+	EmptyCell CellType = iota
+	NumberCell
+	TextCell
+	DateCell
+	BoolCell
+	DurationCell
+	ErrorCell
+	RichTextCell
+	CurrencyCell
+)
+
+var cellTypeNames = []string{"empty", "number", "text", "date", "bool", "duration", "error", "richtext", "currency"}
+
+func (t CellType) String() string {
+	if int(t) < len(cellTypeNames) {
+		return cellTypeNames[t]
+	}
+	return fmt.Sprintf("CellType(%d)", int(t))
+}
+
+// Cell is a decoded table cell. Number holds the value of number, currency, duration (in seconds) and boolean
+// (0 or 1) cells, Time the value of date cells and Text the value of text cells. For rich text cells Text is the
+// plain text and RichText the underlying storage. Formula cells hold their last computed value, and the formula
+// itself, like "=SUM(A1:B3)", in Formula. References to other tables are written as Numbers shows them, like
+// "Table 2::B3", or "Sheet 2::Table 2::B3" for a table on another sheet.
+type Cell struct {
+	Type     CellType             `json:"type"`
+	Number   float64              `json:"number,omitempty"`
+	Text     string               `json:"text,omitempty"`
+	Time     time.Time            `json:"time,omitempty"`
+	Formula  string               `json:"formula,omitempty"`
+	RichText *TSWP.StorageArchive `json:"-"`
+
+	// keys into the data store tables, 0 if absent
+	StyleKey   uint32 `json:"-"`
+	FormatKey  uint32 `json:"-"`
+	FormulaKey uint32 `json:"-"`
+	ControlKey uint32 `json:"-"`
+
+	ConditionalKey uint32 `json:"-"`
+}
+
+// String returns the cell value the way a plain text export would show it.
+func (c Cell) String() string {
+	switch c.Type {
+	case NumberCell, CurrencyCell, DurationCell:
+		return strconv.FormatFloat(c.Number, 'f', -1, 64)
+	case BoolCell:
+		if c.Number != 0 {
+			return "TRUE"
+		}
+		return "FALSE"
+	case DateCell:
+		return c.Time.Format(time.RFC3339)
+	case ErrorCell:
+		if c.Text != "" {
+			return c.Text
+		}
+		return "#ERROR"
+	}
+	return c.Text
+}
+
+// appleEpoch is the offset of the Apple reference date (2001-01-01) from the unix epoch, in seconds.
+const appleEpoch = 978307200
+
+// tileRows is the number of rows in a tile when the table doesn't record a row tile tree.
+const tileRows = 256
+
+// Cells decodes the contents of a table into a grid of rows and columns. The grid is cut short at Limits.MaxCells.
+func (ix *Index) Cells(tm *TST.TableModelArchive) [][]Cell {
+	nrows, ncols := int(tm.GetNumberOfRows()), int(tm.GetNumberOfColumns())
+	if max := ix.limits.withDefaults().MaxCells; ncols > 0 && nrows > max/ncols {
+		nrows = max / ncols
+	}
+	rows := make([][]Cell, nrows)
+	for i := range rows {
+		rows[i] = make([]Cell, ncols)
+	}
+	ds := tm.DataStore
+	if ds == nil || ds.Tiles == nil {
+		return rows
+	}
+
+	strs := ix.tableStrings(ds.StringTable)
+	errs := ix.tableStrings(ds.FormulaErrorTable)
+	formulas := ix.Entries(ds.FormulaTable)
+	rich := ix.Entries(ds.RichTextPayloadTable)
+	tables := ix.crossTable(tm)
+
+	tileStart := make(map[uint32]uint32)
+	if ds.RowTileTree != nil {
+		for _, node := range ds.RowTileTree.Nodes {
+			tileStart[node.GetValue()] = node.GetKey()
+		}
+	}
+
+	for _, tinfo := range ds.Tiles.Tiles {
+		tile, ok := ix.Deref(tinfo.Tile).(*TST.Tile)
+		if !ok {
+			continue
+		}
+		start, ok := tileStart[tinfo.GetTileid()]
+		if !ok {
+			start = tinfo.GetTileid() * tileRows
+		}
+		for _, rinfo := range tile.RowInfos {
+			r := int(start + rinfo.GetTileRowIndex())
+			if r >= len(rows) {
+				continue
+			}
+			for c, cell := range decodeRow(rinfo) {
+				if c >= len(rows[r]) {
+					break
+				}
+				switch cell.Type {
+				case TextCell:
+					cell.Text = strs[cell.textKey]
+				case RichTextCell:
+					if st := ix.richText(rich[cell.richKey]); st != nil {
+						cell.RichText = st
+						cell.Text = storageText(st)
+					}
+				case ErrorCell:
+					cell.Text = errs[cell.errorKey]
+				}
+				if f := formulas[cell.FormulaKey].GetFormula(); f != nil {
+					cell.Formula = formulaText(f, r, c, tables)
+				}
+				rows[r][c] = cell.Cell
+			}
+		}
+	}
+	return rows
+}
+
+func (ix *Index) tableStrings(ref *TSP.Reference) map[uint32]string {
+	if _, ok := ix.Deref(ref).(*TST.TableDataList); !ok {
+		return map[uint32]string{}
+	}
+	return ix.Memo(ref.GetIdentifier(), "strings", func() interface{} {
+		rval := make(map[uint32]string)
+		for key, entry := range ix.Entries(ref) {
+			rval[key] = entry.GetString_()
+		}
+		return rval
+	}).(map[uint32]string)
+}
+
+// richText returns the storage of a rich text list entry.
+func (ix *Index) richText(entry *TST.TableDataList_ListEntry) *TSWP.StorageArchive {
+	if rt, ok := ix.Deref(entry.GetRichTextPayload()).(*TST.RichTextPayloadArchive); ok {
+		st, _ := ix.Deref(rt.Storage).(*TSWP.StorageArchive)
+		return st
+	}
+	return nil
+}
+
+// storageText returns the text of a storage, without attachment placeholders.
+func storageText(st *TSWP.StorageArchive) string {
+	var rval []rune
+	for _, text := range st.Text {
+		for _, r := range text {
+			if r != '￼' {
+				rval = append(rval, r)
+			}
+		}
+	}
+	return string(rval)
+}
+
+// rawCell is a cell as read from the storage buffer, before the table lookups.
+type rawCell struct {
+	Cell
+	textKey      uint32
+	richKey      uint32
+	errorKey     uint32
+	textStyleKey uint32
+	formats      [6]uint32 // see formatSlots
+}
+
+// decodeRow decodes the cells in a tile row, indexed by column. Newer files put the storage buffer in fields that
+// our protos don't know (6-8), older ones in cellStorageBuffer/cellOffsets.
+func decodeRow(rinfo *TST.TileRowInfo) map[int]rawCell {
+	rval := make(map[int]rawCell)
+
+	var buffer, offsets []byte
+	var wide bool
+	for _, f := range wireFields(rinfo.XXX_unrecognized) {
+		switch f.num {
+		case 6:
+			buffer = f.data
+		case 7:
+			offsets = f.data
+		case 8:
+			wide = f.value != 0
+		}
+	}
+	if buffer != nil && offsets != nil {
+		for c := 0; c+1 < len(offsets); c += 2 {
+			offset := int(binary.LittleEndian.Uint16(offsets[c:]))
+			if offset == 0xffff {
+				continue
+			}
+			if wide {
+				offset *= 4
+			}
+			if cell, ok := decodeCellV5(buffer, offset); ok {
+				rval[c/2] = cell
+			}
+		}
+		return rval
+	}
+
+	buffer, offsets = rinfo.CellStorageBuffer, rinfo.CellOffsets
+	for c := 0; c+1 < len(offsets); c += 2 {
+		offset := int(binary.LittleEndian.Uint16(offsets[c:]))
+		if offset == 0xffff {
+			continue
+		}
+		if cell, ok := decodeCellV4(buffer, offset); ok {
+			rval[c/2] = cell
+		}
+	}
+	return rval
+}
+
+// decodeCellV5 decodes a cell in the current storage format: a version byte, the cell type, and a set of flags
+// at offset 8 saying which of the fields that follow are present.
+func decodeCellV5(buf []byte, offset int) (rawCell, bool) {
+	var cell rawCell
+	if offset+12 > len(buf) {
+		return cell, false
+	}
+	b := buf[offset:]
+	flags := binary.LittleEndian.Uint32(b[8:12])
+	o := 12
+
+	var d128, double, seconds float64
+	u32 := func() uint32 {
+		if o+4 > len(b) {
+			return 0
+		}
+		v := binary.LittleEndian.Uint32(b[o:])
+		o += 4
+		return v
+	}
+	f64 := func() float64 {
+		if o+8 > len(b) {
+			return 0
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(b[o:]))
+		o += 8
+		return v
+	}
+	if flags&0x1 != 0 {
+		if o+16 <= len(b) {
+			d128 = decimal128(b[o : o+16])
+		}
+		o += 16
+	}
+	if flags&0x2 != 0 {
+		double = f64()
+	}
+	if flags&0x4 != 0 {
+		seconds = f64()
+	}
+	if flags&0x8 != 0 {
+		cell.textKey = u32()
+	}
+	if flags&0x10 != 0 {
+		cell.richKey = u32()
+	}
+	if flags&0x20 != 0 {
+		cell.StyleKey = u32()
+	}
+	if flags&0x40 != 0 {
+		cell.textStyleKey = u32()
+	}
+	if flags&0x80 != 0 {
+		cell.ConditionalKey = u32()
+	}
+	if flags&0x100 != 0 {
+		u32() // conditional rule style
+	}
+	if flags&0x200 != 0 {
+		cell.FormulaKey = u32()
+	}
+	if flags&0x400 != 0 {
+		cell.ControlKey = u32()
+	}
+	if flags&0x800 != 0 {
+		cell.errorKey = u32()
+	}
+	if flags&0x1000 != 0 {
+		u32() // suggestion
+	}
+	// a cell keeps a format for each value type it has been, in the order number, currency, date, duration,
+	// text and bool; the one for its current type is picked below
+	for i := range cell.formats {
+		if flags&(0x2000<<uint(i)) != 0 {
+			cell.formats[i] = u32()
+		}
+	}
+
+	switch b[1] {
+	case 0:
+		cell.Type = EmptyCell
+	case 2:
+		cell.Type = NumberCell
+		cell.Number = d128
+	case 3:
+		cell.Type = TextCell
+	case 5:
+		cell.Type = DateCell
+		cell.Time = appleTime(seconds)
+	case 6:
+		cell.Type = BoolCell
+		cell.Number = double
+	case 7:
+		cell.Type = DurationCell
+		cell.Number = double
+	case 8:
+		cell.Type = ErrorCell
+	case 9:
+		cell.Type = RichTextCell
+	case 10:
+		cell.Type = CurrencyCell
+		cell.Number = d128
+	default:
+		return cell, false
+	}
+	if i, ok := formatSlots[cell.Type]; ok {
+		cell.FormatKey = cell.formats[i]
+	}
+	return cell, true
+}
+
+// formatSlots maps cell types to the position of their format key in a version 5 cell.
+var formatSlots = map[CellType]int{
+	NumberCell:   0,
+	CurrencyCell: 1,
+	DateCell:     2,
+	DurationCell: 3,
+	TextCell:     4,
+	RichTextCell: 4,
+	BoolCell:     5,
+}
+
+// decodeCellV4 decodes the pre-2015 storage format. The layout isn't well understood, the value sits after one
+// 32-bit field per flag bit.
+func decodeCellV4(buf []byte, offset int) (rawCell, bool) {
+	var cell rawCell
+	if offset+6 > len(buf) {
+		return cell, false
+	}
+	var cellType byte
+	if buf[offset] == 4 {
+		cellType = buf[offset+1]
+	} else {
+		cellType = buf[offset+2]
+	}
+	flags := binary.LittleEndian.Uint16(buf[offset+4 : offset+6])
+	o := popcount(uint32(flags))*4 + 8 + offset
+	if o+4 > len(buf) {
+		return cell, false
+	}
+	key := binary.LittleEndian.Uint32(buf[o:])
+	var value float64
+	if o+8 <= len(buf) {
+		value = math.Float64frombits(binary.LittleEndian.Uint64(buf[o:]))
+	}
+
+	switch cellType {
+	case 0:
+		cell.Type = EmptyCell
+	case 2:
+		cell.Type = NumberCell
+		cell.Number = value
+	case 3:
+		cell.Type = TextCell
+		cell.textKey = key
+	case 5:
+		cell.Type = DateCell
+		cell.Time = appleTime(value)
+	case 6:
+		cell.Type = BoolCell
+		if value != 0 {
+			cell.Number = 1
+		}
+	case 7:
+		cell.Type = DurationCell
+		cell.Number = value
+	case 9:
+		cell.Type = RichTextCell
+		cell.richKey = key
+	default:
+		return cell, false
+	}
+	return cell, true
+}
+
+func appleTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds)+appleEpoch, 0).UTC()
+}
+
+func popcount(v uint32) int {
+	var c int
+	for ; v != 0; c++ {
+		v &= v - 1
+	}
+	return c
+}
+
+// decimal128 converts the 128-bit decimal values used by Numbers to a float64.
+func decimal128(b []byte) float64 {
+	exp := (int(b[15]&0x7f)<<7 | int(b[14]>>1)) - 0x1820
+	mantissa := float64(b[14] & 1)
+	for i := 13; i >= 0; i-- {
+		mantissa = mantissa*256 + float64(b[i])
+	}
+	if b[15]&0x80 != 0 {
+		mantissa = -mantissa
+	}
+	return mantissa * math.Pow10(exp)
+}
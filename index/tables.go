@@ -0,0 +1,222 @@
+package index
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+)
+
+// Table is a table from any of the three apps: a Numbers table, a Pages table or a table on a Keynote slide. ID
+// is the identifier of the table's drawable.
+type Table struct {
+	ID            uint64                 `json:"id"`
+	Name          string                 `json:"name,omitempty"`
+	HeaderRows    int                    `json:"header_rows,omitempty"`
+	HeaderColumns int                    `json:"header_columns,omitempty"`
+	FooterRows    int                    `json:"footer_rows,omitempty"`
+	Rows          [][]Cell               `json:"rows"`
+	Merges        []Merge                `json:"merges,omitempty"`
+	Conditional   []ConditionalFormat    `json:"conditional,omitempty"`
+	Model         *TST.TableModelArchive `json:"-"`
+}
+
+// Table returns the table for a table drawable (a TST.TableInfoArchive or TST.WPTableInfoArchive).
+func (ix *Index) Table(id uint64) (*Table, bool) {
+	var tm *TST.TableModelArchive
+	switch d := ix.Records[id].(type) {
+	case *TST.TableInfoArchive:
+		tm, _ = ix.Deref(d.TableModel).(*TST.TableModelArchive)
+	case *TST.WPTableInfoArchive:
+		tm, _ = ix.Deref(d.GetSuper().GetTableModel()).(*TST.TableModelArchive)
+	}
+	if tm == nil {
+		return nil, false
+	}
+	rows := ix.Cells(tm)
+	return &Table{
+		ID:            id,
+		Name:          tm.GetTableName(),
+		HeaderRows:    int(tm.GetNumberOfHeaderRows()),
+		HeaderColumns: int(tm.GetNumberOfHeaderColumns()),
+		FooterRows:    int(tm.GetNumberOfFooterRows()),
+		Rows:          rows,
+		Merges:        ix.Merges(tm),
+		Conditional:   ix.conditionalFormats(tm, rows),
+		Model:         tm,
+	}, true
+}
+
+// Merge is a range of merged cells. The value sits in the origin cell at Row and Column, the other cells of the
+// range are empty.
+type Merge struct {
+	Row     int `json:"row"`
+	Column  int `json:"column"`
+	Rows    int `json:"rows"`
+	Columns int `json:"columns"`
+}
+
+// Merges returns the merged ranges of a table model, in the order the table stores them. Ranges of a single cell
+// are left out.
+func (ix *Index) Merges(tm *TST.TableModelArchive) []Merge {
+	mm, ok := ix.Deref(tm.GetDataStore().GetMergeRegionMap()).(*TST.MergeRegionMapArchive)
+	if !ok {
+		return nil
+	}
+	var rval []Merge
+	for _, cr := range mm.CellRange {
+		origin, size := cr.GetOrigin().GetPackedData(), cr.GetSize().GetPackedData()
+		m := Merge{Row: int(origin >> 16), Column: int(origin & 0xffff), Rows: int(size >> 16), Columns: int(size & 0xffff)}
+		if m.Rows*m.Columns < 2 {
+			continue
+		}
+		rval = append(rval, m)
+	}
+	return rval
+}
+
+// Tables returns every table in the document. The tables of a Numbers document come sheet by sheet, in the order
+// of Sheets; other tables, and those of other documents, follow ordered by identifier.
+func (ix *Index) Tables() []*Table {
+	var ids []uint64
+	for id, v := range ix.Records {
+		switch v.(type) {
+		case *TST.TableInfoArchive, *TST.WPTableInfoArchive:
+			ids = append(ids, id)
+		}
+	}
+	order := make(map[uint64]int)
+	for _, sheet := range ix.Sheets() {
+		for _, id := range sheet.Tables {
+			if _, ok := order[id]; !ok {
+				order[id] = len(order)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, aok := order[ids[i]]
+		b, bok := order[ids[j]]
+		if aok != bok {
+			return aok
+		}
+		if aok {
+			return a < b
+		}
+		return ids[i] < ids[j]
+	})
+	var rval []*Table
+	for _, id := range ids {
+		if t, ok := ix.Table(id); ok {
+			rval = append(rval, t)
+		}
+	}
+	return rval
+}
+
+// Sheet is a sheet of a Numbers document, with the name on its tab. Tables are the identifiers of its table
+// drawables in the order the sheet lists them, which is the order Numbers shows them in, tables in groups
+// included.
+type Sheet struct {
+	ID     uint64   `json:"id"`
+	Name   string   `json:"name"`
+	Tables []uint64 `json:"tables,omitempty"`
+}
+
+// Sheets returns the sheets of a Numbers document in tab order, or nil for other documents. Sheets that aren't
+// loaded are left out.
+func (ix *Index) Sheets() []Sheet {
+	da, ok := ix.Root().(*TN.DocumentArchive)
+	if !ok {
+		return nil
+	}
+	var rval []Sheet
+	for _, ref := range da.Sheets {
+		sa, ok := ix.Deref(ref).(*TN.SheetArchive)
+		if !ok {
+			continue
+		}
+		sheet := Sheet{ID: ref.GetIdentifier(), Name: sa.GetName()}
+		seen := make(map[uint64]bool)
+		var add func(refs []*TSP.Reference)
+		add = func(refs []*TSP.Reference) {
+			for _, ref := range refs {
+				id := ref.GetIdentifier()
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				v := ix.Records[id]
+				if _, ok := v.(*TST.TableInfoArchive); ok {
+					sheet.Tables = append(sheet.Tables, id)
+				}
+				add(groupChildren(v))
+			}
+		}
+		add(sa.DrawableInfos)
+		rval = append(rval, sheet)
+	}
+	return rval
+}
+
+// CSVOptions control how a table is written by WriteCSVOptions.
+type CSVOptions struct {
+	// Comma is the field separator, ',' if zero. Use '\t' for TSV.
+	Comma rune
+	// Formulas writes the formula, like "=SUM(A1:B3)", instead of the computed value for formula cells.
+	Formulas bool
+	// FillMerged repeats the value of a merged range in each of its cells, rather than leaving all but the first
+	// empty.
+	FillMerged bool
+}
+
+// WriteCSV writes the computed values of the table as CSV.
+func (t *Table) WriteCSV(w io.Writer) error {
+	return t.WriteCSVOptions(w, CSVOptions{})
+}
+
+// WriteCSVOptions writes the table as CSV or TSV. Values are formatted the same way regardless of locale: numbers
+// with a '.' decimal point and no grouping, dates in RFC 3339 form and booleans as TRUE or FALSE.
+func (t *Table) WriteCSVOptions(w io.Writer, opts CSVOptions) error {
+	cw := csv.NewWriter(w)
+	if opts.Comma != 0 {
+		cw.Comma = opts.Comma
+	}
+	value := func(cell Cell) string {
+		if opts.Formulas && cell.Formula != "" {
+			return cell.Formula
+		}
+		return cell.String()
+	}
+	var origins map[[2]int][2]int
+	if opts.FillMerged {
+		origins = make(map[[2]int][2]int)
+		// ranges come from the file, so only the part inside the table is filled
+		for _, m := range t.Merges {
+			if m.Row < 0 || m.Column < 0 {
+				continue
+			}
+			for r := m.Row; r < m.Row+m.Rows && r < len(t.Rows); r++ {
+				for c := m.Column; c < m.Column+m.Columns && c < len(t.Rows[r]); c++ {
+					origins[[2]int{r, c}] = [2]int{m.Row, m.Column}
+				}
+			}
+		}
+	}
+	for r, row := range t.Rows {
+		record := make([]string, len(row))
+		for i, cell := range row {
+			if o, ok := origins[[2]int{r, i}]; ok && o[0] < len(t.Rows) && o[1] < len(t.Rows[o[0]]) {
+				cell = t.Rows[o[0]][o[1]]
+			}
+			record[i] = value(cell)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
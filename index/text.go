@@ -0,0 +1,249 @@
+package index
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Paragraph is a paragraph of a text storage with the attribute tables joined in. Start and End are character
+// (rune) offsets into the storage, End includes the paragraph terminator while Text does not.
+type Paragraph struct {
+	Start     uint32                      `json:"start"`
+	End       uint32                      `json:"end"`
+	Text      string                      `json:"text"`
+	Style     *TSWP.ParagraphStyleArchive `json:"-"`
+	StyleID   uint64                      `json:"style,omitempty"`
+	ListStyle *TSWP.ListStyleArchive      `json:"-"`
+	ListLevel uint32                      `json:"list_level,omitempty"`
+	ListLabel string                      `json:"list_label,omitempty"`
+	Runs      []Run                       `json:"runs"`
+}
+
+// Run is a span of a paragraph with a single character style, language, attachment and smart field. Attachments
+// always get a run of their own, whose text is the U+FFFC placeholder. So do footnote marks, with the
+// TSWP.FootnoteReferenceAttachmentArchive as their attachment. Language is the language tag set on the text, like
+// "en" or "fr_CA", empty if the text has none; RunLanguage falls back to the styles and the document.
+type Run struct {
+	Start      uint32                      `json:"start"`
+	End        uint32                      `json:"end"`
+	Text       string                      `json:"text"`
+	Style      *TSWP.CharacterStyleArchive `json:"-"`
+	StyleID    uint64                      `json:"style,omitempty"`
+	Language   string                      `json:"language,omitempty"`
+	Attachment interface{}                 `json:"-"`
+	Field      interface{}                 `json:"-"`
+}
+
+// maxListLevel is the deepest list level the apps offer, zero based. Deeper levels in a file are treated as it.
+const maxListLevel = 8
+
+// AttachmentChar marks the position of an attachment in storage text.
+const AttachmentChar = '￼'
+
+// attributeAt returns the reference in force at a character position, the last entry at or before it.
+func attributeAt(table *TSWP.ObjectAttributeTable, pos uint32) *TSP.Reference {
+	if table == nil {
+		return nil
+	}
+	var rval *TSP.Reference
+	for _, e := range table.Entries {
+		if e.GetCharacterIndex() > pos {
+			break
+		}
+		rval = e.Object
+	}
+	return rval
+}
+
+// stringAt returns the string in force at a character position, the last entry at or before it.
+func stringAt(table *TSWP.StringAttributeTable, pos uint32) string {
+	if table == nil {
+		return ""
+	}
+	var rval string
+	for _, e := range table.Entries {
+		if e.GetCharacterIndex() > pos {
+			break
+		}
+		rval = e.GetObject()
+	}
+	return rval
+}
+
+// paraDataAt returns the paragraph data (list level) in force at a character position.
+func paraDataAt(table *TSWP.ParaDataAttributeTable, pos uint32) uint32 {
+	if table == nil {
+		return 0
+	}
+	var rval uint32
+	for _, e := range table.Entries {
+		if e.GetCharacterIndex() > pos {
+			break
+		}
+		rval = e.GetFirst()
+	}
+	return rval
+}
+
+// Paragraphs returns the paragraphs of the storage pointed to by ref, or nil if it isn't a storage.
+func (ix *Index) Paragraphs(ref *TSP.Reference) []Paragraph {
+	st, ok := ix.Deref(ref).(*TSWP.StorageArchive)
+	if !ok {
+		return nil
+	}
+	return ix.StorageParagraphs(st)
+}
+
+// StorageParagraphs splits a storage into paragraphs and runs, resolving paragraph styles, list styles, levels and
+// labels, character styles, attachments and smart fields.
+func (ix *Index) StorageParagraphs(st *TSWP.StorageArchive) []Paragraph {
+	rr := []rune(strings.Join(st.Text, ""))
+
+	var starts []uint32
+	if st.TableParaStyle != nil {
+		for _, e := range st.TableParaStyle.Entries {
+			starts = append(starts, e.GetCharacterIndex())
+		}
+	}
+	if len(starts) == 0 || starts[0] != 0 {
+		starts = append([]uint32{0}, starts...)
+	}
+
+	var rval []Paragraph
+	// A null style means "use the previous one"
+	var paraStyle *TSP.Reference
+	var lists listCounter
+	for i, start := range starts {
+		end := uint32(len(rr))
+		if i+1 < len(starts) && starts[i+1] < end {
+			end = starts[i+1]
+		}
+		if start >= end {
+			continue
+		}
+		if ref := attributeAt(st.TableParaStyle, start); ref != nil {
+			paraStyle = ref
+		}
+		textEnd := end
+		for textEnd > start && (rr[textEnd-1] == '\n' || rr[textEnd-1] == '\u2029') {
+			textEnd--
+		}
+
+		p := Paragraph{Start: start, End: end, Text: string(rr[start:textEnd])}
+		if paraStyle != nil {
+			p.Style, _ = ix.Deref(paraStyle).(*TSWP.ParagraphStyleArchive)
+			p.StyleID = paraStyle.GetIdentifier()
+		}
+		if ls, ok := ix.Deref(attributeAt(st.TableListStyle, start)).(*TSWP.ListStyleArchive); ok {
+			p.ListStyle = ls
+		}
+		p.ListLevel = paraDataAt(st.TableParaData, start)
+		if p.ListLevel > maxListLevel {
+			p.ListLevel = maxListLevel
+		}
+		p.ListLabel = lists.label(p)
+		p.Runs = ix.runs(st, rr, start, textEnd)
+		rval = append(rval, p)
+	}
+	return rval
+}
+
+// SectionParagraphs splits the paragraphs of a storage at its section breaks, the boundaries recorded in the
+// section table. A storage without sections comes back as a single section.
+func (ix *Index) SectionParagraphs(st *TSWP.StorageArchive) [][]Paragraph {
+	paras := ix.StorageParagraphs(st)
+	var starts []uint32
+	if st.TableSection != nil {
+		for _, e := range st.TableSection.Entries {
+			if e.GetCharacterIndex() > 0 {
+				starts = append(starts, e.GetCharacterIndex())
+			}
+		}
+	}
+	rval := [][]Paragraph{nil}
+	for _, p := range paras {
+		for len(starts) > 0 && p.Start >= starts[0] {
+			starts = starts[1:]
+			rval = append(rval, nil)
+		}
+		rval[len(rval)-1] = append(rval[len(rval)-1], p)
+	}
+	return rval
+}
+
+func (ix *Index) runs(st *TSWP.StorageArchive, rr []rune, start, end uint32) []Run {
+	if start >= end {
+		return nil
+	}
+	cuts := map[uint32]bool{start: true, end: true}
+	for _, table := range []*TSWP.ObjectAttributeTable{st.TableCharStyle, st.TableSmartfield} {
+		if table == nil {
+			continue
+		}
+		for _, e := range table.Entries {
+			if pos := e.GetCharacterIndex(); pos > start && pos < end {
+				cuts[pos] = true
+			}
+		}
+	}
+	if st.TableLanguage != nil {
+		for _, e := range st.TableLanguage.Entries {
+			if pos := e.GetCharacterIndex(); pos > start && pos < end {
+				cuts[pos] = true
+			}
+		}
+	}
+	// Footnote marks get a run of their own too, so exporters can put the note in its place.
+	if st.TableFootnote != nil {
+		for _, e := range st.TableFootnote.Entries {
+			if pos := e.GetCharacterIndex(); pos >= start && pos < end {
+				cuts[pos] = true
+				cuts[pos+1] = true
+			}
+		}
+	}
+	for pos := start; pos < end; pos++ {
+		if rr[pos] == AttachmentChar {
+			cuts[pos] = true
+			cuts[pos+1] = true
+		}
+	}
+	positions := make([]uint32, 0, len(cuts))
+	for pos := range cuts {
+		positions = append(positions, pos)
+	}
+	sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+
+	var rval []Run
+	for i := 0; i+1 < len(positions); i++ {
+		s, e := positions[i], positions[i+1]
+		run := Run{Start: s, End: e, Text: string(rr[s:e])}
+		if ref := attributeAt(st.TableCharStyle, s); ref != nil {
+			run.Style, _ = ix.Deref(ref).(*TSWP.CharacterStyleArchive)
+			run.StyleID = ref.GetIdentifier()
+		}
+		if ref := attributeAt(st.TableSmartfield, s); ref != nil {
+			run.Field = ix.Deref(ref)
+		}
+		run.Language = stringAt(st.TableLanguage, s)
+		if rr[s] == AttachmentChar && st.TableAttachment != nil {
+			for _, entry := range st.TableAttachment.Entries {
+				if entry.GetCharacterIndex() == s {
+					run.Attachment = ix.Deref(entry.Object)
+				}
+			}
+		}
+		if st.TableFootnote != nil {
+			for _, entry := range st.TableFootnote.Entries {
+				if entry.GetCharacterIndex() == s && e == s+1 {
+					run.Attachment = ix.Deref(entry.Object)
+				}
+			}
+		}
+		rval = append(rval, run)
+	}
+	return rval
+}
@@ -0,0 +1,160 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Kinds of Problem found by Validate
+const (
+	ProblemTruncated   = "truncated"          // an .iwa file ends in the middle of a chunk or archive
+	ProblemDuplicateID = "duplicate_id"       // two archives have the same identifier
+	ProblemDecode      = "decode_error"       // a record of a known type failed to decode
+	ProblemDangling    = "dangling_reference" // a record references one that doesn't exist
+	ProblemMissingData = "missing_data"       // a record references a data file that isn't listed or isn't there
+)
+
+// Problem is an integrity problem of a document. ID is the record it concerns and Ref the record or data
+// identifier it references, if any. File is the .iwa file or data file involved.
+type Problem struct {
+	Kind    string `json:"kind"`
+	ID      uint64 `json:"id,omitempty"`
+	Ref     uint64 `json:"ref,omitempty"`
+	File    string `json:"file,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return p.Kind + ": " + p.Message
+}
+
+// Report is the result of Validate. Index holds what could be loaded despite the problems, nil if nothing could.
+type Report struct {
+	Problems []Problem `json:"problems"`
+	Index    *Index    `json:"-"`
+}
+
+// OK reports whether no problems were found.
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) add(p Problem) {
+	r.Problems = append(r.Problems, p)
+}
+
+// Validate checks the integrity of a document: that its .iwa files are complete, identifiers are unique, records
+// decode, and every TSP.Reference and TSP.DataReference resolves. Unlike Open it carries on past damaged files,
+// loading the archives before the damage, and reports everything it finds. The error is only for documents that
+// can't be read at all, like a wrong password.
+func Validate(ctx context.Context, doc, password string) (*Report, error) {
+	rval := &Report{}
+	onError := func(err *DecodeError) {
+		if !err.Unknown {
+			rval.add(Problem{Kind: ProblemDecode, ID: err.ID, Message: err.Error()})
+		}
+	}
+
+	zf, verifier, err := openZip(doc)
+	if err != nil {
+		// .pages-tef documents have no files to check, just the references
+		ix, err := open(ctx, doc, Options{Password: password, ErrorHandler: onError})
+		if err != nil {
+			return nil, err
+		}
+		rval.Index = ix
+		rval.checkReferences(ix)
+		return rval, nil
+	}
+	defer zf.Close()
+	crypt, err := newDecrypter(verifier, password)
+	if err != nil {
+		return nil, err
+	}
+	limits := DefaultLimits
+	indexType, err := detectZip(doc, &zf.Reader, crypt, limits)
+	if err != nil {
+		return nil, err
+	}
+	ix := &Index{Type: indexType, path: doc, crypt: crypt, limits: limits, onError: onError,
+		Records: make(map[uint64]interface{}), loaded: make(map[string]bool)}
+	rval.Index = ix
+
+	seen := make(map[uint64]string)
+	for _, f := range zf.File {
+		if !strings.HasSuffix(f.Name, ".iwa") {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		archives, err := ix.readZipIWA(ctx, f)
+		if err != nil {
+			if errors.Is(err, ctx.Err()) {
+				return nil, err
+			}
+			rval.add(Problem{Kind: ProblemTruncated, File: f.Name, Message: err.Error()})
+		}
+		for _, a := range archives {
+			id := a.info.GetIdentifier()
+			if prev, ok := seen[id]; ok {
+				rval.add(Problem{Kind: ProblemDuplicateID, ID: id, File: f.Name,
+					Message: fmt.Sprintf("record %d is in both %s and %s", id, prev, f.Name)})
+			}
+			seen[id] = f.Name
+		}
+		if err := ix.addArchives(f.Name, archives); err != nil {
+			return nil, err
+		}
+		ix.loaded[f.Name] = true
+	}
+	rval.checkReferences(ix)
+	return rval, nil
+}
+
+// checkReferences reports the references of the loaded records that don't resolve.
+func (r *Report) checkReferences(ix *Index) {
+	media := make(map[uint64]Media)
+	for _, m := range ix.Media() {
+		media[m.ID] = m
+	}
+	ids := make([]uint64, 0, len(ix.Records))
+	for id := range ix.Records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		var objects, datas []uint64
+		if raw, ok := ix.Records[id].(*RawRecord); ok {
+			objects, _ = ix.rawReferences(raw)
+			if info := ix.infos[id]; info != nil && info.archive != nil {
+				for _, mi := range info.archive.MessageInfos {
+					datas = append(datas, mi.DataReferences...)
+				}
+			}
+		} else {
+			objects, datas = references(ix.Records[id])
+		}
+		for _, ref := range objects {
+			if _, ok := ix.Records[ref]; !ok && ref != 0 {
+				r.add(Problem{Kind: ProblemDangling, ID: id, Ref: ref,
+					Message: fmt.Sprintf("record %d references missing record %d", id, ref)})
+			}
+		}
+		for _, ref := range datas {
+			m, ok := media[ref]
+			switch {
+			case !ok:
+				r.add(Problem{Kind: ProblemMissingData, ID: id, Ref: ref,
+					Message: fmt.Sprintf("record %d references data %d, which the package metadata doesn't list", id, ref)})
+			case m.Size < 0:
+				r.add(Problem{Kind: ProblemMissingData, ID: id, Ref: ref, File: m.Path,
+					Message: fmt.Sprintf("record %d references data %d, but %s is missing", id, ref, m.Path)})
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package index
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VersionRange is a span of package read versions, like "1.0.0" to "2.0.0". iWork saves the oldest reader a
+// document needs as the read version of its package metadata, see Metadata.ReadVersion.
+type VersionRange struct {
+	Min string `json:"min"`
+	Max string `json:"max"`
+}
+
+// supportedVersions are the read versions the protos in this module were generated against.
+var supportedVersions = map[Type]VersionRange{
+	Pages:   {"1.0.0", "2.0.0"},
+	Numbers: {"1.0.0", "2.0.0"},
+	Keynote: {"1.0.0", "2.0.0"},
+}
+
+// SupportedVersions returns the package read versions this package decodes, by document type. Newer documents
+// still open when their document archive decodes, with the records we can't read left out; otherwise Open fails
+// with an *UnsupportedVersionError rather than a document with nothing in it.
+func SupportedVersions() map[Type]VersionRange {
+	rval := make(map[Type]VersionRange, len(supportedVersions))
+	for t, r := range supportedVersions {
+		rval[t] = r
+	}
+	return rval
+}
+
+// UnsupportedVersionError reports a document saved in a newer format than we decode. It matches
+// ErrUnsupportedVersion with errors.Is.
+type UnsupportedVersionError struct {
+	Path      string
+	Version   string // the read version of the document
+	Supported string // the newest read version we decode
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("%s: format %s is newer than %s: %v", e.Path, e.Version, e.Supported, ErrUnsupportedVersion)
+}
+
+// Is makes errors.Is(err, ErrUnsupportedVersion) true for an UnsupportedVersionError.
+func (e *UnsupportedVersionError) Is(target error) bool {
+	return target == ErrUnsupportedVersion
+}
+
+// checkVersion fails for a document that needs a newer reader and whose document archive didn't decode.
+func (ix *Index) checkVersion() error {
+	meta := ix.packageMetadata()
+	r, ok := supportedVersions[Type(ix.Type)]
+	if meta == nil || !ok || len(meta.ReadVersion) == 0 || ix.Root() != nil {
+		return nil
+	}
+	version := formatVersion(meta.ReadVersion)
+	if compareVersions(version, r.Max) <= 0 {
+		return nil
+	}
+	return &UnsupportedVersionError{Path: ix.path, Version: version, Supported: r.Max}
+}
+
+// compareVersions compares dotted versions numerically, missing parts counting as 0.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package index
+
+import (
+	"errors"
+	"sort"
+)
+
+// WalkFunc is called by Walk for each record reached: its identifier, the decoded value (nil if the record isn't
+// loaded or couldn't be decoded), the identifier of the record it was first reached from (0 for the root) and its
+// depth. Returning SkipReferences skips the record's references, any other error stops the walk.
+type WalkFunc func(id uint64, v interface{}, parent uint64, depth int) error
+
+// SkipReferences can be returned by a WalkFunc to leave a record's references unvisited.
+var SkipReferences = errors.New("skip references")
+
+// Walk visits root and every record reachable from it through TSP.Reference fields, each once. The walk is breadth
+// first, so depth is the length of the shortest reference path from root. References are not followed past
+// maxDepth, 0 means no limit. Walk returns the first error from fn other than SkipReferences.
+func (ix *Index) Walk(root uint64, maxDepth int, fn WalkFunc) error {
+	type item struct {
+		id, parent uint64
+		depth      int
+	}
+	seen := map[uint64]bool{root: true}
+	queue := []item{{id: root}}
+	for len(queue) > 0 {
+		it := queue[0]
+		queue = queue[1:]
+		v := ix.Records[it.id]
+		err := fn(it.id, v, it.parent, it.depth)
+		if err == SkipReferences {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if v == nil || (maxDepth > 0 && it.depth >= maxDepth) {
+			continue
+		}
+		var objects []uint64
+		if raw, ok := v.(*RawRecord); ok {
+			objects, _ = ix.rawReferences(raw)
+		} else {
+			objects, _ = references(v)
+		}
+		for _, id := range objects {
+			if !seen[id] {
+				seen[id] = true
+				queue = append(queue, item{id, it.id, it.depth + 1})
+			}
+		}
+	}
+	return nil
+}
+
+// Unreachable returns the identifiers of the loaded records that can't be reached from the document archive
+// (identifier 1) or the package metadata, in order. These are garbage as far as the document is
+// concerned, though the apps sometimes keep caches that way.
+func (ix *Index) Unreachable() []uint64 {
+	reached := make(map[uint64]bool)
+	mark := func(id uint64, v interface{}, parent uint64, depth int) error {
+		reached[id] = true
+		return nil
+	}
+	ix.Walk(1, 0, mark)
+	if meta := ix.packageMetadata(); meta != nil {
+		for id, v := range ix.Records {
+			if v == meta {
+				ix.Walk(id, 0, mark)
+			}
+		}
+	}
+	var rval []uint64
+	for id := range ix.Records {
+		if !reached[id] {
+			rval = append(rval, id)
+		}
+	}
+	sort.Slice(rval, func(i, j int) bool { return rval[i] < rval[j] })
+	return rval
+}
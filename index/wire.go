@@ -0,0 +1,59 @@
+package index
+
+import "encoding/binary"
+
+// wireField is a raw protobuf field. Our protos predate some of the fields Apple writes today, those end up in
+// XXX_unrecognized and have to be picked apart by hand.
+type wireField struct {
+	num   int
+	typ   int
+	value uint64 // varint and fixed values
+	data  []byte // length delimited values
+	raw   []byte // the whole field, tag included
+}
+
+// wireFields splits encoded protobuf data into fields. It stops at the first malformed field.
+func wireFields(data []byte) []wireField {
+	var rval []wireField
+	for len(data) > 0 {
+		start := data
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			break
+		}
+		data = data[n:]
+		f := wireField{num: int(tag >> 3), typ: int(tag & 7)}
+		switch f.typ {
+		case 0:
+			f.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return rval
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return rval
+			}
+			f.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return rval
+			}
+			f.data = data[n : n+int(l)]
+			data = data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return rval
+			}
+			f.value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return rval
+		}
+		f.raw = start[:len(start)-len(data)]
+		rval = append(rval, f)
+	}
+	return rval
+}
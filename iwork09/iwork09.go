@@ -0,0 +1,445 @@
+// Package iwork09 extracts the text and tables of iWork '08 and '09 documents.
+//
+// These predate the protobuf based format handled by the index package. A document is either a bundle directory
+// holding index.xml.gz, or a zip file holding index.xml. The XML is streamed, so large documents don't have to be
+// held in memory as a tree. Only content is extracted: styles, layout, masters and templates are skipped.
+package iwork09
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dunhamsteve/iwork/index"
+)
+
+// Document is the content of an iWork '09 document. Pages documents fill Body and Tables, Numbers documents
+// Sheets and Keynote documents Slides.
+type Document struct {
+	Type   string   `json:"type"`           // "pages", "numbers" or "key", as in index.Index
+	Body   []string `json:"body,omitempty"` // paragraphs
+	Tables []*Table `json:"tables,omitempty"`
+	Sheets []*Sheet `json:"sheets,omitempty"`
+	Slides []*Slide `json:"slides,omitempty"`
+}
+
+// Table is a table, in the same form as the tables of newer documents. Only Name and Rows are filled in.
+type Table = index.Table
+
+// Sheet is a Numbers sheet with its tables and the text of its text boxes.
+type Sheet struct {
+	Name   string   `json:"name"`
+	Text   []string `json:"text,omitempty"`
+	Tables []*Table `json:"tables,omitempty"`
+}
+
+// Slide is a Keynote slide.
+type Slide struct {
+	Text   []string `json:"text,omitempty"`
+	Notes  []string `json:"notes,omitempty"`
+	Tables []*Table `json:"tables,omitempty"`
+}
+
+// IsLegacy reports whether doc looks like an iWork '09 document.
+func IsLegacy(doc string) bool {
+	if _, err := os.Stat(filepath.Join(doc, "index.xml.gz")); err == nil {
+		return true
+	}
+	zr, err := zip.OpenReader(doc)
+	if err != nil {
+		return false
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Name == "index.xml" {
+			return true
+		}
+	}
+	return false
+}
+
+// Open reads an iWork '09 document.
+func Open(doc string) (*Document, error) {
+	if f, err := os.Open(filepath.Join(doc, "index.xml.gz")); err == nil {
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("iwork09: %w", err)
+		}
+		return Read(gz)
+	}
+	zr, err := zip.OpenReader(doc)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Name == "index.xml" {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return Read(rc)
+		}
+	}
+	return nil, errors.New("iwork09: no index.xml in document")
+}
+
+// Read parses the index.xml of an iWork '09 document.
+func Read(r io.Reader) (*Document, error) {
+	p := &parser{dec: xml.NewDecoder(r), doc: &Document{}}
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("iwork09: %w", err)
+	}
+	if p.doc.Type == "" {
+		return nil, errors.New("iwork09: unknown document type")
+	}
+	return p.doc, nil
+}
+
+// Text returns all of the text in the document, one paragraph per line, including table cells.
+func (d *Document) Text() string {
+	var lines []string
+	tables := func(tables []*Table) {
+		for _, t := range tables {
+			for _, row := range t.Rows {
+				var cells []string
+				for _, cell := range row {
+					cells = append(cells, cell.String())
+				}
+				lines = append(lines, strings.Join(cells, "\t"))
+			}
+		}
+	}
+	lines = append(lines, d.Body...)
+	tables(d.Tables)
+	for _, s := range d.Sheets {
+		lines = append(lines, s.Text...)
+		tables(s.Tables)
+	}
+	for _, s := range d.Slides {
+		lines = append(lines, s.Text...)
+		tables(s.Tables)
+		lines = append(lines, s.Notes...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// skipped elements hold styles, templates and masters rather than document content.
+var skipped = map[string]bool{
+	"stylesheet":         true,
+	"section-prototypes": true,
+	"master-slides":      true,
+	"master-slide":       true,
+	"theme-list":         true,
+	"prototype":          true,
+}
+
+// roots maps the document element of each app to its document type.
+var roots = map[string]string{
+	"document":     "pages",
+	"presentation": "key",
+}
+
+type parser struct {
+	dec   *xml.Decoder
+	depth int
+	doc   *Document
+	paras []*strings.Builder // open paragraphs, innermost last
+	slide *Slide
+	notes bool
+	sheet *Sheet
+	table *table
+	cell  *cell
+}
+
+// table collects the cells of a tabular model.
+type table struct {
+	name       string
+	rows, cols int
+	sized      bool // rows and cols came from the grid attributes
+	next       int  // position of the next cell without row and col attributes
+	cells      map[[2]int]index.Cell
+	datasource bool
+}
+
+// cell collects the value of a cell while its element is open.
+type cell struct {
+	depth   int
+	kind    string
+	row     int
+	col     int
+	attrs   map[string]string
+	result  string // element name of a formula result
+	rattrs  map[string]string
+	text    []string
+	formula string
+}
+
+func (p *parser) parse() error {
+	for {
+		tok, err := p.dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			p.depth++
+			if p.depth == 1 {
+				p.doc.Type = roots[t.Name.Local]
+				if t.Name.Space == "http://developer.apple.com/namespaces/ls" {
+					p.doc.Type = "numbers"
+				}
+				continue
+			}
+			if skipped[t.Name.Local] {
+				if err := p.dec.Skip(); err != nil {
+					return err
+				}
+				p.depth--
+				continue
+			}
+			p.start(t)
+		case xml.EndElement:
+			p.end(t)
+			p.depth--
+		case xml.CharData:
+			if n := len(p.paras); n > 0 {
+				p.paras[n-1].Write(t)
+			}
+		}
+	}
+}
+
+func attrs(se xml.StartElement) map[string]string {
+	rval := make(map[string]string)
+	for _, a := range se.Attr {
+		rval[a.Name.Local] = a.Value
+	}
+	return rval
+}
+
+func (p *parser) start(se xml.StartElement) {
+	a := attrs(se)
+	if p.table != nil && p.table.datasource && p.cell == nil {
+		p.cell = &cell{depth: p.depth, kind: se.Name.Local, row: -1, col: -1, attrs: a}
+		if v, err := strconv.Atoi(a["row"]); err == nil {
+			p.cell.row = v
+		}
+		if v, err := strconv.Atoi(a["col"]); err == nil {
+			p.cell.col = v
+		}
+		return
+	}
+	if p.cell != nil {
+		switch se.Name.Local {
+		case "ct":
+			if s, ok := a["s"]; ok {
+				p.cell.text = append(p.cell.text, s)
+			}
+		case "fo":
+			p.cell.formula = a["fs"]
+		case "rn", "rs", "rb", "rd", "rdu":
+			p.cell.result, p.cell.rattrs = se.Name.Local, a
+		}
+	}
+
+	switch se.Name.Local {
+	case "slide":
+		if p.doc.Type == "key" {
+			p.slide = &Slide{}
+			p.doc.Slides = append(p.doc.Slides, p.slide)
+		}
+	case "notes":
+		p.notes = p.slide != nil
+	case "workspace":
+		p.sheet = &Sheet{Name: a["workspace-name"]}
+		p.doc.Sheets = append(p.doc.Sheets, p.sheet)
+	case "tabular-model":
+		if p.table == nil {
+			p.table = &table{name: a["name"], cells: make(map[[2]int]index.Cell)}
+		}
+	case "grid":
+		if p.table != nil {
+			p.table.rows, _ = strconv.Atoi(a["numrows"])
+			p.table.cols, _ = strconv.Atoi(a["numcols"])
+			p.table.sized = p.table.rows > 0 && p.table.cols > 0
+		}
+	case "grid-row":
+		if p.table != nil && !p.table.sized {
+			p.table.rows++
+		}
+	case "grid-column":
+		if p.table != nil && !p.table.sized {
+			p.table.cols++
+		}
+	case "datasource":
+		if p.table != nil {
+			p.table.datasource = true
+		}
+	case "p":
+		p.paras = append(p.paras, &strings.Builder{})
+	case "tab":
+		p.write("\t")
+	case "lnbr":
+		p.write("\n")
+	}
+}
+
+func (p *parser) write(s string) {
+	if n := len(p.paras); n > 0 {
+		p.paras[n-1].WriteString(s)
+	}
+}
+
+func (p *parser) end(ee xml.EndElement) {
+	if p.cell != nil && p.depth == p.cell.depth {
+		p.table.add(p.cell)
+		p.cell = nil
+		return
+	}
+	switch ee.Name.Local {
+	case "p":
+		n := len(p.paras)
+		if n == 0 {
+			return
+		}
+		text := strings.TrimRight(p.paras[n-1].String(), "\n")
+		p.paras = p.paras[:n-1]
+		p.paragraph(text)
+	case "datasource":
+		if p.table != nil {
+			p.table.datasource = false
+		}
+	case "tabular-model":
+		if p.table == nil {
+			return
+		}
+		t := p.table.build()
+		p.table = nil
+		switch {
+		case p.slide != nil:
+			p.slide.Tables = append(p.slide.Tables, t)
+		case p.sheet != nil:
+			p.sheet.Tables = append(p.sheet.Tables, t)
+		default:
+			p.doc.Tables = append(p.doc.Tables, t)
+		}
+	case "notes":
+		p.notes = false
+	case "slide":
+		p.slide, p.notes = nil, false
+	case "workspace":
+		p.sheet = nil
+	}
+}
+
+// paragraph files a finished paragraph under the cell, slide, sheet or document it belongs to.
+func (p *parser) paragraph(text string) {
+	switch {
+	case p.cell != nil:
+		p.cell.text = append(p.cell.text, text)
+	case strings.TrimSpace(text) == "":
+	case p.notes:
+		p.slide.Notes = append(p.slide.Notes, text)
+	case p.slide != nil:
+		p.slide.Text = append(p.slide.Text, text)
+	case p.sheet != nil:
+		p.sheet.Text = append(p.sheet.Text, text)
+	case p.doc.Type == "pages":
+		p.doc.Body = append(p.doc.Body, text)
+	}
+}
+
+func (t *table) add(c *cell) {
+	row, col := c.row, c.col
+	if row < 0 || col < 0 {
+		if t.cols <= 0 {
+			return
+		}
+		row, col = t.next/t.cols, t.next%t.cols
+	}
+	t.next = row*t.cols + col + 1
+	t.cells[[2]int{row, col}] = c.value()
+}
+
+func (t *table) build() *Table {
+	rows, cols := t.rows, t.cols
+	for pos := range t.cells {
+		if pos[0] >= rows {
+			rows = pos[0] + 1
+		}
+		if pos[1] >= cols {
+			cols = pos[1] + 1
+		}
+	}
+	rval := &index.Table{Name: t.name, Rows: make([][]index.Cell, rows)}
+	for r := range rval.Rows {
+		rval.Rows[r] = make([]index.Cell, cols)
+		for c := range rval.Rows[r] {
+			rval.Rows[r][c] = t.cells[[2]int{r, c}]
+		}
+	}
+	return rval
+}
+
+// value decodes a cell. Formula cells take the type of their cached result.
+func (c *cell) value() index.Cell {
+	kind, a := c.kind, c.attrs
+	if kind == "f" && c.result != "" {
+		kind, a = c.result[1:], c.rattrs
+		if kind == "s" {
+			kind = "t"
+		}
+	}
+	var rval index.Cell
+	if c.formula != "" {
+		rval.Formula = "=" + strings.TrimPrefix(c.formula, "=")
+	}
+	switch kind {
+	case "n":
+		if v, err := strconv.ParseFloat(a["v"], 64); err == nil {
+			rval.Type, rval.Number = index.NumberCell, v
+		}
+	case "b":
+		rval.Type = index.BoolCell
+		if a["v"] == "true" || a["v"] == "1" {
+			rval.Number = 1
+		}
+	case "d":
+		if t, ok := parseDate(a["cell-date"]); ok {
+			rval.Type, rval.Time = index.DateCell, t
+		}
+	case "du":
+		if v, err := strconv.ParseFloat(a["du"], 64); err == nil {
+			rval.Type, rval.Number = index.DurationCell, v
+		}
+	case "t":
+		rval.Type, rval.Text = index.TextCell, strings.Join(c.text, "\n")
+	}
+	if rval.Type == index.EmptyCell && len(c.text) > 0 {
+		rval.Type, rval.Text = index.TextCell, strings.Join(c.text, "\n")
+	}
+	return rval
+}
+
+func parseDate(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05-0700", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -8,8 +8,8 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/binary"
-	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -74,23 +74,24 @@ type Attachment struct {
 }
 
 func (ctx *Context) processImage(image *TSD.ImageArchive) *html.Node {
-	dataId := *image.Data.Identifier
-	meta := ctx.ix.Records[2].(*TSP.PackageMetadata)
+	dataId := image.GetData().GetIdentifier()
 	var src string
-	for _, data := range meta.Datas {
-		if dataId == *data.Identifier {
-			if data.FileName != nil {
-				src = *data.FileName
-			} else {
-				fmt.Println("No filename: %#v\n", data)
-				src = *data.PreferredFileName
+	if meta, ok := ctx.ix.Records[2].(*TSP.PackageMetadata); ok {
+		for _, data := range meta.Datas {
+			if dataId == data.GetIdentifier() {
+				if data.FileName != nil {
+					src = data.GetFileName()
+				} else {
+					fmt.Println("No filename: %#v\n", data)
+					src = data.GetPreferredFileName()
+				}
 			}
 		}
 	}
 	ctx.imgs["Data/"+src] = dataId
 	// not sure if this is px or pt.  It's px on the html side.
-	width := fmt.Sprintf("%f", *image.OriginalSize.Width)
-	height := fmt.Sprintf("%f", *image.OriginalSize.Height)
+	width := fmt.Sprintf("%f", image.GetOriginalSize().GetWidth())
+	height := fmt.Sprintf("%f", image.GetOriginalSize().GetHeight())
 	return E("img", []string{"src", "", "width", width, "height", height, "class", "img_" + fmt.Sprint(dataId)})
 }
 
@@ -105,132 +106,49 @@ func popcount(v uint16) int {
 }
 
 func (ctx *Context) processTable(tm *TST.TableModelArchive) *html.Node {
-	stringTable := ctx.ix.Deref(tm.DataStore.StringTable).(*TST.TableDataList).Entries
-	richTable := ctx.ix.Deref(tm.DataStore.RichTextPayloadTable).(*TST.TableDataList).Entries
-
-	// rc := *tm.NumberOfRows
-	cc := *tm.NumberOfColumns
-
-	// I found some hints at http://stingrayreader.sourceforge.net/workbook/numbers_13.html about how
-	// this works, but I'm still flying blind.
-
-	// so for now we assume at most one tile per row, and rows are in the right order.  I suspect long rows (more than
-	// 255 columns) will have multiple tiles, however.  This would likely only happen in a spreadsheet.
-
+	if tm == nil {
+		return nil
+	}
 	table := E("table")
-	for _, tinfo := range tm.DataStore.Tiles.Tiles {
-		tile := ctx.ix.Deref(tinfo.Tile).(*TST.Tile)
-		for r, rinfo := range tile.RowInfos {
-			tr := E("tr")
-			table.AppendChild(tr)
-
-			offsets := make([]uint16, len(rinfo.CellOffsets)/2)
-			binary.Read(bytes.NewBuffer(rinfo.CellOffsets), LE, offsets)
-			// Naïvely assuming that the index is the column number, per the stringrayreader code.
-			// FIXME - figure out the right way to determine column number.
-			for c, offset := range offsets {
-				if uint32(c) >= cc {
-					break
-				}
-				td := E("td")
-				tr.AppendChild(td)
-
-				// 0xffff is an empty cell (This only occurs at the end in my sample document.)
-				if offset == 65535 {
-					continue
-				}
-
-				var cellType int
-				// this has changed since I first wrote the code.  There is now a 4 in the first byte and the type in the next
-				// the "stingrayreader" site says there is a halfword "version" and then the type, which I think worked at one
-				// point, but I no longer have the file.
-				if rinfo.CellStorageBuffer[offset] == 4 {
-					cellType = int(rinfo.CellStorageBuffer[offset+1])
-				} else {
-					panic("not four")
-					cellType = int(rinfo.CellStorageBuffer[offset+2])
-				}
-
-				// As far as I can tell, the records are variable length, with the pointer into the string/rich table at
-				// the end, but this field seems to contain one bit per uint32 before the pointer to the string table
-				// I suspect they are flags indicating which numbers/fields follow.
-				flags := LE.Uint16(rinfo.CellStorageBuffer[offset+4 : offset+6])
-				o := popcount(flags)*4 + 8 + int(offset)
-
-				key := LE.Uint32(rinfo.CellStorageBuffer[o : o+4])
-
-				// fmt.Printf("P %d %x %d %x\n", cellType, flags, popcount(flags), rinfo.CellStorageBuffer[o:o+4])
-				// version := LE.Uint16(rinfo.CellStorageBuffer[offset : offset+2])
-				// fmt.Println("XXX", c, version, cellType, hex.EncodeToString(rinfo.CellStorageBuffer[offset:]))
-				switch cellType {
-				case 0:
-					// blank cells are type 0
-				case 2: // number
-					value := math.Float64frombits(LE.Uint64(rinfo.CellStorageBuffer[o : o+8]))
-					td.AppendChild(E("p", fmt.Sprint(value)))
-				case 5: // date
-					value := math.Float64frombits(LE.Uint64(rinfo.CellStorageBuffer[o : o+8]))
-					value += 978307200 // Apple to unix epoch
-					tm := time.Unix(int64(value), 0)
-					// We'll probably want to figure out formatting here.
-					td.AppendChild(E("p", fmt.Sprint(tm)))
-				case 6: // boolean
-					value := math.Float64frombits(LE.Uint64(rinfo.CellStorageBuffer[o : o+8]))
-					var label = "???"
-					if value == 0 {
-						label = "FALSE"
-					} else if value == 0xf03f {
-						label = "TRUE"
-					}
-					td.AppendChild(E("p", label))
-				case 3:
-					for _, entry := range stringTable {
-						if *entry.Key == key {
-							td.AppendChild(E("p", *entry.String_))
-						}
-					}
-				case 9:
-					for _, entry := range richTable {
-						if *entry.Key == key {
-							rt := ctx.ix.Deref(entry.RichTextPayload).(*TST.RichTextPayloadArchive)
-							st := ctx.ix.Deref(rt.Storage).(*TSWP.StorageArchive)
-							ctx.storageToNode(st, td)
-						}
-					}
-				default:
-					fmt.Printf("P %d %x %d %x\n", cellType, flags, popcount(flags), rinfo.CellStorageBuffer[o:o+8])
-					fmt.Printf("CELL %d:%d type %d %s\n", r, c, cellType, hex.EncodeToString(rinfo.CellStorageBuffer[offset:]))
-					td.AppendChild(E("p", fmt.Sprintf("UNKNOWN CELL TYPE %d", cellType)))
+	for _, row := range ctx.ix.Cells(tm) {
+		tr := E("tr")
+		table.AppendChild(tr)
+		for _, cell := range row {
+			td := E("td")
+			tr.AppendChild(td)
+			switch cell.Type {
+			case index.EmptyCell:
+			case index.RichTextCell:
+				if cell.RichText != nil {
+					ctx.storageToNode(cell.RichText, td)
 				}
+			default:
+				td.AppendChild(E("p", cell.String()))
 			}
 		}
 	}
 	rval := E("div")
-	if tm.TableName != nil {
-		// rval.AppendChild(E("h3", *tm.TableName)) // no need to show table name
-	}
 	rval.AppendChild(table)
 	return rval
 }
 
 func (ctx *Context) processDrawable(ref *TSP.Reference) *html.Node {
 	item := ctx.ix.Deref(ref)
-	switch item.(type) {
+	switch item := item.(type) {
 	case *TSD.ImageArchive:
-		return ctx.processImage(item.(*TSD.ImageArchive))
+		return ctx.processImage(item)
 	case *TST.WPTableInfoArchive:
-		table := item.(*TST.WPTableInfoArchive)
-		tm := ctx.ix.Deref(table.Super.TableModel).(*TST.TableModelArchive)
+		tm, _ := ctx.ix.Deref(item.GetSuper().GetTableModel()).(*TST.TableModelArchive)
 		return ctx.processTable(tm)
 	case *TST.TableInfoArchive:
-		tm := ctx.ix.Deref(item.(*TST.TableInfoArchive).TableModel).(*TST.TableModelArchive)
+		tm, _ := ctx.ix.Deref(item.GetTableModel()).(*TST.TableModelArchive)
 		return ctx.processTable(tm)
 	case *TSWP.ShapeInfoArchive:
-		return ctx.processShapeInfo(item.(*TSWP.ShapeInfoArchive))
+		return ctx.processShapeInfo(item)
 	case *TSD.GroupArchive:
-		return ctx.processDrawableArchive(item.(*TSD.GroupArchive).Super)
+		return ctx.processDrawableArchive(item.Super)
 	case *KN.PlaceholderArchive:
-		return ctx.processShapeInfo(item.(*KN.PlaceholderArchive).Super)
+		return ctx.processShapeInfo(item.Super)
 	default:
 		msg := fmt.Sprintf("*** Unhandled attachment type %T\n", item)
 		fmt.Println(msg)
@@ -240,13 +158,13 @@ func (ctx *Context) processDrawable(ref *TSP.Reference) *html.Node {
 }
 
 func (ctx *Context) processShapeInfo(sia *TSWP.ShapeInfoArchive) *html.Node {
-	if cs := ctx.ix.Deref(sia.ContainedStorage).(*TSWP.StorageArchive); cs != nil {
+	if cs, ok := ctx.ix.Deref(sia.GetContainedStorage()).(*TSWP.StorageArchive); ok {
 		div := E("div")
 		if ctx.storageToNode(cs, div) == nil {
 			return div
 		}
 	}
-	return ctx.processDrawableArchive(sia.Super.Super)
+	return ctx.processDrawableArchive(sia.GetSuper().GetSuper())
 }
 
 func (ctx *Context) processDrawableArchive(da *TSD.DrawableArchive) *html.Node {
@@ -269,15 +187,14 @@ func (ctx *Context) storageToNode(bs *TSWP.StorageArchive, body *html.Node) erro
 	rr := []rune(text)
 
 	// <p>
-	parStyles := bs.TableParaStyle.Entries
+	parStyles := bs.GetTableParaStyle().GetEntries()
 
 	var attachments []Attachment
 	if bs.TableAttachment != nil {
 		for _, entry := range bs.TableAttachment.Entries {
-			pos := *entry.CharacterIndex
-			switch ctx.ix.Deref(entry.Object).(type) {
+			pos := entry.GetCharacterIndex()
+			switch archive := ctx.ix.Deref(entry.Object).(type) {
 			case *TSWP.DrawableAttachmentArchive:
-				archive := ctx.ix.Deref(entry.Object).(*TSWP.DrawableAttachmentArchive)
 				node := ctx.processDrawable(archive.Drawable)
 				if node != nil {
 					attachments = append(attachments, Attachment{pos, node})
@@ -295,10 +212,14 @@ func (ctx *Context) storageToNode(bs *TSWP.StorageArchive, body *html.Node) erro
 	// build paragraphs
 	for i, e := range parStyles {
 
-		pos := *e.CharacterIndex
+		// offsets come from the file, so keep them within the text
 		end := uint32(len(rr))
-		if i+1 < len(parStyles) {
-			end = *parStyles[i+1].CharacterIndex
+		if i+1 < len(parStyles) && parStyles[i+1].GetCharacterIndex() < end {
+			end = parStyles[i+1].GetCharacterIndex()
+		}
+		pos := e.GetCharacterIndex()
+		if pos > end {
+			pos = end
 		}
 
 		for len(attachments) > 0 && attachments[0].pos < end {
@@ -313,28 +234,30 @@ func (ctx *Context) storageToNode(bs *TSWP.StorageArchive, body *html.Node) erro
 		tag := "p"
 
 		// Get style, change tag if appropriate.
-		if e.Object != nil {
-			ref := ix.Deref(e.Object).(*TSWP.ParagraphStyleArchive)
-			className = fmt.Sprintf("ps%d", *e.Object.Identifier)
+		if ref, ok := ix.Deref(e.Object).(*TSWP.ParagraphStyleArchive); ok {
+			className = fmt.Sprintf("ps%d", e.Object.GetIdentifier())
+			if ref.CharProperties == nil {
+				ref.CharProperties = &TSWP.CharacterStylePropertiesArchive{}
+			}
+			if ref.ParaProperties == nil {
+				ref.ParaProperties = &TSWP.ParagraphStylePropertiesArchive{}
+			}
 
 			// Some properties are inherited (e.g. if you apply a style and then tweak it.)
 			// We can't just include both because FirstLineIndent in parent can combine with LeftIndent in child
 			// to produce a css text-indent.
-			if ref.Super.Parent != nil {
-				parent := ix.Deref(ref.Super.Parent).(*TSWP.ParagraphStyleArchive)
+			seen := map[*TSWP.ParagraphStyleArchive]bool{ref: true}
+			for parent, ok := ix.Deref(ref.GetSuper().GetParent()).(*TSWP.ParagraphStyleArchive); ok && !seen[parent]; parent, ok = ix.Deref(parent.GetSuper().GetParent()).(*TSWP.ParagraphStyleArchive) {
+				seen[parent] = true
 				mergeCharProps(ref.CharProperties, parent.CharProperties)
 				mergeParaProps(ref.ParaProperties, parent.ParaProperties)
-
-				if parent.Super.Parent != nil {
-					panic("Need recursion here")
-				}
 			}
 
 			ctx.styles[className] = translateParaProps(ref.ParaProperties) + translateCharProps(ref.CharProperties)
 
 			if ref.ParaProperties.OutlineLevel != nil {
 				level := *ref.ParaProperties.OutlineLevel
-				if level < 7 {
+				if level > 0 && level < 7 {
 					tag = fmt.Sprintf("h%d", level)
 				}
 			}
@@ -345,7 +268,7 @@ func (ctx *Context) storageToNode(bs *TSWP.StorageArchive, body *html.Node) erro
 		if bs.TableCharStyle != nil {
 			charStyles := bs.TableCharStyle.Entries
 			for i, e := range charStyles { // build any span/em/b as needed
-				cs := *e.CharacterIndex
+				cs := e.GetCharacterIndex()
 				if cs < pos {
 					continue
 				}
@@ -354,7 +277,7 @@ func (ctx *Context) storageToNode(bs *TSWP.StorageArchive, body *html.Node) erro
 				}
 				ce := uint32(len(rr))
 				if i+1 < len(charStyles) {
-					ce = *charStyles[i+1].CharacterIndex
+					ce = charStyles[i+1].GetCharacterIndex()
 				}
 				if ce > end {
 					if e.Object != nil {
@@ -366,16 +289,16 @@ func (ctx *Context) storageToNode(bs *TSWP.StorageArchive, body *html.Node) erro
 					p.AppendChild(T(string(rr[pos:cs])))
 					pos = cs
 				}
-				if e.Object != nil {
-					ref := ix.Deref(e.Object).(*TSWP.CharacterStyleArchive)
-					key := fmt.Sprintf("ss%d", *e.Object.Identifier)
+				if ref, ok := ix.Deref(e.Object).(*TSWP.CharacterStyleArchive); ok {
+					key := fmt.Sprintf("ss%d", e.Object.GetIdentifier())
+					if ref.CharProperties == nil {
+						ref.CharProperties = &TSWP.CharacterStylePropertiesArchive{}
+					}
 
-					if ref.Super.Parent != nil {
-						parent := ix.Deref(ref.Super.Parent).(*TSWP.CharacterStyleArchive)
+					seen := map[*TSWP.CharacterStyleArchive]bool{ref: true}
+					for parent, ok := ix.Deref(ref.GetSuper().GetParent()).(*TSWP.CharacterStyleArchive); ok && !seen[parent]; parent, ok = ix.Deref(parent.GetSuper().GetParent()).(*TSWP.CharacterStyleArchive) {
+						seen[parent] = true
 						mergeCharProps(ref.CharProperties, parent.CharProperties)
-						if parent.Super.Parent != nil {
-							panic("Need recursion here")
-						}
 					}
 
 					style := translateCharProps(ref.CharProperties)
@@ -413,17 +336,28 @@ type MinimalOutput struct {
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf(`Extracts text from iWork files to JSON. Outputs to stdout.
+	var sel Selection
+	sheets := flag.String("sheet", "", "comma separated sheet names or numbers to convert (Numbers)")
+	tables := flag.String("table", "", "comma separated table names or numbers to convert")
+	slides := flag.String("slide", "", "comma separated slide titles or numbers to convert (Keynote)")
+	sections := flag.String("section", "", "comma separated section numbers to convert (Pages)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Extracts text from iWork files to JSON. Outputs to stdout.
 
 Usage:
-    %s infile.pages
+    %s [flags] infile.pages
 
 `, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
 		return
 	}
+	sel.Sheets, sel.Tables, sel.Slides, sel.Sections = list(*sheets), list(*tables), list(*slides), list(*sections)
 
-	out, err := Convert(os.Args[1])
+	out, err := ConvertSelection(flag.Arg(0), sel)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -461,7 +395,7 @@ func extractCellValuesFromTable(ix *index.Index, tm *TST.TableModelArchive, seen
 				if offset == 65535 {
 					continue
 				}
-				if int(offset) >= len(rinfo.CellStorageBuffer) {
+				if int(offset)+6 > len(rinfo.CellStorageBuffer) {
 					continue
 				}
 
@@ -472,9 +406,6 @@ func extractCellValuesFromTable(ix *index.Index, tm *TST.TableModelArchive, seen
 					cellType = int(rinfo.CellStorageBuffer[offset+2])
 				}
 
-				if int(offset)+6 > len(rinfo.CellStorageBuffer) {
-					continue
-				}
 				flags := LE.Uint16(rinfo.CellStorageBuffer[offset+4 : offset+6])
 				o := popcount(flags)*4 + 8 + int(offset)
 
@@ -653,11 +584,11 @@ func (ctx *Context) processPages() *html.Node {
 	doc.Type = html.DocumentNode
 	doc.FirstChild.Type = html.DoctypeNode
 
-	da := ctx.ix.Records[1].(*TP.DocumentArchive)
-	bs := ctx.ix.Deref(da.BodyStorage).(*TSWP.StorageArchive)
+	da, _ := ctx.ix.Root().(*TP.DocumentArchive)
+	bs, _ := ctx.ix.Deref(da.GetBodyStorage()).(*TSWP.StorageArchive)
 
-	fda := ctx.ix.Deref(da.FloatingDrawables).(*TP.FloatingDrawablesArchive)
-	if len(fda.PageGroups) != 0 {
+	fda, _ := ctx.ix.Deref(da.GetFloatingDrawables()).(*TP.FloatingDrawablesArchive)
+	if len(fda.GetPageGroups()) != 0 {
 		fmt.Fprintln(os.Stderr, `WARNING - 
             This document has floating drawables (e.g. floating images/tables/text blocks) which we don't handle in HTML
             conversion.
@@ -667,7 +598,9 @@ func (ctx *Context) processPages() *html.Node {
 `)
 	}
 
-	ctx.storageToNode(bs, body)
+	if bs != nil {
+		ctx.storageToNode(bs, body)
+	}
 
 	if img := ctx.renderImgData(); img != nil {
 		body.AppendChild(img)
@@ -688,11 +621,14 @@ func (ctx *Context) processNumbers() *html.Node {
 	doc := E("", E("html"), "\n", E("html", head, "\n", body))
 	doc.Type = html.DocumentNode
 	doc.FirstChild.Type = html.DoctypeNode
-	da := ctx.ix.Records[1].(*TN.DocumentArchive)
+	da, _ := ctx.ix.Root().(*TN.DocumentArchive)
 
-	for _, ref := range da.Sheets {
-		sheet := ctx.ix.Deref(ref).(*TN.SheetArchive)
-		section := E("section", E("h2", "Sheet - ", *sheet.Name))
+	for _, ref := range da.GetSheets() {
+		sheet, ok := ctx.ix.Deref(ref).(*TN.SheetArchive)
+		if !ok {
+			continue
+		}
+		section := E("section", E("h2", "Sheet - ", sheet.GetName()))
 		body.AppendChild(section)
 		for _, ref := range sheet.DrawableInfos {
 			// if this cast throws there are other kinds of drawables...
@@ -725,18 +661,21 @@ func (ctx *Context) processKeynote() *html.Node {
 	doc.Type = html.DocumentNode
 	doc.FirstChild.Type = html.DoctypeNode
 
-	meta := ctx.ix.Records[2].(*TSP.PackageMetadata)
+	meta, _ := ctx.ix.Records[2].(*TSP.PackageMetadata)
 	ids := []uint64{}
-	for _, comp := range meta.Components {
-		if *comp.PreferredLocator == "Slide" {
-			ids = append(ids, *comp.Identifier)
+	for _, comp := range meta.GetComponents() {
+		if comp.GetPreferredLocator() == "Slide" {
+			ids = append(ids, comp.GetIdentifier())
 		}
 	}
 	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
 
 	container := E("container", []string{"class", "slide-container"})
 	for _, id := range ids {
-		slide := ctx.ix.Records[id].(*KN.SlideArchive)
+		slide, ok := ctx.ix.Records[id].(*KN.SlideArchive)
+		if !ok {
+			continue
+		}
 		div := E("div", []string{"class", "slide"})
 		for _, d := range append([]*TSP.Reference{slide.BodyPlaceholder}, slide.Drawables...) {
 			if d == nil {
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/numbers"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Selection picks parts of a document to convert. Each entry is a name or a 1-based index; an empty list selects
+// everything. Sheets and Tables apply to Numbers documents (tables within the selected sheets), Slides to Keynote
+// and Sections to the body of Pages documents. Tables also picks tables out of Pages and Keynote documents.
+type Selection struct {
+	Sheets   []string
+	Tables   []string
+	Slides   []string
+	Sections []string
+}
+
+func (sel Selection) empty() bool {
+	return len(sel.Sheets)+len(sel.Tables)+len(sel.Slides)+len(sel.Sections) == 0
+}
+
+// selected reports whether the nth item (1-based) called name is picked by list.
+func selected(list []string, n int, name string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if i, err := strconv.Atoi(s); err == nil {
+			if i == n {
+				return true
+			}
+		} else if strings.EqualFold(strings.TrimSpace(s), strings.TrimSpace(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConvertSelection is Convert limited to the selected sheets, tables, slides or sections. It fails if a
+// non-empty part of the selection matches nothing.
+func ConvertSelection(in string, sel Selection) (string, error) {
+	if sel.empty() {
+		return Convert(in)
+	}
+	ix, err := index.Open(in)
+	if err != nil {
+		return "", err
+	}
+	texts, err := extractSelection(ix, sel)
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(MinimalOutput{Type: ix.Type, Text: texts})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+type collector struct {
+	texts []string
+	seen  map[string]bool
+}
+
+func (c *collector) add(s string) {
+	s = strings.TrimSpace(strings.Replace(s, string(index.AttachmentChar), "", -1))
+	if s != "" && !c.seen[s] {
+		c.seen[s] = true
+		c.texts = append(c.texts, s)
+	}
+}
+
+func (c *collector) table(t *index.Table) {
+	for _, row := range t.Rows {
+		for _, cell := range row {
+			if cell.Type != index.EmptyCell {
+				c.add(cell.String())
+			}
+		}
+	}
+}
+
+func extractSelection(ix *index.Index, sel Selection) ([]string, error) {
+	c := &collector{seen: make(map[string]bool)}
+	matched := func(what string, list []string, ok bool) error {
+		if len(list) > 0 && !ok {
+			return fmt.Errorf("no %s matches %s", what, strings.Join(list, ", "))
+		}
+		return nil
+	}
+
+	switch ix.Type {
+	case "numbers":
+		doc, err := numbers.Load(ix)
+		if err != nil {
+			return nil, err
+		}
+		var sheetOK, tableOK bool
+		for i, sheet := range doc.Sheets {
+			if !selected(sel.Sheets, i+1, sheet.Name) {
+				continue
+			}
+			sheetOK = true
+			if len(sel.Tables) == 0 {
+				for _, obj := range sheet.Objects {
+					c.add(obj.Text)
+				}
+			}
+			for j, t := range sheet.Tables {
+				if selected(sel.Tables, j+1, t.Name) {
+					tableOK = true
+					c.table(t)
+				}
+			}
+		}
+		if err := matched("sheet", sel.Sheets, sheetOK); err != nil {
+			return nil, err
+		}
+		if err := matched("table", sel.Tables, tableOK); err != nil {
+			return nil, err
+		}
+		return c.texts, nil
+	case "key":
+		if len(sel.Tables) == 0 {
+			var ok bool
+			for i := range ix.Slides() {
+				slide, err := ix.Slide(i + 1)
+				if err != nil {
+					return nil, err
+				}
+				if !selected(sel.Slides, i+1, slide.Title) {
+					continue
+				}
+				ok = true
+				c.add(slide.Title)
+				for _, text := range slide.Text {
+					c.add(text)
+				}
+				c.add(slide.Notes)
+			}
+			if err := matched("slide", sel.Slides, ok); err != nil {
+				return nil, err
+			}
+			return c.texts, nil
+		}
+	case "pages":
+		if len(sel.Tables) == 0 {
+			body := ix.Body()
+			if body == nil {
+				return nil, fmt.Errorf("missing body storage")
+			}
+			var ok bool
+			for i, section := range ix.SectionParagraphs(body) {
+				if !selected(sel.Sections, i+1, "") {
+					continue
+				}
+				ok = true
+				for _, p := range section {
+					c.add(p.Text)
+					for _, run := range p.Runs {
+						if att, isDrawable := run.Attachment.(*TSWP.DrawableAttachmentArchive); isDrawable {
+							if t, isTable := ix.Table(att.Drawable.GetIdentifier()); isTable {
+								c.table(t)
+							}
+						}
+					}
+				}
+			}
+			if err := matched("section", sel.Sections, ok); err != nil {
+				return nil, err
+			}
+			return c.texts, nil
+		}
+	default:
+		return nil, fmt.Errorf("can't select from %s documents", ix.Type)
+	}
+
+	// tables of a Pages or Keynote document
+	var ok bool
+	for i, t := range ix.Tables() {
+		if selected(sel.Tables, i+1, t.Name) {
+			ok = true
+			c.table(t)
+		}
+	}
+	if err := matched("table", sel.Tables, ok); err != nil {
+		return nil, err
+	}
+	return c.texts, nil
+}
+
+// list splits a comma separated flag value.
+func list(s string) []string {
+	var rval []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			rval = append(rval, v)
+		}
+	}
+	return rval
+}
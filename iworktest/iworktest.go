@@ -0,0 +1,265 @@
+// Package iworktest measures how well the index package handles a corpus of documents.
+//
+// Point Run at a directory of .pages, .numbers and .key files (bundles or single files) and it will open each one,
+// read its media, and report the success rate, the archive type ids the decoder didn't know, and a breakdown of the
+// errors encountered. The report marshals to JSON so results from different releases can be compared, including the
+// time and the number of allocations each document took to open.
+package iworktest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dunhamsteve/iwork/cache"
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/iwork09"
+)
+
+// Result is the outcome for a single document.
+type Result struct {
+	Path     string         `json:"path"`
+	Type     string         `json:"type,omitempty"`
+	Legacy   bool           `json:"legacy,omitempty"` // iWork '09 XML, read with the iwork09 package
+	Records  int            `json:"records"`
+	Media    int            `json:"media"`
+	Unknown  map[uint32]int `json:"unknown,omitempty"`
+	Failed   map[uint32]int `json:"failed,omitempty"`
+	Category string         `json:"category,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Duration time.Duration  `json:"duration"`
+	Allocs   uint64         `json:"allocs,omitempty"` // heap allocations made opening the document
+	Cached   bool           `json:"cached,omitempty"`
+}
+
+// OK reports whether the document opened and extracted cleanly.
+func (r *Result) OK() bool {
+	return r.Error == ""
+}
+
+// Report summarizes a corpus run.
+type Report struct {
+	Documents   int            `json:"documents"`
+	Succeeded   int            `json:"succeeded"`
+	SuccessRate float64        `json:"success_rate"`
+	Unknown     map[uint32]int `json:"unknown_types"`
+	Failed      map[uint32]int `json:"failed_types"`
+	Errors      map[string]int `json:"errors"`
+	Results     []Result       `json:"results"`
+}
+
+// Error categories
+const (
+	CategoryEncrypted = "encrypted"
+	CategoryDetect    = "detect"
+	CategoryEmpty     = "empty"
+	CategoryLegacy    = "legacy"
+	CategoryLimit     = "limit"
+	CategoryIO        = "io"
+	CategoryMedia     = "media"
+	CategoryPanic     = "panic"
+	CategoryOther     = "other"
+)
+
+var extensions = map[string]bool{
+	".pages":       true,
+	".numbers":     true,
+	".key":         true,
+	".pages-tef":   true,
+	".template":    true,
+	".nmbtemplate": true,
+	".kth":         true,
+}
+
+// IsDocument reports whether a path looks like an iWork document, based on its extension.
+func IsDocument(fn string) bool {
+	return extensions[strings.ToLower(filepath.Ext(fn))]
+}
+
+// Run opens every document found under dir and returns a coverage report.
+func Run(dir string) (*Report, error) {
+	return RunCached(dir, nil)
+}
+
+// errTransient keeps results that may change on a retry out of the cache.
+var errTransient = errors.New("iworktest: transient error")
+
+// RunCached is Run with the results for each document saved in c, keyed by the document's content hash.
+// Unchanged documents are not opened again on later runs. A nil c disables caching.
+func RunCached(dir string, c *cache.Cache) (*Report, error) {
+	var docs []string
+	err := filepath.Walk(dir, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if IsDocument(fn) {
+			docs = append(docs, fn)
+			if fi.IsDir() {
+				// bundle, don't look inside
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(docs)
+
+	report := &Report{
+		Unknown: make(map[uint32]int),
+		Failed:  make(map[uint32]int),
+		Errors:  make(map[string]int),
+	}
+	for _, fn := range docs {
+		res, err := check(fn, c)
+		if err != nil {
+			return nil, err
+		}
+		report.Documents++
+		if res.OK() {
+			report.Succeeded++
+		} else {
+			report.Errors[res.Category]++
+		}
+		for typ, n := range res.Unknown {
+			report.Unknown[typ] += n
+		}
+		for typ, n := range res.Failed {
+			report.Failed[typ] += n
+		}
+		report.Results = append(report.Results, res)
+	}
+	if report.Documents > 0 {
+		report.SuccessRate = float64(report.Succeeded) / float64(report.Documents)
+	}
+	return report, nil
+}
+
+// check runs Check, through the cache if there is one.
+func check(fn string, c *cache.Cache) (Result, error) {
+	if c == nil {
+		return Check(fn), nil
+	}
+	var res Result
+	ran := false
+	cached, err := c.Load(fn, &res, func() error {
+		res, ran = Check(fn), true
+		if res.Category == CategoryIO {
+			return errTransient
+		}
+		return nil
+	})
+	switch {
+	case err == errTransient:
+		return res, nil
+	case err != nil && !ran:
+		// couldn't hash the document, let Check report the problem
+		return Check(fn), nil
+	case err != nil:
+		return res, err
+	}
+	// the same content may have been seen at another path
+	res.Path = fn
+	res.Cached = cached
+	return res, nil
+}
+
+// Check opens a single document and reads all of its media. Panics in the decoder are caught and reported
+// under CategoryPanic.
+func Check(fn string) (res Result) {
+	res.Path = fn
+	start := time.Now()
+	defer func() {
+		res.Duration = time.Since(start)
+		if r := recover(); r != nil {
+			res.Category = CategoryPanic
+			res.Error = fmt.Sprint(r)
+		}
+	}()
+
+	// Decode failures are tallied in the report, there's no need to print them.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	ix, err := index.OpenOptions(context.Background(), fn, &index.Options{ErrorHandler: func(*index.DecodeError) {}})
+	runtime.ReadMemStats(&after)
+	res.Allocs = after.Mallocs - before.Mallocs
+	if errors.Is(err, index.ErrLegacyFormat) {
+		res.Legacy = true
+		doc, err := iwork09.Open(fn)
+		if err != nil {
+			res.Category = CategoryLegacy
+			res.Error = err.Error()
+			return
+		}
+		res.Type = doc.Type
+		return
+	}
+	if err != nil {
+		res.Category = Categorize(err)
+		res.Error = err.Error()
+		return
+	}
+	res.Type = ix.Type
+	res.Records = len(ix.Records)
+	res.Unknown = ix.UnknownTypes()
+	res.Failed = ix.FailedTypes()
+
+	for _, m := range ix.Media() {
+		if m.Size < 0 {
+			// referenced but not shipped in the bundle, which is normal for some assets
+			continue
+		}
+		rc, err := ix.OpenMedia(m.ID)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, rc)
+			rc.Close()
+		}
+		if err != nil {
+			res.Category = CategoryMedia
+			res.Error = fmt.Sprintf("%s: %v", m.Path, err)
+			return
+		}
+		res.Media++
+	}
+	return
+}
+
+// Categorize buckets an error returned by the index package.
+func Categorize(err error) string {
+	switch {
+	case errors.Is(err, index.ErrEncrypted):
+		return CategoryEncrypted
+	case errors.Is(err, index.ErrDigestMismatch):
+		return CategoryMedia
+	case errors.Is(err, index.ErrNoContent):
+		return CategoryEmpty
+	case errors.Is(err, index.ErrLegacyFormat):
+		return CategoryLegacy
+	case errors.Is(err, index.ErrLimit):
+		return CategoryLimit
+	case errors.Is(err, index.ErrNotIWork):
+		return CategoryDetect
+	}
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return CategoryIO
+	}
+	return CategoryOther
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
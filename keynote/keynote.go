@@ -0,0 +1,134 @@
+// Package keynote creates and combines Keynote documents.
+package keynote
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// FromTemplate opens a Keynote document, like a blank presentation saved with the theme to use, and empties it
+// for use as a new one: slides after the first are deleted, the title and body text of the first are removed and
+// the previews are dropped. The masters come from the theme. Add slides with Index.AppendSlide and write it out
+// with Index.Save.
+func FromTemplate(template string) (*index.Index, error) {
+	ix, err := index.Open(template)
+	if err != nil {
+		return nil, err
+	}
+	if ix.Type != "key" {
+		return nil, fmt.Errorf("keynote: not a Keynote document (%s)", ix.Type)
+	}
+	slides := ix.Slides()
+	if len(slides) == 0 {
+		return nil, errors.New("keynote: template has no slides")
+	}
+	for _, id := range slides[1:] {
+		if err := ix.DeleteSlide(id); err != nil {
+			return nil, fmt.Errorf("keynote: %w", err)
+		}
+	}
+	if slide, ok := ix.Records[slides[0]].(*KN.SlideArchive); ok {
+		for _, ph := range []interface{}{ix.Deref(slide.TitlePlaceholder), ix.Deref(slide.BodyPlaceholder)} {
+			ph, ok := ph.(*KN.PlaceholderArchive)
+			if !ok {
+				continue
+			}
+			if st, ok := ix.Deref(ph.GetSuper().GetContainedStorage()).(*TSWP.StorageArchive); ok {
+				if err := clearText(ix, st); err != nil {
+					return nil, err
+				}
+			}
+		}
+		slide.ThumbnailTextForTitlePlaceholder = nil
+		slide.ThumbnailTextForBodyPlaceholder = nil
+	}
+	ix.Template = false
+	if err := ix.RemovePreviews(); err != nil {
+		return nil, fmt.Errorf("keynote: %w", err)
+	}
+	return ix, nil
+}
+
+// clearText removes the text of a storage.
+func clearText(ix *index.Index, st *TSWP.StorageArchive) error {
+	var n int
+	for _, s := range st.Text {
+		n += len([]rune(s))
+	}
+	if n == 0 {
+		return nil
+	}
+	if err := ix.ReplaceText(st, 0, n, ""); err != nil {
+		return fmt.Errorf("keynote: %w", err)
+	}
+	return nil
+}
+
+// Append adds the slides of src, with their notes and builds, after the slides of dst. Each slide takes the master
+// of dst with the same name, or the default master of dst if there's none. Styles are matched by name, see
+// Index.Import.
+func Append(dst, src *index.Index) error {
+	if dst.Type != "key" || src.Type != "key" {
+		return fmt.Errorf("keynote: not Keynote documents (%s, %s)", dst.Type, src.Type)
+	}
+	show, srcShow := dst.Show(), src.Show()
+	if show == nil || srcShow == nil {
+		return errors.New("keynote: missing show")
+	}
+	root, ok := dst.Deref(show.GetSlideTree().GetRootSlideNode()).(*KN.SlideNodeArchive)
+	if !ok {
+		return errors.New("keynote: missing slide tree")
+	}
+
+	// masters by name
+	masters := make(map[string][2]uint64)
+	var fallback [2]uint64
+	if theme, ok := dst.Deref(show.Theme).(*KN.ThemeArchive); ok {
+		for _, ref := range theme.Masters {
+			if sn, ok := dst.Deref(ref).(*KN.SlideNodeArchive); ok {
+				m := [2]uint64{ref.GetIdentifier(), sn.GetSlide().GetIdentifier()}
+				if slide, ok := dst.Deref(sn.Slide).(*KN.SlideArchive); ok {
+					if _, ok := masters[slide.GetName()]; !ok {
+						masters[slide.GetName()] = m
+					}
+				}
+				if fallback[0] == 0 || ref.GetIdentifier() == theme.GetDefaultMasterSlideNode().GetIdentifier() {
+					fallback = m
+				}
+			}
+		}
+	}
+	known := make(map[uint64]uint64)
+	if theme, ok := src.Deref(srcShow.Theme).(*KN.ThemeArchive); ok && fallback[0] != 0 {
+		for _, ref := range theme.Masters {
+			sn, ok := src.Deref(ref).(*KN.SlideNodeArchive)
+			if !ok {
+				continue
+			}
+			m := fallback
+			if slide, ok := src.Deref(sn.Slide).(*KN.SlideArchive); ok {
+				if found, ok := masters[slide.GetName()]; ok {
+					m = found
+				}
+			}
+			known[ref.GetIdentifier()] = m[0]
+			known[sn.GetSlide().GetIdentifier()] = m[1]
+		}
+	}
+
+	for _, node := range src.SlideTree() {
+		ids, err := dst.Import(src, []uint64{node.ID}, known)
+		if err != nil {
+			return err
+		}
+		root.Children = append(root.Children, &TSP.Reference{Identifier: proto.Uint64(ids[node.ID])})
+	}
+	return nil
+}
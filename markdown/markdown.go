@@ -0,0 +1,300 @@
+// Package markdown renders the content of Pages and Keynote documents as Markdown.
+//
+// Pages body text keeps its headings, lists, bold and italic runs, tables and images. Keynote slides each get a
+// section with the slide text and the speaker notes; WriteNotes writes just the notes. Layout and styling beyond
+// that are dropped.
+package markdown
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Write renders a Pages or Keynote document as Markdown to w.
+func Write(w io.Writer, ix *index.Index) error {
+	c := &converter{ix: ix, w: bufio.NewWriter(w)}
+	switch ix.Type {
+	case "pages":
+		da, ok := ix.Root().(*TP.DocumentArchive)
+		if !ok {
+			return errors.New("markdown: missing document archive")
+		}
+		st, ok := ix.Deref(da.BodyStorage).(*TSWP.StorageArchive)
+		if !ok {
+			return errors.New("markdown: missing body storage")
+		}
+		c.storage(st)
+	case "key":
+		for i, id := range ix.Slides() {
+			if slide, ok := ix.Records[id].(*KN.SlideArchive); ok {
+				c.slide(i+1, slide)
+			}
+		}
+	default:
+		return fmt.Errorf("markdown: can't convert %s documents", ix.Type)
+	}
+	return c.w.Flush()
+}
+
+// WriteNotes renders the presenter notes of a Keynote document as Markdown to w, for speaker handouts: a section
+// per slide with notes, headed by the slide title, with the bold, italic and lists of the notes kept.
+func WriteNotes(w io.Writer, ix *index.Index) error {
+	notes, err := ix.Notes()
+	if err != nil {
+		return fmt.Errorf("markdown: %w", err)
+	}
+	c := &converter{ix: ix, w: bufio.NewWriter(w)}
+	for _, n := range notes {
+		if n.Text == "" {
+			continue
+		}
+		c.block(false)
+		if title := strings.Join(strings.Fields(strings.Replace(n.Title, string(index.AttachmentChar), "", -1)), " "); title != "" {
+			fmt.Fprintf(c.w, "## %d. %s\n", n.Slide, escape(title))
+		} else {
+			fmt.Fprintf(c.w, "## Slide %d\n", n.Slide)
+		}
+		c.paragraphs(n.Paragraphs)
+	}
+	return c.w.Flush()
+}
+
+type converter struct {
+	ix      *index.Index
+	w       *bufio.Writer
+	started bool
+	list    bool // the last block was a list item
+}
+
+// block starts a new block, separated from the previous one by a blank line unless both are list items.
+func (c *converter) block(list bool) {
+	if c.started && !(list && c.list) {
+		c.w.WriteString("\n")
+	}
+	c.started, c.list = true, list
+}
+
+func (c *converter) storage(st *TSWP.StorageArchive) {
+	c.paragraphs(c.ix.StorageParagraphs(st))
+}
+
+func (c *converter) paragraphs(paragraphs []index.Paragraph) {
+	for _, p := range paragraphs {
+		var line strings.Builder
+		var after []func()
+		for _, run := range p.Runs {
+			if f := c.ix.RunField(run); f != nil {
+				run.Text = f.Text
+			} else if run.Attachment != nil {
+				if img, table := c.attachment(run.Attachment); img != "" {
+					line.WriteString(img)
+				} else if table != nil {
+					after = append(after, table)
+				}
+				continue
+			}
+			line.WriteString(c.run(p, run))
+		}
+
+		text := strings.TrimSpace(line.String())
+		if text != "" {
+			level, numbered := listLevel(p)
+			switch {
+			case level >= 0:
+				c.block(true)
+				marker := "- "
+				if numbered {
+					marker = "1. "
+				}
+				c.w.WriteString(strings.Repeat("  ", level) + marker + text + "\n")
+			case c.ix.OutlineLevel(p.Style) > 0:
+				c.block(false)
+				c.w.WriteString(strings.Repeat("#", int(c.ix.OutlineLevel(p.Style))) + " " + text + "\n")
+			default:
+				c.block(false)
+				c.w.WriteString(text + "\n")
+			}
+		}
+		for _, fn := range after {
+			fn()
+		}
+	}
+}
+
+// listLevel returns the list level of a paragraph and whether it is numbered, or -1 if it isn't a list item.
+func listLevel(p index.Paragraph) (int, bool) {
+	ls := p.ListStyle
+	if ls == nil || len(ls.LabelTypes) == 0 {
+		return -1, false
+	}
+	lt := ls.LabelTypes[len(ls.LabelTypes)-1]
+	if int(p.ListLevel) < len(ls.LabelTypes) {
+		lt = ls.LabelTypes[p.ListLevel]
+	}
+	switch lt {
+	case TSWP.ListStyleArchive_kNumber:
+		return int(p.ListLevel), true
+	case TSWP.ListStyleArchive_kString, TSWP.ListStyleArchive_kImage:
+		return int(p.ListLevel), false
+	}
+	return -1, false
+}
+
+// run renders a text run, with emphasis for bold and italic text.
+func (c *converter) run(p index.Paragraph, run index.Run) string {
+	text := strings.NewReplacer("\u2028", "  \n", "\u000b", "  \n", "\u000c", "", "\t", " ").Replace(escape(run.Text))
+	if strings.TrimSpace(text) == "" {
+		return text
+	}
+	style := c.ix.RunStyle(p, run)
+	bold, italic := style.Bold, style.Italic
+	// emphasis markers have to hug the text
+	trimmed := strings.TrimSpace(text)
+	lead := text[:strings.Index(text, trimmed)]
+	trail := text[len(lead)+len(trimmed):]
+	if italic {
+		trimmed = "*" + trimmed + "*"
+	}
+	if bold {
+		trimmed = "**" + trimmed + "**"
+	}
+	return lead + trimmed + trail
+}
+
+// attachment renders an inline attachment. Images come back as inline Markdown, tables as a function that writes
+// the table once the paragraph is done.
+func (c *converter) attachment(v interface{}) (string, func()) {
+	att, ok := v.(*TSWP.DrawableAttachmentArchive)
+	if !ok {
+		return "", nil
+	}
+	if img, ok := c.ix.Deref(att.Drawable).(*TSD.ImageArchive); ok {
+		return c.image(img), nil
+	}
+	if t, ok := c.ix.Table(att.Drawable.GetIdentifier()); ok {
+		return "", func() { c.table(t) }
+	}
+	return "", nil
+}
+
+// image links to the image file inside the document bundle.
+func (c *converter) image(img *TSD.ImageArchive) string {
+	m, ok := c.ix.MediaFor(img.Data)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("![%s](%s)", escape(img.GetSuper().GetAccessibilityDescription()), strings.Replace(m.Path, " ", "%20", -1))
+}
+
+// table writes a table, using the first row as the header row.
+func (c *converter) table(t *index.Table) {
+	rows := t.Rows
+	if len(rows) == 0 || len(rows[0]) == 0 {
+		return
+	}
+	c.block(false)
+	for r, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = strings.Join(strings.Fields(escape(cell.String())), " ")
+		}
+		c.w.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+		if r == 0 {
+			c.w.WriteString(strings.Repeat("| --- ", len(row)) + "|\n")
+		}
+	}
+}
+
+// slide writes a slide as a section with its title, the text of its other drawables and the speaker notes.
+func (c *converter) slide(n int, slide *KN.SlideArchive) {
+	if n > 1 {
+		c.block(false)
+		c.w.WriteString("---\n")
+	}
+	title := ""
+	if st := c.placeholderStorage(slide.TitlePlaceholder); st != nil {
+		title = strings.Join(strings.Fields(strings.Replace(storageText(st), string(index.AttachmentChar), "", -1)), " ")
+	}
+	c.block(false)
+	if title != "" {
+		fmt.Fprintf(c.w, "## %s\n", escape(title))
+	} else {
+		fmt.Fprintf(c.w, "## Slide %d\n", n)
+	}
+
+	seen := map[uint64]bool{slide.TitlePlaceholder.GetIdentifier(): true}
+	for _, ref := range append([]*TSP.Reference{slide.BodyPlaceholder}, slide.Drawables...) {
+		if ref == nil || seen[ref.GetIdentifier()] {
+			continue
+		}
+		seen[ref.GetIdentifier()] = true
+		c.drawable(ref)
+	}
+
+	if st := c.ix.NotesStorage(slide); st != nil && strings.TrimSpace(storageText(st)) != "" {
+		c.block(false)
+		c.w.WriteString("### Notes\n")
+		c.storage(st)
+	}
+}
+
+func (c *converter) drawable(ref *TSP.Reference) {
+	switch d := c.ix.Deref(ref).(type) {
+	case *KN.PlaceholderArchive:
+		if st, ok := c.ix.Deref(d.GetSuper().GetContainedStorage()).(*TSWP.StorageArchive); ok {
+			c.storage(st)
+		}
+	case *TSWP.ShapeInfoArchive:
+		if st, ok := c.ix.Deref(d.ContainedStorage).(*TSWP.StorageArchive); ok {
+			c.storage(st)
+		}
+	case *TSD.ImageArchive:
+		if img := c.image(d); img != "" {
+			c.block(false)
+			c.w.WriteString(img + "\n")
+		}
+	case *TST.TableInfoArchive:
+		if t, ok := c.ix.Table(ref.GetIdentifier()); ok {
+			c.table(t)
+		}
+	case *TSD.GroupArchive:
+		for _, child := range d.Children {
+			c.drawable(child)
+		}
+	}
+}
+
+func (c *converter) placeholderStorage(ref *TSP.Reference) *TSWP.StorageArchive {
+	if ph, ok := c.ix.Deref(ref).(*KN.PlaceholderArchive); ok {
+		st, _ := c.ix.Deref(ph.GetSuper().GetContainedStorage()).(*TSWP.StorageArchive)
+		return st
+	}
+	return nil
+}
+
+func storageText(st *TSWP.StorageArchive) string {
+	return strings.Join(st.Text, "")
+}
+
+// escape backslash escapes the characters that Markdown would otherwise treat as markup.
+func escape(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune("\\`*_[]<>#|", r) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,57 @@
+package numbers
+
+import (
+	"fmt"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// AppendSheets adds the sheets of src, with their tables and objects, after the sheets of dst. A sheet whose name
+// is taken in dst gets a number added to it. Styles are matched by name, see Index.Import.
+func AppendSheets(dst, src *index.Index) error {
+	if dst.Type != "numbers" || src.Type != "numbers" {
+		return fmt.Errorf("numbers: not Numbers documents (%s, %s)", dst.Type, src.Type)
+	}
+	da, ok := dst.Root().(*TN.DocumentArchive)
+	if !ok {
+		return fmt.Errorf("numbers: missing document archive")
+	}
+	sda, ok := src.Root().(*TN.DocumentArchive)
+	if !ok {
+		return fmt.Errorf("numbers: missing source document archive")
+	}
+	taken := make(map[string]bool)
+	for _, ref := range da.Sheets {
+		if sa, ok := dst.Deref(ref).(*TN.SheetArchive); ok {
+			taken[sa.GetName()] = true
+		}
+	}
+	// one import, so records the sheets share are copied once
+	var roots []uint64
+	for _, ref := range sda.Sheets {
+		roots = append(roots, ref.GetIdentifier())
+	}
+	ids, err := dst.Import(src, roots, nil)
+	if err != nil {
+		return err
+	}
+	for _, ref := range sda.Sheets {
+		id := ids[ref.GetIdentifier()]
+		sa, ok := dst.Records[id].(*TN.SheetArchive)
+		if !ok {
+			continue
+		}
+		name := sa.GetName()
+		for i := 2; taken[name]; i++ {
+			name = fmt.Sprintf("%s %d", sa.GetName(), i)
+		}
+		taken[name] = true
+		sa.Name = proto.String(name)
+		da.Sheets = append(da.Sheets, &TSP.Reference{Identifier: proto.Uint64(id)})
+	}
+	return nil
+}
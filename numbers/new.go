@@ -0,0 +1,52 @@
+package numbers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/TN"
+)
+
+// FromTemplate opens a Numbers template, like the Blank template Numbers ships with, and empties it for use as a
+// new document: sheets after the first are deleted, the tables of the first are cleared and the previews are
+// dropped. Fill it in with Index.SetCell and Index.AppendTableRow and write it out with Index.Save.
+func FromTemplate(template string) (*index.Index, error) {
+	ix, err := index.Open(template)
+	if err != nil {
+		return nil, err
+	}
+	if ix.Type != "numbers" {
+		return nil, fmt.Errorf("numbers: not a Numbers template (%s)", ix.Type)
+	}
+	da, ok := ix.Root().(*TN.DocumentArchive)
+	if !ok || len(da.Sheets) == 0 {
+		return nil, errors.New("numbers: template has no sheets")
+	}
+	var dropped []uint64
+	for _, ref := range da.Sheets[1:] {
+		dropped = append(dropped, ref.GetIdentifier())
+	}
+	for _, id := range dropped {
+		if err := ix.DeleteSheet(id); err != nil {
+			return nil, fmt.Errorf("numbers: %w", err)
+		}
+	}
+	for _, t := range ix.Tables() {
+		for r, row := range t.Rows {
+			for c, cell := range row {
+				if cell.Type == index.EmptyCell {
+					continue
+				}
+				if err := ix.SetCell(t, r, c, index.Cell{}); err != nil {
+					return nil, fmt.Errorf("numbers: %w", err)
+				}
+			}
+		}
+	}
+	ix.Template = false
+	if err := ix.RemovePreviews(); err != nil {
+		return nil, fmt.Errorf("numbers: %w", err)
+	}
+	return ix, nil
+}
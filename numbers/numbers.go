@@ -0,0 +1,215 @@
+// Package numbers is a high level view of Numbers documents: sheets, the tables on them and the free floating
+// objects (text boxes, shapes, images and movies) that sit on the sheet canvas outside of tables.
+package numbers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/TN"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Document is a Numbers document.
+type Document struct {
+	Sheets []*Sheet `json:"sheets"`
+}
+
+// Sheet is a sheet (tab) of a Numbers document.
+type Sheet struct {
+	ID      uint64    `json:"id"`
+	Name    string    `json:"name"`
+	Tables  []*Table  `json:"tables"`
+	Objects []*Object `json:"objects,omitempty"`
+}
+
+// Table is a table on a sheet, the same type index.Tables returns for all documents.
+type Table = index.Table
+
+// CSVOptions control how a table is written by Table.WriteCSVOptions.
+type CSVOptions = index.CSVOptions
+
+// ObjectKind is the kind of a canvas object.
+type ObjectKind string
+
+// Object kinds
+const (
+	ShapeObject ObjectKind = "shape"
+	ImageObject ObjectKind = "image"
+	MovieObject ObjectKind = "movie"
+)
+
+// Object is a drawable on the sheet canvas other than a table. Text holds the text of shapes and text boxes, Media
+// the file behind images and movies. Members of groups are listed individually, positioned on the sheet.
+type Object struct {
+	ID     uint64       `json:"id"`
+	Kind   ObjectKind   `json:"kind"`
+	Text   string       `json:"text,omitempty"`
+	Media  *index.Media `json:"media,omitempty"`
+	X      float32      `json:"x"`
+	Y      float32      `json:"y"`
+	Width  float32      `json:"width"`
+	Height float32      `json:"height"`
+}
+
+// Load builds the high level view of a Numbers document. Documents opened with index.OpenLazy are loaded in full.
+func Load(ix *index.Index) (*Document, error) {
+	if ix.Type != "numbers" {
+		return nil, fmt.Errorf("numbers: not a Numbers document (%s)", ix.Type)
+	}
+	da, ok := ix.Root().(*TN.DocumentArchive)
+	if !ok {
+		return nil, errors.New("numbers: missing document archive")
+	}
+	if err := ix.LoadAll(); err != nil {
+		return nil, err
+	}
+	rval := &Document{}
+	for _, ref := range da.Sheets {
+		if sheet := loadSheet(ix, ref); sheet != nil {
+			rval.Sheets = append(rval.Sheets, sheet)
+		}
+	}
+	return rval, nil
+}
+
+// LoadSheet builds the view of a single sheet, found by name. On a document opened with index.OpenLazy only the
+// components of that sheet are loaded.
+func LoadSheet(ix *index.Index, name string) (*Sheet, error) {
+	if ix.Type != "numbers" {
+		return nil, fmt.Errorf("numbers: not a Numbers document (%s)", ix.Type)
+	}
+	da, ok := ix.Root().(*TN.DocumentArchive)
+	if !ok {
+		return nil, errors.New("numbers: missing document archive")
+	}
+	// Sheet archives normally live in the document archive's file, so the name can be checked before loading
+	// anything else. Sheets stored on their own are loaded one at a time until the name matches.
+	for pass := 0; pass < 2; pass++ {
+		for _, ref := range da.Sheets {
+			sa, loaded := ix.Deref(ref).(*TN.SheetArchive)
+			if loaded == (pass == 1) || (loaded && sa.GetName() != name) {
+				continue
+			}
+			if err := ix.LoadObject(ref.GetIdentifier()); err != nil {
+				return nil, err
+			}
+			if sa, ok := ix.Deref(ref).(*TN.SheetArchive); ok && sa.GetName() == name {
+				return loadSheet(ix, ref), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("numbers: no sheet named %q", name)
+}
+
+func loadSheet(ix *index.Index, ref *TSP.Reference) *Sheet {
+	sa, ok := ix.Deref(ref).(*TN.SheetArchive)
+	if !ok {
+		return nil
+	}
+	sheet := &Sheet{ID: ref.GetIdentifier(), Name: sa.GetName()}
+	for _, ref := range sa.DrawableInfos {
+		sheet.drawable(ix, ref, 0, 0)
+	}
+	return sheet
+}
+
+// drawable adds a drawable to the sheet. Group members are positioned relative to the group, dx and dy carry the
+// group's offset.
+func (s *Sheet) drawable(ix *index.Index, ref *TSP.Reference, dx, dy float32) {
+	switch d := ix.Deref(ref).(type) {
+	case *TST.TableInfoArchive:
+		if t, ok := ix.Table(ref.GetIdentifier()); ok {
+			s.Tables = append(s.Tables, t)
+		}
+	case *TSWP.ShapeInfoArchive:
+		obj := newObject(ref, ShapeObject, d.GetSuper().GetSuper(), dx, dy)
+		if st, ok := ix.Deref(d.ContainedStorage).(*TSWP.StorageArchive); ok {
+			var paras []string
+			for _, p := range ix.StorageParagraphs(st) {
+				paras = append(paras, strings.Replace(p.Text, string(index.AttachmentChar), "", -1))
+			}
+			obj.Text = strings.Join(paras, "\n")
+		}
+		s.Objects = append(s.Objects, obj)
+	case *TSD.ShapeArchive:
+		s.Objects = append(s.Objects, newObject(ref, ShapeObject, d.GetSuper(), dx, dy))
+	case *TSD.ImageArchive:
+		obj := newObject(ref, ImageObject, d.GetSuper(), dx, dy)
+		if m, ok := ix.MediaFor(d.Data); ok {
+			obj.Media = &m
+		}
+		s.Objects = append(s.Objects, obj)
+	case *TSD.MovieArchive:
+		obj := newObject(ref, MovieObject, d.GetSuper(), dx, dy)
+		if m, ok := ix.MediaFor(d.MovieData); ok {
+			obj.Media = &m
+		}
+		s.Objects = append(s.Objects, obj)
+	case *TSD.GroupArchive:
+		pos := d.GetSuper().GetGeometry().GetPosition()
+		for _, child := range d.Children {
+			s.drawable(ix, child, dx+pos.GetX(), dy+pos.GetY())
+		}
+	}
+}
+
+func newObject(ref *TSP.Reference, kind ObjectKind, da *TSD.DrawableArchive, dx, dy float32) *Object {
+	geom := da.GetGeometry()
+	return &Object{
+		ID:     ref.GetIdentifier(),
+		Kind:   kind,
+		X:      geom.GetPosition().GetX() + dx,
+		Y:      geom.GetPosition().GetY() + dy,
+		Width:  geom.GetSize().GetWidth(),
+		Height: geom.GetSize().GetHeight(),
+	}
+}
+
+// Text returns the text of the document: for each sheet its name, the text of the canvas objects and the tables
+// as tab separated rows.
+func (d *Document) Text() string {
+	var sb strings.Builder
+	for _, sheet := range d.Sheets {
+		sb.WriteString(sheet.Name + "\n\n")
+		for _, obj := range sheet.Objects {
+			if obj.Text != "" {
+				sb.WriteString(obj.Text + "\n\n")
+			}
+		}
+		for _, table := range sheet.Tables {
+			if table.Name != "" {
+				sb.WriteString(table.Name + "\n")
+			}
+			for _, row := range table.Rows {
+				values := make([]string, len(row))
+				for i, cell := range row {
+					values[i] = cell.String()
+				}
+				sb.WriteString(strings.Join(values, "\t") + "\n")
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// Media returns the media placed on the sheets, in sheet order and without duplicates.
+func (d *Document) Media() []index.Media {
+	var rval []index.Media
+	seen := make(map[uint64]bool)
+	for _, sheet := range d.Sheets {
+		for _, obj := range sheet.Objects {
+			if obj.Media != nil && !seen[obj.Media.ID] {
+				seen[obj.Media.ID] = true
+				rval = append(rval, *obj.Media)
+			}
+		}
+	}
+	return rval
+}
@@ -0,0 +1,41 @@
+package pages
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/TP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Append adds the body text of src to the end of the body of dst, as new paragraphs, with its inline images,
+// tables and other attachments. Styles are matched by name, see Index.Import. Objects floating on the pages of
+// src aren't copied.
+func Append(dst, src *index.Index) error {
+	if dst.Type != "pages" || src.Type != "pages" {
+		return fmt.Errorf("pages: not Pages documents (%s, %s)", dst.Type, src.Type)
+	}
+	da, ok := src.Root().(*TP.DocumentArchive)
+	if !ok || da.BodyStorage == nil {
+		return errors.New("pages: source has no body text")
+	}
+	body := dst.Body()
+	if body == nil {
+		return errors.New("pages: document has no body text")
+	}
+	ids, err := dst.Import(src, []uint64{da.BodyStorage.GetIdentifier()}, nil)
+	if err != nil {
+		return err
+	}
+	id := ids[da.BodyStorage.GetIdentifier()]
+	st, ok := dst.Records[id].(*TSWP.StorageArchive)
+	if !ok {
+		return errors.New("pages: source body wasn't copied")
+	}
+	if err := dst.AppendStorage(body, st); err != nil {
+		return err
+	}
+	delete(dst.Records, id)
+	return nil
+}
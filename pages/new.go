@@ -0,0 +1,37 @@
+package pages
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dunhamsteve/iwork/index"
+)
+
+// FromTemplate opens a Pages template, like the Blank template Pages ships with, and empties it for use as a new
+// document: the body text is removed and the previews are dropped. The stylesheet, theme and page setup stay as
+// the template has them. Fill it in with the Index mutators and write it out with Index.Save.
+func FromTemplate(template string) (*index.Index, error) {
+	ix, err := index.Open(template)
+	if err != nil {
+		return nil, err
+	}
+	if ix.Type != "pages" {
+		return nil, fmt.Errorf("pages: not a Pages template (%s)", ix.Type)
+	}
+	body := ix.Body()
+	if body == nil {
+		return nil, errors.New("pages: template has no body text")
+	}
+	if n := utf8.RuneCountInString(strings.Join(body.Text, "")); n > 0 {
+		if err := ix.ReplaceText(body, 0, n, ""); err != nil {
+			return nil, fmt.Errorf("pages: %w", err)
+		}
+	}
+	ix.Template = false
+	if err := ix.RemovePreviews(); err != nil {
+		return nil, fmt.Errorf("pages: %w", err)
+	}
+	return ix, nil
+}
@@ -0,0 +1,144 @@
+// Package pages fills the mail merge fields of Pages documents, to generate letters, invoices and the like from a
+// template.
+//
+// A merge field is a placeholder in the text, shown by Pages as its label. Filling it replaces the placeholder with
+// a value, styled as the placeholder was, and turns it into plain text.
+package pages
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// field is a merge field in a storage, over the runes [start, end).
+type field struct {
+	start, end int
+	entry      *TSWP.ObjectAttributeTable_ObjectAttribute
+	archive    *TSWP.MergeSmartFieldArchive
+}
+
+// Fields returns the keys of the merge fields of a document, in order of first appearance by storage. Fields
+// without a key are listed by their label.
+func Fields(ix *index.Index) []string {
+	var rval []string
+	seen := make(map[string]bool)
+	for _, st := range storages(ix) {
+		for _, f := range mergeFields(ix, st) {
+			name := fieldName(f.archive)
+			if !seen[name] {
+				seen[name] = true
+				rval = append(rval, name)
+			}
+		}
+	}
+	return rval
+}
+
+func fieldName(mf *TSWP.MergeSmartFieldArchive) string {
+	if mf.GetKey() != "" {
+		return mf.GetKey()
+	}
+	return mf.GetLabel()
+}
+
+// Merge fills the merge fields of a Pages document with values, looked up by the key of the field, then by its
+// label. Fields without a value are left as they are. Newlines in values become line breaks. It returns the number
+// of fields filled. A Cache installed on the Index should be reset afterwards.
+func Merge(ix *index.Index, values map[string]string) (int, error) {
+	if ix.Type != "pages" {
+		return 0, fmt.Errorf("pages: not a Pages document (%s)", ix.Type)
+	}
+	var count int
+	for _, st := range storages(ix) {
+		fields := mergeFields(ix, st)
+		// from the end, so the offsets of the earlier fields still hold
+		for i := len(fields) - 1; i >= 0; i-- {
+			f := fields[i]
+			value, ok := values[f.archive.GetKey()]
+			if !ok {
+				value, ok = values[f.archive.GetLabel()]
+			}
+			if !ok {
+				continue
+			}
+			value = strings.NewReplacer("\r\n", "\u2028", "\n", "\u2028", "\r", "\u2028").Replace(value)
+			if err := ix.ReplaceText(st, f.start, f.end, value); err != nil {
+				return count, fmt.Errorf("pages: merge field %q: %w", fieldName(f.archive), err)
+			}
+			f.entry.Object = nil
+			count++
+		}
+	}
+	return count, nil
+}
+
+// MergeFiles fills the template at src once for each record of values, and saves the result to the path name returns
+// for the record's index, without previews.
+func MergeFiles(src, password string, records []map[string]string, name func(i int) string) error {
+	if name == nil {
+		return errors.New("pages: no name function")
+	}
+	for i, values := range records {
+		ix, err := index.OpenWithPassword(src, password)
+		if err != nil {
+			return err
+		}
+		if _, err := Merge(ix, values); err != nil {
+			return err
+		}
+		if err := ix.RemovePreviews(); err != nil {
+			return err
+		}
+		if err := ix.Save(name(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storages returns the text storages of a document, ordered by identifier.
+func storages(ix *index.Index) []*TSWP.StorageArchive {
+	ids := make([]uint64, 0, len(ix.Records))
+	for id, v := range ix.Records {
+		if _, ok := v.(*TSWP.StorageArchive); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	rval := make([]*TSWP.StorageArchive, len(ids))
+	for i, id := range ids {
+		rval[i] = ix.Records[id].(*TSWP.StorageArchive)
+	}
+	return rval
+}
+
+// mergeFields returns the merge fields of a storage in text order. A field runs to the next smart field entry or the
+// end of the text.
+func mergeFields(ix *index.Index, st *TSWP.StorageArchive) []field {
+	t := st.TableSmartfield
+	if t == nil {
+		return nil
+	}
+	length := utf8.RuneCountInString(strings.Join(st.Text, ""))
+	var rval []field
+	for i, e := range t.Entries {
+		mf, ok := ix.Deref(e.Object).(*TSWP.MergeSmartFieldArchive)
+		if !ok {
+			continue
+		}
+		end := length
+		if i+1 < len(t.Entries) {
+			end = int(t.Entries[i+1].GetCharacterIndex())
+		}
+		if start := int(e.GetCharacterIndex()); start <= end && end <= length {
+			rval = append(rval, field{start, end, e, mf})
+		}
+	}
+	return rval
+}
@@ -0,0 +1,423 @@
+// Package pptx converts Keynote documents to Office Open XML presentations (.pptx).
+//
+// Slides are written in navigator order with their text boxes, placeholders, images, tables and speaker notes.
+// Everything lands on a single blank layout, so masters, transitions and builds are not carried over.
+package pptx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Write converts a Keynote document and writes the .pptx archive to w.
+func Write(w io.Writer, ix *index.Index) error {
+	if ix.Type != "key" {
+		return fmt.Errorf("pptx: can't convert %s documents", ix.Type)
+	}
+	da, ok := ix.Root().(*KN.DocumentArchive)
+	if !ok {
+		return errors.New("pptx: missing document archive")
+	}
+	show, ok := ix.Deref(da.Show).(*KN.ShowArchive)
+	if !ok {
+		return errors.New("pptx: missing show archive")
+	}
+
+	// Keynote's default is 1024x768 points, which PowerPoint would show as a 14" slide.
+	width, height := float32(1024), float32(768)
+	if size := show.Size; size != nil {
+		width, height = size.GetWidth(), size.GetHeight()
+	}
+	c := &converter{ix: ix, media: make(map[uint64]string)}
+	for _, id := range ix.Slides() {
+		if slide, ok := ix.Records[id].(*KN.SlideArchive); ok {
+			c.slide(slide)
+		}
+	}
+
+	zw := zip.NewWriter(w)
+	parts := []part{
+		{"[Content_Types].xml", c.contentTypes()},
+		{"_rels/.rels", rootRels},
+		{"ppt/presentation.xml", c.presentation(emu(width), emu(height))},
+		{"ppt/_rels/presentation.xml.rels", c.presentationRels()},
+		{"ppt/slideMasters/slideMaster1.xml", slideMaster},
+		{"ppt/slideMasters/_rels/slideMaster1.xml.rels", slideMasterRels},
+		{"ppt/slideLayouts/slideLayout1.xml", slideLayout},
+		{"ppt/slideLayouts/_rels/slideLayout1.xml.rels", slideLayoutRels},
+		{"ppt/notesMasters/notesMaster1.xml", notesMaster},
+		{"ppt/notesMasters/_rels/notesMaster1.xml.rels", notesMasterRels},
+		{"ppt/theme/theme1.xml", theme},
+		{"ppt/theme/theme2.xml", theme},
+	}
+	parts = append(parts, c.parts...)
+	for _, p := range parts {
+		f, err := zw.Create(p.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, p.data); err != nil {
+			return err
+		}
+	}
+	for _, m := range c.files {
+		f, err := zw.Create("ppt/media/" + m.name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(m.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+type part struct {
+	name string
+	data string
+}
+
+type mediaFile struct {
+	name string
+	data []byte
+}
+
+type converter struct {
+	ix     *index.Index
+	parts  []part
+	files  []mediaFile
+	media  map[uint64]string // data id -> file name
+	slides int
+	notes  int
+
+	// per slide state
+	body   bytes.Buffer
+	rels   []string
+	nextID int
+}
+
+// slide writes a slide, its relationships and its notes.
+func (c *converter) slide(slide *KN.SlideArchive) {
+	c.slides++
+	n := c.slides
+	c.body.Reset()
+	c.rels = []string{rel("rId1", "slideLayout", "../slideLayouts/slideLayout1.xml")}
+	c.nextID = 1
+
+	seen := make(map[uint64]bool)
+	refs := append([]*TSP.Reference{slide.TitlePlaceholder, slide.BodyPlaceholder}, slide.Drawables...)
+	for _, ref := range refs {
+		if ref == nil || seen[ref.GetIdentifier()] {
+			continue
+		}
+		seen[ref.GetIdentifier()] = true
+		c.drawable(ref, 0, 0)
+	}
+
+	if note, ok := c.ix.Deref(slide.Note).(*KN.NoteArchive); ok {
+		if st, ok := c.ix.Deref(note.ContainedStorage).(*TSWP.StorageArchive); ok && hasText(st) {
+			c.notes++
+			c.rels = append(c.rels, rel("rIdNotes", "notesSlide", fmt.Sprintf("../notesSlides/notesSlide%d.xml", c.notes)))
+			c.parts = append(c.parts,
+				part{fmt.Sprintf("ppt/notesSlides/notesSlide%d.xml", c.notes), notesHeader + c.txBody(st) + notesFooter},
+				part{fmt.Sprintf("ppt/notesSlides/_rels/notesSlide%d.xml.rels", c.notes), relationships(
+					rel("rId1", "notesMaster", "../notesMasters/notesMaster1.xml"),
+					rel("rId2", "slide", fmt.Sprintf("../slides/slide%d.xml", n)))})
+		}
+	}
+
+	c.parts = append(c.parts,
+		part{fmt.Sprintf("ppt/slides/slide%d.xml", n), slideHeader + c.body.String() + slideFooter},
+		part{fmt.Sprintf("ppt/slides/_rels/slide%d.xml.rels", n), relationships(c.rels...)})
+}
+
+// drawable writes a drawable to the slide. Group children are positioned relative to the group, so dx and dy
+// carry the group's offset.
+func (c *converter) drawable(ref *TSP.Reference, dx, dy float32) {
+	switch d := c.ix.Deref(ref).(type) {
+	case *KN.PlaceholderArchive:
+		c.shape(d.GetSuper(), dx, dy)
+	case *TSWP.ShapeInfoArchive:
+		c.shape(d, dx, dy)
+	case *TSD.ImageArchive:
+		c.image(d, dx, dy)
+	case *TST.TableInfoArchive:
+		if tm, ok := c.ix.Deref(d.TableModel).(*TST.TableModelArchive); ok {
+			c.table(d.GetSuper().GetGeometry(), tm, dx, dy)
+		}
+	case *TSD.GroupArchive:
+		pos := d.GetSuper().GetGeometry().GetPosition()
+		for _, child := range d.Children {
+			c.drawable(child, dx+pos.GetX(), dy+pos.GetY())
+		}
+	}
+}
+
+func (c *converter) shape(si *TSWP.ShapeInfoArchive, dx, dy float32) {
+	st, ok := c.ix.Deref(si.ContainedStorage).(*TSWP.StorageArchive)
+	if !ok || !hasText(st) {
+		return
+	}
+	c.nextID++
+	fmt.Fprintf(&c.body, `<p:sp><p:nvSpPr><p:cNvPr id="%d" name="TextBox %d"/><p:cNvSpPr txBox="1"/><p:nvPr/></p:nvSpPr>`+
+		`<p:spPr>%s<a:prstGeom prst="rect"><a:avLst/></a:prstGeom></p:spPr>%s</p:sp>`,
+		c.nextID, c.nextID, xfrm(si.GetSuper().GetSuper().GetGeometry(), dx, dy), c.txBody(st))
+}
+
+func (c *converter) image(img *TSD.ImageArchive, dx, dy float32) {
+	m, ok := c.ix.MediaFor(img.Data)
+	if !ok {
+		return
+	}
+	name, ok := c.media[m.ID]
+	if !ok {
+		rc, err := c.ix.OpenMedia(m.ID)
+		if err != nil {
+			return
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return
+		}
+		name = fmt.Sprintf("image%d%s", len(c.files)+1, strings.ToLower(path.Ext(m.Path)))
+		c.files = append(c.files, mediaFile{name, data})
+		c.media[m.ID] = name
+	}
+	c.nextID++
+	id := fmt.Sprintf("rIdImg%d", c.nextID)
+	c.rels = append(c.rels, rel(id, "image", "../media/"+name))
+	fmt.Fprintf(&c.body, `<p:pic><p:nvPicPr><p:cNvPr id="%d" name="%s"/><p:cNvPicPr/><p:nvPr/></p:nvPicPr>`+
+		`<p:blipFill><a:blip r:embed="%s"/><a:stretch><a:fillRect/></a:stretch></p:blipFill>`+
+		`<p:spPr>%s<a:prstGeom prst="rect"><a:avLst/></a:prstGeom></p:spPr></p:pic>`,
+		c.nextID, escape(m.Name), id, xfrm(img.GetSuper().GetGeometry(), dx, dy))
+}
+
+func (c *converter) table(geom *TSD.GeometryArchive, tm *TST.TableModelArchive, dx, dy float32) {
+	rows := c.ix.Cells(tm)
+	if len(rows) == 0 || len(rows[0]) == 0 {
+		return
+	}
+	width := emu(geom.GetSize().GetWidth()) / int64(len(rows[0]))
+	height := emu(geom.GetSize().GetHeight()) / int64(len(rows))
+	c.nextID++
+	fmt.Fprintf(&c.body, `<p:graphicFrame><p:nvGraphicFramePr><p:cNvPr id="%d" name="Table %d"/><p:cNvGraphicFramePr/><p:nvPr/></p:nvGraphicFramePr>`,
+		c.nextID, c.nextID)
+	c.body.WriteString(strings.Replace(xfrm(geom, dx, dy), "a:xfrm", "p:xfrm", -1))
+	c.body.WriteString(`<a:graphic><a:graphicData uri="http://schemas.openxmlformats.org/drawingml/2006/table"><a:tbl><a:tblPr firstRow="1" bandRow="1"/><a:tblGrid>`)
+	for range rows[0] {
+		fmt.Fprintf(&c.body, `<a:gridCol w="%d"/>`, width)
+	}
+	c.body.WriteString("</a:tblGrid>")
+	for _, row := range rows {
+		fmt.Fprintf(&c.body, `<a:tr h="%d">`, height)
+		for _, cell := range row {
+			c.body.WriteString(`<a:tc><a:txBody><a:bodyPr/><a:lstStyle/><a:p>`)
+			if cell.Type != index.EmptyCell {
+				fmt.Fprintf(&c.body, `<a:r><a:rPr lang="en-US"/><a:t>%s</a:t></a:r>`, escape(cell.String()))
+			}
+			c.body.WriteString(`</a:p></a:txBody><a:tcPr/></a:tc>`)
+		}
+		c.body.WriteString("</a:tr>")
+	}
+	c.body.WriteString("</a:tbl></a:graphicData></a:graphic></p:graphicFrame>")
+}
+
+// txBody returns the p:txBody for a storage.
+func (c *converter) txBody(st *TSWP.StorageArchive) string {
+	var buf bytes.Buffer
+	buf.WriteString(`<p:txBody><a:bodyPr wrap="square"><a:normAutofit/></a:bodyPr><a:lstStyle/>`)
+	for _, p := range c.ix.StorageParagraphs(st) {
+		buf.WriteString("<a:p>")
+		if p.ListLevel > 0 {
+			fmt.Fprintf(&buf, `<a:pPr lvl="%d"/>`, min(p.ListLevel, 8))
+		}
+		for _, run := range p.Runs {
+			if run.Attachment != nil {
+				continue
+			}
+			text := strings.NewReplacer("\u2028", "\n", "\u000b", "\n", "\t", "    ").Replace(run.Text)
+			for i, line := range strings.Split(text, "\n") {
+				if i > 0 {
+					buf.WriteString(`<a:br><a:rPr lang="en-US"/></a:br>`)
+				}
+				if line != "" {
+					fmt.Fprintf(&buf, `<a:r>%s<a:t>%s</a:t></a:r>`, c.runProps(p, run), escape(line))
+				}
+			}
+		}
+		buf.WriteString(`<a:endParaRPr lang="en-US"/></a:p>`)
+	}
+	buf.WriteString("</p:txBody>")
+	return buf.String()
+}
+
+// runProps returns the a:rPr of a run. The run's character style overrides the paragraph style, and each style its
+// parents.
+func (c *converter) runProps(p index.Paragraph, run index.Run) string {
+	var chain []*TSWP.CharacterStylePropertiesArchive
+	for ps := p.Style; ps != nil && len(chain) < 32; {
+		chain = append([]*TSWP.CharacterStylePropertiesArchive{ps.CharProperties}, chain...)
+		ps, _ = c.ix.Deref(ps.GetSuper().GetParent()).(*TSWP.ParagraphStyleArchive)
+	}
+	var chars []*TSWP.CharacterStylePropertiesArchive
+	for cs := run.Style; cs != nil && len(chars) < 32; {
+		chars = append([]*TSWP.CharacterStylePropertiesArchive{cs.CharProperties}, chars...)
+		cs, _ = c.ix.Deref(cs.GetSuper().GetParent()).(*TSWP.CharacterStyleArchive)
+	}
+
+	var bold, italic, underline bool
+	var size float32
+	var font string
+	for _, cp := range append(chain, chars...) {
+		if cp == nil {
+			continue
+		}
+		if cp.Bold != nil {
+			bold = *cp.Bold
+		}
+		if cp.Italic != nil {
+			italic = *cp.Italic
+		}
+		if cp.Underline != nil {
+			underline = *cp.Underline != TSWP.CharacterStylePropertiesArchive_kNoUnderline
+		}
+		if cp.FontSize != nil {
+			size = *cp.FontSize
+		}
+		if cp.FontName != nil {
+			font = *cp.FontName
+		}
+	}
+
+	attrs := `lang="en-US"`
+	if size > 0 {
+		attrs += fmt.Sprintf(` sz="%d"`, int(size*100))
+	}
+	if bold {
+		attrs += ` b="1"`
+	}
+	if italic {
+		attrs += ` i="1"`
+	}
+	if underline {
+		attrs += ` u="sng"`
+	}
+	if font != "" {
+		return fmt.Sprintf(`<a:rPr %s><a:latin typeface="%s"/></a:rPr>`, attrs, escape(font))
+	}
+	return fmt.Sprintf(`<a:rPr %s/>`, attrs)
+}
+
+func hasText(st *TSWP.StorageArchive) bool {
+	return strings.TrimSpace(strings.Replace(strings.Join(st.Text, ""), string(index.AttachmentChar), "", -1)) != ""
+}
+
+// xfrm returns the a:xfrm for a drawable's geometry.
+func xfrm(geom *TSD.GeometryArchive, dx, dy float32) string {
+	pos, size := geom.GetPosition(), geom.GetSize()
+	rot := ""
+	if angle := geom.GetAngle(); angle != 0 {
+		// Keynote measures angles counterclockwise, PowerPoint clockwise in 60000ths of a degree
+		rot = fmt.Sprintf(` rot="%d"`, int64((360-angle)*60000)%21600000)
+	}
+	return fmt.Sprintf(`<a:xfrm%s><a:off x="%d" y="%d"/><a:ext cx="%d" cy="%d"/></a:xfrm>`, rot,
+		emu(pos.GetX()+dx), emu(pos.GetY()+dy), emu(size.GetWidth()), emu(size.GetHeight()))
+}
+
+func (c *converter) presentation(cx, cy int64) string {
+	var ids string
+	for i := 1; i <= c.slides; i++ {
+		ids += fmt.Sprintf(`<p:sldId id="%d" r:id="rIdSlide%d"/>`, 255+i, i)
+	}
+	if ids != "" {
+		ids = "<p:sldIdLst>" + ids + "</p:sldIdLst>"
+	}
+	return xml.Header + `<p:presentation xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main"` +
+		` xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"` +
+		` xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main">` +
+		`<p:sldMasterIdLst><p:sldMasterId id="2147483648" r:id="rIdMaster"/></p:sldMasterIdLst>` +
+		`<p:notesMasterIdLst><p:notesMasterId r:id="rIdNotesMaster"/></p:notesMasterIdLst>` + ids +
+		fmt.Sprintf(`<p:sldSz cx="%d" cy="%d"/><p:notesSz cx="6858000" cy="9144000"/>`, cx, cy) +
+		`</p:presentation>`
+}
+
+func (c *converter) presentationRels() string {
+	rels := []string{
+		rel("rIdMaster", "slideMaster", "slideMasters/slideMaster1.xml"),
+		rel("rIdNotesMaster", "notesMaster", "notesMasters/notesMaster1.xml"),
+		rel("rIdTheme", "theme", "theme/theme1.xml"),
+	}
+	for i := 1; i <= c.slides; i++ {
+		rels = append(rels, rel(fmt.Sprintf("rIdSlide%d", i), "slide", fmt.Sprintf("slides/slide%d.xml", i)))
+	}
+	return relationships(rels...)
+}
+
+func (c *converter) contentTypes() string {
+	const ct = "application/vnd.openxmlformats-officedocument."
+	overrides := fmt.Sprintf(`<Override PartName="/ppt/presentation.xml" ContentType="%spresentationml.presentation.main+xml"/>`, ct) +
+		fmt.Sprintf(`<Override PartName="/ppt/slideMasters/slideMaster1.xml" ContentType="%spresentationml.slideMaster+xml"/>`, ct) +
+		fmt.Sprintf(`<Override PartName="/ppt/slideLayouts/slideLayout1.xml" ContentType="%spresentationml.slideLayout+xml"/>`, ct) +
+		fmt.Sprintf(`<Override PartName="/ppt/notesMasters/notesMaster1.xml" ContentType="%spresentationml.notesMaster+xml"/>`, ct) +
+		fmt.Sprintf(`<Override PartName="/ppt/theme/theme1.xml" ContentType="%stheme+xml"/>`, ct) +
+		fmt.Sprintf(`<Override PartName="/ppt/theme/theme2.xml" ContentType="%stheme+xml"/>`, ct)
+	for i := 1; i <= c.slides; i++ {
+		overrides += fmt.Sprintf(`<Override PartName="/ppt/slides/slide%d.xml" ContentType="%spresentationml.slide+xml"/>`, i, ct)
+	}
+	for i := 1; i <= c.notes; i++ {
+		overrides += fmt.Sprintf(`<Override PartName="/ppt/notesSlides/notesSlide%d.xml" ContentType="%spresentationml.notesSlide+xml"/>`, i, ct)
+	}
+	exts := map[string]bool{}
+	var defaults string
+	for _, m := range c.files {
+		ext := strings.TrimPrefix(path.Ext(m.name), ".")
+		if ext == "" || exts[ext] {
+			continue
+		}
+		exts[ext] = true
+		mime := "image/" + ext
+		if ext == "jpg" {
+			mime = "image/jpeg"
+		}
+		defaults += fmt.Sprintf(`<Default Extension="%s" ContentType="%s"/>`, ext, mime)
+	}
+	return xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` + defaults + overrides + `</Types>`
+}
+
+func rel(id, typ, target string) string {
+	return fmt.Sprintf(`<Relationship Id="%s" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/%s" Target="%s"/>`,
+		id, typ, target)
+}
+
+func relationships(rels ...string) string {
+	return xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		strings.Join(rels, "") + `</Relationships>`
+}
+
+// emu converts points to English Metric Units.
+func emu(pt float32) int64 {
+	return int64(pt * 12700)
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,218 @@
+// Package redact replaces sensitive text in iWork documents, like social security numbers and email addresses, and
+// writes a sanitized copy.
+//
+// Matches are replaced in text storages (the body, text boxes, shapes, presenter notes and rich text cells), plain
+// text table cells, comments and hyperlink targets. The preview images and slide thumbnails, which show the text as
+// it was, are left out of the copy and redrawn by the apps. Strip writes a copy without the comments, tracked
+// changes and author names instead.
+package redact
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TST"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// Common patterns
+var (
+	SSN   = regexp.MustCompile(`\b[0-9]{3}-[0-9]{2}-[0-9]{4}\b`)
+	Email = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+// Block is the character an empty Replacement blacks out text with.
+const Block = '█'
+
+// Rule replaces the matches of Pattern with Replacement, which can refer to submatches as in
+// regexp.Regexp.Expand. An empty Replacement blacks out each character of the match with Block.
+type Rule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Counts are the number of matches redacted in each part of a document. A string shared by several table cells
+// is counted once.
+type Counts struct {
+	Text     int `json:"text"`
+	Cells    int `json:"cells"`
+	Comments int `json:"comments"`
+	Links    int `json:"links"`
+}
+
+// Total is the number of matches redacted.
+func (c Counts) Total() int {
+	return c.Text + c.Cells + c.Comments + c.Links
+}
+
+// File redacts the document at src and saves the result to dst, without its previews.
+func File(src, dst, password string, rules []Rule) (Counts, error) {
+	ix, err := index.OpenWithPassword(src, password)
+	if err != nil {
+		return Counts{}, err
+	}
+	counts, err := Redact(ix, rules)
+	if err != nil {
+		return counts, err
+	}
+	if err := ix.RemovePreviews(); err != nil {
+		return counts, err
+	}
+	return counts, ix.Save(dst)
+}
+
+// Strip removes the comments, tracked changes, author names and version history of the document at src, as
+// Index.StripMetadata does, and saves the result to dst.
+func Strip(src, dst, password string) (*index.Stripped, error) {
+	ix, err := index.OpenWithPassword(src, password)
+	if err != nil {
+		return nil, err
+	}
+	rval, err := ix.StripMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return rval, ix.Save(dst)
+}
+
+// Redact applies the rules, in order, to the records of an Index. It doesn't touch the previews, see
+// Index.RemovePreviews. A Cache installed on the Index should be reset afterwards. A frozen Index fails with
+// index.ErrFrozen and a lazily opened one with index.ErrPartial, before anything is changed.
+func Redact(ix *index.Index, rules []Rule) (Counts, error) {
+	var rval Counts
+	if ix.Frozen() {
+		return rval, index.ErrFrozen
+	}
+	if ix.Partial() {
+		return rval, index.ErrPartial
+	}
+	ids := make([]uint64, 0, len(ix.Records))
+	for id := range ix.Records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		switch v := ix.Records[id].(type) {
+		case *TSWP.StorageArchive:
+			n, err := redactStorage(ix, v, rules)
+			if err != nil {
+				return rval, err
+			}
+			rval.Text += n
+		case *TST.TableDataList:
+			for _, e := range v.Entries {
+				if e.String_ != nil {
+					rval.Cells += redactString(e.String_, rules)
+				}
+			}
+		case *TSD.CommentStorageArchive:
+			if v.Text != nil {
+				rval.Comments += redactString(v.Text, rules)
+			}
+		case *TSWP.HyperlinkFieldArchive:
+			if v.UrlRef != nil {
+				rval.Links += redactString(v.UrlRef, rules)
+			}
+		case *KN.SlideArchive:
+			// the text the slide navigator shows, a copy of the placeholders
+			for _, s := range []*string{v.ThumbnailTextForTitlePlaceholder, v.ThumbnailTextForBodyPlaceholder} {
+				if s != nil {
+					redactString(s, rules)
+				}
+			}
+		}
+	}
+	return rval, nil
+}
+
+// redactString redacts *s in place and returns the number of matches.
+func redactString(s *string, rules []Rule) int {
+	var count int
+	for _, rule := range rules {
+		var b strings.Builder
+		last := 0
+		for _, m := range rule.Pattern.FindAllStringSubmatchIndex(*s, -1) {
+			if m[0] == m[1] {
+				continue
+			}
+			b.WriteString((*s)[last:m[0]])
+			b.WriteString(replacement(rule, *s, m))
+			last = m[1]
+			count++
+		}
+		if last > 0 {
+			b.WriteString((*s)[last:])
+			*s = b.String()
+		}
+	}
+	return count
+}
+
+// redactStorage redacts the text of a storage. Matches are looked for within paragraphs and between attachments,
+// which can't be replaced.
+func redactStorage(ix *index.Index, st *TSWP.StorageArchive, rules []Rule) (int, error) {
+	var count int
+	for _, rule := range rules {
+		type edit struct {
+			start, end int
+			text       string
+		}
+		var edits []edit
+		text := strings.Join(st.Text, "")
+		pos := 0 // rune offset of text[from:]
+		for from := 0; from < len(text); {
+			to := strings.IndexAny(text[from:], "\n\u2029\u000c"+string(index.AttachmentChar))
+			if to < 0 {
+				to = len(text)
+			} else {
+				to += from
+			}
+			seg := text[from:to]
+			for _, m := range rule.Pattern.FindAllStringSubmatchIndex(seg, -1) {
+				if m[0] == m[1] {
+					continue
+				}
+				start := pos + utf8.RuneCountInString(seg[:m[0]])
+				edits = append(edits, edit{start, start + utf8.RuneCountInString(seg[m[0]:m[1]]), replacement(rule, seg, m)})
+			}
+			pos += utf8.RuneCountInString(seg)
+			if to < len(text) {
+				_, size := utf8.DecodeRuneInString(text[to:])
+				to += size
+				pos++
+			}
+			from = to
+		}
+		// from the end, so the offsets of the earlier edits still hold
+		for i := len(edits) - 1; i >= 0; i-- {
+			e := edits[i]
+			if err := ix.ReplaceText(st, e.start, e.end, e.text); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// replacement is the text a match of rule in s is replaced with. Paragraph breaks in the expanded template are
+// turned into spaces, they can't be added in a replacement.
+func replacement(rule Rule, s string, m []int) string {
+	if rule.Replacement == "" {
+		return strings.Repeat(string(Block), utf8.RuneCountInString(s[m[0]:m[1]]))
+	}
+	text := string(rule.Pattern.ExpandString(nil, rule.Replacement, s, m))
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\n', '\u2029', '\u000c', index.AttachmentChar:
+			return ' '
+		}
+		return r
+	}, text)
+}
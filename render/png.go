@@ -0,0 +1,201 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"sort"
+
+	// decoders for embedded images
+	_ "image/gif"
+	_ "image/jpeg"
+
+	"github.com/dunhamsteve/iwork/index"
+)
+
+// maxWidth bounds the width of PNG output, in pixels.
+const maxWidth = 8192
+
+// PNG draws the nth slide (counting from 1) of a Keynote document as a PNG image width pixels wide, or one pixel
+// per point if width is 0. Text is drawn as bars, see the package documentation.
+func PNG(w io.Writer, ix *index.Index, n, width int) error {
+	if width < 0 || width > maxWidth {
+		return fmt.Errorf("render: width %d out of range", width)
+	}
+	s, err := newScene(ix, n)
+	if err != nil {
+		return err
+	}
+	scale := 1.0
+	if width > 0 {
+		scale = float64(width) / s.width
+	}
+	pw, ph := int(math.Ceil(s.width*scale)), int(math.Ceil(s.height*scale))
+	if pw < 1 || ph < 1 || pw > maxWidth || ph > maxWidth {
+		return fmt.Errorf("render: slide size %gx%g out of range", s.width, s.height)
+	}
+	r := &raster{img: image.NewNRGBA(image.Rect(0, 0, pw, ph)), scale: scale}
+	r.fillRect(0, 0, float64(pw), float64(ph), color.NRGBA{255, 255, 255, 255})
+	for _, it := range s.items {
+		switch {
+		case it.image != nil:
+			r.image(it)
+		case it.lines != nil:
+			r.text(it.lines)
+		default:
+			r.path(it)
+		}
+	}
+	return png.Encode(w, r.img)
+}
+
+// raster draws items onto an image, without antialiasing.
+type raster struct {
+	img   *image.NRGBA
+	scale float64
+}
+
+// blend paints c over the pixel at x, y.
+func (r *raster) blend(x, y int, c color.NRGBA) {
+	if !(image.Point{x, y}.In(r.img.Rect)) {
+		return
+	}
+	i := r.img.PixOffset(x, y)
+	pix := r.img.Pix[i : i+4 : i+4]
+	a := float64(c.A) / 255
+	da := float64(pix[3]) / 255
+	oa := a + da*(1-a)
+	if oa == 0 {
+		return
+	}
+	mix := func(s, d uint8) uint8 {
+		return uint8(math.Round((float64(s)*a + float64(d)*da*(1-a)) / oa))
+	}
+	pix[0], pix[1], pix[2], pix[3] = mix(c.R, pix[0]), mix(c.G, pix[1]), mix(c.B, pix[2]), uint8(math.Round(oa*255))
+}
+
+func (r *raster) fillRect(x0, y0, x1, y1 float64, c color.NRGBA) {
+	b := r.img.Rect
+	for y := int(math.Max(math.Round(y0), float64(b.Min.Y))); y < int(math.Min(math.Round(y1), float64(b.Max.Y))); y++ {
+		for x := int(math.Max(math.Round(x0), float64(b.Min.X))); x < int(math.Min(math.Round(x1), float64(b.Max.X))); x++ {
+			r.blend(x, y, c)
+		}
+	}
+}
+
+// fillPolygon fills subpaths, in pixels, with the even-odd rule by sampling pixel centers.
+func (r *raster) fillPolygon(path [][]point, c color.NRGBA) {
+	if c.A == 0 {
+		return
+	}
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for _, sub := range path {
+		for _, p := range sub {
+			minY, maxY = math.Min(minY, p.y), math.Max(maxY, p.y)
+		}
+	}
+	b := r.img.Rect
+	y0, y1 := int(math.Max(math.Floor(minY), float64(b.Min.Y))), int(math.Min(math.Ceil(maxY), float64(b.Max.Y)))
+	var xs []float64
+	for y := y0; y < y1; y++ {
+		cy := float64(y) + 0.5
+		xs = xs[:0]
+		for _, sub := range path {
+			for i := range sub {
+				p, q := sub[i], sub[(i+1)%len(sub)]
+				if (p.y <= cy) != (q.y <= cy) {
+					xs = append(xs, p.x+(cy-p.y)/(q.y-p.y)*(q.x-p.x))
+				}
+			}
+		}
+		sort.Float64s(xs)
+		for i := 0; i+1 < len(xs); i += 2 {
+			r.fillRect(xs[i], float64(y), xs[i+1], float64(y+1), c)
+		}
+	}
+}
+
+func (r *raster) scaled(path [][]point) [][]point {
+	rval := make([][]point, len(path))
+	for i, sub := range path {
+		for _, p := range sub {
+			rval[i] = append(rval[i], point{p.x * r.scale, p.y * r.scale})
+		}
+	}
+	return rval
+}
+
+func (r *raster) path(it item) {
+	path := r.scaled(it.path)
+	r.fillPolygon(path, it.fill)
+	if it.stroke.A == 0 {
+		return
+	}
+	// each edge is drawn as a rectangle the width of the stroke
+	half := math.Max(it.strokeWidth*r.scale, 1) / 2
+	for _, sub := range path {
+		for i := range sub {
+			p, q := sub[i], sub[(i+1)%len(sub)]
+			dx, dy := q.x-p.x, q.y-p.y
+			length := math.Hypot(dx, dy)
+			if length == 0 {
+				continue
+			}
+			nx, ny := -dy/length*half, dx/length*half
+			r.fillPolygon([][]point{{{p.x + nx, p.y + ny}, {q.x + nx, q.y + ny}, {q.x - nx, q.y - ny}, {p.x - nx, p.y - ny}}},
+				it.stroke)
+		}
+	}
+}
+
+// image draws an image stretched to its frame, ignoring rotation. Images that can't be decoded are drawn as a
+// gray box.
+func (r *raster) image(it item) {
+	b := box{it.frame.x * r.scale, it.frame.y * r.scale, it.frame.w * r.scale, it.frame.h * r.scale}
+	var src image.Image
+	if it.image.data != nil {
+		src, _, _ = image.Decode(bytes.NewReader(it.image.data))
+	}
+	if src == nil || src.Bounds().Empty() || b.w <= 0 || b.h <= 0 {
+		r.fillRect(b.x, b.y, b.x+b.w, b.y+b.h, color.NRGBA{204, 204, 204, 255})
+		return
+	}
+	sb := src.Bounds()
+	x0, y0 := int(math.Round(b.x)), int(math.Round(b.y))
+	x1, y1 := int(math.Round(b.x+b.w)), int(math.Round(b.y+b.h))
+	clip := image.Rect(x0, y0, x1, y1).Intersect(r.img.Rect)
+	for y := clip.Min.Y; y < clip.Max.Y; y++ {
+		sy := sb.Min.Y + int((float64(y)+0.5-b.y)/b.h*float64(sb.Dy()))
+		for x := clip.Min.X; x < clip.Max.X; x++ {
+			sx := sb.Min.X + int((float64(x)+0.5-b.x)/b.w*float64(sb.Dx()))
+			if sx >= sb.Max.X || sy >= sb.Max.Y {
+				continue
+			}
+			r.blend(x, y, color.NRGBAModel.Convert(src.At(sx, sy)).(color.NRGBA))
+		}
+	}
+}
+
+// text draws each span of a line as a bar across the middle of its lowercase letters.
+func (r *raster) text(lines []line) {
+	for _, l := range lines {
+		x := l.x
+		switch l.anchor {
+		case "middle":
+			x -= l.width / 2
+		case "end":
+			x -= l.width
+		}
+		for _, sp := range l.spans {
+			w := textWidth(sp)
+			c := sp.color
+			c.A /= 2
+			r.fillRect(x*r.scale, (l.y-sp.size*0.45)*r.scale, (x+w)*r.scale, (l.y-sp.size*0.1)*r.scale, c)
+			x += w
+		}
+	}
+}
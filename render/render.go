@@ -0,0 +1,655 @@
+// Package render draws Keynote slides as SVG or PNG images, for previews on machines without Keynote.
+//
+// Rendering is best effort. The slide background, the objects of the master, and the text boxes, placeholders,
+// images and shapes of the slide are drawn from their geometry and styles. Gradients are drawn in their average
+// color and text is laid out with estimated character widths. Tables, charts, shadows and image masks are left
+// out. There is no font rasterizer in the standard library, so PNG output shows each line of text as a bar of its
+// color and size; SVG output has the words.
+package render
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"mime"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/KN"
+	"github.com/dunhamsteve/iwork/proto/TSD"
+	"github.com/dunhamsteve/iwork/proto/TSP"
+	"github.com/dunhamsteve/iwork/proto/TSWP"
+)
+
+// point and box are in slide points, y down.
+type point struct{ x, y float64 }
+
+type box struct{ x, y, w, h float64 }
+
+// item is something drawn on the slide: a filled or stroked outline, an image or text. Colors with zero alpha
+// aren't drawn.
+type item struct {
+	path        [][]point
+	fill        color.NRGBA
+	stroke      color.NRGBA
+	strokeWidth float64
+
+	image *picture
+	frame box     // of the image
+	angle float64 // of the image, in degrees counterclockwise
+
+	lines []line
+}
+
+// picture is an image file from the document. data is nil if it couldn't be read.
+type picture struct {
+	data []byte
+	mime string
+}
+
+// line is a laid out line of text. x is the start, middle or end of the line, as anchor says, and y the baseline.
+// width is estimated.
+type line struct {
+	x, y   float64
+	width  float64
+	anchor string
+	spans  []span
+}
+
+type span struct {
+	text   string
+	font   string
+	size   float64
+	bold   bool
+	italic bool
+	color  color.NRGBA
+}
+
+// scene is a slide as a list of items, back to front.
+type scene struct {
+	ix            *index.Index
+	width, height float64
+	items         []item
+}
+
+// Default text size and the padding between a text box and its text, in points.
+const (
+	defaultSize = 18
+	textInset   = 4
+)
+
+// newScene lays out the nth slide (counting from 1) of a Keynote document.
+func newScene(ix *index.Index, n int) (*scene, error) {
+	if ix.Type != "key" {
+		return nil, fmt.Errorf("render: can't render %s documents", ix.Type)
+	}
+	slides := ix.Slides()
+	if n < 1 || n > len(slides) {
+		return nil, fmt.Errorf("render: no slide %d", n)
+	}
+	if err := ix.LoadObject(slides[n-1]); err != nil {
+		return nil, err
+	}
+	slide, ok := ix.Records[slides[n-1]].(*KN.SlideArchive)
+	if !ok {
+		return nil, errors.New("render: missing slide archive")
+	}
+
+	// Keynote's default size, for documents that don't say
+	s := &scene{ix: ix, width: 1024, height: 768}
+	if show := ix.Show(); show != nil && show.Size != nil {
+		s.width, s.height = float64(show.Size.GetWidth()), float64(show.Size.GetHeight())
+	}
+
+	master, _ := ix.Deref(slide.Master).(*KN.SlideArchive)
+	props := s.slideProperties(slide, master)
+	s.fill(props.fill, box{0, 0, s.width, s.height}, 0)
+	if master != nil {
+		for _, ref := range master.Drawables {
+			s.drawable(ref, 0, 0, true)
+		}
+	}
+
+	seen := make(map[uint64]bool)
+	var refs []*TSP.Reference
+	if props.title {
+		refs = append(refs, slide.TitlePlaceholder)
+	}
+	if props.body {
+		refs = append(refs, slide.BodyPlaceholder)
+	}
+	for _, ref := range append(refs, slide.Drawables...) {
+		if ref == nil || seen[ref.GetIdentifier()] {
+			continue
+		}
+		seen[ref.GetIdentifier()] = true
+		s.drawable(ref, 0, 0, false)
+	}
+	return s, nil
+}
+
+// slideProperties are the resolved style properties of a slide.
+type slideProperties struct {
+	fill        *TSD.FillArchive
+	title, body bool // placeholder visibility
+}
+
+// slideProperties resolves the style of a slide, each style winning over its parents, and falls back on the
+// master's background.
+func (s *scene) slideProperties(slide, master *KN.SlideArchive) slideProperties {
+	rval := slideProperties{title: true, body: true}
+	for _, props := range s.slideStyles(slide) {
+		if props.Fill != nil {
+			rval.fill = props.Fill
+		}
+		if props.TitlePlaceholderVisibility != nil {
+			rval.title = props.GetTitlePlaceholderVisibility()
+		}
+		if props.BodyPlaceholderVisibility != nil {
+			rval.body = props.GetBodyPlaceholderVisibility()
+		}
+	}
+	if rval.fill == nil && master != nil {
+		for _, props := range s.slideStyles(master) {
+			if props.Fill != nil {
+				rval.fill = props.Fill
+			}
+		}
+	}
+	return rval
+}
+
+// slideStyles returns the properties of a slide's style and its ancestors, root first.
+func (s *scene) slideStyles(slide *KN.SlideArchive) []*KN.SlideStylePropertiesArchive {
+	var chain []*KN.SlideStylePropertiesArchive
+	style, _ := s.ix.Deref(slide.Style).(*KN.SlideStyleArchive)
+	for depth := 0; style != nil && depth < 32; depth++ {
+		if style.SlideProperties != nil {
+			chain = append([]*KN.SlideStylePropertiesArchive{style.SlideProperties}, chain...)
+		}
+		style, _ = s.ix.Deref(style.GetSuper().GetParent()).(*KN.SlideStyleArchive)
+	}
+	return chain
+}
+
+// drawable adds a drawable to the scene. Group children are positioned relative to the group, so dx and dy carry
+// the group's offset. The placeholders of a master only hold its sample text, so they're skipped.
+func (s *scene) drawable(ref *TSP.Reference, dx, dy float64, master bool) {
+	switch d := s.ix.Deref(ref).(type) {
+	case *KN.PlaceholderArchive:
+		if !master {
+			s.shape(d.GetSuper(), dx, dy)
+		}
+	case *TSWP.ShapeInfoArchive:
+		s.shape(d, dx, dy)
+	case *TSD.ShapeArchive:
+		s.outline(d, dx, dy)
+	case *TSD.ConnectionLineArchive:
+		s.outline(d.GetSuper(), dx, dy)
+	case *TSD.ImageArchive:
+		geom := d.GetSuper().GetGeometry()
+		s.items = append(s.items, item{image: s.picture(d.Data), frame: frame(geom, dx, dy), angle: float64(geom.GetAngle())})
+	case *TSD.GroupArchive:
+		pos := d.GetSuper().GetGeometry().GetPosition()
+		for _, child := range d.Children {
+			s.drawable(child, dx+float64(pos.GetX()), dy+float64(pos.GetY()), master)
+		}
+	}
+}
+
+// frame returns the box of a drawable's geometry.
+func frame(geom *TSD.GeometryArchive, dx, dy float64) box {
+	pos, size := geom.GetPosition(), geom.GetSize()
+	return box{float64(pos.GetX()) + dx, float64(pos.GetY()) + dy, float64(size.GetWidth()), float64(size.GetHeight())}
+}
+
+// shape adds a text box or shape with text: its outline, then its text.
+func (s *scene) shape(si *TSWP.ShapeInfoArchive, dx, dy float64) {
+	s.outline(si.GetSuper(), dx, dy)
+	st, ok := s.ix.Deref(si.ContainedStorage).(*TSWP.StorageArchive)
+	if !ok {
+		return
+	}
+	if lines := s.text(st, frame(si.GetSuper().GetSuper().GetGeometry(), dx, dy)); len(lines) > 0 {
+		s.items = append(s.items, item{lines: lines})
+	}
+}
+
+// outline adds the fill and stroke of a shape, if its style has either.
+func (s *scene) outline(sh *TSD.ShapeArchive, dx, dy float64) {
+	var fill *TSD.FillArchive
+	var stroke *TSD.StrokeArchive
+	style, _ := s.ix.Deref(sh.Style).(*TSD.ShapeStyleArchive)
+	var chain []*TSD.ShapeStylePropertiesArchive
+	for depth := 0; style != nil && depth < 32; depth++ {
+		if style.ShapeProperties != nil {
+			chain = append([]*TSD.ShapeStylePropertiesArchive{style.ShapeProperties}, chain...)
+		}
+		style, _ = s.ix.Deref(style.GetSuper().GetParent()).(*TSD.ShapeStyleArchive)
+	}
+	for _, props := range chain {
+		if props.Fill != nil {
+			fill = props.Fill
+		}
+		if props.Stroke != nil {
+			stroke = props.Stroke
+		}
+	}
+	if stroke.GetPattern().GetType() == TSD.StrokePatternArchive_TSDEmptyPattern || stroke.GetWidth() <= 0 {
+		stroke = nil
+	}
+	if fill == nil && stroke == nil {
+		return
+	}
+
+	geom := sh.GetSuper().GetGeometry()
+	b := frame(geom, dx, dy)
+	if fill != nil && fill.Image != nil {
+		s.items = append(s.items, item{image: s.picture(fill.Image.Imagedata), frame: b, angle: float64(geom.GetAngle())})
+		fill = nil
+	}
+	it := item{path: rotate(shapePath(sh.Pathsource, b), b, float64(geom.GetAngle())), fill: fillColor(fill)}
+	if stroke != nil {
+		it.stroke, it.strokeWidth = toColor(stroke.Color), float64(stroke.GetWidth())
+	}
+	s.items = append(s.items, it)
+}
+
+// fill adds a background fill covering b.
+func (s *scene) fill(fill *TSD.FillArchive, b box, angle float64) {
+	switch {
+	case fill == nil:
+	case fill.Image != nil:
+		s.items = append(s.items, item{image: s.picture(fill.Image.Imagedata), frame: b, angle: angle})
+	default:
+		s.items = append(s.items, item{path: rotate(rect(b), b, angle), fill: fillColor(fill)})
+	}
+}
+
+// picture reads an image from the document.
+func (s *scene) picture(ref *TSP.DataReference) *picture {
+	rval := &picture{}
+	m, ok := s.ix.MediaFor(ref)
+	if !ok {
+		return rval
+	}
+	rval.mime = mime.TypeByExtension(strings.ToLower(path.Ext(m.Path)))
+	rc, err := s.ix.OpenMedia(m.ID)
+	if err != nil {
+		return rval
+	}
+	defer rc.Close()
+	rval.data, _ = ioutil.ReadAll(rc)
+	return rval
+}
+
+// text lays out a text storage in a text box, wrapping words at the box width. Lines that fall below the box are
+// still drawn, as Keynote does.
+func (s *scene) text(st *TSWP.StorageArchive, b box) []line {
+	var rval []line
+	width := b.w - 2*textInset
+	y := b.y + textInset
+	for _, p := range s.ix.StorageParagraphs(st) {
+		format := s.ix.ResolveParagraph(p.Style)
+		// words keep the style of their run
+		type word struct {
+			span
+			space bool // preceded by a space
+		}
+		var words []word
+		space := false // whitespace since the last word
+		for _, run := range p.Runs {
+			if run.Attachment != nil {
+				continue
+			}
+			style := s.ix.RunStyle(p, run)
+			sp := span{font: style.Font, size: float64(style.Size), bold: style.Bold, italic: style.Italic,
+				color: color.NRGBA{0, 0, 0, 255}}
+			if sp.size <= 0 {
+				sp.size = defaultSize
+			}
+			if style.Color != nil {
+				sp.color = toColor(style.Color)
+			}
+			text := strings.NewReplacer("\u00a0", " ", "\u2028", " ", "\u000b", " ", "\u000c", "", "\t", " ").Replace(run.Text)
+			for k, f := range strings.Fields(text) {
+				if k > 0 || strings.HasPrefix(text, " ") {
+					space = true
+				}
+				w := word{sp, space}
+				w.text = f
+				words = append(words, w)
+				space = false
+			}
+			if strings.HasSuffix(text, " ") {
+				space = true
+			}
+		}
+
+		y += float64(format.SpaceBefore)
+		if len(words) == 0 {
+			y += defaultSize * 1.2
+			continue
+		}
+		left := b.x + textInset + float64(format.LeftIndent)
+		avail := width - float64(format.LeftIndent) - float64(format.RightIndent)
+		for len(words) > 0 {
+			var l line
+			size := 0.0
+			n := 0
+			for n < len(words) {
+				w := words[n]
+				wordWidth := textWidth(w.span)
+				if n > 0 && w.space {
+					wordWidth += textWidth(span{text: " ", size: w.size})
+				}
+				if n > 0 && l.width+wordWidth > avail {
+					break
+				}
+				text := w.text
+				if n > 0 && w.space {
+					text = " " + text
+				}
+				sp := w.span
+				sp.text = text
+				if k := len(l.spans) - 1; k >= 0 && sameStyle(l.spans[k], sp) {
+					l.spans[k].text += text
+				} else {
+					l.spans = append(l.spans, sp)
+				}
+				l.width += wordWidth
+				if w.size > size {
+					size = w.size
+				}
+				n++
+			}
+			words = words[n:]
+			y += size
+			l.y = y
+			switch format.Alignment {
+			case 1:
+				l.x, l.anchor = left+avail, "end"
+			case 2:
+				l.x, l.anchor = left+avail/2, "middle"
+			default:
+				l.x, l.anchor = left, "start"
+			}
+			rval = append(rval, l)
+			y += size * 0.2
+		}
+		y += float64(format.SpaceAfter)
+	}
+	return rval
+}
+
+func sameStyle(a, b span) bool {
+	return a.font == b.font && a.size == b.size && a.bold == b.bold && a.italic == b.italic && a.color == b.color
+}
+
+// textWidth estimates the width of a span from the average width of a character.
+func textWidth(sp span) float64 {
+	avg := 0.5
+	if sp.bold {
+		avg = 0.55
+	}
+	return float64(utf8.RuneCountInString(sp.text)) * sp.size * avg
+}
+
+// shapePath returns the outline of a shape in its box. Rounded rectangles, regular polygons and bezier paths are
+// followed, anything else is drawn as its box.
+func shapePath(ps *TSD.PathSourceArchive, b box) [][]point {
+	var rval [][]point
+	switch {
+	case ps.GetScalarPathSource() != nil:
+		sps := ps.GetScalarPathSource()
+		switch sps.GetType() {
+		case TSD.ScalarPathSourceArchive_kTSDRoundedRectangle:
+			rval = [][]point{roundedRect(b, float64(sps.GetScalar()))}
+		case TSD.ScalarPathSourceArchive_kTSDRegularPolygon:
+			rval = [][]point{polygon(b, int(sps.GetScalar()))}
+		}
+	case ps.GetBezierPathSource().GetPath() != nil:
+		bps := ps.GetBezierPathSource()
+		rval = bezierPath(bps.Path, scaleTo(bps.NaturalSize, b))
+	case ps.GetEditableBezierPathSource() != nil:
+		ebps := ps.GetEditableBezierPathSource()
+		rval = editablePath(ebps, scaleTo(ebps.NaturalSize, b))
+	}
+	if len(rval) == 0 {
+		rval = rect(b)
+	}
+	if ps.GetHorizontalFlip() || ps.GetVerticalFlip() {
+		for _, sub := range rval {
+			for i, p := range sub {
+				if ps.GetHorizontalFlip() {
+					p.x = 2*b.x + b.w - p.x
+				}
+				if ps.GetVerticalFlip() {
+					p.y = 2*b.y + b.h - p.y
+				}
+				sub[i] = p
+			}
+		}
+	}
+	return rval
+}
+
+func rect(b box) [][]point {
+	return [][]point{{{b.x, b.y}, {b.x + b.w, b.y}, {b.x + b.w, b.y + b.h}, {b.x, b.y + b.h}}}
+}
+
+// roundedRect returns a rectangle with corners of radius r.
+func roundedRect(b box, r float64) []point {
+	r = math.Max(0, math.Min(r, math.Min(b.w, b.h)/2))
+	var rval []point
+	corners := []struct{ cx, cy, start float64 }{
+		{b.x + b.w - r, b.y + r, -90},
+		{b.x + b.w - r, b.y + b.h - r, 0},
+		{b.x + r, b.y + b.h - r, 90},
+		{b.x + r, b.y + r, 180},
+	}
+	for _, c := range corners {
+		for k := 0; k <= 8; k++ {
+			a := (c.start + float64(k)*90/8) * math.Pi / 180
+			rval = append(rval, point{c.cx + r*math.Cos(a), c.cy + r*math.Sin(a)})
+		}
+	}
+	return rval
+}
+
+// polygon returns a regular polygon with n sides inscribed in b, pointing up.
+func polygon(b box, n int) []point {
+	if n < 3 || n > 1000 {
+		return rect(b)[0]
+	}
+	var rval []point
+	for k := 0; k < n; k++ {
+		a := -math.Pi/2 + 2*math.Pi*float64(k)/float64(n)
+		rval = append(rval, point{b.x + b.w/2 + b.w/2*math.Cos(a), b.y + b.h/2 + b.h/2*math.Sin(a)})
+	}
+	return rval
+}
+
+// scaleTo returns the mapping from a path's natural size to the box it's drawn in.
+func scaleTo(natural *TSP.Size, b box) func(*TSP.Point) point {
+	sx, sy := 1.0, 1.0
+	if w := float64(natural.GetWidth()); w > 0 {
+		sx = b.w / w
+	}
+	if h := float64(natural.GetHeight()); h > 0 {
+		sy = b.h / h
+	}
+	return func(p *TSP.Point) point {
+		return point{b.x + float64(p.GetX())*sx, b.y + float64(p.GetY())*sy}
+	}
+}
+
+// curveSteps is the number of line segments a curve is flattened to.
+const curveSteps = 16
+
+// bezierPath flattens a path into subpaths of points.
+func bezierPath(path *TSP.Path, at func(*TSP.Point) point) [][]point {
+	var rval [][]point
+	var cur []point
+	last := point{}
+	for _, e := range path.Elements {
+		var pts []point
+		for _, p := range e.Points {
+			pts = append(pts, at(p))
+		}
+		switch e.GetType() {
+		case TSP.Path_moveTo:
+			if len(cur) > 1 {
+				rval = append(rval, cur)
+			}
+			cur = nil
+			if len(pts) > 0 {
+				last = pts[0]
+				cur = []point{last}
+			}
+		case TSP.Path_lineTo:
+			if len(pts) > 0 {
+				last = pts[0]
+				cur = append(cur, last)
+			}
+		case TSP.Path_quadCurveTo:
+			if len(pts) > 1 {
+				cur = append(cur, quadratic(last, pts[0], pts[1])...)
+				last = pts[1]
+			}
+		case TSP.Path_curveTo:
+			if len(pts) > 2 {
+				cur = append(cur, cubic(last, pts[0], pts[1], pts[2])...)
+				last = pts[2]
+			}
+		case TSP.Path_closeSubpath:
+			if len(cur) > 1 {
+				rval = append(rval, cur)
+			}
+			if len(cur) > 0 {
+				last = cur[0]
+			}
+			cur = []point{last}
+		}
+	}
+	if len(cur) > 1 {
+		rval = append(rval, cur)
+	}
+	return rval
+}
+
+// editablePath flattens the subpaths of an editable bezier path, whose nodes carry their control points.
+func editablePath(ps *TSD.EditableBezierPathSourceArchive, at func(*TSP.Point) point) [][]point {
+	var rval [][]point
+	for _, sub := range ps.Subpaths {
+		nodes := sub.Nodes
+		if len(nodes) == 0 {
+			continue
+		}
+		cur := []point{at(nodes[0].NodePoint)}
+		end := len(nodes) - 1
+		if sub.GetClosed() {
+			end = len(nodes)
+		}
+		for k := 0; k < end; k++ {
+			from, to := nodes[k], nodes[(k+1)%len(nodes)]
+			cur = append(cur, cubic(at(from.NodePoint), at(from.OutControlPoint), at(to.InControlPoint), at(to.NodePoint))...)
+		}
+		rval = append(rval, cur)
+	}
+	return rval
+}
+
+func quadratic(p0, p1, p2 point) []point {
+	var rval []point
+	for k := 1; k <= curveSteps; k++ {
+		t := float64(k) / curveSteps
+		u := 1 - t
+		rval = append(rval, point{u*u*p0.x + 2*u*t*p1.x + t*t*p2.x, u*u*p0.y + 2*u*t*p1.y + t*t*p2.y})
+	}
+	return rval
+}
+
+func cubic(p0, p1, p2, p3 point) []point {
+	var rval []point
+	for k := 1; k <= curveSteps; k++ {
+		t := float64(k) / curveSteps
+		u := 1 - t
+		rval = append(rval, point{
+			u*u*u*p0.x + 3*u*u*t*p1.x + 3*u*t*t*p2.x + t*t*t*p3.x,
+			u*u*u*p0.y + 3*u*u*t*p1.y + 3*u*t*t*p2.y + t*t*t*p3.y,
+		})
+	}
+	return rval
+}
+
+// rotate turns the points of a path about the center of b. Keynote measures angles counterclockwise.
+func rotate(path [][]point, b box, angle float64) [][]point {
+	if angle == 0 {
+		return path
+	}
+	a := -angle * math.Pi / 180
+	sin, cos := math.Sin(a), math.Cos(a)
+	cx, cy := b.x+b.w/2, b.y+b.h/2
+	for _, sub := range path {
+		for i, p := range sub {
+			dx, dy := p.x-cx, p.y-cy
+			sub[i] = point{cx + dx*cos - dy*sin, cy + dx*sin + dy*cos}
+		}
+	}
+	return path
+}
+
+// fillColor returns the color of a fill, the average of the stops for gradients.
+func fillColor(fill *TSD.FillArchive) color.NRGBA {
+	switch {
+	case fill == nil:
+	case fill.Color != nil:
+		return toColor(fill.Color)
+	case fill.Gradient != nil && len(fill.Gradient.Stops) > 0:
+		var r, g, b, a float64
+		for _, stop := range fill.Gradient.Stops {
+			c := toColor(stop.Color)
+			r, g, b, a = r+float64(c.R), g+float64(c.G), b+float64(c.B), a+float64(c.A)
+		}
+		n := float64(len(fill.Gradient.Stops))
+		rval := color.NRGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)}
+		if op := fill.Gradient.Opacity; op != nil {
+			rval.A = uint8(float64(rval.A) * clamp(float64(*op)))
+		}
+		return rval
+	}
+	return color.NRGBA{}
+}
+
+// toColor converts a color from any of the iWork color models.
+func toColor(c *TSP.Color) color.NRGBA {
+	if c == nil {
+		return color.NRGBA{}
+	}
+	var r, g, b float64
+	switch c.GetModel() {
+	case TSP.Color_cmyk:
+		k := float64(c.GetK())
+		r = (1 - float64(c.GetC())) * (1 - k)
+		g = (1 - float64(c.GetM())) * (1 - k)
+		b = (1 - float64(c.GetY())) * (1 - k)
+	case TSP.Color_white:
+		r, g, b = float64(c.GetW()), float64(c.GetW()), float64(c.GetW())
+	default:
+		r, g, b = float64(c.GetR()), float64(c.GetG()), float64(c.GetB())
+	}
+	return color.NRGBA{channel(r), channel(g), channel(b), channel(float64(c.GetA()))}
+}
+
+func channel(v float64) uint8 {
+	return uint8(math.Round(clamp(v) * 255))
+}
+
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,122 @@
+package render
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"image/color"
+	"io"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/index"
+)
+
+// SVG draws the nth slide (counting from 1) of a Keynote document as an SVG image, one unit per point.
+func SVG(w io.Writer, ix *index.Index, n int) error {
+	s, err := newScene(ix, n)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="%s" height="%s" viewBox="0 0 %s %s">`+"\n",
+		num(s.width), num(s.height), num(s.width), num(s.height))
+	fmt.Fprintf(bw, `<rect width="%s" height="%s" fill="#ffffff"/>`+"\n", num(s.width), num(s.height))
+	for _, it := range s.items {
+		switch {
+		case it.image != nil:
+			svgImage(bw, it)
+		case it.lines != nil:
+			svgText(bw, it.lines)
+		default:
+			svgPath(bw, it)
+		}
+	}
+	bw.WriteString("</svg>\n")
+	return bw.Flush()
+}
+
+func svgPath(w *bufio.Writer, it item) {
+	var d strings.Builder
+	for _, sub := range it.path {
+		for i, p := range sub {
+			if i == 0 {
+				d.WriteString("M")
+			} else {
+				d.WriteString(" L")
+			}
+			d.WriteString(num(p.x) + " " + num(p.y))
+		}
+		d.WriteString(" Z ")
+	}
+	width := ""
+	if it.stroke.A != 0 {
+		width = fmt.Sprintf(` stroke-width="%s"`, num(it.strokeWidth))
+	}
+	fmt.Fprintf(w, `<path d="%s" fill-rule="evenodd"%s%s%s/>`+"\n", strings.TrimSpace(d.String()), paint("fill", it.fill),
+		paint("stroke", it.stroke), width)
+}
+
+// svgImage embeds an image. Formats browsers can't show, and images that couldn't be read, are drawn as a gray
+// box.
+func svgImage(w *bufio.Writer, it item) {
+	b := it.frame
+	transform := ""
+	if it.angle != 0 {
+		transform = fmt.Sprintf(` transform="rotate(%s %s %s)"`, num(-it.angle), num(b.x+b.w/2), num(b.y+b.h/2))
+	}
+	switch it.image.mime {
+	case "image/png", "image/jpeg", "image/gif", "image/svg+xml":
+		if it.image.data != nil {
+			fmt.Fprintf(w, `<image x="%s" y="%s" width="%s" height="%s" preserveAspectRatio="none"%s xlink:href="data:%s;base64,%s"/>`+"\n",
+				num(b.x), num(b.y), num(b.w), num(b.h), transform, it.image.mime, base64.StdEncoding.EncodeToString(it.image.data))
+			return
+		}
+	}
+	fmt.Fprintf(w, `<rect x="%s" y="%s" width="%s" height="%s" fill="#cccccc"%s/>`+"\n", num(b.x), num(b.y), num(b.w), num(b.h),
+		transform)
+}
+
+func svgText(w *bufio.Writer, lines []line) {
+	for _, l := range lines {
+		fmt.Fprintf(w, `<text x="%s" y="%s" text-anchor="%s" xml:space="preserve">`, num(l.x), num(l.y), l.anchor)
+		for _, sp := range l.spans {
+			w.WriteString(`<tspan`)
+			if sp.font != "" {
+				fmt.Fprintf(w, ` font-family="%s"`, escape(sp.font))
+			}
+			fmt.Fprintf(w, ` font-size="%s"`, num(sp.size))
+			if sp.bold {
+				w.WriteString(` font-weight="bold"`)
+			}
+			if sp.italic {
+				w.WriteString(` font-style="italic"`)
+			}
+			fmt.Fprintf(w, `%s>%s</tspan>`, paint("fill", sp.color), escape(sp.text))
+		}
+		w.WriteString("</text>\n")
+	}
+}
+
+// paint returns a fill or stroke attribute for a color, "none" if it's transparent.
+func paint(attr string, c color.NRGBA) string {
+	if c.A == 0 {
+		return fmt.Sprintf(` %s="none"`, attr)
+	}
+	rval := fmt.Sprintf(` %s="#%02x%02x%02x"`, attr, c.R, c.G, c.B)
+	if c.A != 255 {
+		rval += fmt.Sprintf(` %s-opacity="%s"`, attr, num(float64(c.A)/255))
+	}
+	return rval
+}
+
+// num formats a coordinate without needless digits.
+func num(v float64) string {
+	s := strings.TrimRight(fmt.Sprintf("%.2f", v), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+var escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
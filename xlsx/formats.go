@@ -0,0 +1,180 @@
+package xlsx
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/proto/TSK"
+)
+
+// builtinFormats are the number formats Excel knows without a numFmt entry.
+var builtinFormats = map[string]int{
+	"General":    0,
+	"0":          1,
+	"0.00":       2,
+	"#,##0":      3,
+	"#,##0.00":   4,
+	"0%":         9,
+	"0.00%":      10,
+	"0.00E+00":   11,
+	"# ?/?":      12,
+	"@":          49,
+	"[h]:mm:ss":  46,
+	"yyyy-mm-dd": 14,
+}
+
+var currencySymbols = map[string]string{"USD": "$", "EUR": "€", "GBP": "£", "JPY": "¥", "CNY": "¥", "INR": "₹"}
+
+// numberFormat returns the Excel number format code for a cell, "" for the default.
+func numberFormat(cell index.Cell, f *TSK.FormatStructArchive) string {
+	if f == nil {
+		switch cell.Type {
+		case index.DateCell:
+			return "yyyy-mm-dd hh:mm:ss"
+		case index.DurationCell:
+			return "[h]:mm:ss"
+		}
+		return ""
+	}
+	switch f.GetFormatType() {
+	case index.FormatDecimal, index.FormatCustomNumber:
+		if f.GetCustomFormatString() != "" {
+			return f.GetCustomFormatString()
+		}
+		return decimalFormat(f)
+	case index.FormatCurrency, index.FormatCustomCurrency:
+		symbol, ok := currencySymbols[f.GetCurrencyCode()]
+		if !ok {
+			symbol = fmt.Sprintf(`[$%s] `, f.GetCurrencyCode())
+		}
+		code := symbol + decimalFormat(f)
+		if f.GetNegativeStyle() == 1 || f.GetNegativeStyle() == 3 {
+			code += ";[Red]-" + code
+		}
+		return code
+	case index.FormatPercent:
+		return decimalFormat(f) + "%"
+	case index.FormatScientific:
+		return decimalFormat(f) + "E+00"
+	case index.FormatFraction:
+		return "# ?/?"
+	case index.FormatText:
+		return "@"
+	case index.FormatDate, index.FormatCustomDate:
+		if code := dateFormat(f.GetDateTimeFormat()); code != "" {
+			return code
+		}
+		return "yyyy-mm-dd"
+	case index.FormatDuration:
+		return "[h]:mm:ss"
+	}
+	return ""
+}
+
+func decimalFormat(f *TSK.FormatStructArchive) string {
+	places := f.GetDecimalPlaces()
+	if places == index.AutoDecimals && !f.GetShowThousandsSeparator() {
+		return "General"
+	}
+	code := "0"
+	if f.GetShowThousandsSeparator() {
+		code = "#,##0"
+	}
+	if places > 0 && places != index.AutoDecimals {
+		// Excel allows at most 30 decimal places
+		code += "." + strings.Repeat("0", int(min(places, 30)))
+	}
+	return code
+}
+
+// dateFormat converts a Unicode (ICU) date pattern, like "MMM d, yyyy", to an Excel format code.
+func dateFormat(pattern string) string {
+	var rval strings.Builder
+	rr := []rune(pattern)
+	for i := 0; i < len(rr); {
+		r := rr[i]
+		j := i
+		for j < len(rr) && rr[j] == r {
+			j++
+		}
+		n := j - i
+		switch {
+		case r == '\'':
+			// quoted literal, '' is a single quote
+			k := i + 1
+			for k < len(rr) && rr[k] != '\'' {
+				k++
+			}
+			if k == i+1 {
+				rval.WriteString(`\'`)
+			} else {
+				rval.WriteString(`"` + string(rr[i+1:k]) + `"`)
+			}
+			j = k + 1
+		case r == 'y':
+			if n == 2 {
+				rval.WriteString("yy")
+			} else {
+				rval.WriteString("yyyy")
+			}
+		case r == 'M' || r == 'L':
+			rval.WriteString(strings.Repeat("m", min(n, 4)))
+		case r == 'd':
+			rval.WriteString(strings.Repeat("d", min(n, 2)))
+		case r == 'E':
+			if n >= 4 {
+				rval.WriteString("dddd")
+			} else {
+				rval.WriteString("ddd")
+			}
+		case r == 'h' || r == 'H' || r == 'k' || r == 'K':
+			rval.WriteString(strings.Repeat("h", min(n, 2)))
+		case r == 'm':
+			rval.WriteString(strings.Repeat("m", min(n, 2)))
+		case r == 's':
+			rval.WriteString(strings.Repeat("s", min(n, 2)))
+		case r == 'a':
+			rval.WriteString("AM/PM")
+		case (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			// era, quarter, week, time zone, ... have no Excel equivalent
+		case strings.ContainsRune(" /-:,.", r):
+			rval.WriteString(string(rr[i:j]))
+		default:
+			rval.WriteString(`"` + string(rr[i:j]) + `"`)
+		}
+		i = j
+	}
+	return strings.TrimSpace(rval.String())
+}
+
+func (c *converter) styles() string {
+	var numFmts, xfs string
+	for i, code := range c.fmts {
+		numFmts += fmt.Sprintf(`<numFmt numFmtId="%d" formatCode="%s"/>`, 164+i, escape(code))
+	}
+	xfs = `<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>`
+	for _, code := range c.order {
+		id, ok := builtinFormats[code]
+		if !ok {
+			for i, f := range c.fmts {
+				if f == code {
+					id = 164 + i
+				}
+			}
+		}
+		xfs += fmt.Sprintf(`<xf numFmtId="%d" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>`, id)
+	}
+	if numFmts != "" {
+		numFmts = fmt.Sprintf(`<numFmts count="%d">%s</numFmts>`, len(c.fmts), numFmts)
+	}
+	return xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` + numFmts +
+		`<fonts count="1"><font><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		fmt.Sprintf(`<cellXfs count="%d">%s</cellXfs>`, len(c.order)+1, xfs) +
+		`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+		`</styleSheet>`
+}
@@ -0,0 +1,315 @@
+// Package xlsx converts Numbers documents to Office Open XML spreadsheets (.xlsx).
+//
+// Each table becomes a worksheet named after its sheet and table. Cell types, number formats, merged cells and the
+// choices of pop-up menus are carried over. Formulas are written as their cached values.
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dunhamsteve/iwork/index"
+	"github.com/dunhamsteve/iwork/numbers"
+	"github.com/dunhamsteve/iwork/proto/TSK"
+	"github.com/dunhamsteve/iwork/proto/TST"
+)
+
+// Write converts a Numbers document and writes the .xlsx archive to w.
+func Write(w io.Writer, ix *index.Index) error {
+	if ix.Type != "numbers" {
+		return fmt.Errorf("xlsx: can't convert %s documents", ix.Type)
+	}
+	doc, err := numbers.Load(ix)
+	if err != nil {
+		return err
+	}
+
+	c := &converter{ix: ix, names: make(map[string]bool), xfs: map[string]int{"": 0}}
+	for _, sheet := range doc.Sheets {
+		for _, table := range sheet.Tables {
+			c.worksheet(sheet.Name, table)
+		}
+	}
+	if len(c.sheets) == 0 {
+		return errors.New("xlsx: document has no tables")
+	}
+
+	zw := zip.NewWriter(w)
+	parts := []struct {
+		name string
+		data string
+	}{
+		{"[Content_Types].xml", c.contentTypes()},
+		{"_rels/.rels", rootRels},
+		{"xl/workbook.xml", c.workbook()},
+		{"xl/_rels/workbook.xml.rels", c.workbookRels()},
+		{"xl/styles.xml", c.styles()},
+	}
+	for i, s := range c.sheets {
+		parts = append(parts, struct {
+			name string
+			data string
+		}{fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), s.data})
+	}
+	for _, part := range parts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+type worksheet struct {
+	name string
+	data string
+}
+
+type converter struct {
+	ix     *index.Index
+	sheets []worksheet
+	names  map[string]bool
+	fmts   []string       // custom number formats, numFmtId 164 onwards
+	xfs    map[string]int // number format -> cellXfs index
+	order  []string       // number formats in cellXfs order, after the default
+}
+
+// worksheet converts a table to a worksheet.
+func (c *converter) worksheet(sheetName string, table *numbers.Table) {
+	tm := table.Model
+	formats := c.formats(tm)
+	controls := c.ix.Controls(tm)
+	validated := make(map[uint32][]string) // control key -> cell refs
+	var keys []uint32
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for r, row := range table.Rows {
+		fmt.Fprintf(&buf, `<row r="%d">`, r+1)
+		for col, cell := range row {
+			if controls[cell.ControlKey] != nil {
+				if validated[cell.ControlKey] == nil {
+					keys = append(keys, cell.ControlKey)
+				}
+				validated[cell.ControlKey] = append(validated[cell.ControlKey], cellRef(r, col))
+			}
+			if cell.Type == index.EmptyCell {
+				continue
+			}
+			ref := cellRef(r, col)
+			style := c.style(cell, formats[cell.FormatKey])
+			s := ""
+			if style != 0 {
+				s = fmt.Sprintf(` s="%d"`, style)
+			}
+			switch cell.Type {
+			case index.NumberCell, index.CurrencyCell:
+				fmt.Fprintf(&buf, `<c r="%s"%s><v>%s</v></c>`, ref, s, cell.String())
+			case index.DurationCell:
+				fmt.Fprintf(&buf, `<c r="%s"%s><v>%v</v></c>`, ref, s, cell.Number/86400)
+			case index.DateCell:
+				fmt.Fprintf(&buf, `<c r="%s"%s><v>%v</v></c>`, ref, s, serial(cell))
+			case index.BoolCell:
+				v := 0
+				if cell.Number != 0 {
+					v = 1
+				}
+				fmt.Fprintf(&buf, `<c r="%s"%s t="b"><v>%d</v></c>`, ref, s, v)
+			case index.ErrorCell:
+				fmt.Fprintf(&buf, `<c r="%s"%s t="e"><v>%s</v></c>`, ref, s, errorValue(cell.Text))
+			default:
+				fmt.Fprintf(&buf, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, s, escape(cell.Text))
+			}
+		}
+		buf.WriteString("</row>")
+	}
+	buf.WriteString("</sheetData>")
+	if merges := c.merges(tm); len(merges) > 0 {
+		fmt.Fprintf(&buf, `<mergeCells count="%d">`, len(merges))
+		for _, m := range merges {
+			fmt.Fprintf(&buf, `<mergeCell ref="%s"/>`, m)
+		}
+		buf.WriteString("</mergeCells>")
+	}
+	var validations []string
+	for _, key := range keys {
+		if v := validation(controls[key], validated[key]); v != "" {
+			validations = append(validations, v)
+		}
+	}
+	if len(validations) > 0 {
+		fmt.Fprintf(&buf, `<dataValidations count="%d">%s</dataValidations>`, len(validations), strings.Join(validations, ""))
+	}
+	buf.WriteString("</worksheet>")
+
+	name := sheetName
+	if table.Name != "" {
+		name += " - " + table.Name
+	}
+	c.sheets = append(c.sheets, worksheet{c.sheetName(name), buf.String()})
+}
+
+// formats returns the format table of a table, by key.
+func (c *converter) formats(tm *TST.TableModelArchive) map[uint32]*TSK.FormatStructArchive {
+	rval := make(map[uint32]*TSK.FormatStructArchive)
+	if list, ok := c.ix.Deref(tm.GetDataStore().GetFormatTable()).(*TST.TableDataList); ok {
+		for _, entry := range list.Entries {
+			if entry.Format != nil {
+				rval[entry.GetKey()] = entry.Format
+			}
+		}
+	}
+	return rval
+}
+
+// merges returns the merged ranges of a table in A1:B2 form.
+func (c *converter) merges(tm *TST.TableModelArchive) []string {
+	var rval []string
+	for _, m := range c.ix.Merges(tm) {
+		rval = append(rval, cellRef(m.Row, m.Column)+":"+cellRef(m.Row+m.Rows-1, m.Column+m.Columns-1))
+	}
+	return rval
+}
+
+// validation recreates a pop-up menu as a list validation and a stepper or slider as a range validation. Menus
+// Excel can't hold inline (over 255 characters, or with commas in the choices) are left out.
+func validation(ctl *index.Control, refs []string) string {
+	sqref := strings.Join(refs, " ")
+	if len(ctl.Items) > 0 {
+		var items []string
+		for _, item := range ctl.Items {
+			s := item.String()
+			if strings.Contains(s, ",") {
+				return ""
+			}
+			items = append(items, strings.Replace(s, `"`, `""`, -1))
+		}
+		list := strings.Join(items, ",")
+		if len(list) > 255 {
+			return ""
+		}
+		return fmt.Sprintf(`<dataValidation type="list" allowBlank="1" showErrorMessage="1" sqref="%s"><formula1>%s</formula1></dataValidation>`,
+			sqref, escape(`"`+list+`"`))
+	}
+	if ctl.Minimum != nil && ctl.Maximum != nil {
+		return fmt.Sprintf(`<dataValidation type="decimal" operator="between" allowBlank="1" showErrorMessage="1" sqref="%s"><formula1>%v</formula1><formula2>%v</formula2></dataValidation>`,
+			sqref, *ctl.Minimum, *ctl.Maximum)
+	}
+	return ""
+}
+
+// style returns the cellXfs index for a cell, adding a number format if needed.
+func (c *converter) style(cell index.Cell, f *TSK.FormatStructArchive) int {
+	code := numberFormat(cell, f)
+	if xf, ok := c.xfs[code]; ok {
+		return xf
+	}
+	c.order = append(c.order, code)
+	c.xfs[code] = len(c.order)
+	if _, ok := builtinFormats[code]; !ok {
+		c.fmts = append(c.fmts, code)
+	}
+	return c.xfs[code]
+}
+
+// sheetName makes a name valid and unique as an Excel sheet name.
+func (c *converter) sheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, "'")
+	if name == "" {
+		name = "Sheet"
+	}
+	base := truncate(name, 31)
+	name = base
+	for i := 2; c.names[strings.ToLower(name)]; i++ {
+		suffix := fmt.Sprintf(" (%d)", i)
+		name = truncate(base, 31-len(suffix)) + suffix
+	}
+	c.names[strings.ToLower(name)] = true
+	return name
+}
+
+func truncate(s string, n int) string {
+	rr := []rune(s)
+	if len(rr) > n {
+		rr = rr[:n]
+	}
+	return string(rr)
+}
+
+// cellRef returns the A1 style reference for a zero based row and column.
+func cellRef(row, col int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return fmt.Sprintf("%s%d", name, row+1)
+}
+
+// serial converts a date cell to an Excel serial date (days since 1899-12-30).
+func serial(cell index.Cell) float64 {
+	return float64(cell.Time.Unix())/86400 + 25569
+}
+
+var errorValues = []string{"#NULL!", "#DIV/0!", "#VALUE!", "#REF!", "#NAME?", "#NUM!", "#N/A"}
+
+func errorValue(s string) string {
+	for _, v := range errorValues {
+		if s == v {
+			return v
+		}
+	}
+	return "#VALUE!"
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func (c *converter) workbook() string {
+	var sheets string
+	for i, s := range c.sheets {
+		sheets += fmt.Sprintf(`<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, escape(s.name), i+1, i+1)
+	}
+	return xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"` +
+		` xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>` + sheets + `</sheets></workbook>`
+}
+
+func (c *converter) workbookRels() string {
+	rels := `<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`
+	for i := range c.sheets {
+		rels += fmt.Sprintf(`<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	return xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` + rels + `</Relationships>`
+}
+
+func (c *converter) contentTypes() string {
+	var sheets string
+	for i := range c.sheets {
+		sheets += fmt.Sprintf(`<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+	}
+	return xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		sheets + `</Types>`
+}
+
+const rootRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`